@@ -0,0 +1,594 @@
+/*
+Admin API to inspect and change the running proxy, built by the config loader or wired in Go with the host
+and expression routers. Replies and requests are JSON:
+
+	GET    /v1/hosts                              hosts and routes
+	GET    /v1/locations                          locations with endpoints, options and middlewares
+	GET    /v1/locations/<id>                     single location
+	POST   /v1/locations/<id>/endpoints           {"Version": 1, "Url": "http://localhost:5000", "Weight": 1}
+	DELETE /v1/locations/<id>/endpoints?url=<url>&version=<version>
+	PUT    /v1/locations/<id>/options             {"Version": 1, "Options": {"Timeouts": {"Read": "5s"}}}
+	PUT    /v1/locations/<id>/middlewares/<id>    {"Version": 1, "Type": "ratelimit", "Priority": 1, "Spec": {...}}
+
+Every reply has the current version, changes should supply it and are rejected with 409 Conflict if someone else
+has changed the proxy in between. Changes of the source, e.g. of the config file, change the version as well, and
+take precedence over the changes made with the API for the entries changed in the file. Endpoints and middlewares
+added with the API are left alone by the config loader, so the config adding the same ones fails to load.
+
+Locations are found by the routes of the source's router: hostroute.HostRouter routes by the hostname,
+exproute.ExpRouter and route.ConstRouter lead to the locations. Router that does not route by the hostname
+is listed as the host with the empty name.
+*/
+package admin
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	log "github.com/mailgun/gotools-log"
+
+	"github.com/mailgun/vulcan/config"
+	"github.com/mailgun/vulcan/endpoint"
+	"github.com/mailgun/vulcan/limit"
+	"github.com/mailgun/vulcan/limit/connlimit"
+	"github.com/mailgun/vulcan/limit/tokenbucket"
+	"github.com/mailgun/vulcan/loadbalance"
+	"github.com/mailgun/vulcan/loadbalance/roundrobin"
+	"github.com/mailgun/vulcan/location"
+	"github.com/mailgun/vulcan/location/httploc"
+	"github.com/mailgun/vulcan/middleware"
+	"github.com/mailgun/vulcan/route"
+)
+
+// Source of the router managed by the API, e.g. config.Loader
+type Source interface {
+	// Returns the router of the proxy, the source may replace it, e.g. when the config file changes
+	GetRouter() route.Router
+	// Changes every time the source changes the router or the locations
+	GetVersion() int64
+}
+
+// Source that knows the options the locations have been configured with, e.g. config.Loader.
+// Options of the locations from the other sources are converted back from the location options.
+type OptionsSource interface {
+	GetLocationOptions(id string) (config.LocationOptions, bool)
+}
+
+// Source with the router wired in Go, changed only with the API
+type StaticSource struct {
+	Router route.Router
+}
+
+func (s *StaticSource) GetRouter() route.Router {
+	return s.Router
+}
+
+func (s *StaticSource) GetVersion() int64 {
+	return 0
+}
+
+// Router routing by the hostname, e.g. hostroute.HostRouter
+type HostRouter interface {
+	GetRouters() map[string]route.Router
+}
+
+// Router routing by the expressions, e.g. exproute.ExpRouter
+type ExpRouter interface {
+	GetLocations() map[string]location.Location
+}
+
+// Location managed by the API, e.g. httploc.HttpLocation
+type Location interface {
+	location.Location
+	GetOptions() httploc.Options
+	SetOptions(httploc.Options) error
+	GetLoadBalancer() loadbalance.LoadBalancer
+	GetMiddlewareChain() *middleware.MiddlewareChain
+}
+
+// Load balancer of the location with the endpoints managed by the API, e.g. roundrobin.RoundRobin
+type Balancer interface {
+	GetEndpoints() []*roundrobin.WeightedEndpoint
+	AddEndpointWithOptions(endpoint.Endpoint, roundrobin.EndpointOptions) error
+	RemoveEndpoint(endpoint.Endpoint) error
+}
+
+type Handler struct {
+	source Source
+	// Serializes the API calls
+	mutex   *sync.Mutex
+	version int64
+	// Source version the version has been bumped for last
+	sourceVersion int64
+	// Options set with the API by the location id
+	options map[string]optionsOverride
+}
+
+// Options set with the API are in effect until the source changes the options of the location
+type optionsOverride struct {
+	location Location
+	// Options from the source at the time of the change
+	base    config.LocationOptions
+	options config.LocationOptions
+}
+
+type EndpointStatus struct {
+	Id              string
+	Url             string
+	Weight          int
+	EffectiveWeight int
+}
+
+type RateStatus struct {
+	Units  int64
+	Period config.Duration
+	Burst  int64
+}
+
+type RateLimitStatus struct {
+	Rates    []RateStatus
+	Capacity int
+}
+
+type ConnLimitStatus struct {
+	MaxConnections int64
+	Connections    int64
+}
+
+// Settings of the limiter, one of the limits is set
+type LimiterStatus struct {
+	RateLimit *RateLimitStatus `json:",omitempty"`
+	ConnLimit *ConnLimitStatus `json:",omitempty"`
+	// Some requests are exempt from the limits
+	Exempt bool
+}
+
+type MiddlewareStatus struct {
+	Id       string
+	Priority int
+	// Go type of the middleware, e.g. *tokenbucket.TokenLimiter
+	Type    string
+	Limiter *LimiterStatus `json:",omitempty"`
+}
+
+type LocationStatus struct {
+	Id          string
+	Options     config.LocationOptions
+	Endpoints   []EndpointStatus
+	Middlewares []MiddlewareStatus
+}
+
+type HostsReply struct {
+	Version int64
+	Hosts   []config.Host
+}
+
+type LocationsReply struct {
+	Version   int64
+	Locations []LocationStatus
+}
+
+type LocationReply struct {
+	Version  int64
+	Location LocationStatus
+}
+
+type ErrorReply struct {
+	Error   string
+	Version int64
+}
+
+type EndpointRequest struct {
+	Version int64
+	Url     string
+	// Relative weight of the endpoint, defaults to 1
+	Weight int
+}
+
+type OptionsRequest struct {
+	Version int64
+	Options config.LocationOptions
+}
+
+type MiddlewareRequest struct {
+	Version  int64
+	Type     string
+	Priority int
+	Spec     json.RawMessage
+}
+
+func NewHandler(source Source) (*Handler, error) {
+	if source == nil {
+		return nil, fmt.Errorf("Provide source")
+	}
+	return &Handler{
+		source: source,
+		mutex:  &sync.Mutex{},
+		// First sync bumps the version, so changes are allowed even if the source never changes
+		sourceVersion: -1,
+		options:       make(map[string]optionsOverride),
+	}, nil
+}
+
+// Error replied with the status code
+type apiError struct {
+	statusCode int
+	message    string
+}
+
+func (e *apiError) Error() string {
+	return e.message
+}
+
+func errorf(statusCode int, format string, args ...interface{}) *apiError {
+	return &apiError{statusCode: statusCode, message: fmt.Sprintf(format, args...)}
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.syncVersion()
+
+	statusCode, reply, err := h.serve(r)
+	if err != nil {
+		statusCode = http.StatusInternalServerError
+		if e, ok := err.(*apiError); ok {
+			statusCode = e.statusCode
+		}
+		reply = &ErrorReply{Error: err.Error(), Version: h.version}
+	}
+	body, err := json.Marshal(reply)
+	if err != nil {
+		log.Errorf("Failed to serialize: %s", err)
+		statusCode, body = http.StatusInternalServerError, []byte("{}")
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	w.Write(body)
+}
+
+// Changes of the source are the changes of the proxy as well
+func (h *Handler) syncVersion() {
+	if v := h.source.GetVersion(); v != h.sourceVersion {
+		h.sourceVersion = v
+		h.version++
+	}
+}
+
+func (h *Handler) serve(r *http.Request) (int, interface{}, error) {
+	path := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(path) < 2 || path[0] != "v1" {
+		return 0, nil, errorf(http.StatusNotFound, "Not found")
+	}
+	switch {
+	case len(path) == 2 && path[1] == "hosts":
+		if r.Method != "GET" {
+			return 0, nil, errorf(http.StatusMethodNotAllowed, "Method not allowed")
+		}
+		return http.StatusOK, &HostsReply{Version: h.version, Hosts: h.hosts()}, nil
+	case len(path) == 2 && path[1] == "locations":
+		if r.Method != "GET" {
+			return 0, nil, errorf(http.StatusMethodNotAllowed, "Method not allowed")
+		}
+		return h.listLocations()
+	case len(path) < 3 || path[1] != "locations":
+		return 0, nil, errorf(http.StatusNotFound, "Not found")
+	}
+
+	id := path[2]
+	location := h.getLocation(id)
+	if location == nil {
+		return 0, nil, errorf(http.StatusNotFound, "Location '%s' not found", id)
+	}
+	notAllowed := errorf(http.StatusMethodNotAllowed, "Method not allowed")
+	switch {
+	case len(path) == 3:
+		if r.Method != "GET" {
+			return 0, nil, notAllowed
+		}
+		return h.locationReply(http.StatusOK, id, location)
+	case len(path) == 4 && path[3] == "endpoints":
+		switch r.Method {
+		case "POST":
+			return h.addEndpoint(r, id, location)
+		case "DELETE":
+			return h.removeEndpoint(r, id, location)
+		}
+		return 0, nil, notAllowed
+	case len(path) == 4 && path[3] == "options":
+		if r.Method != "PUT" {
+			return 0, nil, notAllowed
+		}
+		return h.setOptions(r, id, location)
+	case len(path) == 5 && path[3] == "middlewares":
+		if r.Method != "PUT" {
+			return 0, nil, notAllowed
+		}
+		return h.upsertMiddleware(r, id, path[4], location)
+	}
+	return 0, nil, errorf(http.StatusNotFound, "Not found")
+}
+
+func (h *Handler) listLocations() (int, interface{}, error) {
+	reply := &LocationsReply{Version: h.version, Locations: []LocationStatus{}}
+	for _, location := range h.locations() {
+		reply.Locations = append(reply.Locations, h.locationStatus(location.GetId(), location))
+	}
+	return http.StatusOK, reply, nil
+}
+
+// Route of the source's router leading to the location
+type routeEntry struct {
+	expression string
+	location   location.Location
+}
+
+// Returns the hosts with their routes sorted by the name and the expression
+func (h *Handler) hosts() []config.Host {
+	hosts := []config.Host{}
+	for name, entries := range h.routes() {
+		host := config.Host{Name: name, Routes: []config.Route{}}
+		for _, e := range entries {
+			host.Routes = append(host.Routes, config.Route{Expression: e.expression, Location: e.location.GetId()})
+		}
+		hosts = append(hosts, host)
+	}
+	sort.Slice(hosts, func(i, j int) bool { return hosts[i].Name < hosts[j].Name })
+	return hosts
+}
+
+// Returns the routes of the source's router by the hostname
+func (h *Handler) routes() map[string][]routeEntry {
+	router := h.source.GetRouter()
+	if hr, ok := router.(HostRouter); ok {
+		routes := make(map[string][]routeEntry)
+		for name, r := range hr.GetRouters() {
+			routes[name] = routerEntries(r)
+		}
+		return routes
+	}
+	if router == nil {
+		return map[string][]routeEntry{}
+	}
+	return map[string][]routeEntry{"": routerEntries(router)}
+}
+
+func routerEntries(router route.Router) []routeEntry {
+	entries := []routeEntry{}
+	switch r := router.(type) {
+	case ExpRouter:
+		for expr, l := range r.GetLocations() {
+			entries = append(entries, routeEntry{expression: expr, location: l})
+		}
+	case *route.ConstRouter:
+		if r.Location != nil {
+			entries = append(entries, routeEntry{location: r.Location})
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].expression < entries[j].expression })
+	return entries
+}
+
+// Returns the locations managed by the API the routes lead to, sorted by the id
+func (h *Handler) locations() []Location {
+	seen := make(map[string]bool)
+	locations := []Location{}
+	for _, entries := range h.routes() {
+		for _, e := range entries {
+			l, ok := e.location.(Location)
+			if !ok || seen[l.GetId()] {
+				continue
+			}
+			seen[l.GetId()] = true
+			locations = append(locations, l)
+		}
+	}
+	sort.Slice(locations, func(i, j int) bool { return locations[i].GetId() < locations[j].GetId() })
+	return locations
+}
+
+// Returns the location by the id, nil if no route leads to such location
+func (h *Handler) getLocation(id string) Location {
+	for _, l := range h.locations() {
+		if l.GetId() == id {
+			return l
+		}
+	}
+	return nil
+}
+
+func (h *Handler) locationReply(statusCode int, id string, location Location) (int, interface{}, error) {
+	return statusCode, &LocationReply{Version: h.version, Location: h.locationStatus(id, location)}, nil
+}
+
+func (h *Handler) locationStatus(id string, location Location) LocationStatus {
+	status := LocationStatus{Id: id, Endpoints: []EndpointStatus{}, Middlewares: []MiddlewareStatus{}}
+	status.Options = h.sourceOptions(id, location)
+	if o, ok := h.options[id]; ok && o.location == location && reflect.DeepEqual(o.base, status.Options) {
+		status.Options = o.options
+	}
+	if b, ok := location.GetLoadBalancer().(Balancer); ok {
+		for _, e := range b.GetEndpoints() {
+			status.Endpoints = append(status.Endpoints, EndpointStatus{
+				Id:              e.GetId(),
+				Url:             e.GetUrl().String(),
+				Weight:          e.GetOriginalWeight(),
+				EffectiveWeight: e.GetEffectiveWeight(),
+			})
+		}
+	}
+	for _, e := range location.GetMiddlewareChain().GetEntries() {
+		status.Middlewares = append(status.Middlewares, MiddlewareStatus{
+			Id:       e.Id,
+			Priority: e.Priority,
+			Type:     fmt.Sprintf("%T", e.Middleware),
+			Limiter:  limiterStatus(e.Middleware),
+		})
+	}
+	return status
+}
+
+// Returns the options the location has been configured with by the source. Options of the locations
+// the source does not describe are converted from the location's options, and only the API changes them.
+func (h *Handler) sourceOptions(id string, location Location) config.LocationOptions {
+	if s, ok := h.source.(OptionsSource); ok {
+		if o, ok := s.GetLocationOptions(id); ok {
+			return o
+		}
+	}
+	if o, ok := h.options[id]; ok && o.location == location {
+		return o.base
+	}
+	return config.FromOptions(location.GetOptions())
+}
+
+func limiterStatus(m middleware.Middleware) *LimiterStatus {
+	switch l := m.(type) {
+	case *limit.ExemptLimiter:
+		status := limiterStatus(l.GetLimiter())
+		if status != nil {
+			status.Exempt = true
+		}
+		return status
+	case *tokenbucket.TokenLimiter:
+		rates := []RateStatus{}
+		for _, r := range l.GetRates() {
+			rates = append(rates, RateStatus{Units: r.Rate.Units, Period: config.Duration(r.Rate.Period), Burst: r.Burst})
+		}
+		return &LimiterStatus{RateLimit: &RateLimitStatus{Rates: rates, Capacity: l.GetCapacity()}}
+	case *connlimit.ConnectionLimiter:
+		return &LimiterStatus{
+			ConnLimit: &ConnLimitStatus{MaxConnections: l.GetMaxConnections(), Connections: l.GetConnectionCount()},
+		}
+	}
+	return nil
+}
+
+func (h *Handler) addEndpoint(r *http.Request, id string, location Location) (int, interface{}, error) {
+	var req EndpointRequest
+	if err := decodeRequest(r, &req); err != nil {
+		return 0, nil, err
+	}
+	if err := h.checkVersion(req.Version); err != nil {
+		return 0, nil, err
+	}
+	b, err := balancer(location)
+	if err != nil {
+		return 0, nil, err
+	}
+	e, err := endpoint.ParseUrl(req.Url)
+	if err != nil {
+		return 0, nil, errorf(http.StatusBadRequest, "%s", err)
+	}
+	if req.Weight < 0 {
+		return 0, nil, errorf(http.StatusBadRequest, "Weight should be >= 0")
+	}
+	if err := b.AddEndpointWithOptions(e, roundrobin.EndpointOptions{Weight: req.Weight}); err != nil {
+		return 0, nil, errorf(http.StatusBadRequest, "%s", err)
+	}
+	log.Infof("Admin added %s to %s", e, id)
+	h.version++
+	return h.locationReply(http.StatusCreated, id, location)
+}
+
+func (h *Handler) removeEndpoint(r *http.Request, id string, location Location) (int, interface{}, error) {
+	version, err := strconv.ParseInt(r.URL.Query().Get("version"), 10, 64)
+	if err != nil {
+		return 0, nil, errorf(http.StatusBadRequest, "Provide version")
+	}
+	if err := h.checkVersion(version); err != nil {
+		return 0, nil, err
+	}
+	b, err := balancer(location)
+	if err != nil {
+		return 0, nil, err
+	}
+	e, err := endpoint.ParseUrl(r.URL.Query().Get("url"))
+	if err != nil {
+		return 0, nil, errorf(http.StatusBadRequest, "%s", err)
+	}
+	if err := b.RemoveEndpoint(e); err != nil {
+		return 0, nil, errorf(http.StatusNotFound, "%s", err)
+	}
+	log.Infof("Admin removed %s from %s", e, id)
+	h.version++
+	return h.locationReply(http.StatusOK, id, location)
+}
+
+func (h *Handler) setOptions(r *http.Request, id string, location Location) (int, interface{}, error) {
+	var req OptionsRequest
+	if err := decodeRequest(r, &req); err != nil {
+		return 0, nil, err
+	}
+	if err := h.checkVersion(req.Version); err != nil {
+		return 0, nil, err
+	}
+	o, err := req.Options.ToOptions()
+	if err != nil {
+		return 0, nil, errorf(http.StatusBadRequest, "%s", err)
+	}
+	base := h.sourceOptions(id, location)
+	o.TimeProvider = location.GetOptions().TimeProvider
+	if err := location.SetOptions(o); err != nil {
+		return 0, nil, errorf(http.StatusBadRequest, "%s", err)
+	}
+	log.Infof("Admin updated options of %s", id)
+	h.options[id] = optionsOverride{location: location, base: base, options: req.Options}
+	h.version++
+	return h.locationReply(http.StatusOK, id, location)
+}
+
+func (h *Handler) upsertMiddleware(r *http.Request, id, middlewareId string, location Location) (int, interface{}, error) {
+	var req MiddlewareRequest
+	if err := decodeRequest(r, &req); err != nil {
+		return 0, nil, err
+	}
+	if err := h.checkVersion(req.Version); err != nil {
+		return 0, nil, err
+	}
+	if middlewareId == httploc.BalancerId || middlewareId == httploc.RewriterId {
+		return 0, nil, errorf(http.StatusBadRequest, "Middleware '%s' is managed by the location", middlewareId)
+	}
+	m := &config.Middleware{Id: middlewareId, Type: req.Type, Priority: req.Priority, Spec: req.Spec}
+	built, err := m.Build()
+	if err != nil {
+		return 0, nil, errorf(http.StatusBadRequest, "%s", err)
+	}
+	location.GetMiddlewareChain().Upsert(middlewareId, req.Priority, built)
+	log.Infof("Admin upserted middleware %s of %s", middlewareId, id)
+	h.version++
+	return h.locationReply(http.StatusOK, id, location)
+}
+
+func (h *Handler) checkVersion(version int64) error {
+	if version == 0 {
+		return errorf(http.StatusBadRequest, "Provide version")
+	}
+	if version != h.version {
+		return errorf(http.StatusConflict, "Version %d is outdated, current version is %d", version, h.version)
+	}
+	return nil
+}
+
+func balancer(location Location) (Balancer, error) {
+	b, ok := location.GetLoadBalancer().(Balancer)
+	if !ok {
+		return nil, errorf(http.StatusBadRequest, "Load balancer of '%s' does not support endpoint changes", location.GetId())
+	}
+	return b, nil
+}
+
+func decodeRequest(r *http.Request, out interface{}) error {
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(out); err != nil {
+		return errorf(http.StatusBadRequest, "Failed to parse request: %s", err)
+	}
+	return nil
+}
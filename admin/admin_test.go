@@ -0,0 +1,312 @@
+package admin
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mailgun/vulcan/config"
+	"github.com/mailgun/vulcan/endpoint"
+	"github.com/mailgun/vulcan/loadbalance/roundrobin"
+	"github.com/mailgun/vulcan/location/httploc"
+	"github.com/mailgun/vulcan/route/exproute"
+	"github.com/mailgun/vulcan/route/hostroute"
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type AdminSuite struct {
+	path   string
+	loader *config.Loader
+	admin  *httptest.Server
+}
+
+var _ = Suite(&AdminSuite{})
+
+const testConfig = `{
+  "Hosts": [{"Name": "example.com", "Routes": [{"Expression": "TrieRoute(\"/a\")", "Location": "a"}]}],
+  "Locations": [
+    {
+      "Id": "a",
+      "Endpoints": [{"Url": "http://localhost:5000", "Weight": 2}],
+      "Options": {"Limits": {"MaxBodyBytes": %d}},
+      "Middlewares": [
+        {"Id": "rl", "Type": "ratelimit", "Priority": 1,
+         "Spec": {"Variable": "client.ip", "Units": 10, "Period": "1s", "Burst": 5, "Exempt": "ClientIpIn(\"10.0.0.0/8\")"}},
+        {"Id": "cl", "Type": "connlimit", "Spec": {"Variable": "client.ip", "Connections": 3}}
+      ]
+    }
+  ]
+}`
+
+func (s *AdminSuite) SetUpTest(c *C) {
+	s.path = filepath.Join(c.MkDir(), "vulcan.json")
+	s.writeConfig(c, 1024)
+	loader, err := config.NewLoader(s.path)
+	c.Assert(err, IsNil)
+	s.loader = loader
+	handler, err := NewHandler(loader)
+	c.Assert(err, IsNil)
+	s.admin = httptest.NewServer(handler)
+}
+
+func (s *AdminSuite) TearDownTest(c *C) {
+	s.admin.Close()
+}
+
+func (s *AdminSuite) writeConfig(c *C, maxBodyBytes int) {
+	c.Assert(os.WriteFile(s.path, []byte(fmt.Sprintf(testConfig, maxBodyBytes)), 0600), IsNil)
+}
+
+// Makes the request and decodes the reply into out
+func (s *AdminSuite) call(c *C, method, path string, in interface{}, out interface{}) int {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		c.Assert(err, IsNil)
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, s.admin.URL+path, body)
+	c.Assert(err, IsNil)
+	response, err := http.DefaultClient.Do(req)
+	c.Assert(err, IsNil)
+	defer response.Body.Close()
+	c.Assert(response.Header.Get("Content-Type"), Equals, "application/json")
+	if out != nil {
+		c.Assert(json.NewDecoder(response.Body).Decode(out), IsNil)
+	}
+	return response.StatusCode
+}
+
+func (s *AdminSuite) getLocation(c *C, id string) *LocationReply {
+	var reply LocationReply
+	c.Assert(s.call(c, "GET", "/v1/locations/"+id, nil, &reply), Equals, http.StatusOK)
+	return &reply
+}
+
+func (s *AdminSuite) TestHosts(c *C) {
+	var reply HostsReply
+	c.Assert(s.call(c, "GET", "/v1/hosts", nil, &reply), Equals, http.StatusOK)
+	c.Assert(reply.Version, Equals, int64(1))
+	c.Assert(reply.Hosts, DeepEquals, []config.Host{
+		{Name: "example.com", Routes: []config.Route{{Expression: `TrieRoute("/a")`, Location: "a"}}},
+	})
+}
+
+func (s *AdminSuite) TestLocations(c *C) {
+	var reply LocationsReply
+	c.Assert(s.call(c, "GET", "/v1/locations", nil, &reply), Equals, http.StatusOK)
+	c.Assert(len(reply.Locations), Equals, 1)
+
+	l := reply.Locations[0]
+	c.Assert(l.Id, Equals, "a")
+	c.Assert(l.Options.Limits.MaxBodyBytes, Equals, int64(1024))
+	c.Assert(l.Endpoints, DeepEquals, []EndpointStatus{
+		{Id: "http://localhost:5000", Url: "http://localhost:5000", Weight: 2, EffectiveWeight: 2},
+	})
+
+	middlewares := map[string]MiddlewareStatus{}
+	for _, m := range l.Middlewares {
+		middlewares[m.Id] = m
+	}
+	c.Assert(middlewares["rl"], DeepEquals, MiddlewareStatus{
+		Id:       "rl",
+		Priority: 1,
+		Type:     "*limit.ExemptLimiter",
+		Limiter: &LimiterStatus{
+			RateLimit: &RateLimitStatus{
+				Rates:    []RateStatus{{Units: 10, Period: config.Duration(time.Second), Burst: 5}},
+				Capacity: 65536,
+			},
+			Exempt: true,
+		},
+	})
+	c.Assert(middlewares["cl"], DeepEquals, MiddlewareStatus{
+		Id:      "cl",
+		Type:    "*connlimit.ConnectionLimiter",
+		Limiter: &LimiterStatus{ConnLimit: &ConnLimitStatus{MaxConnections: 3}},
+	})
+	// Chain lists the location's own middlewares too
+	c.Assert(len(l.Middlewares), Equals, 4)
+}
+
+func (s *AdminSuite) TestAddRemoveEndpoint(c *C) {
+	var reply LocationReply
+	status := s.call(c, "POST", "/v1/locations/a/endpoints", &EndpointRequest{Version: 1, Url: "http://localhost:5001", Weight: 3}, &reply)
+	c.Assert(status, Equals, http.StatusCreated)
+	c.Assert(reply.Version, Equals, int64(2))
+	c.Assert(reply.Location.Endpoints[1], DeepEquals, EndpointStatus{
+		Id: "http://localhost:5001", Url: "http://localhost:5001", Weight: 3, EffectiveWeight: 3,
+	})
+
+	// Endpoint is already there
+	status = s.call(c, "POST", "/v1/locations/a/endpoints", &EndpointRequest{Version: 2, Url: "http://localhost:5001"}, nil)
+	c.Assert(status, Equals, http.StatusBadRequest)
+
+	query := url.Values{"url": {"http://localhost:5001"}, "version": {"2"}}
+	c.Assert(s.call(c, "DELETE", "/v1/locations/a/endpoints?"+query.Encode(), nil, &reply), Equals, http.StatusOK)
+	c.Assert(reply.Version, Equals, int64(3))
+	c.Assert(len(reply.Location.Endpoints), Equals, 1)
+
+	query.Set("version", "3")
+	c.Assert(s.call(c, "DELETE", "/v1/locations/a/endpoints?"+query.Encode(), nil, nil), Equals, http.StatusNotFound)
+}
+
+func (s *AdminSuite) TestVersionConflict(c *C) {
+	var reply LocationReply
+	status := s.call(c, "POST", "/v1/locations/a/endpoints", &EndpointRequest{Version: 1, Url: "http://localhost:5001"}, &reply)
+	c.Assert(status, Equals, http.StatusCreated)
+
+	// Second client has read the version before the change
+	var e ErrorReply
+	status = s.call(c, "POST", "/v1/locations/a/endpoints", &EndpointRequest{Version: 1, Url: "http://localhost:5002"}, &e)
+	c.Assert(status, Equals, http.StatusConflict)
+	c.Assert(e.Version, Equals, int64(2))
+	c.Assert(len(s.getLocation(c, "a").Location.Endpoints), Equals, 2)
+
+	status = s.call(c, "POST", "/v1/locations/a/endpoints", &EndpointRequest{Url: "http://localhost:5002"}, nil)
+	c.Assert(status, Equals, http.StatusBadRequest)
+	c.Assert(s.call(c, "DELETE", "/v1/locations/a/endpoints?url=http://localhost:5001", nil, nil), Equals, http.StatusBadRequest)
+}
+
+func (s *AdminSuite) TestSetOptions(c *C) {
+	var reply LocationReply
+	options := config.LocationOptions{Timeouts: config.Timeouts{Read: config.Duration(5 * time.Second)}}
+	status := s.call(c, "PUT", "/v1/locations/a/options", &OptionsRequest{Version: 1, Options: options}, &reply)
+	c.Assert(status, Equals, http.StatusOK)
+	c.Assert(reply.Version, Equals, int64(2))
+	c.Assert(reply.Location.Options, DeepEquals, options)
+
+	o := s.loader.GetLocation("a").GetOptions()
+	c.Assert(o.Timeouts.Read, Equals, 5*time.Second)
+	c.Assert(o.Limits.MaxBodyBytes, Equals, int64(0))
+
+	invalid := config.LocationOptions{Failover: "IsNetworkError &&"}
+	status = s.call(c, "PUT", "/v1/locations/a/options", &OptionsRequest{Version: 2, Options: invalid}, nil)
+	c.Assert(status, Equals, http.StatusBadRequest)
+	c.Assert(s.getLocation(c, "a").Version, Equals, int64(2))
+
+	// Config change that keeps the options of the location keeps the options set with the API
+	c.Assert(os.WriteFile(s.path, []byte(fmt.Sprintf(testConfig+"\n", 1024)), 0600), IsNil)
+	c.Assert(s.loader.Reload(), IsNil)
+	reply = *s.getLocation(c, "a")
+	c.Assert(reply.Version, Equals, int64(3))
+	c.Assert(reply.Location.Options, DeepEquals, options)
+	c.Assert(s.loader.GetLocation("a").GetOptions().Timeouts.Read, Equals, 5*time.Second)
+}
+
+func (s *AdminSuite) TestUpsertMiddleware(c *C) {
+	var reply LocationReply
+	status := s.call(c, "PUT", "/v1/locations/a/middlewares/cl", &MiddlewareRequest{
+		Version:  1,
+		Type:     "connlimit",
+		Priority: 2,
+		Spec:     json.RawMessage(`{"Variable": "client.ip", "Connections": 10}`),
+	}, &reply)
+	c.Assert(status, Equals, http.StatusOK)
+	c.Assert(reply.Version, Equals, int64(2))
+	for _, m := range reply.Location.Middlewares {
+		if m.Id == "cl" {
+			c.Assert(m.Priority, Equals, 2)
+			c.Assert(m.Limiter.ConnLimit.MaxConnections, Equals, int64(10))
+		}
+	}
+
+	invalid := []*MiddlewareRequest{
+		{Version: 2, Type: "unknown"},
+		{Version: 2, Type: "connlimit", Spec: json.RawMessage(`{"Variable": "client.ip", "Connections": 0}`)},
+	}
+	for _, req := range invalid {
+		c.Assert(s.call(c, "PUT", "/v1/locations/a/middlewares/cl", req, nil), Equals, http.StatusBadRequest)
+	}
+
+	// Location's own middlewares can't be replaced
+	req := &MiddlewareRequest{Version: 2, Type: "connlimit", Spec: json.RawMessage(`{"Variable": "client.ip", "Connections": 1}`)}
+	c.Assert(s.call(c, "PUT", "/v1/locations/a/middlewares/__loadBalancer", req, nil), Equals, http.StatusBadRequest)
+}
+
+func (s *AdminSuite) TestConfigChangeBumpsVersion(c *C) {
+	options := config.LocationOptions{Limits: config.Limits{MaxBodyBytes: 1}}
+	c.Assert(s.call(c, "PUT", "/v1/locations/a/options", &OptionsRequest{Version: 1, Options: options}, nil), Equals, http.StatusOK)
+
+	s.writeConfig(c, 2048)
+	c.Assert(s.loader.Reload(), IsNil)
+
+	reply := s.getLocation(c, "a")
+	c.Assert(reply.Version, Equals, int64(3))
+	c.Assert(reply.Location.Options.Limits.MaxBodyBytes, Equals, int64(2048))
+	c.Assert(s.loader.GetLocation("a").GetOptions().Limits.MaxBodyBytes, Equals, int64(2048))
+
+	// Change based on the version before the config change is rejected
+	options.Limits.MaxBodyBytes = 4096
+	c.Assert(s.call(c, "PUT", "/v1/locations/a/options", &OptionsRequest{Version: 2, Options: options}, nil), Equals, http.StatusConflict)
+}
+
+func (s *AdminSuite) TestStaticSource(c *C) {
+	rr, err := roundrobin.NewRoundRobin()
+	c.Assert(err, IsNil)
+	c.Assert(rr.AddEndpoint(endpoint.MustParseUrl("http://localhost:5000")), IsNil)
+	l, err := httploc.NewLocationWithOptions("b", rr, httploc.Options{Limits: httploc.Limits{MaxBodyBytes: 512}})
+	c.Assert(err, IsNil)
+	router := exproute.NewExpRouter()
+	c.Assert(router.AddLocation(`TrieRoute("/b")`, l), IsNil)
+	hosts := hostroute.NewHostRouter()
+	c.Assert(hosts.SetRouter("example.org", router), IsNil)
+
+	handler, err := NewHandler(&StaticSource{Router: hosts})
+	c.Assert(err, IsNil)
+	s.admin.Close()
+	s.admin = httptest.NewServer(handler)
+
+	var hostsReply HostsReply
+	c.Assert(s.call(c, "GET", "/v1/hosts", nil, &hostsReply), Equals, http.StatusOK)
+	c.Assert(hostsReply.Hosts, DeepEquals, []config.Host{
+		{Name: "example.org", Routes: []config.Route{{Expression: `TrieRoute("/b")`, Location: "b"}}},
+	})
+
+	reply := s.getLocation(c, "b")
+	c.Assert(reply.Version, Equals, int64(1))
+	c.Assert(reply.Location.Options.Limits.MaxBodyBytes, Equals, int64(512))
+	c.Assert(len(reply.Location.Endpoints), Equals, 1)
+
+	var changed LocationReply
+	status := s.call(c, "POST", "/v1/locations/b/endpoints", &EndpointRequest{Version: 1, Url: "http://localhost:5001"}, &changed)
+	c.Assert(status, Equals, http.StatusCreated)
+	c.Assert(len(changed.Location.Endpoints), Equals, 2)
+
+	options := config.LocationOptions{Limits: config.Limits{MaxBodyBytes: 1024}}
+	status = s.call(c, "PUT", "/v1/locations/b/options", &OptionsRequest{Version: 2, Options: options}, &changed)
+	c.Assert(status, Equals, http.StatusOK)
+	c.Assert(changed.Version, Equals, int64(3))
+	c.Assert(changed.Location.Options, DeepEquals, options)
+	c.Assert(l.GetOptions().Limits.MaxBodyBytes, Equals, int64(1024))
+}
+
+func (s *AdminSuite) TestNotFound(c *C) {
+	c.Assert(s.call(c, "GET", "/v1/locations/b", nil, nil), Equals, http.StatusNotFound)
+	c.Assert(s.call(c, "GET", "/v1/locations/a/unknown", nil, nil), Equals, http.StatusNotFound)
+	c.Assert(s.call(c, "GET", "/v2/hosts", nil, nil), Equals, http.StatusNotFound)
+	c.Assert(s.call(c, "POST", "/v1/hosts", nil, nil), Equals, http.StatusMethodNotAllowed)
+	c.Assert(s.call(c, "GET", "/v1/locations/a/options", nil, nil), Equals, http.StatusMethodNotAllowed)
+}
+
+func (s *AdminSuite) TestInvalidRequest(c *C) {
+	req, err := http.NewRequest("PUT", s.admin.URL+"/v1/locations/a/options", bytes.NewBufferString(`{"Version": 1, "Unknown": 1}`))
+	c.Assert(err, IsNil)
+	response, err := http.DefaultClient.Do(req)
+	c.Assert(err, IsNil)
+	response.Body.Close()
+	c.Assert(response.StatusCode, Equals, http.StatusBadRequest)
+
+	_, err = NewHandler(nil)
+	c.Assert(err, NotNil)
+}
@@ -0,0 +1,490 @@
+// Response caching middleware following the shared cache semantics of RFC 7234
+package cache
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/mailgun/gotools-log"
+	"github.com/mailgun/gotools-time"
+
+	"github.com/mailgun/vulcan/headers"
+	"github.com/mailgun/vulcan/location"
+	"github.com/mailgun/vulcan/netutils"
+	"github.com/mailgun/vulcan/request"
+)
+
+type Options struct {
+	// Responses with larger bodies are not cached, defaults to 1MB
+	MaxBodyBytes int64
+	// Time the request waits for the concurrent request fetching the same key, defaults to 5 seconds
+	CollapseTimeout time.Duration
+	// Location used to revalidate the stale responses in the background during the stale-while-revalidate window,
+	// usually the location the cache is attached to. Without it the first request after the response
+	// has become stale revalidates it, while the concurrent requests are served the stale response.
+	Location     location.Location
+	TimeProvider timetools.TimeProvider
+}
+
+// Cache serves GET and HEAD requests from the stored responses while they are fresh and revalidates
+// stale responses with conditional requests. Concurrent misses of the same key are collapsed into
+// a single upstream request. Unsafe requests invalidate the responses stored for their URL.
+type Cache struct {
+	mutex   *sync.Mutex
+	storage Storage
+	options Options
+	flights map[string]*flight
+}
+
+// Request fetching the key, the concurrent requests for the same key wait till it's done
+type flight struct {
+	done chan bool
+	once sync.Once
+}
+
+func (f *flight) finish() {
+	f.once.Do(func() { close(f.done) })
+}
+
+// State of the request passing through the cache
+type requestState struct {
+	key         string
+	served      bool      // Response has been served from the cache
+	invalidate  bool      // Unsafe request invalidating the stored responses
+	store       bool      // Response can be stored
+	stale       *Entry    // Stored entry that is being revalidated and can be served in case of errors
+	revalidate  bool      // Request should carry the conditional headers validating the stale entry
+	flight      *flight   // Set if the request fetches the key for the collapsed requests
+	requestTime time.Time // Time the last attempt has been sent
+}
+
+func NewCache(storage Storage) (*Cache, error) {
+	return NewCacheWithOptions(storage, Options{})
+}
+
+func NewCacheWithOptions(storage Storage, o Options) (*Cache, error) {
+	if storage == nil {
+		return nil, fmt.Errorf("Provide storage")
+	}
+	return &Cache{
+		mutex:   &sync.Mutex{},
+		storage: storage,
+		options: parseOptions(o),
+		flights: make(map[string]*flight),
+	}, nil
+}
+
+func (c *Cache) GetOptions() Options {
+	return c.options
+}
+
+// Returns the cache key of the request: the URL including the host and query
+func Key(req *http.Request) string {
+	scheme := "http"
+	if req.TLS != nil {
+		scheme = "https"
+	}
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	return fmt.Sprintf("%s://%s%s", scheme, host, req.URL.RequestURI())
+}
+
+// Removes the responses stored under the key
+func (c *Cache) Purge(key string) error {
+	return c.storage.Delete(key)
+}
+
+// Removes the responses stored under the keys starting with the prefix, e.g. "http://example.com/api/"
+func (c *Cache) PurgePrefix(prefix string) (int, error) {
+	return c.storage.DeletePrefix(prefix)
+}
+
+func (c *Cache) ProcessRequest(r request.Request) (*http.Response, error) {
+	// Failover attempts and background revalidations already have the state
+	if s, ok := r.GetUserData(c.userDataKey()); ok {
+		c.prepare(r.GetHttpRequest(), s.(*requestState))
+		return nil, nil
+	}
+	state, re := c.lookup(r)
+	if state == nil {
+		return nil, nil
+	}
+	r.SetUserData(c.userDataKey(), state)
+	if re != nil {
+		return re, nil
+	}
+	c.prepare(r.GetHttpRequest(), state)
+	return nil, nil
+}
+
+func (c *Cache) ProcessResponse(r request.Request, a request.Attempt) {
+	s, ok := r.GetUserData(c.userDataKey())
+	if !ok {
+		return
+	}
+	state := s.(*requestState)
+	req, now := r.GetHttpRequest(), c.options.TimeProvider.UtcNow()
+
+	switch {
+	case state.served:
+		return
+	case state.invalidate:
+		if a.GetResponse() != nil && a.GetResponse().StatusCode < http.StatusBadRequest {
+			if err := c.storage.Delete(state.key); err != nil {
+				log.Errorf("%s failed to invalidate %s: %s", c, state.key, err)
+			}
+		}
+		return
+	}
+
+	re := a.GetResponse()
+	if a.GetError() != nil || re == nil || isServerError(re.StatusCode) {
+		if state.stale != nil && -state.stale.freshness(now) <= state.stale.staleWindow("stale-if-error") {
+			c.replaceResponse(a, state.stale.response(c.clientRequest(req, state), now))
+		}
+		c.finish(state)
+		return
+	}
+
+	if re.StatusCode == http.StatusNotModified && state.revalidate {
+		updated := state.stale.update(re, state.requestTime, now)
+		c.store(state.key, req, updated)
+		c.replaceResponse(a, updated.response(c.clientRequest(req, state), now))
+		c.finish(state)
+		return
+	}
+
+	if !state.store || !isStorable(req, re) || re.ContentLength > c.options.MaxBodyBytes {
+		c.finish(state)
+		return
+	}
+	requestTime, flight := state.requestTime, state.flight
+	state.flight = nil
+	re.Body = &cachingBody{
+		ReadCloser: re.Body,
+		buffer:     &bytes.Buffer{},
+		maxBytes:   c.options.MaxBodyBytes,
+		onDone: func(body []byte, complete bool) {
+			if complete {
+				c.store(state.key, req, newEntry(req, re, body, requestTime, now))
+			}
+			c.finishFlight(state.key, flight)
+		},
+	}
+}
+
+func (c *Cache) String() string {
+	return fmt.Sprintf("Cache(storage=%T)", c.storage)
+}
+
+func (c *Cache) userDataKey() string {
+	return fmt.Sprintf("cache.state.%p", c)
+}
+
+// Returns the response served from the cache or the state of the request that goes upstream,
+// nil state means that the cache is bypassed
+func (c *Cache) lookup(r request.Request) (*requestState, *http.Response) {
+	req := r.GetHttpRequest()
+	key := Key(req)
+	if req.Method != "GET" && req.Method != "HEAD" {
+		return &requestState{key: key, invalidate: true}, nil
+	}
+	reqCc := parseCacheControl(req.Header)
+	if reqCc.has("no-store") {
+		return nil, nil
+	}
+	waited := false
+	for {
+		entry, err := c.getEntry(key, req)
+		if err != nil {
+			log.Errorf("%s failed to get %s, bypassing the cache: %s", c, key, err)
+			return nil, nil
+		}
+		now := c.options.TimeProvider.UtcNow()
+		if entry != nil && isUsable(entry, req, reqCc, now) {
+			return &requestState{key: key, served: true}, entry.response(req, now)
+		}
+		if reqCc.has("only-if-cached") {
+			return &requestState{key: key, served: true}, netutils.NewTextResponse(req, http.StatusGatewayTimeout, "Response is not cached")
+		}
+
+		// HEAD requests are served from the stored GET responses, but never fetch them
+		if req.Method == "HEAD" {
+			return nil, nil
+		}
+		state := &requestState{
+			key:        key,
+			store:      true,
+			stale:      entry,
+			revalidate: entry != nil && entry.hasValidators() && !isConditional(req),
+		}
+		f, leader := c.joinFlight(key)
+		if entry != nil && canServeWhileRevalidating(entry, reqCc, now) {
+			switch {
+			case !leader:
+				return &requestState{key: key, served: true}, entry.response(req, now)
+			case c.options.Location != nil:
+				state.flight = f
+				go c.revalidate(r, state)
+				return &requestState{key: key, served: true}, entry.response(req, now)
+			}
+		}
+		if leader {
+			state.flight = f
+			return state, nil
+		}
+		if waited || !c.wait(f) {
+			return state, nil
+		}
+		waited = true
+	}
+}
+
+// Sets up the attempt to the upstream
+func (c *Cache) prepare(req *http.Request, state *requestState) {
+	state.requestTime = c.options.TimeProvider.UtcNow()
+	if state.revalidate {
+		state.stale.addValidators(req)
+	}
+}
+
+// Returns the request as it has been sent by the client, without the conditional headers added by the cache
+func (c *Cache) clientRequest(req *http.Request, state *requestState) *http.Request {
+	if !state.revalidate {
+		return req
+	}
+	out := new(http.Request)
+	*out = *req
+	out.Header = make(http.Header)
+	netutils.CopyHeaders(out.Header, req.Header)
+	out.Header.Del(headers.IfNoneMatch)
+	out.Header.Del(headers.IfModifiedSince)
+	return out
+}
+
+// Revalidates the stale entry by sending the request through the location
+func (c *Cache) revalidate(r request.Request, state *requestState) {
+	// Revalidation outlives the client's request
+	req := r.GetHttpRequest().WithContext(context.Background())
+	req.Method = "GET"
+	req.Body = ioutil.NopCloser(&bytes.Buffer{})
+	req.ContentLength = 0
+	req.Header = make(http.Header)
+	netutils.CopyHeaders(req.Header, r.GetHttpRequest().Header)
+	req.Header.Del(headers.IfNoneMatch)
+	req.Header.Del(headers.IfModifiedSince)
+
+	background := request.NewBaseRequest(req, r.GetId(), nil)
+	background.SetUserData(c.userDataKey(), state)
+	re, err := c.options.Location.RoundTrip(background)
+	if err != nil {
+		log.Errorf("%s failed to revalidate %s: %s", c, state.key, err)
+	}
+	if re != nil {
+		io.Copy(ioutil.Discard, re.Body)
+		re.Body.Close()
+	}
+	// The flight is finished by the response, unless the request has not reached the cache
+	c.finish(state)
+}
+
+// Returns the stored variant of the response matching the request
+func (c *Cache) getEntry(key string, req *http.Request) (*Entry, error) {
+	entries, err := c.storage.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		if e.matches(req) {
+			return e, nil
+		}
+	}
+	return nil, nil
+}
+
+// Stores the entry replacing the variant matching the request
+func (c *Cache) store(key string, req *http.Request, e *Entry) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	entries, err := c.storage.Get(key)
+	if err != nil {
+		log.Errorf("%s failed to get %s: %s", c, key, err)
+		return
+	}
+	updated := []*Entry{e}
+	for _, existing := range entries {
+		if !existing.matches(req) {
+			updated = append(updated, existing)
+		}
+	}
+	if err := c.storage.Set(key, updated); err != nil {
+		log.Errorf("%s failed to store %s: %s", c, key, err)
+	}
+}
+
+// Returns the flight fetching the key, true if the caller has started the flight and should fetch the key
+func (c *Cache) joinFlight(key string) (*flight, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if f, ok := c.flights[key]; ok {
+		return f, false
+	}
+	f := &flight{done: make(chan bool)}
+	c.flights[key] = f
+	return f, true
+}
+
+func (c *Cache) finishFlight(key string, f *flight) {
+	if f == nil {
+		return
+	}
+	c.mutex.Lock()
+	if c.flights[key] == f {
+		delete(c.flights, key)
+	}
+	c.mutex.Unlock()
+	f.finish()
+}
+
+func (c *Cache) finish(state *requestState) {
+	c.finishFlight(state.key, state.flight)
+	state.flight = nil
+}
+
+// Waits for the flight to finish, returns false in case of timeout
+func (c *Cache) wait(f *flight) bool {
+	select {
+	case <-f.done:
+		return true
+	case <-c.options.TimeProvider.After(c.options.CollapseTimeout):
+		return false
+	}
+}
+
+// Replaces the response of the attempt, location passes it to the client once the middleware chain is unwound
+func (c *Cache) replaceResponse(a request.Attempt, re *http.Response) {
+	ba, ok := a.(*request.BaseAttempt)
+	if !ok {
+		return
+	}
+	if ba.Response != nil {
+		ba.Response.Body.Close()
+	}
+	ba.Response, ba.Error = re, nil
+}
+
+// Returns true if the entry can be served to the request without revalidation
+func isUsable(e *Entry, req *http.Request, reqCc cacheControl, now time.Time) bool {
+	if reqCc.has("no-cache") || (len(reqCc) == 0 && req.Header.Get(headers.Pragma) == "no-cache") {
+		return false
+	}
+	if parseCacheControl(e.Header).has("no-cache") {
+		return false
+	}
+	if maxAge, ok := reqCc.duration("max-age"); ok && e.age(now) > maxAge {
+		return false
+	}
+	freshness := e.freshness(now)
+	if minFresh, ok := reqCc.duration("min-fresh"); ok {
+		freshness -= minFresh
+	}
+	if freshness > 0 {
+		return true
+	}
+	if !reqCc.has("max-stale") || !e.allowsStale() {
+		return false
+	}
+	// Client accepts the response of any staleness if max-stale has no value
+	maxStale, ok := reqCc.duration("max-stale")
+	return !ok || -freshness <= maxStale
+}
+
+func canServeWhileRevalidating(e *Entry, reqCc cacheControl, now time.Time) bool {
+	if reqCc.has("no-cache") || reqCc.has("max-age") {
+		return false
+	}
+	stale := -e.freshness(now)
+	return stale > 0 && stale <= e.staleWindow("stale-while-revalidate")
+}
+
+func isConditional(req *http.Request) bool {
+	return req.Header.Get(headers.IfNoneMatch) != "" || req.Header.Get(headers.IfModifiedSince) != ""
+}
+
+// Status codes that allow serving the stale response, http://tools.ietf.org/html/rfc5861#section-4
+func isServerError(statusCode int) bool {
+	switch statusCode {
+	case http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// Response body that is stored in the cache once it has been read to the end
+type cachingBody struct {
+	io.ReadCloser
+	buffer   *bytes.Buffer
+	maxBytes int64
+	onDone   func(body []byte, complete bool)
+	done     bool
+}
+
+func (b *cachingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 && b.buffer != nil {
+		if int64(b.buffer.Len()+n) > b.maxBytes {
+			b.buffer = nil
+		} else {
+			b.buffer.Write(p[:n])
+		}
+	}
+	if err == io.EOF {
+		b.finish(true)
+	}
+	return n, err
+}
+
+func (b *cachingBody) Close() error {
+	b.finish(false)
+	return b.ReadCloser.Close()
+}
+
+func (b *cachingBody) finish(complete bool) {
+	if b.done {
+		return
+	}
+	b.done = true
+	if b.buffer == nil {
+		b.onDone(nil, false)
+		return
+	}
+	b.onDone(b.buffer.Bytes(), complete)
+}
+
+const (
+	DefaultMaxBodyBytes    = 1048576
+	DefaultCollapseTimeout = 5 * time.Second
+)
+
+func parseOptions(o Options) Options {
+	if o.MaxBodyBytes <= 0 {
+		o.MaxBodyBytes = DefaultMaxBodyBytes
+	}
+	if o.CollapseTimeout <= 0 {
+		o.CollapseTimeout = DefaultCollapseTimeout
+	}
+	if o.TimeProvider == nil {
+		o.TimeProvider = &timetools.RealTime{}
+	}
+	return o
+}
@@ -0,0 +1,418 @@
+package cache
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	timetools "github.com/mailgun/gotools-time"
+	. "gopkg.in/check.v1"
+
+	"github.com/mailgun/vulcan"
+	"github.com/mailgun/vulcan/endpoint"
+	"github.com/mailgun/vulcan/loadbalance/roundrobin"
+	"github.com/mailgun/vulcan/location/httploc"
+	"github.com/mailgun/vulcan/route"
+	. "github.com/mailgun/vulcan/testutils"
+)
+
+func TestCache(t *testing.T) { TestingT(t) }
+
+type CacheSuite struct {
+	tm *timetools.FreezedTime
+}
+
+var _ = Suite(&CacheSuite{})
+
+func (s *CacheSuite) SetUpTest(c *C) {
+	s.tm = &timetools.FreezedTime{
+		CurrentTime: time.Date(2012, 3, 4, 5, 6, 7, 0, time.UTC),
+	}
+}
+
+func (s *CacheSuite) advance(d time.Duration) {
+	s.tm.CurrentTime = s.tm.CurrentTime.Add(d)
+}
+
+// Creates the proxy with the cache in front of the server
+func (s *CacheSuite) newProxy(c *C, server *httptest.Server, o Options) (*Cache, *httptest.Server) {
+	rr, err := roundrobin.NewRoundRobin()
+	c.Assert(err, IsNil)
+	rr.AddEndpoint(endpoint.MustParseUrl(server.URL))
+
+	location, err := httploc.NewLocation("dummy", rr)
+	c.Assert(err, IsNil)
+
+	storage, err := NewMemoryStorage(1048576)
+	c.Assert(err, IsNil)
+	if o.TimeProvider == nil {
+		o.TimeProvider = s.tm
+	}
+	cache, err := NewCacheWithOptions(storage, o)
+	c.Assert(err, IsNil)
+	location.GetMiddlewareChain().Add("cache", 0, cache)
+
+	proxy, err := vulcan.NewProxy(&route.ConstRouter{Location: location})
+	c.Assert(err, IsNil)
+	return cache, httptest.NewServer(proxy)
+}
+
+// Server counting the requests it has received
+func newCountingServer(handler func(count int64, w http.ResponseWriter, r *http.Request)) (*httptest.Server, *int64) {
+	var count int64
+	server := NewTestServer(func(w http.ResponseWriter, r *http.Request) {
+		handler(atomic.AddInt64(&count, 1), w, r)
+	})
+	return server, &count
+}
+
+func (s *CacheSuite) TestFreshHit(c *C) {
+	server, count := newCountingServer(func(n int64, w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte(fmt.Sprintf("response %d", n)))
+	})
+	defer server.Close()
+	_, proxy := s.newProxy(c, server, Options{})
+	defer proxy.Close()
+
+	_, body := Get(c, proxy.URL, nil, "")
+	c.Assert(string(body), Equals, "response 1")
+
+	s.advance(10 * time.Second)
+	re, body := Get(c, proxy.URL, nil, "")
+	c.Assert(re.StatusCode, Equals, http.StatusOK)
+	c.Assert(string(body), Equals, "response 1")
+	c.Assert(re.Header.Get("Age"), Equals, "10")
+	c.Assert(atomic.LoadInt64(count), Equals, int64(1))
+
+	// Different URL is a different key
+	_, body = Get(c, proxy.URL+"/other", nil, "")
+	c.Assert(string(body), Equals, "response 2")
+}
+
+func (s *CacheSuite) TestNotStored(c *C) {
+	server, count := newCountingServer(func(n int64, w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "no-store")
+		w.Write([]byte("hello"))
+	})
+	defer server.Close()
+	_, proxy := s.newProxy(c, server, Options{})
+	defer proxy.Close()
+
+	Get(c, proxy.URL, nil, "")
+	Get(c, proxy.URL, nil, "")
+	c.Assert(atomic.LoadInt64(count), Equals, int64(2))
+}
+
+func (s *CacheSuite) TestRequestDirectives(c *C) {
+	server, count := newCountingServer(func(n int64, w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte(fmt.Sprintf("response %d", n)))
+	})
+	defer server.Close()
+	_, proxy := s.newProxy(c, server, Options{})
+	defer proxy.Close()
+
+	// Nothing is cached yet
+	re, _ := Get(c, proxy.URL, http.Header{"Cache-Control": []string{"only-if-cached"}}, "")
+	c.Assert(re.StatusCode, Equals, http.StatusGatewayTimeout)
+
+	Get(c, proxy.URL, nil, "")
+	s.advance(30 * time.Second)
+
+	_, body := Get(c, proxy.URL, http.Header{"Cache-Control": []string{"only-if-cached"}}, "")
+	c.Assert(string(body), Equals, "response 1")
+
+	_, body = Get(c, proxy.URL, http.Header{"Cache-Control": []string{"min-fresh=40"}}, "")
+	c.Assert(string(body), Equals, "response 2")
+
+	s.advance(20 * time.Second)
+	_, body = Get(c, proxy.URL, http.Header{"Cache-Control": []string{"max-age=10"}}, "")
+	c.Assert(string(body), Equals, "response 3")
+
+	_, body = Get(c, proxy.URL, http.Header{"Cache-Control": []string{"no-cache"}}, "")
+	c.Assert(string(body), Equals, "response 4")
+
+	// Stale responses are served if the client accepts them
+	s.advance(70 * time.Second)
+	_, body = Get(c, proxy.URL, http.Header{"Cache-Control": []string{"max-stale=20"}}, "")
+	c.Assert(string(body), Equals, "response 4")
+	_, body = Get(c, proxy.URL, http.Header{"Cache-Control": []string{"max-stale=5"}}, "")
+	c.Assert(string(body), Equals, "response 5")
+	c.Assert(atomic.LoadInt64(count), Equals, int64(5))
+}
+
+func (s *CacheSuite) TestRevalidation(c *C) {
+	server, count := newCountingServer(func(n int64, w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("ETag", `"v1"`)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.Header().Set("X-Revalidated", fmt.Sprintf("%d", n))
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Write([]byte("hello"))
+	})
+	defer server.Close()
+	_, proxy := s.newProxy(c, server, Options{})
+	defer proxy.Close()
+
+	Get(c, proxy.URL, nil, "")
+	s.advance(61 * time.Second)
+
+	// Stale response is revalidated and the client receives the full response
+	re, body := Get(c, proxy.URL, nil, "")
+	c.Assert(re.StatusCode, Equals, http.StatusOK)
+	c.Assert(string(body), Equals, "hello")
+	c.Assert(re.Header.Get("X-Revalidated"), Equals, "2")
+	c.Assert(re.Header.Get("Age"), Equals, "0")
+
+	// Revalidated response is fresh again
+	re, body = Get(c, proxy.URL, nil, "")
+	c.Assert(string(body), Equals, "hello")
+	c.Assert(atomic.LoadInt64(count), Equals, int64(2))
+
+	// Client's own conditional request is answered from the cache
+	re, _ = Get(c, proxy.URL, http.Header{"If-None-Match": []string{`"v0", W/"v1"`}}, "")
+	c.Assert(re.StatusCode, Equals, http.StatusNotModified)
+	c.Assert(atomic.LoadInt64(count), Equals, int64(2))
+}
+
+func (s *CacheSuite) TestVary(c *C) {
+	server, count := newCountingServer(func(n int64, w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Vary", "Accept-Language")
+		w.Write([]byte(r.Header.Get("Accept-Language")))
+	})
+	defer server.Close()
+	_, proxy := s.newProxy(c, server, Options{})
+	defer proxy.Close()
+
+	for i := 0; i < 2; i++ {
+		for _, lang := range []string{"en", "fr"} {
+			_, body := Get(c, proxy.URL, http.Header{"Accept-Language": []string{lang}}, "")
+			c.Assert(string(body), Equals, lang)
+		}
+	}
+	c.Assert(atomic.LoadInt64(count), Equals, int64(2))
+}
+
+func (s *CacheSuite) TestUnsafeMethodInvalidates(c *C) {
+	server, count := newCountingServer(func(n int64, w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte(fmt.Sprintf("response %d", n)))
+	})
+	defer server.Close()
+	_, proxy := s.newProxy(c, server, Options{})
+	defer proxy.Close()
+
+	Get(c, proxy.URL+"/a", nil, "")
+	Post(c, proxy.URL+"/a", nil, nil)
+
+	_, body := Get(c, proxy.URL+"/a", nil, "")
+	c.Assert(string(body), Equals, "response 3")
+	c.Assert(atomic.LoadInt64(count), Equals, int64(3))
+}
+
+func (s *CacheSuite) TestHeadServedFromGet(c *C) {
+	server, count := newCountingServer(func(n int64, w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("hello"))
+	})
+	defer server.Close()
+	_, proxy := s.newProxy(c, server, Options{})
+	defer proxy.Close()
+
+	Get(c, proxy.URL, nil, "")
+	re, err := http.Head(proxy.URL)
+	c.Assert(err, IsNil)
+	re.Body.Close()
+	c.Assert(re.StatusCode, Equals, http.StatusOK)
+	c.Assert(re.ContentLength, Equals, int64(5))
+	c.Assert(atomic.LoadInt64(count), Equals, int64(1))
+}
+
+func (s *CacheSuite) TestStaleIfError(c *C) {
+	server, _ := newCountingServer(func(n int64, w http.ResponseWriter, r *http.Request) {
+		if n > 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Cache-Control", "max-age=60, stale-if-error=30")
+		w.Write([]byte("hello"))
+	})
+	defer server.Close()
+	_, proxy := s.newProxy(c, server, Options{})
+	defer proxy.Close()
+
+	Get(c, proxy.URL, nil, "")
+
+	s.advance(80 * time.Second)
+	re, body := Get(c, proxy.URL, nil, "")
+	c.Assert(re.StatusCode, Equals, http.StatusOK)
+	c.Assert(string(body), Equals, "hello")
+
+	// Window is over, the error is passed to the client
+	s.advance(20 * time.Second)
+	re, _ = Get(c, proxy.URL, nil, "")
+	c.Assert(re.StatusCode, Equals, http.StatusServiceUnavailable)
+}
+
+func (s *CacheSuite) TestStaleWhileRevalidate(c *C) {
+	server, count := newCountingServer(func(n int64, w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60, stale-while-revalidate=30")
+		w.Write([]byte(fmt.Sprintf("response %d", n)))
+	})
+	defer server.Close()
+	_, proxy := s.newProxy(c, server, Options{})
+	defer proxy.Close()
+
+	Get(c, proxy.URL, nil, "")
+	s.advance(70 * time.Second)
+
+	// Without the location the first request revalidates the response
+	_, body := Get(c, proxy.URL, nil, "")
+	c.Assert(string(body), Equals, "response 2")
+	c.Assert(atomic.LoadInt64(count), Equals, int64(2))
+}
+
+func (s *CacheSuite) TestStaleWhileRevalidateInBackground(c *C) {
+	server, count := newCountingServer(func(n int64, w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60, stale-while-revalidate=30")
+		w.Write([]byte(fmt.Sprintf("response %d", n)))
+	})
+	defer server.Close()
+
+	rr, err := roundrobin.NewRoundRobin()
+	c.Assert(err, IsNil)
+	rr.AddEndpoint(endpoint.MustParseUrl(server.URL))
+	location, err := httploc.NewLocation("dummy", rr)
+	c.Assert(err, IsNil)
+	storage, err := NewMemoryStorage(1048576)
+	c.Assert(err, IsNil)
+	cache, err := NewCacheWithOptions(storage, Options{Location: location, TimeProvider: &timetools.RealTime{}})
+	c.Assert(err, IsNil)
+	location.GetMiddlewareChain().Add("cache", 0, cache)
+	p, err := vulcan.NewProxy(&route.ConstRouter{Location: location})
+	c.Assert(err, IsNil)
+	proxy := httptest.NewServer(p)
+	defer proxy.Close()
+
+	// Store the response that has become stale a second ago
+	_, body := Get(c, proxy.URL, nil, "")
+	c.Assert(string(body), Equals, "response 1")
+	req, err := http.NewRequest("GET", proxy.URL, nil)
+	c.Assert(err, IsNil)
+	entries, err := storage.Get(Key(req))
+	c.Assert(err, IsNil)
+	c.Assert(len(entries), Equals, 1)
+	entries[0].ResponseTime = entries[0].ResponseTime.Add(-61 * time.Second)
+
+	_, body = Get(c, proxy.URL, nil, "")
+	c.Assert(string(body), Equals, "response 1")
+
+	for i := 0; i < 100 && atomic.LoadInt64(count) < 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Assert(atomic.LoadInt64(count), Equals, int64(2))
+	for i := 0; i < 100; i++ {
+		if _, body = Get(c, proxy.URL, nil, ""); string(body) == "response 2" {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Assert(string(body), Equals, "response 2")
+	c.Assert(atomic.LoadInt64(count), Equals, int64(2))
+}
+
+func (s *CacheSuite) TestCollapsedMisses(c *C) {
+	release := make(chan bool)
+	server, count := newCountingServer(func(n int64, w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte(fmt.Sprintf("response %d", n)))
+	})
+	defer server.Close()
+	_, proxy := s.newProxy(c, server, Options{TimeProvider: &timetools.RealTime{}})
+	defer proxy.Close()
+
+	bodies := make(chan string, 5)
+	wg := &sync.WaitGroup{}
+	get := func() {
+		defer wg.Done()
+		_, body := Get(c, proxy.URL, nil, "")
+		bodies <- string(body)
+	}
+	wg.Add(1)
+	go get()
+	for atomic.LoadInt64(count) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go get()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	close(bodies)
+
+	for body := range bodies {
+		c.Assert(body, Equals, "response 1")
+	}
+	c.Assert(atomic.LoadInt64(count), Equals, int64(1))
+}
+
+func (s *CacheSuite) TestPurge(c *C) {
+	server, count := newCountingServer(func(n int64, w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("hello"))
+	})
+	defer server.Close()
+	cache, proxy := s.newProxy(c, server, Options{})
+	defer proxy.Close()
+
+	for _, path := range []string{"/a/1", "/a/2", "/b"} {
+		Get(c, proxy.URL+path, nil, "")
+	}
+	base := "http://" + proxy.Listener.Addr().String()
+
+	c.Assert(cache.Purge(base+"/b"), IsNil)
+	deleted, err := cache.PurgePrefix(base + "/a/")
+	c.Assert(err, IsNil)
+	c.Assert(deleted, Equals, 2)
+
+	for _, path := range []string{"/a/1", "/a/2", "/b"} {
+		Get(c, proxy.URL+path, nil, "")
+	}
+	c.Assert(atomic.LoadInt64(count), Equals, int64(6))
+}
+
+func (s *CacheSuite) TestMaxBodyBytes(c *C) {
+	server, count := newCountingServer(func(n int64, w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("hello, world"))
+	})
+	defer server.Close()
+	_, proxy := s.newProxy(c, server, Options{MaxBodyBytes: 5})
+	defer proxy.Close()
+
+	for i := 0; i < 2; i++ {
+		_, body := Get(c, proxy.URL, nil, "")
+		c.Assert(string(body), Equals, "hello, world")
+	}
+	c.Assert(atomic.LoadInt64(count), Equals, int64(2))
+}
+
+func (s *CacheSuite) TestKey(c *C) {
+	req, err := http.NewRequest("GET", "http://localhost:5000/path?a=b", nil)
+	c.Assert(err, IsNil)
+	c.Assert(Key(req), Equals, "http://localhost:5000/path?a=b")
+
+	req.Host = "example.com"
+	c.Assert(Key(req), Equals, "http://example.com/path?a=b")
+}
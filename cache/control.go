@@ -0,0 +1,117 @@
+package cache
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mailgun/vulcan/headers"
+)
+
+// Cache-Control directives mapped to their arguments, empty string for directives without arguments
+type cacheControl map[string]string
+
+func parseCacheControl(h http.Header) cacheControl {
+	cc := cacheControl{}
+	for _, value := range h[headers.CacheControl] {
+		for _, part := range strings.Split(value, ",") {
+			part = strings.TrimSpace(part)
+			if part == "" {
+				continue
+			}
+			name, arg := part, ""
+			if i := strings.Index(part, "="); i != -1 {
+				name, arg = part[:i], strings.Trim(strings.TrimSpace(part[i+1:]), `"`)
+			}
+			cc[strings.ToLower(strings.TrimSpace(name))] = arg
+		}
+	}
+	return cc
+}
+
+func (cc cacheControl) has(directive string) bool {
+	_, ok := cc[directive]
+	return ok
+}
+
+// Returns the duration argument of the directive in seconds, false if directive is missing or invalid
+func (cc cacheControl) duration(directive string) (time.Duration, bool) {
+	arg, ok := cc[directive]
+	if !ok {
+		return 0, false
+	}
+	seconds, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil || seconds < 0 {
+		return 0, false
+	}
+	return time.Duration(seconds) * time.Second, true
+}
+
+// Returns the time value of the header, false if the header is missing or invalid
+func headerTime(h http.Header, name string) (time.Time, bool) {
+	value := h.Get(name)
+	if value == "" {
+		return time.Time{}, false
+	}
+	t, err := http.ParseTime(value)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+// Status codes that are cacheable by default, http://tools.ietf.org/html/rfc7231#section-6.1
+var heuristicStatusCodes = map[int]bool{
+	http.StatusOK:                   true,
+	http.StatusNonAuthoritativeInfo: true,
+	http.StatusNoContent:            true,
+	http.StatusMultipleChoices:      true,
+	http.StatusMovedPermanently:     true,
+	http.StatusNotFound:             true,
+	http.StatusMethodNotAllowed:     true,
+	http.StatusGone:                 true,
+	http.StatusRequestURITooLong:    true,
+	http.StatusNotImplemented:       true,
+}
+
+// Returns true if the shared cache is allowed to store the response, http://tools.ietf.org/html/rfc7234#section-3
+func isStorable(req *http.Request, re *http.Response) bool {
+	if req.Method != "GET" || re.StatusCode == http.StatusPartialContent {
+		return false
+	}
+	reqCc, cc := parseCacheControl(req.Header), parseCacheControl(re.Header)
+	if reqCc.has("no-store") || cc.has("no-store") || cc.has("private") {
+		return false
+	}
+	// Responses to the authorized requests are private unless stated otherwise
+	if req.Header.Get(headers.Authorization) != "" && !cc.has("public") && !cc.has("s-maxage") && !cc.has("must-revalidate") {
+		return false
+	}
+	// Cookies of one client should not be served to another one
+	if len(re.Header[headers.SetCookie]) != 0 {
+		return false
+	}
+	for _, name := range varyHeaders(re.Header) {
+		if name == "*" {
+			return false
+		}
+	}
+	if cc.has("public") || cc.has("max-age") || cc.has("s-maxage") || re.Header.Get(headers.Expires) != "" {
+		return true
+	}
+	return heuristicStatusCodes[re.StatusCode]
+}
+
+// Returns canonical names of the request headers listed in the Vary header
+func varyHeaders(h http.Header) []string {
+	names := []string{}
+	for _, value := range h[headers.Vary] {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+	return names
+}
@@ -0,0 +1,137 @@
+package cache
+
+import (
+	"crypto/sha1"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// DiskStorage keeps every key in a separate file of the directory, so the cache survives restarts
+type DiskStorage struct {
+	mutex *sync.Mutex
+	dir   string
+}
+
+func NewDiskStorage(dir string) (*DiskStorage, error) {
+	if dir == "" {
+		return nil, fmt.Errorf("Provide cache directory")
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &DiskStorage{mutex: &sync.Mutex{}, dir: dir}, nil
+}
+
+const diskFileSuffix = ".cache"
+
+// File keeps the key, so the keys can be matched by prefix
+type diskRecord struct {
+	Key     string
+	Entries []*Entry
+}
+
+func (s *DiskStorage) Get(key string) ([]*Entry, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	r, err := s.read(s.path(key))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if r.Key != key {
+		return nil, nil
+	}
+	return r.Entries, nil
+}
+
+func (s *DiskStorage) Set(key string, entries []*Entry) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// Write to the temporary file first, so the readers never see partially written records
+	f, err := ioutil.TempFile(s.dir, "tmp-")
+	if err != nil {
+		return err
+	}
+	err = gob.NewEncoder(f).Encode(&diskRecord{Key: key, Entries: entries})
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), s.path(key))
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+func (s *DiskStorage) Delete(key string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if err := os.Remove(s.path(key)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (s *DiskStorage) DeletePrefix(prefix string) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	infos, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return 0, err
+	}
+	deleted := 0
+	for _, info := range infos {
+		if !strings.HasSuffix(info.Name(), diskFileSuffix) {
+			continue
+		}
+		path := filepath.Join(s.dir, info.Name())
+		r, err := s.read(path)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return deleted, err
+		}
+		if !strings.HasPrefix(r.Key, prefix) {
+			continue
+		}
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return deleted, err
+		}
+		deleted += 1
+	}
+	return deleted, nil
+}
+
+func (s *DiskStorage) path(key string) string {
+	sum := sha1.Sum([]byte(key))
+	return filepath.Join(s.dir, hex.EncodeToString(sum[:])+diskFileSuffix)
+}
+
+func (s *DiskStorage) read(path string) (*diskRecord, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := &diskRecord{}
+	if err := gob.NewDecoder(f).Decode(r); err != nil {
+		return nil, fmt.Errorf("Failed to decode %s: %s", path, err)
+	}
+	return r, nil
+}
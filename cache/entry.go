@@ -0,0 +1,222 @@
+package cache
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mailgun/vulcan/headers"
+	"github.com/mailgun/vulcan/netutils"
+)
+
+// Entry is the cached response
+type Entry struct {
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+	// Values of the request headers listed in the response Vary header
+	Vary http.Header
+	// Time when the request was sent and when the response was received
+	RequestTime  time.Time
+	ResponseTime time.Time
+}
+
+// Maximum freshness lifetime calculated from the Last-Modified header
+const MaxHeuristicLifetime = 24 * time.Hour
+
+func newEntry(req *http.Request, re *http.Response, body []byte, requestTime, responseTime time.Time) *Entry {
+	e := &Entry{
+		StatusCode:   re.StatusCode,
+		Header:       make(http.Header),
+		Body:         body,
+		Vary:         make(http.Header),
+		RequestTime:  requestTime,
+		ResponseTime: responseTime,
+	}
+	netutils.CopyHeaders(e.Header, re.Header)
+	netutils.RemoveHeaders(headers.HopHeaders, e.Header)
+	e.Header.Del(headers.ContentLength)
+	for _, name := range varyHeaders(re.Header) {
+		e.Vary[name] = req.Header[name]
+	}
+	return e
+}
+
+// Returns true if the entry is the variant of the response selected by the request headers
+func (e *Entry) matches(req *http.Request) bool {
+	for name, values := range e.Vary {
+		if strings.Join(values, ",") != strings.Join(req.Header[name], ",") {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns the current age of the entry, http://tools.ietf.org/html/rfc7234#section-4.2.3
+func (e *Entry) age(now time.Time) time.Duration {
+	apparentAge := time.Duration(0)
+	if date, ok := headerTime(e.Header, headers.Date); ok && e.ResponseTime.After(date) {
+		apparentAge = e.ResponseTime.Sub(date)
+	}
+	correctedAge := e.ResponseTime.Sub(e.RequestTime)
+	if seconds, err := strconv.ParseInt(e.Header.Get(headers.Age), 10, 64); err == nil && seconds > 0 {
+		correctedAge += time.Duration(seconds) * time.Second
+	}
+	initialAge := apparentAge
+	if correctedAge > initialAge {
+		initialAge = correctedAge
+	}
+	return initialAge + now.Sub(e.ResponseTime)
+}
+
+// Returns the freshness lifetime of the entry, http://tools.ietf.org/html/rfc7234#section-4.2.1
+func (e *Entry) lifetime() time.Duration {
+	cc := parseCacheControl(e.Header)
+	if d, ok := cc.duration("s-maxage"); ok {
+		return d
+	}
+	if d, ok := cc.duration("max-age"); ok {
+		return d
+	}
+	date, ok := headerTime(e.Header, headers.Date)
+	if !ok {
+		date = e.ResponseTime
+	}
+	if e.Header.Get(headers.Expires) != "" {
+		// Invalid dates, e.g. "0" mean that the response has already expired
+		expires, ok := headerTime(e.Header, headers.Expires)
+		if !ok || !expires.After(date) {
+			return 0
+		}
+		return expires.Sub(date)
+	}
+	if modified, ok := headerTime(e.Header, headers.LastModified); ok && heuristicStatusCodes[e.StatusCode] && date.After(modified) {
+		lifetime := date.Sub(modified) / 10
+		if lifetime > MaxHeuristicLifetime {
+			lifetime = MaxHeuristicLifetime
+		}
+		return lifetime
+	}
+	return 0
+}
+
+// Returns the duration the entry stays fresh, negative duration shows how long the entry has been stale
+func (e *Entry) freshness(now time.Time) time.Duration {
+	return e.lifetime() - e.age(now)
+}
+
+// Returns true if the response allows the cache to serve it stale
+func (e *Entry) allowsStale() bool {
+	cc := parseCacheControl(e.Header)
+	return !cc.has("must-revalidate") && !cc.has("proxy-revalidate") && !cc.has("s-maxage") && !cc.has("no-cache")
+}
+
+// Returns the window of the Cache-Control extension (stale-while-revalidate or stale-if-error)
+// during which the stale entry can be served, http://tools.ietf.org/html/rfc5861
+func (e *Entry) staleWindow(directive string) time.Duration {
+	if !e.allowsStale() {
+		return 0
+	}
+	d, _ := parseCacheControl(e.Header).duration(directive)
+	return d
+}
+
+func (e *Entry) hasValidators() bool {
+	return e.Header.Get(headers.ETag) != "" || e.Header.Get(headers.LastModified) != ""
+}
+
+// Adds the conditional headers validating the entry to the request
+func (e *Entry) addValidators(req *http.Request) {
+	if etag := e.Header.Get(headers.ETag); etag != "" {
+		req.Header.Set(headers.IfNoneMatch, etag)
+	}
+	if modified := e.Header.Get(headers.LastModified); modified != "" {
+		req.Header.Set(headers.IfModifiedSince, modified)
+	}
+}
+
+// Returns the copy of the entry with the headers updated by the 304 Not Modified response,
+// http://tools.ietf.org/html/rfc7234#section-4.3.4
+func (e *Entry) update(re *http.Response, requestTime, responseTime time.Time) *Entry {
+	updated := *e
+	updated.Header = make(http.Header)
+	netutils.CopyHeaders(updated.Header, e.Header)
+	for name, values := range re.Header {
+		if name == headers.ContentLength {
+			continue
+		}
+		updated.Header[name] = values
+	}
+	netutils.RemoveHeaders(headers.HopHeaders, updated.Header)
+	updated.RequestTime, updated.ResponseTime = requestTime, responseTime
+	return &updated
+}
+
+// Returns true if the client's conditional request matches the entry, http://tools.ietf.org/html/rfc7232#section-6
+func (e *Entry) notModified(req *http.Request) bool {
+	if match := req.Header.Get(headers.IfNoneMatch); match != "" {
+		etag := strings.TrimPrefix(e.Header.Get(headers.ETag), "W/")
+		if etag == "" {
+			return false
+		}
+		for _, tag := range strings.Split(match, ",") {
+			tag = strings.TrimSpace(tag)
+			if tag == "*" || strings.TrimPrefix(tag, "W/") == etag {
+				return true
+			}
+		}
+		return false
+	}
+	since, ok := headerTime(req.Header, headers.IfModifiedSince)
+	if !ok {
+		return false
+	}
+	modified, ok := headerTime(e.Header, headers.LastModified)
+	return ok && !modified.After(since)
+}
+
+// Creates the response to the request from the entry
+func (e *Entry) response(req *http.Request, now time.Time) *http.Response {
+	re := &http.Response{
+		StatusCode: e.StatusCode,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(http.Header),
+		Request:    req,
+	}
+	netutils.CopyHeaders(re.Header, e.Header)
+	re.Header.Set(headers.Age, strconv.FormatInt(int64(e.age(now)/time.Second), 10))
+
+	body := e.Body
+	if e.notModified(req) {
+		re.StatusCode = http.StatusNotModified
+		body = nil
+	} else if req.Method == "HEAD" {
+		body = nil
+	}
+	re.Status = fmt.Sprintf("%d %s", re.StatusCode, http.StatusText(re.StatusCode))
+	if re.StatusCode != http.StatusNotModified {
+		re.Header.Set(headers.ContentLength, strconv.Itoa(len(e.Body)))
+	}
+	re.Body = ioutil.NopCloser(bytes.NewReader(body))
+	re.ContentLength = int64(len(body))
+	return re
+}
+
+func (e *Entry) size() int64 {
+	size := int64(len(e.Body))
+	for _, h := range []http.Header{e.Header, e.Vary} {
+		for name, values := range h {
+			size += int64(len(name))
+			for _, v := range values {
+				size += int64(len(v))
+			}
+		}
+	}
+	return size
+}
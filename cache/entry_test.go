@@ -0,0 +1,172 @@
+package cache
+
+import (
+	"net/http"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+type EntrySuite struct {
+	now time.Time
+}
+
+var _ = Suite(&EntrySuite{now: time.Date(2012, 3, 4, 5, 6, 7, 0, time.UTC)})
+
+func (s *EntrySuite) newEntry(statusCode int, h http.Header) *Entry {
+	return &Entry{StatusCode: statusCode, Header: h, RequestTime: s.now, ResponseTime: s.now}
+}
+
+func (s *EntrySuite) TestLifetime(c *C) {
+	date := s.now.Format(http.TimeFormat)
+	tc := []struct {
+		StatusCode int
+		Header     http.Header
+		Lifetime   time.Duration
+	}{
+		{
+			StatusCode: 200,
+			Header:     http.Header{"Cache-Control": []string{"max-age=60, s-maxage=30"}},
+			Lifetime:   30 * time.Second,
+		},
+		{
+			StatusCode: 200,
+			Header:     http.Header{"Cache-Control": []string{"public, max-age=60"}, "Expires": []string{date}},
+			Lifetime:   60 * time.Second,
+		},
+		{
+			StatusCode: 200,
+			Header:     http.Header{"Date": []string{date}, "Expires": []string{s.now.Add(time.Hour).Format(http.TimeFormat)}},
+			Lifetime:   time.Hour,
+		},
+		{
+			StatusCode: 200,
+			Header:     http.Header{"Expires": []string{"0"}},
+			Lifetime:   0,
+		},
+		{
+			StatusCode: 200,
+			Header:     http.Header{"Date": []string{date}, "Last-Modified": []string{s.now.Add(-10 * time.Hour).Format(http.TimeFormat)}},
+			Lifetime:   time.Hour,
+		},
+		{
+			StatusCode: 200,
+			Header:     http.Header{"Date": []string{date}, "Last-Modified": []string{s.now.Add(-1000 * time.Hour).Format(http.TimeFormat)}},
+			Lifetime:   MaxHeuristicLifetime,
+		},
+		{
+			StatusCode: 500,
+			Header:     http.Header{"Date": []string{date}, "Last-Modified": []string{s.now.Add(-10 * time.Hour).Format(http.TimeFormat)}},
+			Lifetime:   0,
+		},
+	}
+	for i, t := range tc {
+		c.Assert(s.newEntry(t.StatusCode, t.Header).lifetime(), Equals, t.Lifetime, Commentf("Test case #%d", i))
+	}
+}
+
+func (s *EntrySuite) TestAge(c *C) {
+	e := s.newEntry(200, http.Header{
+		"Date": []string{s.now.Add(-5 * time.Second).Format(http.TimeFormat)},
+		"Age":  []string{"2"},
+	})
+	e.RequestTime = s.now.Add(-time.Second)
+
+	// Apparent age exceeds the corrected age of 1 + 2 seconds
+	c.Assert(e.age(s.now), Equals, 5*time.Second)
+	c.Assert(e.age(s.now.Add(10*time.Second)), Equals, 15*time.Second)
+
+	e.Header.Set("Age", "7")
+	c.Assert(e.age(s.now), Equals, 8*time.Second)
+}
+
+func (s *EntrySuite) TestStaleWindow(c *C) {
+	e := s.newEntry(200, http.Header{"Cache-Control": []string{"max-age=60, stale-while-revalidate=10, stale-if-error=20"}})
+	c.Assert(e.staleWindow("stale-while-revalidate"), Equals, 10*time.Second)
+	c.Assert(e.staleWindow("stale-if-error"), Equals, 20*time.Second)
+
+	e.Header.Set("Cache-Control", "max-age=60, must-revalidate, stale-if-error=20")
+	c.Assert(e.staleWindow("stale-if-error"), Equals, time.Duration(0))
+}
+
+func (s *EntrySuite) TestIsStorable(c *C) {
+	tc := []struct {
+		Method        string
+		RequestHeader http.Header
+		StatusCode    int
+		Header        http.Header
+		Storable      bool
+	}{
+		{Method: "GET", StatusCode: 200, Header: http.Header{}, Storable: true},
+		{Method: "POST", StatusCode: 200, Header: http.Header{"Cache-Control": []string{"max-age=60"}}, Storable: false},
+		{Method: "GET", StatusCode: 206, Header: http.Header{"Cache-Control": []string{"max-age=60"}}, Storable: false},
+		{Method: "GET", StatusCode: 500, Header: http.Header{}, Storable: false},
+		{Method: "GET", StatusCode: 500, Header: http.Header{"Cache-Control": []string{"max-age=60"}}, Storable: true},
+		{Method: "GET", StatusCode: 200, Header: http.Header{"Cache-Control": []string{"private, max-age=60"}}, Storable: false},
+		{Method: "GET", StatusCode: 200, Header: http.Header{"Cache-Control": []string{"no-store"}}, Storable: false},
+		{Method: "GET", RequestHeader: http.Header{"Cache-Control": []string{"no-store"}}, StatusCode: 200, Header: http.Header{}, Storable: false},
+		{Method: "GET", StatusCode: 200, Header: http.Header{"Set-Cookie": []string{"a=b"}}, Storable: false},
+		{Method: "GET", StatusCode: 200, Header: http.Header{"Vary": []string{"*"}}, Storable: false},
+		{Method: "GET", RequestHeader: http.Header{"Authorization": []string{"Basic YTpi"}}, StatusCode: 200, Header: http.Header{"Cache-Control": []string{"max-age=60"}}, Storable: false},
+		{Method: "GET", RequestHeader: http.Header{"Authorization": []string{"Basic YTpi"}}, StatusCode: 200, Header: http.Header{"Cache-Control": []string{"public, max-age=60"}}, Storable: true},
+	}
+	for i, t := range tc {
+		h := t.RequestHeader
+		if h == nil {
+			h = http.Header{}
+		}
+		req := &http.Request{Method: t.Method, Header: h}
+		re := &http.Response{StatusCode: t.StatusCode, Header: t.Header}
+		c.Assert(isStorable(req, re), Equals, t.Storable, Commentf("Test case #%d", i))
+	}
+}
+
+func (s *EntrySuite) TestUpdate(c *C) {
+	e := s.newEntry(200, http.Header{"Cache-Control": []string{"max-age=60"}, "X-A": []string{"a"}})
+	e.Body = []byte("hello")
+
+	later := s.now.Add(time.Minute)
+	updated := e.update(&http.Response{
+		StatusCode: 304,
+		Header:     http.Header{"Cache-Control": []string{"max-age=120"}, "Content-Length": []string{"0"}},
+	}, later, later)
+
+	c.Assert(updated.Header.Get("Cache-Control"), Equals, "max-age=120")
+	c.Assert(updated.Header.Get("X-A"), Equals, "a")
+	c.Assert(updated.Header.Get("Content-Length"), Equals, "")
+	c.Assert(string(updated.Body), Equals, "hello")
+	c.Assert(updated.ResponseTime, Equals, later)
+
+	// Original entry is intact
+	c.Assert(e.Header.Get("Cache-Control"), Equals, "max-age=60")
+}
+
+func (s *EntrySuite) TestMatchesVary(c *C) {
+	req := &http.Request{Header: http.Header{"Accept-Encoding": []string{"gzip"}}}
+	re := &http.Response{StatusCode: 200, Header: http.Header{"Vary": []string{"accept-encoding"}}}
+	e := newEntry(req, re, nil, s.now, s.now)
+
+	c.Assert(e.matches(req), Equals, true)
+	c.Assert(e.matches(&http.Request{Header: http.Header{}}), Equals, false)
+	c.Assert(e.matches(&http.Request{Header: http.Header{"Accept-Encoding": []string{"br"}}}), Equals, false)
+}
+
+func (s *EntrySuite) TestResponse(c *C) {
+	e := s.newEntry(200, http.Header{"Last-Modified": []string{s.now.Add(-time.Hour).Format(http.TimeFormat)}})
+	e.Body = []byte("hello")
+
+	re := e.response(&http.Request{Method: "GET", Header: http.Header{}}, s.now)
+	c.Assert(re.StatusCode, Equals, 200)
+	c.Assert(re.ContentLength, Equals, int64(5))
+
+	re = e.response(&http.Request{Method: "HEAD", Header: http.Header{}}, s.now)
+	c.Assert(re.StatusCode, Equals, 200)
+	c.Assert(re.ContentLength, Equals, int64(0))
+	c.Assert(re.Header.Get("Content-Length"), Equals, "5")
+
+	re = e.response(&http.Request{Method: "GET", Header: http.Header{"If-Modified-Since": []string{s.now.Format(http.TimeFormat)}}}, s.now)
+	c.Assert(re.StatusCode, Equals, http.StatusNotModified)
+
+	re = e.response(&http.Request{Method: "GET", Header: http.Header{"If-Modified-Since": []string{s.now.Add(-2 * time.Hour).Format(http.TimeFormat)}}}, s.now)
+	c.Assert(re.StatusCode, Equals, 200)
+}
@@ -0,0 +1,119 @@
+package cache
+
+import (
+	"container/list"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// Storage keeps the cached responses. Key is the URL of the response,
+// entries are the variants of the response selected by the Vary header.
+type Storage interface {
+	// Returns the entries stored under the key, nil if there are none
+	Get(key string) ([]*Entry, error)
+	// Replaces the entries stored under the key
+	Set(key string, entries []*Entry) error
+	Delete(key string) error
+	// Deletes all the keys starting with the prefix, returns the amount of deleted keys
+	DeletePrefix(prefix string) (int, error)
+}
+
+// MemoryStorage keeps the responses in memory and evicts the least recently used ones
+// once the size of the stored responses exceeds the limit
+type MemoryStorage struct {
+	mutex    *sync.Mutex
+	maxBytes int64
+	used     int64
+	ll       *list.List
+	items    map[string]*list.Element
+}
+
+type memoryItem struct {
+	key     string
+	entries []*Entry
+	size    int64
+}
+
+func NewMemoryStorage(maxBytes int64) (*MemoryStorage, error) {
+	if maxBytes <= 0 {
+		return nil, fmt.Errorf("Max bytes should be > 0, got: %d", maxBytes)
+	}
+	return &MemoryStorage{
+		mutex:    &sync.Mutex{},
+		maxBytes: maxBytes,
+		ll:       list.New(),
+		items:    make(map[string]*list.Element),
+	}, nil
+}
+
+// Returns the size of the stored responses
+func (s *MemoryStorage) GetSize() int64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.used
+}
+
+func (s *MemoryStorage) Get(key string) ([]*Entry, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	el, ok := s.items[key]
+	if !ok {
+		return nil, nil
+	}
+	s.ll.MoveToFront(el)
+	return el.Value.(*memoryItem).entries, nil
+}
+
+func (s *MemoryStorage) Set(key string, entries []*Entry) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	item := &memoryItem{key: key, entries: entries}
+	for _, e := range entries {
+		item.size += e.size()
+	}
+	if item.size > s.maxBytes {
+		return fmt.Errorf("Entries of %d bytes exceed the storage size %d", item.size, s.maxBytes)
+	}
+	if el, ok := s.items[key]; ok {
+		s.remove(el)
+	}
+	s.items[key] = s.ll.PushFront(item)
+	s.used += item.size
+	for s.used > s.maxBytes {
+		s.remove(s.ll.Back())
+	}
+	return nil
+}
+
+func (s *MemoryStorage) Delete(key string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if el, ok := s.items[key]; ok {
+		s.remove(el)
+	}
+	return nil
+}
+
+func (s *MemoryStorage) DeletePrefix(prefix string) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	deleted := 0
+	for key, el := range s.items {
+		if strings.HasPrefix(key, prefix) {
+			s.remove(el)
+			deleted += 1
+		}
+	}
+	return deleted, nil
+}
+
+func (s *MemoryStorage) remove(el *list.Element) {
+	item := s.ll.Remove(el).(*memoryItem)
+	delete(s.items, item.key)
+	s.used -= item.size
+}
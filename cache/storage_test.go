@@ -0,0 +1,111 @@
+package cache
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+
+	. "gopkg.in/check.v1"
+)
+
+type StorageSuite struct {
+}
+
+var _ = Suite(&StorageSuite{})
+
+func newTestEntry(body string) *Entry {
+	return &Entry{StatusCode: 200, Header: http.Header{"Content-Type": []string{"text/plain"}}, Body: []byte(body)}
+}
+
+func (s *StorageSuite) testStorage(c *C, storage Storage) {
+	entries, err := storage.Get("http://a/1")
+	c.Assert(err, IsNil)
+	c.Assert(entries, IsNil)
+
+	for _, key := range []string{"http://a/1", "http://a/2", "http://b/1"} {
+		c.Assert(storage.Set(key, []*Entry{newTestEntry(key)}), IsNil)
+	}
+	entries, err = storage.Get("http://a/1")
+	c.Assert(err, IsNil)
+	c.Assert(len(entries), Equals, 1)
+	c.Assert(string(entries[0].Body), Equals, "http://a/1")
+	c.Assert(entries[0].Header.Get("Content-Type"), Equals, "text/plain")
+
+	c.Assert(storage.Set("http://a/1", []*Entry{newTestEntry("v1"), newTestEntry("v2")}), IsNil)
+	entries, err = storage.Get("http://a/1")
+	c.Assert(err, IsNil)
+	c.Assert(len(entries), Equals, 2)
+
+	c.Assert(storage.Delete("http://b/1"), IsNil)
+	c.Assert(storage.Delete("http://b/1"), IsNil)
+	entries, err = storage.Get("http://b/1")
+	c.Assert(err, IsNil)
+	c.Assert(entries, IsNil)
+
+	deleted, err := storage.DeletePrefix("http://a/")
+	c.Assert(err, IsNil)
+	c.Assert(deleted, Equals, 2)
+	entries, err = storage.Get("http://a/2")
+	c.Assert(err, IsNil)
+	c.Assert(entries, IsNil)
+}
+
+func (s *StorageSuite) TestMemoryStorage(c *C) {
+	storage, err := NewMemoryStorage(1024)
+	c.Assert(err, IsNil)
+	s.testStorage(c, storage)
+	c.Assert(storage.GetSize(), Equals, int64(0))
+}
+
+func (s *StorageSuite) TestMemoryStorageEvictsLeastRecentlyUsed(c *C) {
+	e := newTestEntry("hello")
+	storage, err := NewMemoryStorage(2 * e.size())
+	c.Assert(err, IsNil)
+
+	c.Assert(storage.Set("a", []*Entry{e}), IsNil)
+	c.Assert(storage.Set("b", []*Entry{e}), IsNil)
+	storage.Get("a")
+	c.Assert(storage.Set("c", []*Entry{e}), IsNil)
+
+	for key, present := range map[string]bool{"a": true, "b": false, "c": true} {
+		entries, err := storage.Get(key)
+		c.Assert(err, IsNil)
+		c.Assert(entries != nil, Equals, present, Commentf("Key %s", key))
+	}
+	c.Assert(storage.GetSize(), Equals, 2*e.size())
+
+	// Entries that never fit are rejected
+	c.Assert(storage.Set("d", []*Entry{e, e, e}), NotNil)
+}
+
+func (s *StorageSuite) TestDiskStorage(c *C) {
+	dir, err := ioutil.TempDir("", "vulcan-cache")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	storage, err := NewDiskStorage(dir)
+	c.Assert(err, IsNil)
+	s.testStorage(c, storage)
+}
+
+func (s *StorageSuite) TestDiskStorageSurvivesRestart(c *C) {
+	dir, err := ioutil.TempDir("", "vulcan-cache")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	storage, err := NewDiskStorage(dir)
+	c.Assert(err, IsNil)
+	c.Assert(storage.Set("http://a/1", []*Entry{newTestEntry("hello")}), IsNil)
+
+	storage, err = NewDiskStorage(dir)
+	c.Assert(err, IsNil)
+	entries, err := storage.Get("http://a/1")
+	c.Assert(err, IsNil)
+	c.Assert(len(entries), Equals, 1)
+	c.Assert(string(entries[0].Body), Equals, "hello")
+}
+
+func (s *StorageSuite) TestDiskStorageNoDir(c *C) {
+	_, err := NewDiskStorage("")
+	c.Assert(err, NotNil)
+}
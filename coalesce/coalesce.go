@@ -0,0 +1,248 @@
+// Middleware that merges identical in-flight GET and HEAD requests into a single upstream round trip
+package coalesce
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mailgun/gotools-time"
+
+	"github.com/mailgun/vulcan/limit"
+	"github.com/mailgun/vulcan/netutils"
+	"github.com/mailgun/vulcan/request"
+)
+
+type Options struct {
+	// Responses with larger bodies are not shared, waiting requests are sent upstream instead. Defaults to 1MB
+	MaxBodyBytes int64
+	// Time the request waits for the identical request in flight, defaults to 10 seconds
+	WaitTimeout  time.Duration
+	TimeProvider timetools.TimeProvider
+}
+
+// Coalescer lets the first request of the key (leader) go upstream, while the identical requests
+// arriving before it completes wait for the leader's response and receive its copy.
+type Coalescer struct {
+	mutex     *sync.Mutex
+	mapper    limit.TokenMapperFn
+	options   Options
+	calls     map[string]*call
+	coalesced int64
+}
+
+// Round trip of the leader shared with the waiting requests
+type call struct {
+	done chan bool
+	once sync.Once
+	// Outcome of the round trip, nil response means that waiters should send their own requests
+	response *http.Response
+	header   http.Header
+	body     []byte
+}
+
+func (c *call) finish() {
+	c.once.Do(func() { close(c.done) })
+}
+
+// State of the request passing through the coalescer
+type requestState struct {
+	key    string
+	call   *call
+	leader bool
+}
+
+func NewCoalescer(mapper limit.TokenMapperFn) (*Coalescer, error) {
+	return NewCoalescerWithOptions(mapper, Options{})
+}
+
+func NewCoalescerWithOptions(mapper limit.TokenMapperFn, o Options) (*Coalescer, error) {
+	if mapper == nil {
+		return nil, fmt.Errorf("Provide mapper function")
+	}
+	return &Coalescer{
+		mutex:   &sync.Mutex{},
+		mapper:  mapper,
+		options: parseOptions(o),
+		calls:   make(map[string]*call),
+	}, nil
+}
+
+// Maps the request to the key identifying identical requests: the method, the URL and the credentials,
+// so responses are never shared between the clients authorized differently
+var RequestToKey = limit.MakeCompositeTokenMapper(
+	limit.RequestToMethod,
+	limit.RequestToHost,
+	requestToURI,
+	limit.MakeRequestToHeader("Authorization"),
+	limit.MakeRequestToHeader("Cookie"),
+)
+
+func requestToURI(req request.Request) (string, error) {
+	return req.GetHttpRequest().URL.RequestURI(), nil
+}
+
+// Returns the amount of requests served with the response of the identical request
+func (c *Coalescer) GetCoalescedCount() int64 {
+	return atomic.LoadInt64(&c.coalesced)
+}
+
+func (c *Coalescer) ProcessRequest(r request.Request) (*http.Response, error) {
+	// Failover attempts are always sent upstream
+	if _, ok := r.GetUserData(c.userDataKey()); ok {
+		return nil, nil
+	}
+	req := r.GetHttpRequest()
+	if req.Method != "GET" && req.Method != "HEAD" {
+		return nil, nil
+	}
+	key, err := c.mapper(r)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mutex.Lock()
+	cl, ok := c.calls[key]
+	if !ok {
+		cl = &call{done: make(chan bool)}
+		c.calls[key] = cl
+	}
+	c.mutex.Unlock()
+
+	if !ok {
+		r.SetUserData(c.userDataKey(), &requestState{key: key, call: cl, leader: true})
+		return nil, nil
+	}
+
+	select {
+	case <-cl.done:
+	case <-c.options.TimeProvider.After(c.options.WaitTimeout):
+		return nil, nil
+	case <-req.Context().Done():
+		return nil, req.Context().Err()
+	}
+	if cl.response == nil {
+		return nil, nil
+	}
+	atomic.AddInt64(&c.coalesced, 1)
+	r.SetUserData(c.userDataKey(), &requestState{key: key, call: cl})
+	return cl.newResponse(req), nil
+}
+
+func (c *Coalescer) ProcessResponse(r request.Request, a request.Attempt) {
+	s, ok := r.GetUserData(c.userDataKey())
+	if !ok {
+		return
+	}
+	state := s.(*requestState)
+	cl := state.call
+	if cl == nil {
+		return
+	}
+	state.call = nil
+
+	// Request served with the leader's response has not reached the endpoint, so meters skip it
+	if !state.leader {
+		if ba, ok := a.(*request.BaseAttempt); ok {
+			ba.Coalesced = true
+		}
+		return
+	}
+
+	defer c.finish(state.key, cl)
+	re := a.GetResponse()
+	// Errors and failures are specific to the leader's attempt, so the waiters send their own requests
+	if a.GetError() != nil || re == nil || !sharedStatusCodes[re.StatusCode] {
+		return
+	}
+	// Read the body, so it can be replayed to every waiting request
+	body, err := ioutil.ReadAll(io.LimitReader(re.Body, c.options.MaxBodyBytes+1))
+	if err != nil {
+		re.Body.Close()
+		if ba, ok := a.(*request.BaseAttempt); ok {
+			ba.Response, ba.Error = nil, err
+		}
+		return
+	}
+	if int64(len(body)) > c.options.MaxBodyBytes {
+		re.Body = &prefixedBody{Reader: io.MultiReader(bytes.NewReader(body), re.Body), Closer: re.Body}
+		return
+	}
+	re.Body.Close()
+	re.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	// Location keeps changing the leader's response, e.g. wraps its body, so waiters copy the snapshot
+	snapshot := *re
+	cl.response, cl.body = &snapshot, body
+	// Proxy modifies the leader's headers while the waiters copy them
+	cl.header = make(http.Header)
+	netutils.CopyHeaders(cl.header, re.Header)
+}
+
+// Successful responses that can be shared with the waiting requests
+var sharedStatusCodes = map[int]bool{
+	http.StatusOK:                   true,
+	http.StatusNonAuthoritativeInfo: true,
+	http.StatusNoContent:            true,
+	http.StatusMultipleChoices:      true,
+	http.StatusMovedPermanently:     true,
+}
+
+func (c *Coalescer) String() string {
+	return fmt.Sprintf("Coalescer(coalesced=%d)", c.GetCoalescedCount())
+}
+
+func (c *Coalescer) userDataKey() string {
+	return fmt.Sprintf("coalesce.state.%p", c)
+}
+
+func (c *Coalescer) finish(key string, cl *call) {
+	c.mutex.Lock()
+	if c.calls[key] == cl {
+		delete(c.calls, key)
+	}
+	c.mutex.Unlock()
+	cl.finish()
+}
+
+// Creates the copy of the leader's response for the waiting request
+func (c *call) newResponse(req *http.Request) *http.Response {
+	re := new(http.Response)
+	*re = *c.response
+	re.Request = req
+	re.Header = make(http.Header)
+	netutils.CopyHeaders(re.Header, c.header)
+	re.Body = ioutil.NopCloser(bytes.NewReader(c.body))
+	re.ContentLength = int64(len(c.body))
+	re.TransferEncoding = nil
+	return re
+}
+
+// Body of the response that has been partially read
+type prefixedBody struct {
+	io.Reader
+	io.Closer
+}
+
+const (
+	DefaultMaxBodyBytes = 1048576
+	DefaultWaitTimeout  = 10 * time.Second
+)
+
+func parseOptions(o Options) Options {
+	if o.MaxBodyBytes <= 0 {
+		o.MaxBodyBytes = DefaultMaxBodyBytes
+	}
+	if o.WaitTimeout <= 0 {
+		o.WaitTimeout = DefaultWaitTimeout
+	}
+	if o.TimeProvider == nil {
+		o.TimeProvider = &timetools.RealTime{}
+	}
+	return o
+}
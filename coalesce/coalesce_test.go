@@ -0,0 +1,296 @@
+package coalesce
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	timetools "github.com/mailgun/gotools-time"
+	. "gopkg.in/check.v1"
+
+	"github.com/mailgun/vulcan"
+	"github.com/mailgun/vulcan/endpoint"
+	"github.com/mailgun/vulcan/loadbalance/roundrobin"
+	"github.com/mailgun/vulcan/location/httploc"
+	"github.com/mailgun/vulcan/metrics"
+	"github.com/mailgun/vulcan/request"
+	"github.com/mailgun/vulcan/route"
+	. "github.com/mailgun/vulcan/testutils"
+)
+
+func TestCoalesce(t *testing.T) { TestingT(t) }
+
+type CoalesceSuite struct {
+}
+
+var _ = Suite(&CoalesceSuite{})
+
+func makeRequest(method, url string, header http.Header) request.Request {
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		panic(err)
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	return request.NewBaseRequest(req, 1, nil)
+}
+
+func makeResponse(body string) *http.Response {
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": []string{"text/plain"}},
+		Body:       ioutil.NopCloser(strings.NewReader(body)),
+	}
+}
+
+// Starts the waiting requests and returns the channel receiving their attempts
+func startWaiters(c *Coalescer, count int, method, url string) chan request.Attempt {
+	attempts := make(chan request.Attempt, count)
+	for i := 0; i < count; i++ {
+		go func() {
+			r := makeRequest(method, url, nil)
+			// Location assigns the endpoint chosen by the load balancer before the middlewares run
+			a := &request.BaseAttempt{Endpoint: endpoint.MustParseUrl("http://localhost:5001")}
+			a.Response, a.Error = c.ProcessRequest(r)
+			c.ProcessResponse(r, a)
+			attempts <- a
+		}()
+	}
+	// Let the waiters block on the leader
+	time.Sleep(20 * time.Millisecond)
+	return attempts
+}
+
+func readBody(c *C, re *http.Response) string {
+	body, err := ioutil.ReadAll(re.Body)
+	c.Assert(err, IsNil)
+	return string(body)
+}
+
+func (s *CoalesceSuite) TestWaitersShareResponse(c *C) {
+	cl, err := NewCoalescer(RequestToKey)
+	c.Assert(err, IsNil)
+
+	leader := makeRequest("GET", "http://localhost/a", nil)
+	re, err := cl.ProcessRequest(leader)
+	c.Assert(re, IsNil)
+	c.Assert(err, IsNil)
+
+	attempts := startWaiters(cl, 3, "GET", "http://localhost/a")
+
+	e := endpoint.MustParseUrl("http://localhost:5000")
+	a := &request.BaseAttempt{Endpoint: e, Response: makeResponse("hello"), Duration: time.Second}
+	cl.ProcessResponse(leader, a)
+	c.Assert(readBody(c, a.Response), Equals, "hello")
+
+	for i := 0; i < 3; i++ {
+		wa := (<-attempts).(*request.BaseAttempt)
+		c.Assert(wa.Error, IsNil)
+		c.Assert(readBody(c, wa.Response), Equals, "hello")
+		c.Assert(wa.Response.Header.Get("Content-Type"), Equals, "text/plain")
+		c.Assert(wa.Response.ContentLength, Equals, int64(5))
+		// Waiters have not reached the endpoint, so they are marked for the meters to skip them
+		c.Assert(wa.Endpoint.GetUrl().String(), Equals, "http://localhost:5001")
+		c.Assert(wa.Coalesced, Equals, true)
+	}
+	c.Assert(cl.GetCoalescedCount(), Equals, int64(3))
+
+	// Call is over, next request leads the new one
+	re, err = cl.ProcessRequest(makeRequest("GET", "http://localhost/a", nil))
+	c.Assert(re, IsNil)
+	c.Assert(err, IsNil)
+}
+
+func (s *CoalesceSuite) TestDifferentKeys(c *C) {
+	cl, err := NewCoalescer(RequestToKey)
+	c.Assert(err, IsNil)
+
+	for _, r := range []request.Request{
+		makeRequest("GET", "http://localhost/a", nil),
+		makeRequest("GET", "http://localhost/a?b=c", nil),
+		makeRequest("HEAD", "http://localhost/a", nil),
+		makeRequest("GET", "http://localhost/a", http.Header{"Authorization": []string{"Basic YTpi"}}),
+		makeRequest("GET", "http://localhost/a", http.Header{"Cookie": []string{"session=1"}}),
+	} {
+		re, err := cl.ProcessRequest(r)
+		c.Assert(re, IsNil)
+		c.Assert(err, IsNil)
+	}
+}
+
+func (s *CoalesceSuite) TestUnsafeMethodsPass(c *C) {
+	cl, err := NewCoalescer(RequestToKey)
+	c.Assert(err, IsNil)
+
+	for i := 0; i < 2; i++ {
+		r := makeRequest("POST", "http://localhost/a", nil)
+		re, err := cl.ProcessRequest(r)
+		c.Assert(re, IsNil)
+		c.Assert(err, IsNil)
+		_, ok := r.GetUserData(cl.userDataKey())
+		c.Assert(ok, Equals, false)
+	}
+}
+
+func (s *CoalesceSuite) TestLeaderErrorReleasesWaiters(c *C) {
+	cl, err := NewCoalescer(RequestToKey)
+	c.Assert(err, IsNil)
+
+	leader := makeRequest("GET", "http://localhost/a", nil)
+	cl.ProcessRequest(leader)
+	attempts := startWaiters(cl, 2, "GET", "http://localhost/a")
+
+	cl.ProcessResponse(leader, &request.BaseAttempt{Error: fmt.Errorf("Connection refused")})
+
+	// Waiters send their own requests
+	for i := 0; i < 2; i++ {
+		a := <-attempts
+		c.Assert(a.GetResponse(), IsNil)
+		c.Assert(a.GetError(), IsNil)
+	}
+	c.Assert(cl.GetCoalescedCount(), Equals, int64(0))
+}
+
+func (s *CoalesceSuite) TestFailedResponseNotShared(c *C) {
+	cl, err := NewCoalescer(RequestToKey)
+	c.Assert(err, IsNil)
+
+	for _, status := range []int{http.StatusNotFound, http.StatusTooManyRequests, http.StatusBadGateway} {
+		leader := makeRequest("GET", "http://localhost/a", nil)
+		cl.ProcessRequest(leader)
+		attempts := startWaiters(cl, 2, "GET", "http://localhost/a")
+
+		a := &request.BaseAttempt{Response: makeResponse("failed")}
+		a.Response.StatusCode = status
+		cl.ProcessResponse(leader, a)
+		c.Assert(readBody(c, a.Response), Equals, "failed")
+
+		// Waiters send their own requests
+		for i := 0; i < 2; i++ {
+			wa := <-attempts
+			c.Assert(wa.GetResponse(), IsNil)
+			c.Assert(wa.GetError(), IsNil)
+		}
+	}
+	c.Assert(cl.GetCoalescedCount(), Equals, int64(0))
+}
+
+func (s *CoalesceSuite) TestWaiterGone(c *C) {
+	cl, err := NewCoalescer(RequestToKey)
+	c.Assert(err, IsNil)
+
+	leader := makeRequest("GET", "http://localhost/a", nil)
+	cl.ProcessRequest(leader)
+
+	req, err := http.NewRequest("GET", "http://localhost/a", nil)
+	c.Assert(err, IsNil)
+	ctx, cancel := context.WithCancel(req.Context())
+	cancel()
+	re, err := cl.ProcessRequest(request.NewBaseRequest(req.WithContext(ctx), 2, nil))
+	c.Assert(re, IsNil)
+	c.Assert(err, Equals, context.Canceled)
+	c.Assert(cl.GetCoalescedCount(), Equals, int64(0))
+}
+
+func (s *CoalesceSuite) TestLargeBodyNotShared(c *C) {
+	cl, err := NewCoalescerWithOptions(RequestToKey, Options{MaxBodyBytes: 4})
+	c.Assert(err, IsNil)
+
+	leader := makeRequest("GET", "http://localhost/a", nil)
+	cl.ProcessRequest(leader)
+	attempts := startWaiters(cl, 2, "GET", "http://localhost/a")
+
+	a := &request.BaseAttempt{Response: makeResponse("hello, world")}
+	cl.ProcessResponse(leader, a)
+	c.Assert(readBody(c, a.Response), Equals, "hello, world")
+
+	for i := 0; i < 2; i++ {
+		c.Assert((<-attempts).GetResponse(), IsNil)
+	}
+}
+
+func (s *CoalesceSuite) TestFailoverAttemptsPass(c *C) {
+	cl, err := NewCoalescer(RequestToKey)
+	c.Assert(err, IsNil)
+
+	leader := makeRequest("GET", "http://localhost/a", nil)
+	cl.ProcessRequest(leader)
+	cl.ProcessResponse(leader, &request.BaseAttempt{Error: fmt.Errorf("Connection refused")})
+
+	other := makeRequest("GET", "http://localhost/a", nil)
+	cl.ProcessRequest(other)
+
+	// Retry of the leader does not wait for the new call
+	re, err := cl.ProcessRequest(leader)
+	c.Assert(re, IsNil)
+	c.Assert(err, IsNil)
+}
+
+func (s *CoalesceSuite) TestThunderingHerd(c *C) {
+	var count int64
+	release := make(chan bool)
+	server := NewTestServer(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&count, 1)
+		<-release
+		w.Write([]byte("hello"))
+	})
+	defer server.Close()
+
+	e := endpoint.MustParseUrl(server.URL)
+	endpointMeter, err := metrics.NewRollingMeter(e, 10, time.Second, &timetools.RealTime{}, metrics.IsNetworkError)
+	c.Assert(err, IsNil)
+	rr, err := roundrobin.NewRoundRobin()
+	c.Assert(err, IsNil)
+	rr.AddEndpointWithOptions(e, roundrobin.EndpointOptions{Meter: endpointMeter})
+	location, err := httploc.NewLocation("dummy", rr)
+	c.Assert(err, IsNil)
+	locationMeter, err := metrics.NewLocationRollingMeter(10, time.Second, &timetools.RealTime{}, metrics.IsNetworkError)
+	c.Assert(err, IsNil)
+	location.GetObserverChain().Add("meter", locationMeter)
+	cl, err := NewCoalescer(RequestToKey)
+	c.Assert(err, IsNil)
+	location.GetMiddlewareChain().Add("coalesce", 0, cl)
+	p, err := vulcan.NewProxy(&route.ConstRouter{Location: location})
+	c.Assert(err, IsNil)
+	proxy := httptest.NewServer(p)
+	defer proxy.Close()
+
+	wg := &sync.WaitGroup{}
+	bodies := make(chan string, 5)
+	get := func() {
+		defer wg.Done()
+		_, body := Get(c, proxy.URL, nil, "")
+		bodies <- string(body)
+	}
+	wg.Add(1)
+	go get()
+	for atomic.LoadInt64(&count) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go get()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	close(bodies)
+
+	for body := range bodies {
+		c.Assert(body, Equals, "hello")
+	}
+	c.Assert(atomic.LoadInt64(&count), Equals, int64(1))
+	c.Assert(cl.GetCoalescedCount(), Equals, int64(4))
+
+	// Only the leader has reached the endpoint, waiters are not accounted by the meters
+	c.Assert(endpointMeter.ProcessedCount(), Equals, int64(1))
+	c.Assert(locationMeter.ProcessedCount(), Equals, int64(1))
+}
@@ -0,0 +1,324 @@
+// Middleware compressing the responses and decompressing the request bodies
+package compression
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/mailgun/vulcan/errors"
+	"github.com/mailgun/vulcan/headers"
+	"github.com/mailgun/vulcan/netutils"
+	"github.com/mailgun/vulcan/request"
+)
+
+type Options struct {
+	// Encoders in the order of the server preference, defaults to gzip and deflate
+	Encoders []Encoder
+	// Compressed content types, e.g. "application/json", or "text/*" for all the subtypes. Defaults to DefaultContentTypes
+	ContentTypes []string
+	// Content types that are never compressed, even if they match ContentTypes. Defaults to DefaultExcludedContentTypes if nil
+	ExcludedContentTypes []string
+	// Responses with smaller bodies are not compressed, defaults to 1024 bytes.
+	// Bodies of unknown length are compressed while they are streamed, as waiting for MinBytes would delay them
+	MinBytes int64
+	// Decompress gzip encoded request bodies for the backends that can't handle them
+	DecompressRequests bool
+	// Upper limit of the decompressed request body, unlimited if not set
+	MaxDecompressedBytes int64
+}
+
+var DefaultContentTypes = []string{
+	"text/*",
+	"application/json",
+	"application/javascript",
+	"application/xml",
+	"application/xhtml+xml",
+	"application/rss+xml",
+	"application/atom+xml",
+	"image/svg+xml",
+}
+
+// Event streams are flushed by the upstream event by event, so they are passed through as is
+var DefaultExcludedContentTypes = []string{
+	"text/event-stream",
+}
+
+// Compressor negotiates the content coding with the client and compresses the eligible upstream responses
+type Compressor struct {
+	options Options
+}
+
+func NewCompressor() (*Compressor, error) {
+	return NewCompressorWithOptions(Options{})
+}
+
+func NewCompressorWithOptions(o Options) (*Compressor, error) {
+	options, err := parseOptions(o)
+	if err != nil {
+		return nil, err
+	}
+	return &Compressor{options: options}, nil
+}
+
+func (c *Compressor) GetOptions() Options {
+	return c.options
+}
+
+func (c *Compressor) ProcessRequest(r request.Request) (*http.Response, error) {
+	req := r.GetHttpRequest()
+	// ETags of the compressed responses are altered, restore them so the upstream recognizes them
+	for _, name := range []string{headers.IfNoneMatch, headers.IfMatch} {
+		if value := req.Header.Get(name); value != "" {
+			req.Header.Set(name, c.restoreETags(value))
+		}
+	}
+	if c.options.DecompressRequests && strings.EqualFold(req.Header.Get(headers.ContentEncoding), "gzip") {
+		reader, err := gzip.NewReader(req.Body)
+		if err != nil {
+			return nil, errors.FromStatus(http.StatusBadRequest)
+		}
+		req.Body = &decompressedBody{Reader: reader, body: req.Body, maxBytes: c.options.MaxDecompressedBytes}
+		req.ContentLength = -1
+		req.Header.Del(headers.ContentLength)
+		req.Header.Del(headers.ContentEncoding)
+	}
+	return nil, nil
+}
+
+func (c *Compressor) ProcessResponse(r request.Request, a request.Attempt) {
+	re := a.GetResponse()
+	if a.GetError() != nil || re == nil || !c.isEligible(r.GetHttpRequest(), re) {
+		return
+	}
+	// Representation depends on the Accept-Encoding, even if this client gets it uncompressed
+	addVary(re.Header, headers.AcceptEncoding)
+
+	encoder := negotiate(r.GetHttpRequest().Header.Get(headers.AcceptEncoding), c.options.Encoders)
+	if encoder == nil {
+		return
+	}
+	body, err := newCompressedBody(re.Body, encoder)
+	if err != nil {
+		return
+	}
+	re.Body = body
+	re.ContentLength = -1
+	re.Header.Del(headers.ContentLength)
+	re.Header.Set(headers.ContentEncoding, encoder.GetName())
+	if etag := re.Header.Get(headers.ETag); etag != "" {
+		re.Header.Set(headers.ETag, encodedETag(etag, encoder.GetName()))
+	}
+}
+
+func (c *Compressor) String() string {
+	return fmt.Sprintf("Compressor(encoders=%d)", len(c.options.Encoders))
+}
+
+// Returns true if the response can be compressed
+func (c *Compressor) isEligible(req *http.Request, re *http.Response) bool {
+	if req.Method == "HEAD" {
+		return false
+	}
+	switch re.StatusCode {
+	case http.StatusNoContent, http.StatusNotModified, http.StatusPartialContent:
+		return false
+	}
+	if re.StatusCode < http.StatusOK || re.Header.Get(headers.ContentRange) != "" {
+		return false
+	}
+	// Never compress twice
+	if encoding := re.Header.Get(headers.ContentEncoding); encoding != "" && !strings.EqualFold(encoding, "identity") {
+		return false
+	}
+	for _, h := range []http.Header{req.Header, re.Header} {
+		for _, value := range h[headers.CacheControl] {
+			if strings.Contains(strings.ToLower(value), "no-transform") {
+				return false
+			}
+		}
+	}
+	if re.ContentLength >= 0 && re.ContentLength < c.options.MinBytes {
+		return false
+	}
+	return c.isCompressible(re.Header.Get(headers.ContentType))
+}
+
+func (c *Compressor) isCompressible(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return matchesMediaType(mediaType, c.options.ContentTypes) && !matchesMediaType(mediaType, c.options.ExcludedContentTypes)
+}
+
+func matchesMediaType(mediaType string, types []string) bool {
+	for _, t := range types {
+		if t == mediaType || (strings.HasSuffix(t, "/*") && strings.HasPrefix(mediaType, t[:len(t)-1])) {
+			return true
+		}
+	}
+	return false
+}
+
+// Replaces the ETags of the compressed responses with the original ones
+func (c *Compressor) restoreETags(value string) string {
+	tags := strings.Split(value, ",")
+	for i, tag := range tags {
+		tag = strings.TrimSpace(tag)
+		for _, e := range c.options.Encoders {
+			suffix := "-" + e.GetName() + `"`
+			if strings.HasSuffix(tag, suffix) {
+				tag = tag[:len(tag)-len(suffix)] + `"`
+				break
+			}
+		}
+		tags[i] = tag
+	}
+	return strings.Join(tags, ", ")
+}
+
+// Strong ETag identifies the exact bytes of the response, so the compressed response gets a distinct one.
+// Weak ETags stay the same, as the compressed response is semantically equivalent.
+func encodedETag(etag, encoding string) string {
+	if strings.HasPrefix(etag, "W/") || !strings.HasSuffix(etag, `"`) {
+		return etag
+	}
+	return etag[:len(etag)-1] + "-" + encoding + `"`
+}
+
+func addVary(h http.Header, name string) {
+	for _, value := range h[headers.Vary] {
+		for _, v := range strings.Split(value, ",") {
+			v = strings.TrimSpace(v)
+			if v == "*" || strings.EqualFold(v, name) {
+				return
+			}
+		}
+	}
+	h.Add(headers.Vary, name)
+}
+
+// Response body compressed on the fly. Every chunk read from the upstream is flushed,
+// so the streamed responses reach the client without delays.
+type compressedBody struct {
+	body   io.ReadCloser
+	writer io.WriteCloser
+	buffer *bytes.Buffer
+	chunk  []byte
+	eof    bool
+}
+
+type flusher interface {
+	Flush() error
+}
+
+const compressChunkBytes = 32768
+
+func newCompressedBody(body io.ReadCloser, e Encoder) (*compressedBody, error) {
+	buffer := &bytes.Buffer{}
+	writer, err := e.NewWriter(buffer)
+	if err != nil {
+		return nil, err
+	}
+	return &compressedBody{
+		body:   body,
+		writer: writer,
+		buffer: buffer,
+		chunk:  make([]byte, compressChunkBytes),
+	}, nil
+}
+
+func (b *compressedBody) Read(p []byte) (int, error) {
+	for b.buffer.Len() == 0 {
+		if b.eof {
+			return 0, io.EOF
+		}
+		if err := b.fill(); err != nil {
+			return 0, err
+		}
+	}
+	return b.buffer.Read(p)
+}
+
+func (b *compressedBody) fill() error {
+	n, err := b.body.Read(b.chunk)
+	if n > 0 {
+		if _, err := b.writer.Write(b.chunk[:n]); err != nil {
+			return err
+		}
+		if f, ok := b.writer.(flusher); ok {
+			if err := f.Flush(); err != nil {
+				return err
+			}
+		}
+	}
+	if err == io.EOF {
+		b.eof = true
+		return b.writer.Close()
+	}
+	return err
+}
+
+func (b *compressedBody) Close() error {
+	return b.body.Close()
+}
+
+// Decompressed request body, limited to the maximum size
+type decompressedBody struct {
+	io.Reader
+	body     io.Closer
+	read     int64
+	maxBytes int64
+}
+
+func (b *decompressedBody) Read(p []byte) (int, error) {
+	n, err := b.Reader.Read(p)
+	b.read += int64(n)
+	if b.maxBytes > 0 && b.read > b.maxBytes {
+		return n, &netutils.MaxSizeReachedError{MaxSize: b.maxBytes}
+	}
+	return n, err
+}
+
+func (b *decompressedBody) Close() error {
+	return b.body.Close()
+}
+
+const DefaultMinBytes = 1024
+
+func parseOptions(o Options) (Options, error) {
+	if len(o.Encoders) == 0 {
+		gz, err := NewGzipEncoder(gzip.DefaultCompression)
+		if err != nil {
+			return o, err
+		}
+		deflate, err := NewDeflateEncoder(gzip.DefaultCompression)
+		if err != nil {
+			return o, err
+		}
+		o.Encoders = []Encoder{gz, deflate}
+	}
+	if len(o.ContentTypes) == 0 {
+		o.ContentTypes = DefaultContentTypes
+	}
+	if o.ExcludedContentTypes == nil {
+		o.ExcludedContentTypes = DefaultExcludedContentTypes
+	}
+	for _, t := range append(append([]string{}, o.ContentTypes...), o.ExcludedContentTypes...) {
+		if _, _, err := mime.ParseMediaType(strings.Replace(t, "*", "any", 1)); err != nil {
+			return o, fmt.Errorf("Invalid content type %s: %s", t, err)
+		}
+	}
+	if o.MinBytes <= 0 {
+		o.MinBytes = DefaultMinBytes
+	}
+	if o.MaxDecompressedBytes < 0 {
+		return o, fmt.Errorf("Max decompressed bytes should be >= 0, got: %d", o.MaxDecompressedBytes)
+	}
+	return o, nil
+}
@@ -0,0 +1,223 @@
+package compression
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/mailgun/vulcan"
+	"github.com/mailgun/vulcan/endpoint"
+	"github.com/mailgun/vulcan/loadbalance/roundrobin"
+	"github.com/mailgun/vulcan/location/httploc"
+	"github.com/mailgun/vulcan/request"
+	"github.com/mailgun/vulcan/route"
+	. "github.com/mailgun/vulcan/testutils"
+)
+
+func TestCompression(t *testing.T) { TestingT(t) }
+
+type CompressionSuite struct {
+}
+
+var _ = Suite(&CompressionSuite{})
+
+var text = strings.Repeat("hello, world ", 200)
+
+func (s *CompressionSuite) newProxy(c *C, server *httptest.Server, o Options) *httptest.Server {
+	rr, err := roundrobin.NewRoundRobin()
+	c.Assert(err, IsNil)
+	rr.AddEndpoint(endpoint.MustParseUrl(server.URL))
+	location, err := httploc.NewLocation("dummy", rr)
+	c.Assert(err, IsNil)
+	compressor, err := NewCompressorWithOptions(o)
+	c.Assert(err, IsNil)
+	location.GetMiddlewareChain().Add("compression", 0, compressor)
+	proxy, err := vulcan.NewProxy(&route.ConstRouter{Location: location})
+	c.Assert(err, IsNil)
+	return httptest.NewServer(proxy)
+}
+
+func gunzip(c *C, body []byte) string {
+	r, err := gzip.NewReader(bytes.NewReader(body))
+	c.Assert(err, IsNil)
+	out, err := ioutil.ReadAll(r)
+	c.Assert(err, IsNil)
+	return string(out)
+}
+
+func (s *CompressionSuite) TestCompressResponse(c *C) {
+	server := NewTestServer(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Vary", "Accept-Language")
+		w.Write([]byte(text))
+	})
+	defer server.Close()
+	proxy := s.newProxy(c, server, Options{})
+	defer proxy.Close()
+
+	re, body := Get(c, proxy.URL, http.Header{"Accept-Encoding": []string{"gzip"}}, "")
+	c.Assert(re.StatusCode, Equals, http.StatusOK)
+	c.Assert(re.Header.Get("Content-Encoding"), Equals, "gzip")
+	c.Assert(re.ContentLength == -1 || re.ContentLength == int64(len(body)), Equals, true)
+	c.Assert(re.Header["Vary"], DeepEquals, []string{"Accept-Language", "Accept-Encoding"})
+	c.Assert(re.Header.Get("ETag"), Equals, `"v1-gzip"`)
+	c.Assert(len(body) < len(text), Equals, true)
+	c.Assert(gunzip(c, body), Equals, text)
+
+	// Client that does not accept the encoding gets the response as is
+	re, body = Get(c, proxy.URL, http.Header{"Accept-Encoding": []string{"identity"}}, "")
+	c.Assert(re.Header.Get("Content-Encoding"), Equals, "")
+	c.Assert(re.Header.Get("ETag"), Equals, `"v1"`)
+	c.Assert(string(body), Equals, text)
+}
+
+func (s *CompressionSuite) TestNotEligible(c *C) {
+	server := NewTestServer(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/image":
+			w.Header().Set("Content-Type", "image/png")
+		case "/small":
+			w.Header().Set("Content-Type", "text/plain")
+			w.Write([]byte("hello"))
+			return
+		case "/no-transform":
+			w.Header().Set("Content-Type", "text/plain")
+			w.Header().Set("Cache-Control", "public, no-transform")
+		case "/compressed":
+			w.Header().Set("Content-Type", "text/plain")
+			w.Header().Set("Content-Encoding", "br")
+		}
+		w.Write([]byte(text))
+	})
+	defer server.Close()
+	proxy := s.newProxy(c, server, Options{})
+	defer proxy.Close()
+
+	for _, path := range []string{"/image", "/small", "/no-transform", "/compressed"} {
+		re, _ := Get(c, proxy.URL+path, http.Header{"Accept-Encoding": []string{"gzip"}}, "")
+		c.Assert(re.Header.Get("Content-Encoding") != "gzip", Equals, true, Commentf("Path %s", path))
+	}
+}
+
+func (s *CompressionSuite) TestUnknownLength(c *C) {
+	release := make(chan bool)
+	server := NewTestServer(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", r.URL.Query().Get("type"))
+		w.Write([]byte("abc"))
+		w.(http.Flusher).Flush()
+		<-release
+		w.Write([]byte("def"))
+	})
+	defer server.Close()
+	proxy := s.newProxy(c, server, Options{})
+	defer proxy.Close()
+
+	get := func(contentType string) (*http.Response, []byte) {
+		req, err := http.NewRequest("GET", proxy.URL+"?type="+url.QueryEscape(contentType), nil)
+		c.Assert(err, IsNil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		re, err := http.DefaultTransport.RoundTrip(req)
+		c.Assert(err, IsNil)
+
+		// Body shorter than MinBytes is not held back until the upstream completes it
+		r := io.Reader(re.Body)
+		if re.Header.Get("Content-Encoding") == "gzip" {
+			r, err = gzip.NewReader(re.Body)
+			c.Assert(err, IsNil)
+		}
+		first := make([]byte, 3)
+		_, err = io.ReadFull(r, first)
+		c.Assert(err, IsNil)
+		release <- true
+		rest, err := ioutil.ReadAll(r)
+		c.Assert(err, IsNil)
+		re.Body.Close()
+		return re, append(first, rest...)
+	}
+
+	re, body := get("application/json")
+	c.Assert(re.Header.Get("Content-Encoding"), Equals, "gzip")
+	c.Assert(string(body), Equals, "abcdef")
+
+	// Event streams are never compressed
+	re, body = get("text/event-stream")
+	c.Assert(re.Header.Get("Content-Encoding"), Equals, "")
+	c.Assert(string(body), Equals, "abcdef")
+}
+
+func (s *CompressionSuite) TestRestoreETags(c *C) {
+	var ifNoneMatch string
+	server := NewTestServer(func(w http.ResponseWriter, r *http.Request) {
+		ifNoneMatch = r.Header.Get("If-None-Match")
+		w.WriteHeader(http.StatusNotModified)
+	})
+	defer server.Close()
+	proxy := s.newProxy(c, server, Options{})
+	defer proxy.Close()
+
+	Get(c, proxy.URL, http.Header{"If-None-Match": []string{`"v1-gzip", "v2", W/"v3-deflate"`}}, "")
+	c.Assert(ifNoneMatch, Equals, `"v1", "v2", W/"v3"`)
+}
+
+func (s *CompressionSuite) TestDecompressRequest(c *C) {
+	var received string
+	var contentEncoding string
+	server := NewTestServer(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		received, contentEncoding = string(body), r.Header.Get("Content-Encoding")
+		w.Write([]byte("ok"))
+	})
+	defer server.Close()
+	proxy := s.newProxy(c, server, Options{DecompressRequests: true, MaxDecompressedBytes: int64(len(text))})
+	defer proxy.Close()
+
+	buffer := &bytes.Buffer{}
+	w := gzip.NewWriter(buffer)
+	w.Write([]byte(text))
+	w.Close()
+
+	re, _ := Get(c, proxy.URL, http.Header{"Content-Encoding": []string{"gzip"}}, buffer.String())
+	c.Assert(re.StatusCode, Equals, http.StatusOK)
+	c.Assert(received, Equals, text)
+	c.Assert(contentEncoding, Equals, "")
+
+	re, _ = Get(c, proxy.URL, http.Header{"Content-Encoding": []string{"gzip"}}, "not gzip")
+	c.Assert(re.StatusCode, Equals, http.StatusBadRequest)
+}
+
+func (s *CompressionSuite) TestDecompressLimit(c *C) {
+	compressor, err := NewCompressorWithOptions(Options{DecompressRequests: true, MaxDecompressedBytes: 10})
+	c.Assert(err, IsNil)
+
+	buffer := &bytes.Buffer{}
+	w := gzip.NewWriter(buffer)
+	w.Write([]byte(text))
+	w.Close()
+
+	req, err := http.NewRequest("POST", "http://localhost", buffer)
+	c.Assert(err, IsNil)
+	req.Header.Set("Content-Encoding", "gzip")
+	re, err := compressor.ProcessRequest(request.NewBaseRequest(req, 1, nil))
+	c.Assert(re, IsNil)
+	c.Assert(err, IsNil)
+	c.Assert(req.ContentLength, Equals, int64(-1))
+
+	_, err = ioutil.ReadAll(req.Body)
+	c.Assert(err, NotNil)
+}
+
+func (s *CompressionSuite) TestInvalidOptions(c *C) {
+	_, err := NewCompressorWithOptions(Options{ContentTypes: []string{"text/"}})
+	c.Assert(err, NotNil)
+	_, err = NewCompressorWithOptions(Options{MaxDecompressedBytes: -1})
+	c.Assert(err, NotNil)
+}
@@ -0,0 +1,97 @@
+package compression
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Encoder compresses the response bodies with the content coding, e.g. gzip.
+// Codings that are not available in the standard library, e.g. brotli ("br"), are added by implementing this interface.
+type Encoder interface {
+	// Returns the name of the content coding as it appears in Accept-Encoding and Content-Encoding headers
+	GetName() string
+	NewWriter(w io.Writer) (io.WriteCloser, error)
+}
+
+type GzipEncoder struct {
+	level int
+}
+
+// Creates gzip encoder with the compression level, see compress/gzip for the valid levels
+func NewGzipEncoder(level int) (*GzipEncoder, error) {
+	if level < gzip.HuffmanOnly || level > gzip.BestCompression {
+		return nil, fmt.Errorf("Invalid gzip compression level: %d", level)
+	}
+	return &GzipEncoder{level: level}, nil
+}
+
+func (e *GzipEncoder) GetName() string {
+	return "gzip"
+}
+
+func (e *GzipEncoder) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return gzip.NewWriterLevel(w, e.level)
+}
+
+type DeflateEncoder struct {
+	level int
+}
+
+// Creates deflate encoder with the compression level, see compress/flate for the valid levels
+func NewDeflateEncoder(level int) (*DeflateEncoder, error) {
+	if level < flate.HuffmanOnly || level > flate.BestCompression {
+		return nil, fmt.Errorf("Invalid deflate compression level: %d", level)
+	}
+	return &DeflateEncoder{level: level}, nil
+}
+
+func (e *DeflateEncoder) GetName() string {
+	return "deflate"
+}
+
+func (e *DeflateEncoder) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return flate.NewWriter(w, e.level)
+}
+
+// Returns the encoder with the highest quality value in the Accept-Encoding header, ties are resolved
+// in favor of the encoder listed first. Returns nil if the client does not accept any of the encoders.
+func negotiate(acceptEncoding string, encoders []Encoder) Encoder {
+	if acceptEncoding == "" {
+		return nil
+	}
+	qualities := make(map[string]float64)
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		params := strings.Split(part, ";")
+		name := strings.ToLower(strings.TrimSpace(params[0]))
+		if name == "" {
+			continue
+		}
+		q := 1.0
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if !strings.HasPrefix(param, "q=") {
+				continue
+			}
+			if v, err := strconv.ParseFloat(param[2:], 64); err == nil {
+				q = v
+			}
+		}
+		qualities[name] = q
+	}
+	var best Encoder
+	bestQ := 0.0
+	for _, e := range encoders {
+		q, ok := qualities[e.GetName()]
+		if !ok {
+			q, ok = qualities["*"]
+		}
+		if ok && q > bestQ {
+			best, bestQ = e, q
+		}
+	}
+	return best
+}
@@ -0,0 +1,67 @@
+package compression
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"io/ioutil"
+
+	. "gopkg.in/check.v1"
+)
+
+type EncoderSuite struct {
+	gzip    Encoder
+	deflate Encoder
+}
+
+var _ = Suite(&EncoderSuite{})
+
+func (s *EncoderSuite) SetUpSuite(c *C) {
+	var err error
+	s.gzip, err = NewGzipEncoder(gzip.BestSpeed)
+	c.Assert(err, IsNil)
+	s.deflate, err = NewDeflateEncoder(flate.BestSpeed)
+	c.Assert(err, IsNil)
+}
+
+func (s *EncoderSuite) TestNegotiate(c *C) {
+	encoders := []Encoder{s.gzip, s.deflate}
+	tc := []struct {
+		AcceptEncoding string
+		Expected       Encoder
+	}{
+		{AcceptEncoding: "", Expected: nil},
+		{AcceptEncoding: "identity", Expected: nil},
+		{AcceptEncoding: "br", Expected: nil},
+		{AcceptEncoding: "gzip", Expected: s.gzip},
+		{AcceptEncoding: "deflate", Expected: s.deflate},
+		{AcceptEncoding: "GZIP", Expected: s.gzip},
+		{AcceptEncoding: "deflate, gzip", Expected: s.gzip},
+		{AcceptEncoding: "gzip;q=0.5, deflate", Expected: s.deflate},
+		{AcceptEncoding: "gzip;q=0, *", Expected: s.deflate},
+		{AcceptEncoding: "*;q=0", Expected: nil},
+		{AcceptEncoding: "br, *;q=0.1", Expected: s.gzip},
+	}
+	for i, t := range tc {
+		c.Assert(negotiate(t.AcceptEncoding, encoders), Equals, t.Expected, Commentf("Test case #%d: %s", i, t.AcceptEncoding))
+	}
+}
+
+func (s *EncoderSuite) TestInvalidLevel(c *C) {
+	_, err := NewGzipEncoder(42)
+	c.Assert(err, NotNil)
+	_, err = NewDeflateEncoder(-42)
+	c.Assert(err, NotNil)
+}
+
+func (s *EncoderSuite) TestDeflate(c *C) {
+	buffer := &bytes.Buffer{}
+	w, err := s.deflate.NewWriter(buffer)
+	c.Assert(err, IsNil)
+	w.Write([]byte("hello"))
+	c.Assert(w.Close(), IsNil)
+
+	out, err := ioutil.ReadAll(flate.NewReader(buffer))
+	c.Assert(err, IsNil)
+	c.Assert(string(out), Equals, "hello")
+}
@@ -0,0 +1,329 @@
+/*
+Declarative configuration of the hosts, routes, locations, endpoints and middlewares in JSON:
+
+	{
+	  "Hosts": [
+	    {"Name": "example.com", "Routes": [{"Expression": "TrieRoute(\"/api\")", "Location": "api"}]}
+	  ],
+	  "Locations": [
+	    {
+	      "Id": "api",
+	      "Endpoints": [{"Url": "http://localhost:5000", "Weight": 2}, {"Url": "http://localhost:5001"}],
+	      "Options": {"Timeouts": {"Read": "5s"}, "Failover": "IsNetworkError && AttemptsLe(2)"},
+	      "Middlewares": [
+	        {"Id": "rl", "Type": "ratelimit", "Spec": {"Variable": "client.ip", "Units": 10, "Period": "1s", "Burst": 20}}
+	      ]
+	    }
+	  ]
+	}
+
+Durations are strings in Go format, e.g. "1.5s". Loader builds the proxy's router from the file and applies the changes
+to the file while the proxy is running.
+*/
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/mailgun/vulcan/endpoint"
+	"github.com/mailgun/vulcan/failover"
+	"github.com/mailgun/vulcan/location/httploc"
+)
+
+type Config struct {
+	Hosts     []Host
+	Locations []Location
+}
+
+// Host routes the requests with the Host header matching the name by the route expressions
+type Host struct {
+	Name   string
+	Routes []Route
+}
+
+type Route struct {
+	// Route expression, e.g. TrieRoute("/api")
+	Expression string
+	// Id of the location
+	Location string
+}
+
+type Location struct {
+	Id          string
+	Endpoints   []Endpoint
+	Options     LocationOptions
+	Middlewares []Middleware
+}
+
+type Endpoint struct {
+	Url string
+	// Relative weight of the endpoint, defaults to 1
+	Weight int
+}
+
+type Middleware struct {
+	Id string
+	// Registered middleware type, e.g. ratelimit or connlimit
+	Type string
+	// Middlewares with lower priority process the requests first
+	Priority int
+	// Settings of the middleware, depend on the type
+	Spec json.RawMessage
+}
+
+// Options of the location, see httploc.Options
+type LocationOptions struct {
+	Timeouts  Timeouts
+	KeepAlive KeepAlive
+	Limits    Limits
+	// Failover predicate, e.g. IsNetworkError && AttemptsLe(2)
+	Failover string
+	// HTTP/1.1, HTTP/2 or h2c
+	Protocol string
+	TLS      *TLS
+	// Used in forwarding headers
+	Hostname           string
+	TrustForwardHeader bool
+}
+
+type Timeouts struct {
+	Read         Duration
+	Dial         Duration
+	TlsHandshake Duration
+}
+
+type KeepAlive struct {
+	Period                Duration
+	MaxIdleConnsPerHost   int
+	MaxConnsPerHost       int
+	IdleConnTimeout       Duration
+	MaxConnLifetime       Duration
+	MaxConnLifetimeJitter Duration
+	PrewarmConnsPerHost   int
+}
+
+type Limits struct {
+	MaxMemBodyBytes int64
+	MaxBodyBytes    int64
+}
+
+type TLS struct {
+	CAFile             string
+	CertFile           string
+	KeyFile            string
+	ServerName         string
+	MinVersion         uint16
+	CipherSuites       []uint16
+	InsecureSkipVerify bool
+	ReloadInterval     Duration
+}
+
+// Duration in Go format, e.g. "300ms"
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("Duration should be a string, e.g. \"1s\", got %s", data)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// Parses and validates the config, unknown fields are treated as errors to catch the typos
+func ParseConfig(data []byte) (*Config, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	var c Config
+	if err := decoder.Decode(&c); err != nil {
+		return nil, fmt.Errorf("Failed to parse config: %s", err)
+	}
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+func (c *Config) validate() error {
+	locations := make(map[string]bool, len(c.Locations))
+	for _, l := range c.Locations {
+		if l.Id == "" {
+			return fmt.Errorf("Location id can't be empty")
+		}
+		if locations[l.Id] {
+			return fmt.Errorf("Duplicate location '%s'", l.Id)
+		}
+		locations[l.Id] = true
+		if err := l.validate(); err != nil {
+			return fmt.Errorf("Location '%s': %s", l.Id, err)
+		}
+	}
+	hosts := make(map[string]bool, len(c.Hosts))
+	for _, h := range c.Hosts {
+		name := strings.ToLower(h.Name)
+		if name == "" {
+			return fmt.Errorf("Host name can't be empty")
+		}
+		if hosts[name] {
+			return fmt.Errorf("Duplicate host '%s'", h.Name)
+		}
+		hosts[name] = true
+		expressions := make(map[string]bool, len(h.Routes))
+		for _, r := range h.Routes {
+			if r.Expression == "" {
+				return fmt.Errorf("Host '%s': route expression can't be empty", h.Name)
+			}
+			if expressions[r.Expression] {
+				return fmt.Errorf("Host '%s': duplicate route '%s'", h.Name, r.Expression)
+			}
+			expressions[r.Expression] = true
+			if !locations[r.Location] {
+				return fmt.Errorf("Host '%s': route '%s' refers to unknown location '%s'", h.Name, r.Expression, r.Location)
+			}
+		}
+	}
+	return nil
+}
+
+func (l *Location) validate() error {
+	if _, err := l.Options.ToOptions(); err != nil {
+		return err
+	}
+	endpoints := make(map[string]bool, len(l.Endpoints))
+	for _, e := range l.Endpoints {
+		parsed, err := endpoint.ParseUrl(e.Url)
+		if err != nil {
+			return err
+		}
+		if endpoints[parsed.GetId()] {
+			return fmt.Errorf("Duplicate endpoint '%s'", e.Url)
+		}
+		endpoints[parsed.GetId()] = true
+		if e.Weight < 0 {
+			return fmt.Errorf("Endpoint '%s': weight should be >= 0", e.Url)
+		}
+	}
+	middlewares := make(map[string]bool, len(l.Middlewares))
+	for _, m := range l.Middlewares {
+		if m.Id == "" {
+			return fmt.Errorf("Middleware id can't be empty")
+		}
+		if middlewares[m.Id] {
+			return fmt.Errorf("Duplicate middleware '%s'", m.Id)
+		}
+		middlewares[m.Id] = true
+		if getMiddlewareFactory(m.Type) == nil {
+			return fmt.Errorf("Middleware '%s': unknown type '%s'", m.Id, m.Type)
+		}
+	}
+	return nil
+}
+
+// Converts the options to the location options, defaults are set by the location
+func (o *LocationOptions) ToOptions() (httploc.Options, error) {
+	out := httploc.Options{
+		Timeouts: httploc.Timeouts{
+			Read:         time.Duration(o.Timeouts.Read),
+			Dial:         time.Duration(o.Timeouts.Dial),
+			TlsHandshake: time.Duration(o.Timeouts.TlsHandshake),
+		},
+		KeepAlive: httploc.KeepAlive{
+			Period:                time.Duration(o.KeepAlive.Period),
+			MaxIdleConnsPerHost:   o.KeepAlive.MaxIdleConnsPerHost,
+			MaxConnsPerHost:       o.KeepAlive.MaxConnsPerHost,
+			IdleConnTimeout:       time.Duration(o.KeepAlive.IdleConnTimeout),
+			MaxConnLifetime:       time.Duration(o.KeepAlive.MaxConnLifetime),
+			MaxConnLifetimeJitter: time.Duration(o.KeepAlive.MaxConnLifetimeJitter),
+			PrewarmConnsPerHost:   o.KeepAlive.PrewarmConnsPerHost,
+		},
+		Limits: httploc.Limits{
+			MaxMemBodyBytes: o.Limits.MaxMemBodyBytes,
+			MaxBodyBytes:    o.Limits.MaxBodyBytes,
+		},
+		Hostname:           o.Hostname,
+		TrustForwardHeader: o.TrustForwardHeader,
+	}
+	if o.Failover != "" {
+		predicate, err := failover.ParseExpression(o.Failover)
+		if err != nil {
+			return out, fmt.Errorf("Invalid failover expression '%s': %s", o.Failover, err)
+		}
+		out.ShouldFailover = predicate
+	}
+	switch o.Protocol {
+	case "", httploc.HTTP1.String():
+		out.Protocol = httploc.HTTP1
+	case httploc.HTTP2.String():
+		out.Protocol = httploc.HTTP2
+	case httploc.H2C.String():
+		out.Protocol = httploc.H2C
+	default:
+		return out, fmt.Errorf("Unsupported protocol '%s'", o.Protocol)
+	}
+	if o.TLS != nil {
+		out.TLS = &httploc.TLS{
+			CAFile:             o.TLS.CAFile,
+			CertFile:           o.TLS.CertFile,
+			KeyFile:            o.TLS.KeyFile,
+			ServerName:         o.TLS.ServerName,
+			MinVersion:         o.TLS.MinVersion,
+			CipherSuites:       o.TLS.CipherSuites,
+			InsecureSkipVerify: o.TLS.InsecureSkipVerify,
+			ReloadInterval:     time.Duration(o.TLS.ReloadInterval),
+		}
+	}
+	return out, nil
+}
+
+// Converts the location options back to the config form. Failover predicate can't be converted back,
+// so it's left empty.
+func FromOptions(o httploc.Options) LocationOptions {
+	out := LocationOptions{
+		Timeouts: Timeouts{
+			Read:         Duration(o.Timeouts.Read),
+			Dial:         Duration(o.Timeouts.Dial),
+			TlsHandshake: Duration(o.Timeouts.TlsHandshake),
+		},
+		KeepAlive: KeepAlive{
+			Period:                Duration(o.KeepAlive.Period),
+			MaxIdleConnsPerHost:   o.KeepAlive.MaxIdleConnsPerHost,
+			MaxConnsPerHost:       o.KeepAlive.MaxConnsPerHost,
+			IdleConnTimeout:       Duration(o.KeepAlive.IdleConnTimeout),
+			MaxConnLifetime:       Duration(o.KeepAlive.MaxConnLifetime),
+			MaxConnLifetimeJitter: Duration(o.KeepAlive.MaxConnLifetimeJitter),
+			PrewarmConnsPerHost:   o.KeepAlive.PrewarmConnsPerHost,
+		},
+		Limits: Limits{
+			MaxMemBodyBytes: o.Limits.MaxMemBodyBytes,
+			MaxBodyBytes:    o.Limits.MaxBodyBytes,
+		},
+		Protocol:           o.Protocol.String(),
+		Hostname:           o.Hostname,
+		TrustForwardHeader: o.TrustForwardHeader,
+	}
+	if o.TLS != nil {
+		out.TLS = &TLS{
+			CAFile:             o.TLS.CAFile,
+			CertFile:           o.TLS.CertFile,
+			KeyFile:            o.TLS.KeyFile,
+			ServerName:         o.TLS.ServerName,
+			MinVersion:         o.TLS.MinVersion,
+			CipherSuites:       o.TLS.CipherSuites,
+			InsecureSkipVerify: o.TLS.InsecureSkipVerify,
+			ReloadInterval:     Duration(o.TLS.ReloadInterval),
+		}
+	}
+	return out
+}
@@ -0,0 +1,154 @@
+package config
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/mailgun/vulcan/limit"
+	"github.com/mailgun/vulcan/limit/connlimit"
+	"github.com/mailgun/vulcan/limit/tokenbucket"
+	"github.com/mailgun/vulcan/location/httploc"
+	"github.com/mailgun/vulcan/middleware"
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type ConfigSuite struct{}
+
+var _ = Suite(&ConfigSuite{})
+
+func (s *ConfigSuite) TestParse(c *C) {
+	cfg, err := ParseConfig([]byte(`{
+	  "Hosts": [{"Name": "Example.com", "Routes": [{"Expression": "TrieRoute(\"/api\")", "Location": "api"}]}],
+	  "Locations": [
+	    {
+	      "Id": "api",
+	      "Endpoints": [{"Url": "http://localhost:5000", "Weight": 2}, {"Url": "http://localhost:5001"}],
+	      "Options": {
+	        "Timeouts": {"Read": "5s", "Dial": "300ms"},
+	        "KeepAlive": {"MaxConnsPerHost": 10},
+	        "Failover": "IsNetworkError && AttemptsLe(2)",
+	        "Protocol": "h2c"
+	      },
+	      "Middlewares": [
+	        {"Id": "rl", "Type": "ratelimit", "Priority": 1, "Spec": {"Variable": "client.ip", "Units": 10, "Period": "1s", "Burst": 20}},
+	        {"Id": "cl", "Type": "connlimit", "Spec": {"Variable": "client.ip", "Connections": 5, "Exempt": "ClientIpIn(\"10.0.0.0/8\")"}}
+	      ]
+	    }
+	  ]
+	}`))
+	c.Assert(err, IsNil)
+	c.Assert(len(cfg.Hosts), Equals, 1)
+	c.Assert(cfg.Hosts[0].Routes[0].Location, Equals, "api")
+
+	l := cfg.Locations[0]
+	c.Assert(l.Endpoints, DeepEquals, []Endpoint{{Url: "http://localhost:5000", Weight: 2}, {Url: "http://localhost:5001"}})
+
+	o, err := l.Options.ToOptions()
+	c.Assert(err, IsNil)
+	c.Assert(o.Timeouts, Equals, httploc.Timeouts{Read: 5 * time.Second, Dial: 300 * time.Millisecond})
+	c.Assert(o.KeepAlive.MaxConnsPerHost, Equals, 10)
+	c.Assert(o.ShouldFailover, NotNil)
+	c.Assert(o.Protocol, Equals, httploc.H2C)
+
+	// Failover predicate is the only option that can't be converted back
+	back := l.Options
+	back.Failover = ""
+	c.Assert(FromOptions(o), DeepEquals, back)
+
+	rl, err := l.Middlewares[0].Build()
+	c.Assert(err, IsNil)
+	tl, ok := rl.(*tokenbucket.TokenLimiter)
+	c.Assert(ok, Equals, true)
+	c.Assert(tl.GetRate(), Equals, tokenbucket.Rate{Units: 10, Period: time.Second})
+	c.Assert(tl.GetBurst(), Equals, int64(20))
+
+	cl, err := l.Middlewares[1].Build()
+	c.Assert(err, IsNil)
+	exempt, ok := cl.(*limit.ExemptLimiter)
+	c.Assert(ok, Equals, true)
+	c.Assert(exempt.GetLimiter().(*connlimit.ConnectionLimiter).GetMaxConnections(), Equals, int64(5))
+}
+
+func (s *ConfigSuite) TestDuration(c *C) {
+	var d Duration
+	c.Assert(json.Unmarshal([]byte(`"1m30s"`), &d), IsNil)
+	c.Assert(time.Duration(d), Equals, 90*time.Second)
+
+	out, err := json.Marshal(d)
+	c.Assert(err, IsNil)
+	c.Assert(string(out), Equals, `"1m30s"`)
+
+	c.Assert(json.Unmarshal([]byte(`90`), &d), NotNil)
+	c.Assert(json.Unmarshal([]byte(`"90 seconds"`), &d), NotNil)
+}
+
+func (s *ConfigSuite) TestInvalid(c *C) {
+	invalid := []string{
+		`{`,
+		// Typo in the field name
+		`{"Location": []}`,
+		`{"Locations": [{"Id": ""}]}`,
+		`{"Locations": [{"Id": "a"}, {"Id": "a"}]}`,
+		`{"Locations": [{"Id": "a", "Endpoints": [{"Url": "localhost"}]}]}`,
+		`{"Locations": [{"Id": "a", "Endpoints": [{"Url": "http://localhost:5000"}, {"Url": "http://localhost:5000"}]}]}`,
+		`{"Locations": [{"Id": "a", "Endpoints": [{"Url": "http://localhost:5000", "Weight": -1}]}]}`,
+		`{"Locations": [{"Id": "a", "Options": {"Timeouts": {"Read": 5}}}]}`,
+		`{"Locations": [{"Id": "a", "Options": {"Failover": "IsNetworkError &&"}}]}`,
+		`{"Locations": [{"Id": "a", "Options": {"Protocol": "SPDY"}}]}`,
+		`{"Locations": [{"Id": "a", "Middlewares": [{"Id": "m", "Type": "unknown"}]}]}`,
+		`{"Locations": [{"Id": "a", "Middlewares": [{"Type": "ratelimit"}]}]}`,
+		`{"Locations": [{"Id": "a", "Middlewares": [{"Id": "m", "Type": "ratelimit"}, {"Id": "m", "Type": "ratelimit"}]}]}`,
+		`{"Hosts": [{"Name": ""}]}`,
+		`{"Hosts": [{"Name": "a.com"}, {"Name": "A.com"}]}`,
+		`{"Hosts": [{"Name": "a.com", "Routes": [{"Expression": "", "Location": "a"}]}], "Locations": [{"Id": "a"}]}`,
+		`{"Hosts": [{"Name": "a.com", "Routes": [{"Expression": "TrieRoute(\"/\")", "Location": "b"}]}], "Locations": [{"Id": "a"}]}`,
+		`{"Hosts": [{"Name": "a.com", "Routes": [
+		  {"Expression": "TrieRoute(\"/\")", "Location": "a"}, {"Expression": "TrieRoute(\"/\")", "Location": "a"}]}],
+		  "Locations": [{"Id": "a"}]}`,
+	}
+	for _, in := range invalid {
+		_, err := ParseConfig([]byte(in))
+		c.Assert(err, NotNil, Commentf("%s", in))
+	}
+}
+
+func (s *ConfigSuite) TestInvalidMiddlewareSpec(c *C) {
+	invalid := []string{
+		``,
+		`{"Variable": "client.ip", "Units": 10, "Period": "1s", "Unknown": 1}`,
+		`{"Variable": "client.unknown", "Units": 10, "Period": "1s"}`,
+		`{"Variable": "client.ip", "Units": 0, "Period": "1s"}`,
+		`{"Variable": "client.ip", "Units": 10, "Period": "1s", "Exempt": "ClientIpIn("}`,
+	}
+	for _, spec := range invalid {
+		m := &Middleware{Id: "rl", Type: "ratelimit", Spec: json.RawMessage(spec)}
+		_, err := m.Build()
+		c.Assert(err, NotNil, Commentf("%s", spec))
+	}
+	m := &Middleware{Id: "cl", Type: "connlimit", Spec: json.RawMessage(`{"Variable": "client.ip", "Connections": 0}`)}
+	_, err := m.Build()
+	c.Assert(err, NotNil)
+}
+
+func (s *ConfigSuite) TestRegisterMiddleware(c *C) {
+	RegisterMiddleware("noop", func(spec json.RawMessage) (middleware.Middleware, error) {
+		return &middleware.MiddlewareWrapper{}, nil
+	})
+	cfg, err := ParseConfig([]byte(`{"Locations": [{"Id": "a", "Middlewares": [{"Id": "m", "Type": "noop"}]}]}`))
+	c.Assert(err, IsNil)
+	m, err := cfg.Locations[0].Middlewares[0].Build()
+	c.Assert(err, IsNil)
+	c.Assert(m, NotNil)
+}
+
+func (s *ConfigSuite) TestSameSpec(c *C) {
+	a := &Middleware{Type: "ratelimit", Spec: json.RawMessage(`{"Units": 1,  "Period": "1s"}`)}
+	b := &Middleware{Type: "ratelimit", Spec: json.RawMessage(`{"Units":1,"Period":"1s"}`)}
+	c.Assert(a.sameSpec(b), Equals, true)
+
+	b.Spec = json.RawMessage(`{"Units": 2, "Period": "1s"}`)
+	c.Assert(a.sameSpec(b), Equals, false)
+}
@@ -0,0 +1,463 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/mailgun/gotools-log"
+	timetools "github.com/mailgun/gotools-time"
+
+	"github.com/mailgun/vulcan/endpoint"
+	"github.com/mailgun/vulcan/loadbalance/roundrobin"
+	"github.com/mailgun/vulcan/location"
+	"github.com/mailgun/vulcan/location/httploc"
+	"github.com/mailgun/vulcan/request"
+	"github.com/mailgun/vulcan/route"
+	"github.com/mailgun/vulcan/route/exproute"
+	"github.com/mailgun/vulcan/route/hostroute"
+)
+
+type Options struct {
+	// How often the file is checked for changes
+	Interval time.Duration
+	// Time provider (useful for testing purposes)
+	TimeProvider timetools.TimeProvider
+}
+
+const DefaultInterval = 5 * time.Second
+
+// Loader builds the router from the config file and applies the changes to the file on the fly.
+// Changes are validated and prepared first and applied all at once, so the invalid config leaves
+// the running one as is. Locations, endpoints and middlewares that have not changed are kept,
+// so the requests in flight are not dropped and the limiters keep their state.
+type Loader struct {
+	path    string
+	options Options
+	// Serializes the reloads
+	reloadMutex *sync.Mutex
+	data        []byte
+	locations   map[string]*liveLocation
+	// Guards the router and the config swapped by the reloads
+	mutex  *sync.RWMutex
+	router *hostroute.HostRouter
+	config *Config
+	// Incremented by every applied config
+	version int64
+	stop    chan bool
+	done    chan bool
+}
+
+// Location built from the config entry
+type liveLocation struct {
+	config   Location
+	location *httploc.HttpLocation
+	balancer *roundrobin.RoundRobin
+}
+
+func NewLoader(path string) (*Loader, error) {
+	return NewLoaderWithOptions(path, Options{})
+}
+
+// Creates the loader and loads the file, the file should exist and be valid
+func NewLoaderWithOptions(path string, o Options) (*Loader, error) {
+	if path == "" {
+		return nil, fmt.Errorf("Provide config path")
+	}
+	o, err := parseOptions(o)
+	if err != nil {
+		return nil, err
+	}
+	l := &Loader{
+		path:        path,
+		options:     o,
+		reloadMutex: &sync.Mutex{},
+		locations:   make(map[string]*liveLocation),
+		mutex:       &sync.RWMutex{},
+		router:      hostroute.NewHostRouter(),
+		config:      &Config{},
+	}
+	if err := l.Reload(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *Loader) String() string {
+	return fmt.Sprintf("Loader(path=%s)", l.path)
+}
+
+// Routes the request by the current config
+func (l *Loader) Route(req request.Request) (location.Location, error) {
+	l.mutex.RLock()
+	router := l.router
+	l.mutex.RUnlock()
+	return router.Route(req)
+}
+
+// Returns the router built from the config applied last, every reload replaces it
+func (l *Loader) GetRouter() route.Router {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	return l.router
+}
+
+// Returns the config applied last
+func (l *Loader) GetConfig() *Config {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	return l.config
+}
+
+// Returns the number of the configs applied so far, it changes once the file changes
+func (l *Loader) GetVersion() int64 {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	return l.version
+}
+
+// Returns the location by the id from the config, nil if there's no such location
+func (l *Loader) GetLocation(id string) *httploc.HttpLocation {
+	l.reloadMutex.Lock()
+	defer l.reloadMutex.Unlock()
+	if live, ok := l.locations[id]; ok {
+		return live.location
+	}
+	return nil
+}
+
+// Returns the options of the location from the config applied last, false if there's no such location
+func (l *Loader) GetLocationOptions(id string) (LocationOptions, bool) {
+	for _, c := range l.GetConfig().Locations {
+		if c.Id == id {
+			return c.Options, true
+		}
+	}
+	return LocationOptions{}, false
+}
+
+// Checks the file for the changes on the interval until stopped
+func (l *Loader) Start() {
+	l.reloadMutex.Lock()
+	defer l.reloadMutex.Unlock()
+	if l.stop != nil {
+		return
+	}
+	l.stop, l.done = make(chan bool), make(chan bool)
+	go l.run(l.stop, l.done)
+}
+
+// Stops watching the file, the config applied last stays in effect
+func (l *Loader) Stop() {
+	l.reloadMutex.Lock()
+	stop, done := l.stop, l.done
+	l.stop, l.done = nil, nil
+	l.reloadMutex.Unlock()
+	if stop != nil {
+		close(stop)
+		<-done
+	}
+}
+
+func (l *Loader) run(stop, done chan bool) {
+	defer close(done)
+	for {
+		select {
+		case <-stop:
+			return
+		case <-l.options.TimeProvider.After(l.options.Interval):
+		}
+		if err := l.Reload(); err != nil {
+			log.Errorf("%s failed to reload: %s", l, err)
+		}
+	}
+}
+
+// Reads the file and applies the changes, does nothing if the file has not changed.
+// In case of error the running config is left intact.
+func (l *Loader) Reload() error {
+	data, err := os.ReadFile(l.path)
+	if err != nil {
+		return err
+	}
+	l.reloadMutex.Lock()
+	defer l.reloadMutex.Unlock()
+	if l.data != nil && bytes.Equal(l.data, data) {
+		return nil
+	}
+	c, err := ParseConfig(data)
+	if err != nil {
+		return err
+	}
+	p, err := l.plan(c)
+	if err != nil {
+		return err
+	}
+	l.apply(p)
+	l.data = data
+	log.Infof("%s applied config with %d hosts and %d locations", l, len(c.Hosts), len(c.Locations))
+	return nil
+}
+
+// Changes prepared by the reload, applying them can't fail
+type plan struct {
+	config    *Config
+	router    *hostroute.HostRouter
+	locations map[string]*liveLocation
+	// Updates of the locations that are kept
+	updates []func()
+	removed []*liveLocation
+}
+
+func (l *Loader) plan(c *Config) (*plan, error) {
+	p := &plan{
+		config:    c,
+		router:    hostroute.NewHostRouter(),
+		locations: make(map[string]*liveLocation, len(c.Locations)),
+	}
+	for i := range c.Locations {
+		lc := c.Locations[i]
+		live, ok := l.locations[lc.Id]
+		if !ok {
+			built, err := l.buildLocation(lc)
+			if err != nil {
+				return nil, fmt.Errorf("Location '%s': %s", lc.Id, err)
+			}
+			p.locations[lc.Id] = built
+			continue
+		}
+		updates, err := l.planLocation(live, lc)
+		if err != nil {
+			return nil, fmt.Errorf("Location '%s': %s", lc.Id, err)
+		}
+		p.updates = append(p.updates, updates...)
+		p.locations[lc.Id] = &liveLocation{config: lc, location: live.location, balancer: live.balancer}
+	}
+	for id, live := range l.locations {
+		if _, ok := p.locations[id]; !ok {
+			p.removed = append(p.removed, live)
+		}
+	}
+	for _, h := range c.Hosts {
+		router := exproute.NewExpRouter()
+		for _, r := range h.Routes {
+			if err := router.AddLocation(r.Expression, p.locations[r.Location].location); err != nil {
+				return nil, fmt.Errorf("Host '%s': route '%s': %s", h.Name, r.Expression, err)
+			}
+		}
+		if err := p.router.SetRouter(strings.ToLower(h.Name), router); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+func (l *Loader) apply(p *plan) {
+	for _, update := range p.updates {
+		update()
+	}
+	l.mutex.Lock()
+	l.router = p.router
+	l.config = p.config
+	l.version++
+	l.mutex.Unlock()
+	l.locations = p.locations
+
+	// Requests in flight to the removed locations are served till the end, idle connections are not needed anymore
+	for _, live := range p.removed {
+		_, tr := live.location.GetOptionsAndTransport()
+		tr.CloseIdleConnections()
+	}
+}
+
+func (l *Loader) buildLocation(c Location) (*liveLocation, error) {
+	o, err := c.Options.ToOptions()
+	if err != nil {
+		return nil, err
+	}
+	o.TimeProvider = l.options.TimeProvider
+	rr, err := roundrobin.NewRoundRobinWithOptions(roundrobin.Options{TimeProvider: l.options.TimeProvider})
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range c.Endpoints {
+		parsed, err := endpoint.ParseUrl(e.Url)
+		if err != nil {
+			return nil, err
+		}
+		if err := rr.AddEndpointWithOptions(parsed, roundrobin.EndpointOptions{Weight: e.Weight}); err != nil {
+			return nil, err
+		}
+	}
+	loc, err := httploc.NewLocationWithOptions(c.Id, rr, o)
+	if err != nil {
+		return nil, err
+	}
+	for i := range c.Middlewares {
+		m := &c.Middlewares[i]
+		built, err := m.Build()
+		if err != nil {
+			return nil, err
+		}
+		if err := loc.GetMiddlewareChain().Add(m.Id, m.Priority, built); err != nil {
+			return nil, err
+		}
+	}
+	return &liveLocation{config: c, location: loc, balancer: rr}, nil
+}
+
+// Prepares the updates of the running location. Endpoints and middlewares not coming from the config,
+// e.g. the ones added by the discovery, are left alone.
+func (l *Loader) planLocation(live *liveLocation, c Location) ([]func(), error) {
+	var updates []func()
+
+	if !optionsEqual(live.config.Options, c.Options) {
+		o, err := c.Options.ToOptions()
+		if err != nil {
+			return nil, err
+		}
+		o.TimeProvider = l.options.TimeProvider
+		// Options like TLS files are validated by building the location, so SetOptions won't fail later
+		if _, err := httploc.NewLocationWithOptions(c.Id, live.balancer, o); err != nil {
+			return nil, err
+		}
+		updates = append(updates, func() {
+			if err := live.location.SetOptions(o); err != nil {
+				log.Errorf("%s failed to update options of %s: %s", l, c.Id, err)
+			}
+		})
+	}
+
+	endpointUpdates, err := l.planEndpoints(live, c)
+	if err != nil {
+		return nil, err
+	}
+	updates = append(updates, endpointUpdates...)
+
+	middlewareUpdates, err := l.planMiddlewares(live, c)
+	if err != nil {
+		return nil, err
+	}
+	return append(updates, middlewareUpdates...), nil
+}
+
+func (l *Loader) planEndpoints(live *liveLocation, c Location) ([]func(), error) {
+	var updates []func()
+	current := make(map[string]Endpoint, len(live.config.Endpoints))
+	for _, e := range live.config.Endpoints {
+		current[endpoint.MustParseUrl(e.Url).GetId()] = e
+	}
+	wanted := make(map[string]bool, len(c.Endpoints))
+	for _, e := range c.Endpoints {
+		parsed, err := endpoint.ParseUrl(e.Url)
+		if err != nil {
+			return nil, err
+		}
+		wanted[parsed.GetId()] = true
+		existing, ok := current[parsed.GetId()]
+		if !ok {
+			if live.balancer.FindEndpointById(parsed.GetId()) != nil {
+				return nil, fmt.Errorf("Endpoint '%s' has been added outside of the config", e.Url)
+			}
+			weight := e.Weight
+			updates = append(updates, func() {
+				if err := live.balancer.AddEndpointWithOptions(parsed, roundrobin.EndpointOptions{Weight: weight}); err != nil {
+					log.Errorf("%s failed to add %s to %s: %s", l, parsed, c.Id, err)
+				}
+			})
+			continue
+		}
+		if weightOrDefault(existing.Weight) != weightOrDefault(e.Weight) {
+			weight := weightOrDefault(e.Weight)
+			updates = append(updates, func() {
+				if err := live.balancer.SetEndpointWeight(parsed, weight); err != nil {
+					log.Errorf("%s failed to set %s weight in %s: %s", l, parsed, c.Id, err)
+				}
+			})
+		}
+	}
+	for id, e := range current {
+		if wanted[id] {
+			continue
+		}
+		parsed := endpoint.MustParseUrl(e.Url)
+		updates = append(updates, func() {
+			if err := live.balancer.RemoveEndpoint(parsed); err != nil {
+				log.Errorf("%s failed to remove %s from %s: %s", l, parsed, c.Id, err)
+			}
+		})
+	}
+	return updates, nil
+}
+
+func (l *Loader) planMiddlewares(live *liveLocation, c Location) ([]func(), error) {
+	var updates []func()
+	chain := live.location.GetMiddlewareChain()
+	current := make(map[string]*Middleware, len(live.config.Middlewares))
+	for i := range live.config.Middlewares {
+		current[live.config.Middlewares[i].Id] = &live.config.Middlewares[i]
+	}
+	wanted := make(map[string]bool, len(c.Middlewares))
+	for i := range c.Middlewares {
+		m := &c.Middlewares[i]
+		wanted[m.Id] = true
+		existing, ok := current[m.Id]
+		if !ok && chain.Get(m.Id) != nil {
+			return nil, fmt.Errorf("Middleware '%s' has been added outside of the config", m.Id)
+		}
+		if ok && existing.sameSpec(m) {
+			if existing.Priority != m.Priority {
+				instance, id, priority := chain.Get(m.Id), m.Id, m.Priority
+				updates = append(updates, func() { chain.Upsert(id, priority, instance) })
+			}
+			continue
+		}
+		built, err := m.Build()
+		if err != nil {
+			return nil, err
+		}
+		id, priority := m.Id, m.Priority
+		updates = append(updates, func() { chain.Upsert(id, priority, built) })
+	}
+	for id := range current {
+		if wanted[id] {
+			continue
+		}
+		removed := id
+		updates = append(updates, func() {
+			if err := chain.Remove(removed); err != nil {
+				log.Errorf("%s failed to remove middleware %s from %s: %s", l, removed, c.Id, err)
+			}
+		})
+	}
+	return updates, nil
+}
+
+func optionsEqual(a, b LocationOptions) bool {
+	return reflect.DeepEqual(a, b)
+}
+
+// Round robin treats weight 0 as the default weight
+func weightOrDefault(weight int) int {
+	if weight == 0 {
+		return 1
+	}
+	return weight
+}
+
+func parseOptions(o Options) (Options, error) {
+	if o.Interval < 0 {
+		return o, fmt.Errorf("Interval should be >= 0")
+	}
+	if o.Interval == 0 {
+		o.Interval = DefaultInterval
+	}
+	if o.TimeProvider == nil {
+		o.TimeProvider = &timetools.RealTime{}
+	}
+	return o, nil
+}
@@ -0,0 +1,284 @@
+package config
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/mailgun/vulcan"
+	"github.com/mailgun/vulcan/endpoint"
+	. "github.com/mailgun/vulcan/testutils"
+	. "gopkg.in/check.v1"
+)
+
+type LoaderSuite struct {
+	path    string
+	servers []*httptest.Server
+}
+
+var _ = Suite(&LoaderSuite{})
+
+func (s *LoaderSuite) SetUpTest(c *C) {
+	s.path = filepath.Join(c.MkDir(), "vulcan.json")
+	s.servers = nil
+}
+
+func (s *LoaderSuite) TearDownTest(c *C) {
+	for _, server := range s.servers {
+		server.Close()
+	}
+}
+
+// Starts the server replying with the body
+func (s *LoaderSuite) newServer(body string) *httptest.Server {
+	server := NewTestServer(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(body))
+	})
+	s.servers = append(s.servers, server)
+	return server
+}
+
+func (s *LoaderSuite) writeConfig(c *C, format string, args ...interface{}) {
+	c.Assert(os.WriteFile(s.path, []byte(fmt.Sprintf(format, args...)), 0600), IsNil)
+}
+
+func (s *LoaderSuite) newProxy(c *C, o Options) (*Loader, *httptest.Server) {
+	loader, err := NewLoaderWithOptions(s.path, o)
+	c.Assert(err, IsNil)
+	proxy, err := vulcan.NewProxy(loader)
+	c.Assert(err, IsNil)
+	return loader, httptest.NewServer(proxy)
+}
+
+// Proxy is reached by the ip address, so it's the host name of the routes
+const singleLocation = `{
+  "Hosts": [{"Name": "127.0.0.1", "Routes": [{"Expression": "TrieRoute(\"/a\")", "Location": "a"}]}],
+  "Locations": [{"Id": "a", "Endpoints": [{"Url": "%s"}], "Middlewares": [%s]}]
+}`
+
+const rateLimit = `{"Id": "rl", "Type": "ratelimit", "Spec": {"Variable": "client.ip", "Units": 1, "Period": "1m"}}`
+
+func (s *LoaderSuite) TestProxy(c *C) {
+	a, b := s.newServer("a"), s.newServer("b")
+	s.writeConfig(c, `{
+	  "Hosts": [{"Name": "127.0.0.1", "Routes": [
+	    {"Expression": "TrieRoute(\"/a\")", "Location": "a"},
+	    {"Expression": "TrieRoute(\"/b\")", "Location": "b"}
+	  ]}],
+	  "Locations": [{"Id": "a", "Endpoints": [{"Url": "%s"}]}, {"Id": "b", "Endpoints": [{"Url": "%s"}]}]
+	}`, a.URL, b.URL)
+
+	_, proxy := s.newProxy(c, Options{})
+	defer proxy.Close()
+
+	_, body := Get(c, proxy.URL+"/a", nil, "")
+	c.Assert(string(body), Equals, "a")
+	_, body = Get(c, proxy.URL+"/b", nil, "")
+	c.Assert(string(body), Equals, "b")
+
+	response, _ := Get(c, proxy.URL+"/c", nil, "")
+	c.Assert(response.StatusCode, Equals, http.StatusBadGateway)
+}
+
+func (s *LoaderSuite) TestReloadEndpoints(c *C) {
+	a, b := s.newServer("a"), s.newServer("b")
+	s.writeConfig(c, singleLocation, a.URL, "")
+
+	loader, proxy := s.newProxy(c, Options{})
+	defer proxy.Close()
+	location := loader.GetLocation("a")
+	c.Assert(loader.GetVersion(), Equals, int64(1))
+
+	_, body := Get(c, proxy.URL+"/a", nil, "")
+	c.Assert(string(body), Equals, "a")
+
+	// File has not changed
+	c.Assert(loader.Reload(), IsNil)
+	c.Assert(loader.GetVersion(), Equals, int64(1))
+
+	s.writeConfig(c, singleLocation, b.URL, "")
+	c.Assert(loader.Reload(), IsNil)
+	c.Assert(loader.GetVersion(), Equals, int64(2))
+
+	_, body = Get(c, proxy.URL+"/a", nil, "")
+	c.Assert(string(body), Equals, "b")
+	// Location is updated in place
+	c.Assert(loader.GetLocation("a") == location, Equals, true)
+	c.Assert(len(loader.locations["a"].balancer.GetEndpoints()), Equals, 1)
+}
+
+func (s *LoaderSuite) TestReloadKeepsLimiterState(c *C) {
+	a := s.newServer("a")
+	s.writeConfig(c, singleLocation, a.URL, rateLimit)
+
+	loader, proxy := s.newProxy(c, Options{})
+	defer proxy.Close()
+	limiter := loader.GetLocation("a").GetMiddlewareChain().Get("rl")
+
+	response, _ := Get(c, proxy.URL+"/a", nil, "")
+	c.Assert(response.StatusCode, Equals, http.StatusOK)
+	response, _ = Get(c, proxy.URL+"/a", nil, "")
+	c.Assert(response.StatusCode, Equals, 429)
+
+	// Spec is the same, formatting aside, so the limiter is kept along with its buckets
+	s.writeConfig(c, singleLocation, a.URL, strings.Replace(rateLimit, " ", "", -1))
+	c.Assert(loader.Reload(), IsNil)
+	c.Assert(loader.GetLocation("a").GetMiddlewareChain().Get("rl") == limiter, Equals, true)
+	response, _ = Get(c, proxy.URL+"/a", nil, "")
+	c.Assert(response.StatusCode, Equals, 429)
+
+	// Spec has changed, so the limiter starts over
+	s.writeConfig(c, singleLocation, a.URL, strings.Replace(rateLimit, `"Period": "1m"`, `"Period": "1m", "Burst": 1`, 1))
+	c.Assert(loader.Reload(), IsNil)
+	c.Assert(loader.GetLocation("a").GetMiddlewareChain().Get("rl") == limiter, Equals, false)
+	response, _ = Get(c, proxy.URL+"/a", nil, "")
+	c.Assert(response.StatusCode, Equals, http.StatusOK)
+
+	// Middleware is gone
+	s.writeConfig(c, singleLocation, a.URL, "")
+	c.Assert(loader.Reload(), IsNil)
+	c.Assert(loader.GetLocation("a").GetMiddlewareChain().Get("rl"), IsNil)
+}
+
+func (s *LoaderSuite) TestReloadOptions(c *C) {
+	a := s.newServer("a")
+	s.writeConfig(c, singleLocation, a.URL, "")
+
+	loader, proxy := s.newProxy(c, Options{})
+	defer proxy.Close()
+
+	s.writeConfig(c, `{
+	  "Hosts": [{"Name": "127.0.0.1", "Routes": [{"Expression": "TrieRoute(\"/a\")", "Location": "a"}]}],
+	  "Locations": [{"Id": "a", "Endpoints": [{"Url": "%s"}], "Options": {"Limits": {"MaxBodyBytes": 4}}}]
+	}`, a.URL)
+	c.Assert(loader.Reload(), IsNil)
+	c.Assert(loader.GetLocation("a").GetOptions().Limits.MaxBodyBytes, Equals, int64(4))
+
+	response, _ := Get(c, proxy.URL+"/a", nil, "hello, world")
+	c.Assert(response.StatusCode, Equals, http.StatusRequestEntityTooLarge)
+}
+
+func (s *LoaderSuite) TestInvalidConfigKeepsRunningOne(c *C) {
+	a := s.newServer("a")
+	s.writeConfig(c, singleLocation, a.URL, "")
+
+	loader, proxy := s.newProxy(c, Options{})
+	defer proxy.Close()
+	config := loader.GetConfig()
+
+	for _, invalid := range []string{
+		`{"Hosts": [`,
+		`{"Hosts": [{"Name": "127.0.0.1", "Routes": [{"Expression": "TrieRoute(\"/a\")", "Location": "b"}]}]}`,
+		// Passes the validation, but fails to compile
+		`{"Hosts": [{"Name": "127.0.0.1", "Routes": [{"Expression": "Unknown()", "Location": "a"}]}], "Locations": [{"Id": "a"}]}`,
+	} {
+		s.writeConfig(c, "%s", invalid)
+		c.Assert(loader.Reload(), NotNil, Commentf("%s", invalid))
+		c.Assert(loader.GetConfig() == config, Equals, true)
+
+		_, body := Get(c, proxy.URL+"/a", nil, "")
+		c.Assert(string(body), Equals, "a")
+	}
+}
+
+func (s *LoaderSuite) TestRemoveLocation(c *C) {
+	a := s.newServer("a")
+	s.writeConfig(c, singleLocation, a.URL, "")
+
+	loader, proxy := s.newProxy(c, Options{})
+	defer proxy.Close()
+
+	s.writeConfig(c, `{}`)
+	c.Assert(loader.Reload(), IsNil)
+	c.Assert(loader.GetLocation("a"), IsNil)
+
+	response, _ := Get(c, proxy.URL+"/a", nil, "")
+	c.Assert(response.StatusCode, Equals, http.StatusBadGateway)
+}
+
+func (s *LoaderSuite) TestInFlightRequests(c *C) {
+	entered, unblock := make(chan bool), make(chan bool)
+	slow := NewTestServer(func(w http.ResponseWriter, r *http.Request) {
+		entered <- true
+		<-unblock
+		w.Write([]byte("slow"))
+	})
+	defer slow.Close()
+	fast := s.newServer("fast")
+	s.writeConfig(c, singleLocation, slow.URL, "")
+
+	loader, proxy := s.newProxy(c, Options{})
+	defer proxy.Close()
+
+	done := make(chan string)
+	go func() {
+		_, body := Get(c, proxy.URL+"/a", nil, "")
+		done <- string(body)
+	}()
+	<-entered
+
+	s.writeConfig(c, singleLocation, fast.URL, rateLimit)
+	c.Assert(loader.Reload(), IsNil)
+	close(unblock)
+	c.Assert(<-done, Equals, "slow")
+}
+
+func (s *LoaderSuite) TestEndpointsAddedOutsideAreKept(c *C) {
+	a, b := s.newServer("a"), s.newServer("b")
+	s.writeConfig(c, singleLocation, a.URL, "")
+
+	loader, proxy := s.newProxy(c, Options{})
+	defer proxy.Close()
+
+	rr := loader.locations["a"].balancer
+	c.Assert(rr.AddEndpoint(endpoint.MustParseUrl(b.URL)), IsNil)
+
+	s.writeConfig(c, `{
+	  "Hosts": [{"Name": "127.0.0.1", "Routes": [{"Expression": "TrieRoute(\"/a\")", "Location": "a"}]}],
+	  "Locations": [{"Id": "a"}]
+	}`)
+	c.Assert(loader.Reload(), IsNil)
+	c.Assert(len(rr.GetEndpoints()), Equals, 1)
+	c.Assert(rr.GetEndpoints()[0].GetId(), Equals, endpoint.MustParseUrl(b.URL).GetId())
+
+	// Config can't take over the endpoint
+	s.writeConfig(c, singleLocation, b.URL, "")
+	c.Assert(loader.Reload(), NotNil)
+}
+
+func (s *LoaderSuite) TestStartStop(c *C) {
+	a := s.newServer("a")
+	s.writeConfig(c, `{}`)
+
+	loader, proxy := s.newProxy(c, Options{Interval: time.Millisecond})
+	defer proxy.Close()
+	loader.Start()
+	loader.Start()
+	defer loader.Stop()
+
+	s.writeConfig(c, singleLocation, a.URL, "")
+	for i := 0; i < 100 && loader.GetLocation("a") == nil; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Assert(loader.GetLocation("a"), NotNil)
+	_, body := Get(c, proxy.URL+"/a", nil, "")
+	c.Assert(string(body), Equals, "a")
+
+	loader.Stop()
+	loader.Stop()
+}
+
+func (s *LoaderSuite) TestInvalidOptions(c *C) {
+	_, err := NewLoader("")
+	c.Assert(err, NotNil)
+	_, err = NewLoader(filepath.Join(c.MkDir(), "missing.json"))
+	c.Assert(err, NotNil)
+
+	s.writeConfig(c, `{}`)
+	_, err = NewLoaderWithOptions(s.path, Options{Interval: -1})
+	c.Assert(err, NotNil)
+}
@@ -0,0 +1,142 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/mailgun/vulcan/limit"
+	"github.com/mailgun/vulcan/limit/connlimit"
+	"github.com/mailgun/vulcan/limit/tokenbucket"
+	"github.com/mailgun/vulcan/middleware"
+)
+
+// Creates the middleware from the spec of the config entry
+type MiddlewareFactory func(spec json.RawMessage) (middleware.Middleware, error)
+
+var factories = struct {
+	mutex  *sync.Mutex
+	byType map[string]MiddlewareFactory
+}{
+	mutex:  &sync.Mutex{},
+	byType: make(map[string]MiddlewareFactory),
+}
+
+func init() {
+	RegisterMiddleware("ratelimit", newRateLimiter)
+	RegisterMiddleware("connlimit", newConnLimiter)
+}
+
+// Makes the middleware type available to the config, replaces the factory registered with the same type
+func RegisterMiddleware(kind string, factory MiddlewareFactory) {
+	factories.mutex.Lock()
+	defer factories.mutex.Unlock()
+	factories.byType[kind] = factory
+}
+
+func getMiddlewareFactory(kind string) MiddlewareFactory {
+	factories.mutex.Lock()
+	defer factories.mutex.Unlock()
+	return factories.byType[kind]
+}
+
+func (m *Middleware) Build() (middleware.Middleware, error) {
+	factory := getMiddlewareFactory(m.Type)
+	if factory == nil {
+		return nil, fmt.Errorf("Middleware '%s': unknown type '%s'", m.Id, m.Type)
+	}
+	out, err := factory(m.Spec)
+	if err != nil {
+		return nil, fmt.Errorf("Middleware '%s': %s", m.Id, err)
+	}
+	return out, nil
+}
+
+// Middlewares with the same type and spec are interchangeable, so the running one keeps its state
+func (m *Middleware) sameSpec(o *Middleware) bool {
+	return m.Type == o.Type && bytes.Equal(compactJSON(m.Spec), compactJSON(o.Spec))
+}
+
+func compactJSON(data json.RawMessage) []byte {
+	out := &bytes.Buffer{}
+	if err := json.Compact(out, data); err != nil {
+		return data
+	}
+	return out.Bytes()
+}
+
+func decodeSpec(spec json.RawMessage, out interface{}) error {
+	if len(spec) == 0 {
+		return fmt.Errorf("Provide middleware spec")
+	}
+	decoder := json.NewDecoder(bytes.NewReader(spec))
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(out)
+}
+
+// Spec of the ratelimit middleware, see tokenbucket.TokenLimiter
+type RateLimitSpec struct {
+	// Token expression, e.g. client.ip
+	Variable string
+	// Amount expression, defaults to request.count
+	Amount string
+	Units  int64
+	Period Duration
+	Burst  int64
+	// Requests matching the predicate are not limited, e.g. ClientIpIn("10.0.0.0/8")
+	Exempt string
+}
+
+// Spec of the connlimit middleware, see connlimit.ConnectionLimiter
+type ConnLimitSpec struct {
+	Variable    string
+	Amount      string
+	Connections int64
+	Exempt      string
+}
+
+func newRateLimiter(spec json.RawMessage) (middleware.Middleware, error) {
+	var s RateLimitSpec
+	if err := decodeSpec(spec, &s); err != nil {
+		return nil, err
+	}
+	mapper, err := limit.ParseMapper(s.Variable, s.Amount)
+	if err != nil {
+		return nil, err
+	}
+	l, err := tokenbucket.NewTokenLimiterWithOptions(
+		mapper, tokenbucket.Rate{Units: s.Units, Period: time.Duration(s.Period)}, tokenbucket.Options{Burst: s.Burst})
+	if err != nil {
+		return nil, err
+	}
+	return withExempt(s.Exempt, l)
+}
+
+func newConnLimiter(spec json.RawMessage) (middleware.Middleware, error) {
+	var s ConnLimitSpec
+	if err := decodeSpec(spec, &s); err != nil {
+		return nil, err
+	}
+	mapper, err := limit.ParseMapper(s.Variable, s.Amount)
+	if err != nil {
+		return nil, err
+	}
+	l, err := connlimit.NewConnectionLimiter(mapper, s.Connections)
+	if err != nil {
+		return nil, err
+	}
+	return withExempt(s.Exempt, l)
+}
+
+func withExempt(expr string, l limit.Limiter) (middleware.Middleware, error) {
+	if expr == "" {
+		return l, nil
+	}
+	predicate, err := limit.ParsePredicate(expr)
+	if err != nil {
+		return nil, err
+	}
+	return limit.NewExemptLimiter(predicate, l)
+}
@@ -0,0 +1,76 @@
+package dialer
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+
+	"github.com/mailgun/vulcan/netutils"
+)
+
+// Connects through the HTTP proxy with the CONNECT method
+type connectDialer struct {
+	addr    string
+	user    *url.Userinfo
+	forward Dialer
+}
+
+func (d *connectDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if err := checkNetwork(network); err != nil {
+		return nil, err
+	}
+	conn, err := d.forward.DialContext(ctx, "tcp", d.addr)
+	if err != nil {
+		return nil, err
+	}
+	reset := setDeadline(ctx, conn)
+	defer reset()
+	out, err := d.connect(conn, addr)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("HTTP proxy %s failed to connect to %s: %s", d.addr, addr, err)
+	}
+	return out, nil
+}
+
+func (d *connectDialer) connect(conn net.Conn, addr string) (net.Conn, error) {
+	req := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if d.user != nil {
+		password, _ := d.user.Password()
+		req.Header.Set("Proxy-Authorization", (&netutils.BasicAuth{Username: d.user.Username(), Password: password}).String())
+	}
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+	reader := bufio.NewReader(conn)
+	re, err := http.ReadResponse(reader, req)
+	if err != nil {
+		return nil, err
+	}
+	re.Body.Close()
+	if re.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Proxy replied with %s", re.Status)
+	}
+	// Proxy could have sent the first bytes of the tunnel along with the reply
+	if reader.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, reader: reader}, nil
+	}
+	return conn, nil
+}
+
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
@@ -0,0 +1,169 @@
+package dialer
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type DialerSuite struct {
+}
+
+var _ = Suite(&DialerSuite{})
+
+// Minimal SOCKS5 proxy accepting one connection, returns the address it has been asked to connect to
+func startSocksProxy(c *C, username, password string) (net.Listener, chan string) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	targets := make(chan string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		header := make([]byte, 2)
+		io.ReadFull(r, header)
+		io.ReadFull(r, make([]byte, header[1]))
+		if username != "" {
+			conn.Write([]byte{socksVersion, socksPasswordAuth})
+			io.ReadFull(r, header)
+			user := make([]byte, header[1])
+			io.ReadFull(r, user)
+			length, _ := r.ReadByte()
+			pass := make([]byte, length)
+			io.ReadFull(r, pass)
+			if string(user) != username || string(pass) != password {
+				conn.Write([]byte{socksPasswordVersion, 1})
+				return
+			}
+			conn.Write([]byte{socksPasswordVersion, 0})
+		} else {
+			conn.Write([]byte{socksVersion, socksNoAuth})
+		}
+		request := make([]byte, 4)
+		io.ReadFull(r, request)
+		var host string
+		switch request[3] {
+		case socksIPv4:
+			ip := make([]byte, net.IPv4len)
+			io.ReadFull(r, ip)
+			host = net.IP(ip).String()
+		case socksDomain:
+			length, _ := r.ReadByte()
+			name := make([]byte, length)
+			io.ReadFull(r, name)
+			host = string(name)
+		}
+		port := make([]byte, 2)
+		io.ReadFull(r, port)
+		targets <- net.JoinHostPort(host, itoa(binary.BigEndian.Uint16(port)))
+		conn.Write([]byte{socksVersion, 0, 0, socksIPv4, 127, 0, 0, 1, 0, 80})
+		conn.Write([]byte("tunnel"))
+	}()
+	return ln, targets
+}
+
+func itoa(v uint16) string {
+	return (&net.TCPAddr{Port: int(v)}).String()[1:]
+}
+
+func (s *DialerSuite) TestSocks(c *C) {
+	ln, targets := startSocksProxy(c, "", "")
+	defer ln.Close()
+
+	d, err := NewProxyDialer("socks5://"+ln.Addr().String(), &net.Dialer{})
+	c.Assert(err, IsNil)
+	conn, err := d.DialContext(context.Background(), "tcp", "example.com:8080")
+	c.Assert(err, IsNil)
+	defer conn.Close()
+	c.Assert(<-targets, Equals, "example.com:8080")
+	data, err := ioutil.ReadAll(conn)
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "tunnel")
+}
+
+func (s *DialerSuite) TestSocksAuth(c *C) {
+	ln, targets := startSocksProxy(c, "user", "secret")
+	defer ln.Close()
+
+	d, err := NewProxyDialer("socks5://user:secret@"+ln.Addr().String(), &net.Dialer{})
+	c.Assert(err, IsNil)
+	conn, err := d.DialContext(context.Background(), "tcp", "10.0.0.1:80")
+	c.Assert(err, IsNil)
+	conn.Close()
+	c.Assert(<-targets, Equals, "10.0.0.1:80")
+
+	ln, _ = startSocksProxy(c, "user", "secret")
+	defer ln.Close()
+	d, err = NewProxyDialer("socks5://user:wrong@"+ln.Addr().String(), &net.Dialer{})
+	c.Assert(err, IsNil)
+	_, err = d.DialContext(context.Background(), "tcp", "10.0.0.1:80")
+	c.Assert(err, NotNil)
+}
+
+func (s *DialerSuite) TestConnect(c *C) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hi, tunnel"))
+	}))
+	defer target.Close()
+
+	authorized := make(chan string, 1)
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.Assert(r.Method, Equals, "CONNECT")
+		authorized <- r.Header.Get("Proxy-Authorization")
+		upstream, err := net.Dial("tcp", r.Host)
+		c.Assert(err, IsNil)
+		conn, _, err := w.(http.Hijacker).Hijack()
+		c.Assert(err, IsNil)
+		conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+		go io.Copy(upstream, conn)
+		io.Copy(conn, upstream)
+		conn.Close()
+	}))
+	defer proxy.Close()
+
+	d, err := NewProxyDialer("http://user:secret@"+proxy.Listener.Addr().String(), &net.Dialer{})
+	c.Assert(err, IsNil)
+	client := &http.Client{Transport: &http.Transport{DialContext: d.DialContext}}
+	re, err := client.Get(target.URL)
+	c.Assert(err, IsNil)
+	body, _ := ioutil.ReadAll(re.Body)
+	re.Body.Close()
+	c.Assert(string(body), Equals, "hi, tunnel")
+	c.Assert(<-authorized, Equals, "Basic dXNlcjpzZWNyZXQ=")
+}
+
+func (s *DialerSuite) TestConnectRefused(c *C) {
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer proxy.Close()
+
+	d, err := NewProxyDialer("http://"+proxy.Listener.Addr().String(), &net.Dialer{})
+	c.Assert(err, IsNil)
+	_, err = d.DialContext(context.Background(), "tcp", "example.com:80")
+	c.Assert(err, NotNil)
+	_, err = d.DialContext(context.Background(), "unix", "/tmp/app.sock")
+	c.Assert(err, NotNil)
+}
+
+func (s *DialerSuite) TestInvalidProxy(c *C) {
+	for _, u := range []string{"", "ftp://localhost:21", "socks5://", "http---{}{\\bad"} {
+		_, err := NewProxyDialer(u, &net.Dialer{})
+		c.Assert(err, NotNil, Commentf("Url %s", u))
+	}
+	_, err := NewProxyDialer("socks5://localhost", nil)
+	c.Assert(err, NotNil)
+}
@@ -0,0 +1,72 @@
+package dialer
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+)
+
+// PipeListener connects the dialer and the listener in memory, so the servers can be tested without the network:
+// http.Server serves the listener, while the location dials it
+type PipeListener struct {
+	mutex  *sync.Mutex
+	conns  chan net.Conn
+	closed chan bool
+}
+
+func NewPipeListener() *PipeListener {
+	return &PipeListener{
+		mutex:  &sync.Mutex{},
+		conns:  make(chan net.Conn),
+		closed: make(chan bool),
+	}
+}
+
+// Connects to the listener no matter what the address is
+func (l *PipeListener) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	client, server := net.Pipe()
+	select {
+	case l.conns <- server:
+		return client, nil
+	case <-l.closed:
+		return nil, fmt.Errorf("Pipe listener is closed")
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (l *PipeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, fmt.Errorf("Pipe listener is closed")
+	}
+}
+
+func (l *PipeListener) Close() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	select {
+	case <-l.closed:
+	default:
+		close(l.closed)
+	}
+	return nil
+}
+
+func (l *PipeListener) Addr() net.Addr {
+	return pipeAddr{}
+}
+
+type pipeAddr struct {
+}
+
+func (pipeAddr) Network() string {
+	return "pipe"
+}
+
+func (pipeAddr) String() string {
+	return "pipe"
+}
@@ -0,0 +1,40 @@
+package dialer
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+
+	. "gopkg.in/check.v1"
+)
+
+type PipeSuite struct {
+}
+
+var _ = Suite(&PipeSuite{})
+
+func (s *PipeSuite) TestServeHttp(c *C) {
+	ln := NewPipeListener()
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hi, pipe"))
+	})}
+	go srv.Serve(ln)
+	defer srv.Close()
+
+	client := &http.Client{Transport: &http.Transport{DialContext: ln.DialContext}}
+	re, err := client.Get("http://any.host/")
+	c.Assert(err, IsNil)
+	body, _ := ioutil.ReadAll(re.Body)
+	re.Body.Close()
+	c.Assert(string(body), Equals, "hi, pipe")
+}
+
+func (s *PipeSuite) TestClosed(c *C) {
+	ln := NewPipeListener()
+	c.Assert(ln.Close(), IsNil)
+	c.Assert(ln.Close(), IsNil)
+	_, err := ln.Accept()
+	c.Assert(err, NotNil)
+	_, err = ln.DialContext(context.Background(), "tcp", "any:80")
+	c.Assert(err, NotNil)
+}
@@ -0,0 +1,158 @@
+package dialer
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+)
+
+// Connects through the SOCKS5 proxy, see https://tools.ietf.org/html/rfc1928
+type socksDialer struct {
+	addr    string
+	user    *url.Userinfo
+	forward Dialer
+}
+
+const (
+	socksVersion         = 5
+	socksNoAuth          = 0
+	socksPasswordAuth    = 2
+	socksNoAcceptable    = 0xff
+	socksConnect         = 1
+	socksIPv4            = 1
+	socksDomain          = 3
+	socksIPv6            = 4
+	socksPasswordVersion = 1
+)
+
+func (d *socksDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if err := checkNetwork(network); err != nil {
+		return nil, err
+	}
+	conn, err := d.forward.DialContext(ctx, "tcp", d.addr)
+	if err != nil {
+		return nil, err
+	}
+	reset := setDeadline(ctx, conn)
+	defer reset()
+	if err := d.handshake(conn, addr); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("SOCKS5 proxy %s failed to connect to %s: %s", d.addr, addr, err)
+	}
+	return conn, nil
+}
+
+func (d *socksDialer) handshake(conn net.Conn, addr string) error {
+	methods := []byte{socksNoAuth}
+	if d.user != nil {
+		methods = append(methods, socksPasswordAuth)
+	}
+	if _, err := conn.Write(append([]byte{socksVersion, byte(len(methods))}, methods...)); err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[0] != socksVersion {
+		return fmt.Errorf("Unexpected version %d", reply[0])
+	}
+	switch reply[1] {
+	case socksNoAuth:
+	case socksPasswordAuth:
+		if d.user == nil {
+			return fmt.Errorf("Proxy requires authentication")
+		}
+		if err := d.authenticate(conn); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("No acceptable authentication methods")
+	}
+
+	request, err := connectRequest(addr)
+	if err != nil {
+		return err
+	}
+	if _, err := conn.Write(request); err != nil {
+		return err
+	}
+	// Reply has the same layout as the request: version, status, reserved byte and the bound address
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return err
+	}
+	if header[1] != 0 {
+		return fmt.Errorf("Connect failed with status %d", header[1])
+	}
+	var size int
+	switch header[3] {
+	case socksIPv4:
+		size = net.IPv4len
+	case socksIPv6:
+		size = net.IPv6len
+	case socksDomain:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return err
+		}
+		size = int(length[0])
+	default:
+		return fmt.Errorf("Unexpected address type %d", header[3])
+	}
+	// Bound address and port are not used
+	_, err = io.ReadFull(conn, make([]byte, size+2))
+	return err
+}
+
+// Username and password authentication, see https://tools.ietf.org/html/rfc1929
+func (d *socksDialer) authenticate(conn net.Conn) error {
+	username := d.user.Username()
+	password, _ := d.user.Password()
+	if len(username) > 255 || len(password) > 255 {
+		return fmt.Errorf("Username and password should be at most 255 bytes")
+	}
+	request := []byte{socksPasswordVersion, byte(len(username))}
+	request = append(request, username...)
+	request = append(request, byte(len(password)))
+	request = append(request, password...)
+	if _, err := conn.Write(request); err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[1] != 0 {
+		return fmt.Errorf("Authentication failed")
+	}
+	return nil
+}
+
+func connectRequest(addr string) ([]byte, error) {
+	host, portString, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portString)
+	if err != nil || port < 0 || port > 0xffff {
+		return nil, fmt.Errorf("Invalid port in %s", addr)
+	}
+	request := []byte{socksVersion, socksConnect, 0}
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			request = append(append(request, socksIPv4), ip4...)
+		} else {
+			request = append(append(request, socksIPv6), ip.To16()...)
+		}
+	} else {
+		if len(host) > 255 {
+			return nil, fmt.Errorf("Host name %s is too long", host)
+		}
+		request = append(append(request, socksDomain, byte(len(host))), host...)
+	}
+	return append(request, byte(port>>8), byte(port)), nil
+}
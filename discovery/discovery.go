@@ -0,0 +1,302 @@
+// Discovers the endpoints of the load balancer with DNS
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/mailgun/gotools-log"
+	timetools "github.com/mailgun/gotools-time"
+
+	"github.com/mailgun/vulcan/endpoint"
+	"github.com/mailgun/vulcan/loadbalance/roundrobin"
+)
+
+// Resolves the names, net.Resolver implements it, tests can supply the fake one
+type Resolver interface {
+	LookupHost(ctx context.Context, host string) ([]string, error)
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+}
+
+// Load balancer with the endpoint set controlled by the discovery, e.g. roundrobin.RoundRobin
+type Balancer interface {
+	AddEndpointWithOptions(endpoint.Endpoint, roundrobin.EndpointOptions) error
+	RemoveEndpoint(endpoint.Endpoint) error
+	SetEndpointWeight(endpoint.Endpoint, int) error
+}
+
+type Options struct {
+	// Resolve SRV records instead of the host addresses, e.g. _http._tcp.example.com,
+	// endpoints get the ports and weights from the records
+	SRV bool
+	// Scheme of the discovered endpoints, defaults to http
+	Scheme string
+	// Port of the endpoints resolved from the host addresses, defaults to the scheme port
+	Port int
+	// How often the name is resolved
+	Interval time.Duration
+	// Timeout of a single resolution
+	Timeout time.Duration
+	// Endpoints gone from DNS get no new requests, and are removed from the load balancer after this period,
+	// so the requests in flight can finish. Endpoint coming back while it's drained is restored.
+	DrainTimeout time.Duration
+	// Resolver, defaults to net.DefaultResolver
+	Resolver Resolver
+	// Time provider (useful for testing purposes)
+	TimeProvider timetools.TimeProvider
+}
+
+const (
+	DefaultInterval     = 30 * time.Second
+	DefaultTimeout      = 5 * time.Second
+	DefaultDrainTimeout = 30 * time.Second
+)
+
+// Resolves the name on the interval and reconciles the endpoints of the load balancer with the results.
+// Discovery manages the endpoints it has added only, so the endpoints added by hand are left alone.
+type Discovery struct {
+	name     string
+	balancer Balancer
+	options  Options
+	mutex    *sync.Mutex
+	// Endpoints added by the discovery by the endpoint id
+	endpoints map[string]*discovered
+	stop      chan bool
+	done      chan bool
+}
+
+type discovered struct {
+	endpoint endpoint.Endpoint
+	weight   int
+	// Time the endpoint has started draining at, zero if it's not draining
+	draining time.Time
+}
+
+func NewDiscovery(name string, balancer Balancer) (*Discovery, error) {
+	return NewDiscoveryWithOptions(name, balancer, Options{})
+}
+
+func NewDiscoveryWithOptions(name string, balancer Balancer, o Options) (*Discovery, error) {
+	if name == "" {
+		return nil, fmt.Errorf("Provide name to resolve")
+	}
+	if balancer == nil {
+		return nil, fmt.Errorf("Provide load balancer")
+	}
+	o, err := parseOptions(o)
+	if err != nil {
+		return nil, err
+	}
+	return &Discovery{
+		name:      name,
+		balancer:  balancer,
+		options:   o,
+		mutex:     &sync.Mutex{},
+		endpoints: make(map[string]*discovered),
+	}, nil
+}
+
+func (d *Discovery) String() string {
+	if d.options.SRV {
+		return fmt.Sprintf("Discovery(srv=%s)", d.name)
+	}
+	return fmt.Sprintf("Discovery(host=%s)", d.name)
+}
+
+// Resolves the name right away and then on the interval until stopped
+func (d *Discovery) Start() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.stop != nil {
+		return
+	}
+	d.stop, d.done = make(chan bool), make(chan bool)
+	go d.run(d.stop, d.done)
+}
+
+// Stops the resolution, endpoints are left in the load balancer
+func (d *Discovery) Stop() {
+	d.mutex.Lock()
+	stop, done := d.stop, d.done
+	d.stop, d.done = nil, nil
+	d.mutex.Unlock()
+	if stop != nil {
+		close(stop)
+		<-done
+	}
+}
+
+func (d *Discovery) run(stop, done chan bool) {
+	defer close(done)
+	for {
+		if err := d.Resolve(); err != nil {
+			log.Errorf("%s failed to resolve: %s", d, err)
+		}
+		select {
+		case <-stop:
+			return
+		case <-d.options.TimeProvider.After(d.options.Interval):
+		}
+	}
+}
+
+// Resolves the name once and reconciles the endpoints. Endpoints are kept as is if the resolution fails,
+// so the temporary DNS failures don't take the endpoints out of the load balancer.
+func (d *Discovery) Resolve() error {
+	ctx, cancel := context.WithTimeout(context.Background(), d.options.Timeout)
+	defer cancel()
+	var found map[string]*discovered
+	var err error
+	if d.options.SRV {
+		found, err = d.resolveSRV(ctx)
+	} else {
+		found, err = d.resolveHost(ctx)
+	}
+	if err != nil {
+		return err
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.reconcile(found)
+}
+
+func (d *Discovery) resolveHost(ctx context.Context) (map[string]*discovered, error) {
+	addrs, err := d.options.Resolver.LookupHost(ctx, d.name)
+	if err != nil {
+		return nil, err
+	}
+	port := strconv.Itoa(d.options.Port)
+	found := make(map[string]*discovered, len(addrs))
+	for _, addr := range addrs {
+		if err := d.add(found, net.JoinHostPort(addr, port), 1); err != nil {
+			return nil, err
+		}
+	}
+	return found, nil
+}
+
+// Lowest priority records are used only, others are the backups according to RFC 2782
+func (d *Discovery) resolveSRV(ctx context.Context) (map[string]*discovered, error) {
+	_, records, err := d.options.Resolver.LookupSRV(ctx, "", "", d.name)
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].Priority < records[j].Priority
+	})
+	found := make(map[string]*discovered, len(records))
+	for _, r := range records {
+		if r.Priority != records[0].Priority {
+			break
+		}
+		// Records with weight 0 should be picked rarely, but never skipped
+		weight := int(r.Weight)
+		if weight == 0 {
+			weight = 1
+		}
+		host := net.JoinHostPort(strings.TrimSuffix(r.Target, "."), strconv.Itoa(int(r.Port)))
+		if err := d.add(found, host, weight); err != nil {
+			return nil, err
+		}
+	}
+	return found, nil
+}
+
+func (d *Discovery) add(found map[string]*discovered, host string, weight int) error {
+	e, err := endpoint.ParseUrl(fmt.Sprintf("%s://%s", d.options.Scheme, host))
+	if err != nil {
+		return err
+	}
+	// Same address may come with several records
+	if existing, ok := found[e.GetId()]; ok {
+		existing.weight += weight
+		return nil
+	}
+	found[e.GetId()] = &discovered{endpoint: e, weight: weight}
+	return nil
+}
+
+func (d *Discovery) reconcile(found map[string]*discovered) error {
+	now := d.options.TimeProvider.UtcNow()
+	for id, current := range d.endpoints {
+		f, ok := found[id]
+		if ok {
+			if !current.draining.IsZero() || current.weight != f.weight {
+				if err := d.balancer.SetEndpointWeight(current.endpoint, f.weight); err != nil {
+					return err
+				}
+				log.Infof("%s set %s weight to %d", d, current.endpoint, f.weight)
+				current.weight, current.draining = f.weight, time.Time{}
+			}
+			continue
+		}
+		if current.draining.IsZero() {
+			if err := d.balancer.SetEndpointWeight(current.endpoint, 0); err != nil {
+				return err
+			}
+			log.Infof("%s draining %s", d, current.endpoint)
+			current.draining = now
+			continue
+		}
+		if now.Sub(current.draining) >= d.options.DrainTimeout {
+			if err := d.balancer.RemoveEndpoint(current.endpoint); err != nil {
+				return err
+			}
+			log.Infof("%s removed %s", d, current.endpoint)
+			delete(d.endpoints, id)
+		}
+	}
+	for id, f := range found {
+		if _, ok := d.endpoints[id]; ok {
+			continue
+		}
+		if err := d.balancer.AddEndpointWithOptions(f.endpoint, roundrobin.EndpointOptions{Weight: f.weight}); err != nil {
+			// Endpoint has been added by someone else, so it's not ours to manage
+			log.Errorf("%s failed to add %s: %s", d, f.endpoint, err)
+			continue
+		}
+		log.Infof("%s added %s with weight %d", d, f.endpoint, f.weight)
+		d.endpoints[id] = f
+	}
+	return nil
+}
+
+func parseOptions(o Options) (Options, error) {
+	if o.Scheme == "" {
+		o.Scheme = "http"
+	}
+	if o.Scheme != "http" && o.Scheme != "https" {
+		return o, fmt.Errorf("Unsupported scheme '%s', expected http or https", o.Scheme)
+	}
+	if o.Port < 0 || o.Port > 0xffff {
+		return o, fmt.Errorf("Invalid port %d", o.Port)
+	}
+	if o.Port == 0 {
+		o.Port = 80
+		if o.Scheme == "https" {
+			o.Port = 443
+		}
+	}
+	if o.Interval <= 0 {
+		o.Interval = DefaultInterval
+	}
+	if o.Timeout <= 0 {
+		o.Timeout = DefaultTimeout
+	}
+	if o.DrainTimeout <= 0 {
+		o.DrainTimeout = DefaultDrainTimeout
+	}
+	if o.Resolver == nil {
+		o.Resolver = net.DefaultResolver
+	}
+	if o.TimeProvider == nil {
+		o.TimeProvider = &timetools.RealTime{}
+	}
+	return o, nil
+}
@@ -0,0 +1,229 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	timetools "github.com/mailgun/gotools-time"
+	"github.com/mailgun/vulcan/endpoint"
+	"github.com/mailgun/vulcan/loadbalance/roundrobin"
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type DiscoverySuite struct {
+	tm       *timetools.FreezedTime
+	resolver *fakeResolver
+	rr       *roundrobin.RoundRobin
+}
+
+var _ = Suite(&DiscoverySuite{})
+
+func (s *DiscoverySuite) SetUpTest(c *C) {
+	s.tm = &timetools.FreezedTime{
+		CurrentTime: time.Date(2012, 3, 4, 5, 6, 7, 0, time.UTC),
+	}
+	s.resolver = &fakeResolver{mutex: &sync.Mutex{}, resolved: make(chan bool, 10)}
+	rr, err := roundrobin.NewRoundRobinWithOptions(roundrobin.Options{TimeProvider: s.tm})
+	c.Assert(err, IsNil)
+	s.rr = rr
+}
+
+func (s *DiscoverySuite) newDiscovery(c *C, name string, o Options) *Discovery {
+	o.Resolver = s.resolver
+	o.TimeProvider = s.tm
+	d, err := NewDiscoveryWithOptions(name, s.rr, o)
+	c.Assert(err, IsNil)
+	return d
+}
+
+// Returns the endpoints of the load balancer as id=weight strings
+func (s *DiscoverySuite) endpoints() []string {
+	out := []string{}
+	for _, e := range s.rr.GetEndpoints() {
+		out = append(out, fmt.Sprintf("%s=%d", e.GetId(), e.GetOriginalWeight()))
+	}
+	sort.Strings(out)
+	return out
+}
+
+func (s *DiscoverySuite) TestHost(c *C) {
+	d := s.newDiscovery(c, "app.example.com", Options{Port: 5000})
+
+	s.resolver.setHosts("10.0.0.1", "10.0.0.2")
+	c.Assert(d.Resolve(), IsNil)
+	c.Assert(s.endpoints(), DeepEquals, []string{"http://10.0.0.1:5000=1", "http://10.0.0.2:5000=1"})
+
+	// Same results change nothing
+	c.Assert(d.Resolve(), IsNil)
+	c.Assert(s.endpoints(), DeepEquals, []string{"http://10.0.0.1:5000=1", "http://10.0.0.2:5000=1"})
+
+	s.resolver.setHosts("10.0.0.2", "::1")
+	c.Assert(d.Resolve(), IsNil)
+	c.Assert(s.endpoints(), DeepEquals, []string{"http://10.0.0.1:5000=0", "http://10.0.0.2:5000=1", "http://[::1]:5000=1"})
+}
+
+func (s *DiscoverySuite) TestDrain(c *C) {
+	d := s.newDiscovery(c, "app.example.com", Options{DrainTimeout: time.Minute})
+
+	s.resolver.setHosts("10.0.0.1", "10.0.0.2")
+	c.Assert(d.Resolve(), IsNil)
+
+	// Endpoint is gone, so it gets no new requests
+	s.resolver.setHosts("10.0.0.2")
+	c.Assert(d.Resolve(), IsNil)
+	c.Assert(s.endpoints(), DeepEquals, []string{"http://10.0.0.1:80=0", "http://10.0.0.2:80=1"})
+
+	// Still draining
+	s.tm.CurrentTime = s.tm.CurrentTime.Add(30 * time.Second)
+	c.Assert(d.Resolve(), IsNil)
+	c.Assert(s.endpoints(), DeepEquals, []string{"http://10.0.0.1:80=0", "http://10.0.0.2:80=1"})
+
+	s.tm.CurrentTime = s.tm.CurrentTime.Add(30 * time.Second)
+	c.Assert(d.Resolve(), IsNil)
+	c.Assert(s.endpoints(), DeepEquals, []string{"http://10.0.0.2:80=1"})
+}
+
+func (s *DiscoverySuite) TestDrainedEndpointComesBack(c *C) {
+	d := s.newDiscovery(c, "app.example.com", Options{DrainTimeout: time.Minute})
+
+	s.resolver.setHosts("10.0.0.1", "10.0.0.2")
+	c.Assert(d.Resolve(), IsNil)
+	s.resolver.setHosts("10.0.0.2")
+	c.Assert(d.Resolve(), IsNil)
+
+	s.resolver.setHosts("10.0.0.1", "10.0.0.2")
+	c.Assert(d.Resolve(), IsNil)
+	c.Assert(s.endpoints(), DeepEquals, []string{"http://10.0.0.1:80=1", "http://10.0.0.2:80=1"})
+
+	// Restored endpoint is not removed once the drain timeout passes
+	s.tm.CurrentTime = s.tm.CurrentTime.Add(2 * time.Minute)
+	c.Assert(d.Resolve(), IsNil)
+	c.Assert(s.endpoints(), DeepEquals, []string{"http://10.0.0.1:80=1", "http://10.0.0.2:80=1"})
+}
+
+func (s *DiscoverySuite) TestSRV(c *C) {
+	d := s.newDiscovery(c, "_http._tcp.example.com", Options{SRV: true, Scheme: "https"})
+
+	s.resolver.setSRV(
+		&net.SRV{Target: "a.example.com.", Port: 8000, Priority: 10, Weight: 3},
+		&net.SRV{Target: "b.example.com.", Port: 8001, Priority: 10, Weight: 0},
+		// Backup records are not used while the records with the lower priority are there
+		&net.SRV{Target: "c.example.com.", Port: 8002, Priority: 20, Weight: 5},
+	)
+	c.Assert(d.Resolve(), IsNil)
+	c.Assert(s.endpoints(), DeepEquals, []string{"https://a.example.com:8000=3", "https://b.example.com:8001=1"})
+
+	// Weights are updated
+	s.resolver.setSRV(
+		&net.SRV{Target: "a.example.com.", Port: 8000, Priority: 10, Weight: 1},
+		&net.SRV{Target: "b.example.com.", Port: 8001, Priority: 10, Weight: 2},
+	)
+	c.Assert(d.Resolve(), IsNil)
+	c.Assert(s.endpoints(), DeepEquals, []string{"https://a.example.com:8000=1", "https://b.example.com:8001=2"})
+}
+
+func (s *DiscoverySuite) TestResolveFailureKeepsEndpoints(c *C) {
+	d := s.newDiscovery(c, "app.example.com", Options{})
+
+	s.resolver.setHosts("10.0.0.1")
+	c.Assert(d.Resolve(), IsNil)
+
+	s.resolver.setError(fmt.Errorf("SERVFAIL"))
+	c.Assert(d.Resolve(), NotNil)
+	c.Assert(s.endpoints(), DeepEquals, []string{"http://10.0.0.1:80=1"})
+}
+
+func (s *DiscoverySuite) TestEndpointsAddedByHandAreKept(c *C) {
+	c.Assert(s.rr.AddEndpoint(endpoint.MustParseUrl("http://10.0.0.1:80")), IsNil)
+	c.Assert(s.rr.AddEndpoint(endpoint.MustParseUrl("http://localhost:5000")), IsNil)
+	d := s.newDiscovery(c, "app.example.com", Options{DrainTimeout: time.Minute})
+
+	s.resolver.setHosts("10.0.0.1", "10.0.0.2")
+	c.Assert(d.Resolve(), IsNil)
+	c.Assert(s.endpoints(), DeepEquals, []string{"http://10.0.0.1:80=1", "http://10.0.0.2:80=1", "http://localhost:5000=1"})
+
+	s.resolver.setHosts()
+	c.Assert(d.Resolve(), IsNil)
+	s.tm.CurrentTime = s.tm.CurrentTime.Add(time.Minute)
+	c.Assert(d.Resolve(), IsNil)
+	c.Assert(s.endpoints(), DeepEquals, []string{"http://10.0.0.1:80=1", "http://localhost:5000=1"})
+}
+
+func (s *DiscoverySuite) TestStartStop(c *C) {
+	d, err := NewDiscoveryWithOptions("app.example.com", s.rr, Options{Resolver: s.resolver, Interval: time.Millisecond})
+	c.Assert(err, IsNil)
+
+	s.resolver.setHosts("10.0.0.1")
+	d.Start()
+	d.Start()
+	<-s.resolver.resolved
+	<-s.resolver.resolved
+	d.Stop()
+	d.Stop()
+	c.Assert(s.endpoints(), DeepEquals, []string{"http://10.0.0.1:80=1"})
+}
+
+func (s *DiscoverySuite) TestInvalidOptions(c *C) {
+	_, err := NewDiscovery("", s.rr)
+	c.Assert(err, NotNil)
+	_, err = NewDiscovery("app.example.com", nil)
+	c.Assert(err, NotNil)
+	for _, o := range []Options{{Scheme: "ftp"}, {Port: -1}, {Port: 70000}} {
+		_, err := NewDiscoveryWithOptions("app.example.com", s.rr, o)
+		c.Assert(err, NotNil)
+	}
+}
+
+type fakeResolver struct {
+	mutex    *sync.Mutex
+	hosts    []string
+	srv      []*net.SRV
+	err      error
+	resolved chan bool
+}
+
+func (r *fakeResolver) setHosts(hosts ...string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.hosts, r.err = hosts, nil
+}
+
+func (r *fakeResolver) setSRV(records ...*net.SRV) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.srv, r.err = records, nil
+}
+
+func (r *fakeResolver) setError(err error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.err = err
+}
+
+func (r *fakeResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	defer r.notify()
+	return r.hosts, r.err
+}
+
+func (r *fakeResolver) LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	defer r.notify()
+	return name, r.srv, r.err
+}
+
+func (r *fakeResolver) notify() {
+	select {
+	case r.resolved <- true:
+	default:
+	}
+}
@@ -24,7 +24,7 @@ func ParseUrl(in string) (*HttpEndpoint, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &HttpEndpoint{url: url, id: fmt.Sprintf("%s://%s", url.Scheme, url.Host)}, nil
+	return &HttpEndpoint{url: url, id: getId(url)}, nil
 }
 
 func MustParseUrl(in string) *HttpEndpoint {
@@ -41,7 +41,15 @@ func NewHttpEndpoint(in *url.URL) (*HttpEndpoint, error) {
 	}
 	return &HttpEndpoint{
 		url: netutils.CopyUrl(in),
-		id:  fmt.Sprintf("%s://%s", in.Scheme, in.Host)}, nil
+		id:  getId(in)}, nil
+}
+
+// Unix socket endpoints are identified by the socket path, as they have no host
+func getId(u *url.URL) string {
+	if u.Scheme == netutils.UnixScheme {
+		return fmt.Sprintf("%s://%s", u.Scheme, u.Path)
+	}
+	return fmt.Sprintf("%s://%s", u.Scheme, u.Host)
 }
 
 func (e *HttpEndpoint) String() string {
@@ -20,6 +20,23 @@ type Formatter interface {
 	Format(ProxyError) (statusCode int, body []byte, contentType string)
 }
 
+// ResponseFormatter is implemented by the formatters that depend on the request and set the response headers,
+// e.g. gRPC formatter replies to the gRPC clients with the status in the headers
+type ResponseFormatter interface {
+	Formatter
+	FormatResponse(req *http.Request, err ProxyError, header http.Header) (statusCode int, body []byte)
+}
+
+// Formats the error replied to the request, sets the response headers and returns the status code and body
+func FormatResponse(f Formatter, req *http.Request, err ProxyError, header http.Header) (int, []byte) {
+	if rf, ok := f.(ResponseFormatter); ok {
+		return rf.FormatResponse(req, err, header)
+	}
+	statusCode, body, contentType := f.Format(err)
+	header.Set("Content-Type", contentType)
+	return statusCode, body
+}
+
 type JsonFormatter struct {
 }
 
@@ -9,9 +9,22 @@ Examples:
 * RequestMethodEq("GET") && AttemptsLe(2) && (IsNetworkError || ResponseCodeEq(408))
   This predicate allows failover for GET requests with maximum 2 attempts with failover
   triggered on network errors or when upstream returns special http response code 408.
+* IsIdempotent && !IsTimeout && (IsConnectRefused || ResponseCodeIn(500, 599)) && TotalDurationLt("5s")
+  This predicate allows failover for idempotent requests that did not time out, in case if
+  upstream refused the connection or replied with 5xx code, as long as the attempts took
+  less than 5 seconds in total.
+* GrpcStatusEq(14) && AttemptsLe(2)
+  This predicate allows failover of gRPC calls rejected by the upstream with UNAVAILABLE status.
 */
 
 import (
+	"net"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/mailgun/vulcan/grpc"
+	"github.com/mailgun/vulcan/headers"
 	"github.com/mailgun/vulcan/request"
 )
 
@@ -24,12 +37,60 @@ func RequestMethodEq(method string) Predicate {
 	}
 }
 
+// Allows failover of the requests that are safe to repeat: GET, HEAD, PUT and DELETE,
+// and POST requests that carry Idempotency-Key header
+func IsIdempotent(req request.Request) bool {
+	r := req.GetHttpRequest()
+	switch r.Method {
+	case "GET", "HEAD", "PUT", "DELETE":
+		return true
+	case "POST":
+		return r.Header.Get(headers.IdempotencyKey) != ""
+	}
+	return false
+}
+
 // Failover in case if last attempt resulted in error
 func IsNetworkError(req request.Request) bool {
 	attempts := len(req.GetAttempts())
 	return attempts != 0 && req.GetAttempts()[attempts-1].GetError() != nil
 }
 
+// Failover in case if last attempt timed out
+func IsTimeout(req request.Request) bool {
+	a := req.GetLastAttempt()
+	if a == nil || a.GetError() == nil {
+		return false
+	}
+	err, ok := a.GetError().(net.Error)
+	return ok && err.Timeout()
+}
+
+// Failover in case if the endpoint refused connection during the last attempt,
+// it is safe to fail over any request in this case, as it has never reached the endpoint
+func IsConnectRefused(req request.Request) bool {
+	a := req.GetLastAttempt()
+	if a == nil || a.GetError() == nil {
+		return false
+	}
+	opErr, ok := a.GetError().(*net.OpError)
+	if !ok || opErr.Op != "dial" {
+		return false
+	}
+	err := opErr.Err
+	if sysErr, ok := err.(*os.SyscallError); ok {
+		err = sysErr.Err
+	}
+	return err == syscall.ECONNREFUSED
+}
+
+// Function that returns predicate negating the passed predicate
+func Negate(fn Predicate) Predicate {
+	return func(req request.Request) bool {
+		return !fn(req)
+	}
+}
+
 // Function that returns predicate by joining the passed predicates with AND
 func And(fns ...Predicate) Predicate {
 	return func(req request.Request) bool {
@@ -72,3 +133,73 @@ func ResponseCodeEq(code int) Predicate {
 		return lastResponse != nil && lastResponse.StatusCode == code
 	}
 }
+
+// Function that returns predicate triggering failover in case if proxy returned http code in range [from, to]
+func ResponseCodeIn(from, to int) Predicate {
+	return func(req request.Request) bool {
+		a := req.GetLastAttempt()
+		if a == nil || a.GetResponse() == nil {
+			return false
+		}
+		code := a.GetResponse().StatusCode
+		return code >= from && code <= to
+	}
+}
+
+// Function that returns predicate triggering failover in case if the last gRPC call ended with the status code,
+// e.g. GrpcStatusEq(14) fails over the calls rejected by the endpoint as UNAVAILABLE. Status is read from the headers
+// of trailers-only responses, as the trailers of other responses are not known before the body is streamed to the client.
+func GrpcStatusEq(code int) Predicate {
+	return func(req request.Request) bool {
+		a := req.GetLastAttempt()
+		if a == nil {
+			return false
+		}
+		status, ok := grpc.GetStatus(a.GetResponse())
+		return ok && int(status) == code
+	}
+}
+
+// Function that returns predicate matching the request header value
+func RequestHeaderEq(header, value string) Predicate {
+	return func(req request.Request) bool {
+		return req.GetHttpRequest().Header.Get(header) == value
+	}
+}
+
+// Function that returns predicate matching the request host
+func RequestHostEq(host string) Predicate {
+	return func(req request.Request) bool {
+		return req.GetHttpRequest().Host == host
+	}
+}
+
+// Function that returns predicate matching the header value of the last response
+func ResponseHeaderEq(header, value string) Predicate {
+	return func(req request.Request) bool {
+		a := req.GetLastAttempt()
+		if a == nil || a.GetResponse() == nil {
+			return false
+		}
+		return a.GetResponse().Header.Get(header) == value
+	}
+}
+
+// Function that returns predicate triggering failover in case if the last attempt took longer than the given duration
+func AttemptDurationGt(d time.Duration) Predicate {
+	return func(req request.Request) bool {
+		a := req.GetLastAttempt()
+		return a != nil && a.GetDuration() > d
+	}
+}
+
+// Function that returns predicate allowing failover while all the attempts took less than the given duration
+func TotalDurationLt(d time.Duration) Predicate {
+	return func(req request.Request) bool {
+		total := time.Duration(0)
+		for _, a := range req.GetAttempts() {
+			total += a.GetDuration()
+		}
+		return total < d
+	}
+}
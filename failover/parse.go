@@ -7,51 +7,101 @@ import (
 	"go/token"
 	"reflect"
 	"strconv"
+	"time"
 )
 
-// Parses expression in the go language into Failover predicates
+// Parses expression in the go language into Failover predicates.
+// Function names and arguments are checked during parsing, errors
+// point to the column of the offending sub expression.
 func ParseExpression(in string) (Predicate, error) {
-	expr, err := parser.ParseExpr(in)
+	p, expr, err := NewExprParser(in)
 	if err != nil {
 		return nil, err
 	}
+	return p.ParsePredicate(expr, functions, predicates)
+}
+
+// ExprParser parses expressions in the go language, so the other packages can define
+// their expressions in the same syntax, e.g. limiter keys and exemptions
+type ExprParser struct {
+	fset *token.FileSet
+}
 
-	return parseNode(expr)
+func NewExprParser(in string) (*ExprParser, ast.Expr, error) {
+	fset := token.NewFileSet()
+	expr, err := parser.ParseExprFrom(fset, "", in, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &ExprParser{fset: fset}, expr, nil
 }
 
-func parseNode(node ast.Node) (Predicate, error) {
+// Returns the error pointing to the column of the sub expression
+func (p *ExprParser) Errorf(pos token.Pos, format string, args ...interface{}) error {
+	return fmt.Errorf("column %d: %s", p.fset.Position(pos).Column, fmt.Sprintf(format, args...))
+}
+
+// Returns the byte offset of the position in the parsed expression
+func (p *ExprParser) Offset(pos token.Pos) int {
+	return p.fset.Position(pos).Offset
+}
+
+// Parses the predicate that uses the given functions and predicates only. Functions accept literal arguments
+// and return Predicate, optionally with the error, e.g. func(networks ...string) (Predicate, error)
+func (p *ExprParser) ParsePredicate(node ast.Expr, functions map[string]interface{}, predicates map[string]Predicate) (Predicate, error) {
 	switch n := node.(type) {
 	case *ast.BinaryExpr:
-		x, err := parseNode(n.X)
+		x, err := p.ParsePredicate(n.X, functions, predicates)
 		if err != nil {
 			return nil, err
 		}
-		y, err := parseNode(n.Y)
+		y, err := p.ParsePredicate(n.Y, functions, predicates)
 		if err != nil {
 			return nil, err
 		}
-		return joinPredicates(n.Op, x, y)
+		pred, err := joinPredicates(n.Op, x, y)
+		if err != nil {
+			return nil, p.Errorf(n.OpPos, "%s", err)
+		}
+		return pred, nil
+	case *ast.UnaryExpr:
+		if n.Op != token.NOT {
+			return nil, p.Errorf(n.OpPos, "unsupported operator: %s", n.Op)
+		}
+		x, err := p.ParsePredicate(n.X, functions, predicates)
+		if err != nil {
+			return nil, err
+		}
+		return Negate(x), nil
 	case *ast.Ident:
-		return getPredicateByName(n.Name)
+		pred, ok := predicates[n.Name]
+		if !ok {
+			return nil, p.Errorf(n.Pos(), "unsupported predicate: %s", n.Name)
+		}
+		return pred, nil
 	case *ast.CallExpr:
 		// We expect function that will return predicate
 		name, err := getIdentifier(n.Fun)
 		if err != nil {
-			return nil, err
+			return nil, p.Errorf(n.Fun.Pos(), "%s", err)
 		}
-		fn, err := getFunctionByName(name)
+		fn, ok := functions[name]
+		if !ok {
+			return nil, p.Errorf(n.Fun.Pos(), "unsupported method: %s", name)
+		}
+		arguments, err := p.collectArguments(name, reflect.TypeOf(fn), n)
 		if err != nil {
 			return nil, err
 		}
-		arguments, err := collectLiterals(n.Args)
+		pred, err := createPredicate(fn, arguments)
 		if err != nil {
-			return nil, err
+			return nil, p.Errorf(n.Fun.Pos(), "%s", err)
 		}
-		return createPredicate(fn, arguments)
+		return pred, nil
 	case *ast.ParenExpr:
-		return parseNode(n.X)
+		return p.ParsePredicate(n.X, functions, predicates)
 	}
-	return nil, fmt.Errorf("unsupported %T", node)
+	return nil, p.Errorf(node.Pos(), "unsupported %T", node)
 }
 
 func getIdentifier(node ast.Node) (string, error) {
@@ -62,82 +112,102 @@ func getIdentifier(node ast.Node) (string, error) {
 	return id.Name, nil
 }
 
-func collectLiterals(nodes []ast.Expr) ([]interface{}, error) {
-	out := make([]interface{}, len(nodes))
-	for i, n := range nodes {
+// Checks that call arguments match the function signature and converts them to the values of expected types
+func (p *ExprParser) collectArguments(name string, fnType reflect.Type, call *ast.CallExpr) ([]reflect.Value, error) {
+	if fnType.IsVariadic() {
+		if len(call.Args) < fnType.NumIn()-1 {
+			return nil, p.Errorf(call.Lparen, "%s expects at least %d arguments, got %d", name, fnType.NumIn()-1, len(call.Args))
+		}
+	} else if fnType.NumIn() != len(call.Args) {
+		return nil, p.Errorf(call.Lparen, "%s expects %d arguments, got %d", name, fnType.NumIn(), len(call.Args))
+	}
+	out := make([]reflect.Value, len(call.Args))
+	for i, n := range call.Args {
 		l, ok := n.(*ast.BasicLit)
 		if !ok {
-			return nil, fmt.Errorf("expected literal, got %T", n)
+			return nil, p.Errorf(n.Pos(), "expected literal, got %T", n)
+		}
+		var argType reflect.Type
+		if fnType.IsVariadic() && i >= fnType.NumIn()-1 {
+			argType = fnType.In(fnType.NumIn() - 1).Elem()
+		} else {
+			argType = fnType.In(i)
 		}
-		val, err := literalToValue(l)
+		val, err := literalToValue(l, argType)
 		if err != nil {
-			return nil, err
+			return nil, p.Errorf(n.Pos(), "%s argument %d: %s", name, i+1, err)
 		}
 		out[i] = val
 	}
 	return out, nil
 }
 
-func literalToValue(a *ast.BasicLit) (interface{}, error) {
-	switch a.Kind {
-	case token.INT:
+var durationType = reflect.TypeOf(time.Duration(0))
+
+func literalToValue(a *ast.BasicLit, t reflect.Type) (reflect.Value, error) {
+	switch {
+	case t == durationType:
+		if a.Kind != token.STRING {
+			return reflect.Value{}, fmt.Errorf("expected duration string, e.g. \"2s\", got: %s", a.Value)
+		}
+		value, err := strconv.Unquote(a.Value)
+		if err != nil {
+			return reflect.Value{}, fmt.Errorf("failed to parse argument: %s, error: %s", a.Value, err)
+		}
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return reflect.Value{}, fmt.Errorf("failed to parse duration: %s, error: %s", a.Value, err)
+		}
+		return reflect.ValueOf(d), nil
+	case t.Kind() == reflect.Int:
+		if a.Kind != token.INT {
+			return reflect.Value{}, fmt.Errorf("expected integer, got: %s", a.Value)
+		}
 		value, err := strconv.Atoi(a.Value)
 		if err != nil {
-			return nil, fmt.Errorf("failed to parse argument: %s, error: %s", a.Value, err)
+			return reflect.Value{}, fmt.Errorf("failed to parse argument: %s, error: %s", a.Value, err)
+		}
+		return reflect.ValueOf(value), nil
+	case t.Kind() == reflect.String:
+		if a.Kind != token.STRING {
+			return reflect.Value{}, fmt.Errorf("expected string, got: %s", a.Value)
 		}
-		return value, nil
-	case token.STRING:
 		value, err := strconv.Unquote(a.Value)
 		if err != nil {
-			return nil, fmt.Errorf("failed to parse argument: %s, error: %s", a.Value, err)
+			return reflect.Value{}, fmt.Errorf("failed to parse argument: %s, error: %s", a.Value, err)
 		}
-		return value, nil
-	}
-	return nil, fmt.Errorf("only integer and string literals are supported as function arguments")
-}
-
-func getPredicateByName(name string) (Predicate, error) {
-	p, ok := map[string]Predicate{
-		"IsNetworkError": IsNetworkError,
-	}[name]
-	if !ok {
-		return nil, fmt.Errorf("unsupported predicate: %s", name)
+		return reflect.ValueOf(value), nil
 	}
-	return p, nil
+	return reflect.Value{}, fmt.Errorf("unsupported argument type: %s", t)
 }
 
-func getFunctionByName(name string) (interface{}, error) {
-	v, ok := map[string]interface{}{
-		"RequestMethodEq": RequestMethodEq,
-		"AttemptsLe":      AttemptsLe,
-		"ResponseCodeEq":  ResponseCodeEq,
-	}[name]
-	if !ok {
-		return nil, fmt.Errorf("unsupported method: %s", name)
-	}
-	return v, nil
+var predicates = map[string]Predicate{
+	"IsNetworkError":   IsNetworkError,
+	"IsTimeout":        IsTimeout,
+	"IsConnectRefused": IsConnectRefused,
+	"IsIdempotent":     IsIdempotent,
 }
 
-func createPredicate(f interface{}, args []interface{}) (p Predicate, err error) {
-	defer func() {
-		if r := recover(); r != nil {
-			err = fmt.Errorf("%s", r)
-		}
-	}()
-	// This function can panic, that's why we are catching errors early
-	return createPredicateInner(f, args)
+var functions = map[string]interface{}{
+	"RequestMethodEq":   RequestMethodEq,
+	"RequestHeaderEq":   RequestHeaderEq,
+	"RequestHostEq":     RequestHostEq,
+	"AttemptsLe":        AttemptsLe,
+	"ResponseCodeEq":    ResponseCodeEq,
+	"ResponseCodeIn":    ResponseCodeIn,
+	"ResponseHeaderEq":  ResponseHeaderEq,
+	"GrpcStatusEq":      GrpcStatusEq,
+	"AttemptDurationGt": AttemptDurationGt,
+	"TotalDurationLt":   TotalDurationLt,
 }
 
-func createPredicateInner(f interface{}, args []interface{}) (Predicate, error) {
-	arguments := make([]reflect.Value, len(args))
-	for i, a := range args {
-		arguments[i] = reflect.ValueOf(a)
+// Arguments have been checked against the function signature, so the call can not panic
+func createPredicate(f interface{}, args []reflect.Value) (Predicate, error) {
+	ret := reflect.ValueOf(f).Call(args)
+	if len(ret) == 2 && !ret[1].IsNil() {
+		return nil, ret[1].Interface().(error)
 	}
-	fn := reflect.ValueOf(f)
-
-	ret := fn.Call(arguments)
-	i := ret[0].Interface()
-	return i.(Predicate), nil
+	return ret[0].Interface().(Predicate), nil
 }
 
 func joinPredicates(op token.Token, a, b Predicate) (Predicate, error) {
@@ -3,8 +3,12 @@ package failover
 import (
 	"fmt"
 	. "gopkg.in/check.v1"
+	"net"
 	"net/http"
+	"os"
+	"syscall"
 	"testing"
+	"time"
 
 	. "github.com/mailgun/vulcan/request"
 )
@@ -111,18 +115,24 @@ func (s *FailoverSuite) TestComplexExpression(c *C) {
 
 func (s *FailoverSuite) TestInvalidCases(c *C) {
 	cases := []string{
-		")(",                                       // invalid expression
-		"1",                                        // standalone literal
-		"SomeFunc",                                 // unsupported id
-		"RequestMethodEq(banana)",                  // unsupported argument
-		"RequestMethodEq(MethodEq)",                // unsupported argument
-		"RequestMethodEq(0.2)",                     // unsupported argument
-		"RequestMethodEq(200, 200)",                // wrong number of arguments
-		`RequestMethodEq("POST") && 1`,             // standalone literal in expression
-		`1 && RequestMethodEq("POST")`,             // standalone literal in expression
+		")(",                           // invalid expression
+		"1",                            // standalone literal
+		"SomeFunc",                     // unsupported id
+		"RequestMethodEq(banana)",      // unsupported argument
+		"RequestMethodEq(MethodEq)",    // unsupported argument
+		"RequestMethodEq(0.2)",         // unsupported argument
+		"RequestMethodEq(200, 200)",    // wrong number of arguments
+		`RequestMethodEq("POST") && 1`, // standalone literal in expression
+		`1 && RequestMethodEq("POST")`, // standalone literal in expression
 		`RequestMethodEq("POST") | IsNetworkError`, // unsupported binary operator
-		`Req(1)`,             // unknown method call
-		`RequestMethodEq(1)`, // bad parameter type
+		`Req(1)`,                           // unknown method call
+		`RequestMethodEq(1)`,               // bad parameter type
+		`-IsNetworkError`,                  // unsupported unary operator
+		`ResponseCodeIn(500)`,              // wrong number of arguments
+		`ResponseCodeIn("500", 599)`,       // bad parameter type
+		`AttemptDurationGt(2)`,             // duration should be a string
+		`AttemptDurationGt("two seconds")`, // bad duration
+		`!RequestHeaderEq("X-A")`,          // wrong number of arguments
 	}
 	for _, tc := range cases {
 		p, err := ParseExpression(tc)
@@ -130,3 +140,170 @@ func (s *FailoverSuite) TestInvalidCases(c *C) {
 		c.Assert(p, IsNil)
 	}
 }
+
+func (s *FailoverSuite) TestErrorColumn(c *C) {
+	cases := []struct {
+		Expression string
+		Error      string
+	}{
+		{`IsNetworkError && Banana`, "column 19: unsupported predicate: Banana"},
+		{`IsNetworkError || AttemptsLe("1")`, "column 30: AttemptsLe argument 1: expected integer, got: \"1\""},
+		{`IsTimeout | IsIdempotent`, "column 11: unsupported operator: |"},
+		{`ResponseCodeIn(500)`, "column 15: ResponseCodeIn expects 2 arguments, got 1"},
+		{`!(IsTimeout && TotalDurationLt("1y"))`, `column 32: TotalDurationLt argument 1: failed to parse duration: "1y", error: time: unknown unit "y" in duration "1y"`},
+	}
+	for _, tc := range cases {
+		_, err := ParseExpression(tc.Expression)
+		c.Assert(err, NotNil)
+		c.Assert(err.Error(), Equals, tc.Error)
+	}
+}
+
+func (s *FailoverSuite) TestNegation(c *C) {
+	p, err := ParseExpression(`!IsNetworkError`)
+	c.Assert(err, IsNil)
+
+	c.Assert(p(&BaseRequest{}), Equals, true)
+	c.Assert(p(&BaseRequest{Attempts: []Attempt{&BaseAttempt{Error: fmt.Errorf("Something failed")}}}), Equals, false)
+}
+
+func (s *FailoverSuite) TestResponseCodeIn(c *C) {
+	p, err := ParseExpression(`ResponseCodeIn(500, 599)`)
+	c.Assert(err, IsNil)
+
+	c.Assert(p(&BaseRequest{}), Equals, false)
+	for code, expected := range map[int]bool{499: false, 500: true, 503: true, 599: true, 600: false} {
+		req := &BaseRequest{Attempts: []Attempt{&BaseAttempt{Response: &http.Response{StatusCode: code}}}}
+		c.Assert(p(req), Equals, expected)
+	}
+}
+
+func (s *FailoverSuite) TestHeaders(c *C) {
+	p, err := ParseExpression(`RequestHeaderEq("X-Retry", "yes") && ResponseHeaderEq("X-Overloaded", "true")`)
+	c.Assert(err, IsNil)
+
+	req := &BaseRequest{
+		HttpRequest: &http.Request{Header: http.Header{"X-Retry": []string{"yes"}}},
+		Attempts: []Attempt{
+			&BaseAttempt{Response: &http.Response{Header: http.Header{"X-Overloaded": []string{"true"}}}},
+		},
+	}
+	c.Assert(p(req), Equals, true)
+
+	req.HttpRequest.Header.Set("X-Retry", "no")
+	c.Assert(p(req), Equals, false)
+}
+
+func (s *FailoverSuite) TestGrpcStatus(c *C) {
+	p, err := ParseExpression(`GrpcStatusEq(14)`)
+	c.Assert(err, IsNil)
+
+	c.Assert(p(&BaseRequest{}), Equals, false)
+	c.Assert(p(&BaseRequest{Attempts: []Attempt{&BaseAttempt{Error: fmt.Errorf("oops")}}}), Equals, false)
+
+	// Trailers-only response carries the status in the headers
+	re := &http.Response{StatusCode: http.StatusOK, Header: http.Header{"Grpc-Status": []string{"14"}}}
+	c.Assert(p(&BaseRequest{Attempts: []Attempt{&BaseAttempt{Response: re}}}), Equals, true)
+
+	re = &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Trailer: http.Header{"Grpc-Status": []string{"14"}}}
+	c.Assert(p(&BaseRequest{Attempts: []Attempt{&BaseAttempt{Response: re}}}), Equals, true)
+
+	re = &http.Response{StatusCode: http.StatusServiceUnavailable, Header: http.Header{"Grpc-Status": []string{"0"}}}
+	c.Assert(p(&BaseRequest{Attempts: []Attempt{&BaseAttempt{Response: re}}}), Equals, false)
+}
+
+func (s *FailoverSuite) TestNetworkErrors(c *C) {
+	refused := &net.OpError{Op: "dial", Err: &os.SyscallError{Syscall: "connect", Err: syscall.ECONNREFUSED}}
+	timeout := &net.OpError{Op: "read", Err: &timeoutError{}}
+
+	isRefused, err := ParseExpression(`IsConnectRefused`)
+	c.Assert(err, IsNil)
+	isTimeout, err := ParseExpression(`IsTimeout`)
+	c.Assert(err, IsNil)
+
+	req := &BaseRequest{Attempts: []Attempt{&BaseAttempt{Error: refused}}}
+	c.Assert(isRefused(req), Equals, true)
+	c.Assert(isTimeout(req), Equals, false)
+
+	req = &BaseRequest{Attempts: []Attempt{&BaseAttempt{Error: timeout}}}
+	c.Assert(isRefused(req), Equals, false)
+	c.Assert(isTimeout(req), Equals, true)
+
+	c.Assert(isRefused(&BaseRequest{}), Equals, false)
+	c.Assert(isTimeout(&BaseRequest{}), Equals, false)
+}
+
+func (s *FailoverSuite) TestDurations(c *C) {
+	p, err := ParseExpression(`AttemptDurationGt("2s") && TotalDurationLt("5s")`)
+	c.Assert(err, IsNil)
+
+	c.Assert(p(&BaseRequest{}), Equals, false)
+
+	req := &BaseRequest{Attempts: []Attempt{&BaseAttempt{Duration: 3 * time.Second}}}
+	c.Assert(p(req), Equals, true)
+
+	req.Attempts = append(req.Attempts, &BaseAttempt{Duration: 3 * time.Second})
+	c.Assert(p(req), Equals, false)
+
+	req = &BaseRequest{Attempts: []Attempt{&BaseAttempt{Duration: time.Second}}}
+	c.Assert(p(req), Equals, false)
+}
+
+func (s *FailoverSuite) TestIsIdempotent(c *C) {
+	p, err := ParseExpression(`IsIdempotent`)
+	c.Assert(err, IsNil)
+
+	for method, expected := range map[string]bool{"GET": true, "HEAD": true, "PUT": true, "DELETE": true, "POST": false, "PATCH": false} {
+		c.Assert(p(&BaseRequest{HttpRequest: &http.Request{Method: method}}), Equals, expected)
+	}
+	req := &BaseRequest{HttpRequest: &http.Request{Method: "POST", Header: http.Header{"Idempotency-Key": []string{"1"}}}}
+	c.Assert(p(req), Equals, true)
+}
+
+// Other packages parse their predicates with their own functions
+func (s *FailoverSuite) TestParsePredicateWithFunctions(c *C) {
+	functions := map[string]interface{}{
+		"RequestHostEq": RequestHostEq,
+		"MethodIn": func(methods ...string) (Predicate, error) {
+			if len(methods) == 0 {
+				return nil, fmt.Errorf("Provide methods")
+			}
+			return func(req Request) bool {
+				for _, m := range methods {
+					if req.GetHttpRequest().Method == m {
+						return true
+					}
+				}
+				return false
+			}, nil
+		},
+	}
+
+	p, expr, err := NewExprParser(`RequestHostEq("localhost") && MethodIn("GET", "HEAD")`)
+	c.Assert(err, IsNil)
+	pred, err := p.ParsePredicate(expr, functions, nil)
+	c.Assert(err, IsNil)
+	c.Assert(pred(&BaseRequest{HttpRequest: &http.Request{Method: "HEAD", Host: "localhost"}}), Equals, true)
+	c.Assert(pred(&BaseRequest{HttpRequest: &http.Request{Method: "POST", Host: "localhost"}}), Equals, false)
+
+	for expression, message := range map[string]string{
+		`MethodIn()`:            "column 1: Provide methods",
+		`MethodIn("GET", 1)`:    `column 17: MethodIn argument 2: expected string, got: 1`,
+		`IsNetworkError`:        "column 1: unsupported predicate: IsNetworkError",
+		`AttemptsLe(1)`:         "column 1: unsupported method: AttemptsLe",
+		`RequestHostEq("a", 1)`: "column 14: RequestHostEq expects 1 arguments, got 2",
+	} {
+		p, expr, err := NewExprParser(expression)
+		c.Assert(err, IsNil)
+		_, err = p.ParsePredicate(expr, functions, nil)
+		c.Assert(err, NotNil)
+		c.Assert(err.Error(), Equals, message)
+	}
+}
+
+type timeoutError struct {
+}
+
+func (e *timeoutError) Error() string   { return "i/o timeout" }
+func (e *timeoutError) Timeout() bool   { return true }
+func (e *timeoutError) Temporary() bool { return true }
@@ -0,0 +1,53 @@
+package grpc
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/mailgun/vulcan/errors"
+	"github.com/mailgun/vulcan/headers"
+)
+
+// Formatter replies to the gRPC calls with trailers-only responses carrying the gRPC status,
+// errors of the other requests are formatted by the fallback formatter
+type Formatter struct {
+	// Formats the errors of the requests that are not gRPC calls, defaults to errors.JsonFormatter
+	Fallback errors.Formatter
+}
+
+// Formats the error without knowing the request, so uses the fallback formatter
+func (f *Formatter) Format(err errors.ProxyError) (int, []byte, string) {
+	return f.fallback().Format(err)
+}
+
+func (f *Formatter) FormatResponse(req *http.Request, err errors.ProxyError, header http.Header) (int, []byte) {
+	if !IsGrpcRequest(req) {
+		return errors.FormatResponse(f.fallback(), req, err, header)
+	}
+	header.Set(headers.ContentType, ContentType)
+	header.Set(headers.GrpcStatus, strconv.Itoa(int(FromHttpStatus(err.GetStatusCode()))))
+	header.Set(headers.GrpcMessage, encodeMessage(err.Error()))
+	return http.StatusOK, nil
+}
+
+func (f *Formatter) fallback() errors.Formatter {
+	if f.Fallback == nil {
+		return &errors.JsonFormatter{}
+	}
+	return f.Fallback
+}
+
+// Percent-encodes the status message as gRPC requires
+func encodeMessage(message string) string {
+	out := make([]byte, 0, len(message))
+	for i := 0; i < len(message); i++ {
+		c := message[i]
+		if c < ' ' || c > '~' || c == '%' {
+			out = append(out, []byte(fmt.Sprintf("%%%02X", c))...)
+		} else {
+			out = append(out, c)
+		}
+	}
+	return string(out)
+}
@@ -0,0 +1,46 @@
+package grpc
+
+import (
+	"net/http"
+
+	"github.com/mailgun/vulcan/errors"
+	. "gopkg.in/check.v1"
+)
+
+type FormatterSuite struct {
+}
+
+var _ = Suite(&FormatterSuite{})
+
+func (s *FormatterSuite) TestGrpcCall(c *C) {
+	f := &Formatter{}
+	req := &http.Request{Method: "POST", Header: http.Header{"Content-Type": []string{"application/grpc"}}}
+	header := make(http.Header)
+
+	statusCode, body := errors.FormatResponse(f, req, &errors.HttpError{StatusCode: 429, Body: "Too many requests, 100%"}, header)
+	c.Assert(statusCode, Equals, http.StatusOK)
+	c.Assert(len(body), Equals, 0)
+	c.Assert(header.Get("Content-Type"), Equals, "application/grpc")
+	c.Assert(header.Get("Grpc-Status"), Equals, "8")
+	c.Assert(header.Get("Grpc-Message"), Equals, "Too many requests, 100%25")
+}
+
+func (s *FormatterSuite) TestFallback(c *C) {
+	req := &http.Request{Method: "GET", Header: http.Header{}}
+
+	header := make(http.Header)
+	statusCode, body := errors.FormatResponse(&Formatter{}, req, errors.FromStatus(http.StatusBadGateway), header)
+	c.Assert(statusCode, Equals, http.StatusBadGateway)
+	c.Assert(string(body), Equals, `{"error":"Bad Gateway"}`)
+	c.Assert(header.Get("Content-Type"), Equals, "application/json")
+	c.Assert(header.Get("Grpc-Status"), Equals, "")
+
+	statusCode, _, contentType := (&Formatter{}).Format(errors.FromStatus(http.StatusBadGateway))
+	c.Assert(statusCode, Equals, http.StatusBadGateway)
+	c.Assert(contentType, Equals, "application/json")
+}
+
+func (s *FormatterSuite) TestEncodeMessage(c *C) {
+	c.Assert(encodeMessage("plain text"), Equals, "plain text")
+	c.Assert(encodeMessage("100% \né"), Equals, "100%25 %0A%C3%A9")
+}
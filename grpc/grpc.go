@@ -0,0 +1,137 @@
+// Helpers for proxying gRPC requests: detecting them, reading their status and replying with gRPC errors
+package grpc
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mailgun/vulcan/headers"
+)
+
+// Status code of the gRPC call, see https://github.com/grpc/grpc/blob/master/doc/statuscodes.md
+type Code int
+
+const (
+	OK Code = iota
+	Canceled
+	Unknown
+	InvalidArgument
+	DeadlineExceeded
+	NotFound
+	AlreadyExists
+	PermissionDenied
+	ResourceExhausted
+	FailedPrecondition
+	Aborted
+	OutOfRange
+	Unimplemented
+	Internal
+	Unavailable
+	DataLoss
+	Unauthenticated
+)
+
+var codeNames = []string{
+	"OK",
+	"CANCELLED",
+	"UNKNOWN",
+	"INVALID_ARGUMENT",
+	"DEADLINE_EXCEEDED",
+	"NOT_FOUND",
+	"ALREADY_EXISTS",
+	"PERMISSION_DENIED",
+	"RESOURCE_EXHAUSTED",
+	"FAILED_PRECONDITION",
+	"ABORTED",
+	"OUT_OF_RANGE",
+	"UNIMPLEMENTED",
+	"INTERNAL",
+	"UNAVAILABLE",
+	"DATA_LOSS",
+	"UNAUTHENTICATED",
+}
+
+func (c Code) String() string {
+	if c >= 0 && int(c) < len(codeNames) {
+		return codeNames[c]
+	}
+	return fmt.Sprintf("Code(%d)", int(c))
+}
+
+const ContentType = "application/grpc"
+
+// Tells if the request is a gRPC call, gRPC-Web requests are not as they carry the trailers in the body
+func IsGrpcRequest(r *http.Request) bool {
+	if r.Method != "POST" {
+		return false
+	}
+	contentType := strings.ToLower(r.Header.Get(headers.ContentType))
+	if !strings.HasPrefix(contentType, ContentType) {
+		return false
+	}
+	rest := contentType[len(ContentType):]
+	return rest == "" || rest[0] == '+' || rest[0] == ';'
+}
+
+// Returns the status of the call. Status is sent in the trailers, so it's known once the body has been read,
+// except for trailers-only responses (usually errors) that carry the status in the headers.
+func GetStatus(re *http.Response) (Code, bool) {
+	value := getValue(re, headers.GrpcStatus)
+	if value == "" {
+		return 0, false
+	}
+	code, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, false
+	}
+	return Code(code), true
+}
+
+// Returns the delay before the retry requested by the server. Negative delay means that the call should not be retried.
+func GetRetryPushback(re *http.Response) (time.Duration, bool) {
+	value := getValue(re, headers.GrpcRetryPushback)
+	if value == "" {
+		return 0, false
+	}
+	ms, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || ms < 0 {
+		return -1, true
+	}
+	return time.Duration(ms) * time.Millisecond, true
+}
+
+func getValue(re *http.Response, key string) string {
+	if re == nil {
+		return ""
+	}
+	if value := re.Trailer.Get(key); value != "" {
+		return value
+	}
+	return re.Header.Get(key)
+}
+
+// Maps the status of the error generated by the proxy to the code of the call
+func FromHttpStatus(statusCode int) Code {
+	switch statusCode {
+	case http.StatusOK:
+		return OK
+	case http.StatusBadRequest:
+		return Internal
+	case http.StatusUnauthorized:
+		return Unauthenticated
+	case http.StatusForbidden:
+		return PermissionDenied
+	case http.StatusNotFound:
+		return Unimplemented
+	case http.StatusRequestTimeout, http.StatusGatewayTimeout:
+		return DeadlineExceeded
+	case http.StatusRequestEntityTooLarge, http.StatusTooManyRequests, http.StatusInsufficientStorage:
+		return ResourceExhausted
+	case http.StatusBadGateway, http.StatusServiceUnavailable:
+		return Unavailable
+	}
+	return Unknown
+}
@@ -0,0 +1,91 @@
+package grpc
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type GrpcSuite struct {
+}
+
+var _ = Suite(&GrpcSuite{})
+
+func (s *GrpcSuite) TestIsGrpcRequest(c *C) {
+	tc := []struct {
+		Method      string
+		ContentType string
+		Expected    bool
+	}{
+		{Method: "POST", ContentType: "application/grpc", Expected: true},
+		{Method: "POST", ContentType: "application/grpc+proto", Expected: true},
+		{Method: "POST", ContentType: "Application/GRPC;charset=utf-8", Expected: true},
+		{Method: "GET", ContentType: "application/grpc", Expected: false},
+		{Method: "POST", ContentType: "application/grpc-web", Expected: false},
+		{Method: "POST", ContentType: "application/json", Expected: false},
+		{Method: "POST", ContentType: "", Expected: false},
+	}
+	for _, t := range tc {
+		req := &http.Request{Method: t.Method, Header: http.Header{"Content-Type": []string{t.ContentType}}}
+		c.Assert(IsGrpcRequest(req), Equals, t.Expected, Commentf("%s %s", t.Method, t.ContentType))
+	}
+}
+
+func (s *GrpcSuite) TestGetStatus(c *C) {
+	_, ok := GetStatus(nil)
+	c.Assert(ok, Equals, false)
+
+	re := &http.Response{Header: http.Header{}, Trailer: http.Header{}}
+	_, ok = GetStatus(re)
+	c.Assert(ok, Equals, false)
+
+	// Trailers-only response
+	re.Header.Set("Grpc-Status", "14")
+	code, ok := GetStatus(re)
+	c.Assert(ok, Equals, true)
+	c.Assert(code, Equals, Unavailable)
+
+	// Trailers win over the headers
+	re.Trailer.Set("Grpc-Status", "0")
+	code, ok = GetStatus(re)
+	c.Assert(ok, Equals, true)
+	c.Assert(code, Equals, OK)
+
+	re.Trailer.Set("Grpc-Status", "bad")
+	_, ok = GetStatus(re)
+	c.Assert(ok, Equals, false)
+}
+
+func (s *GrpcSuite) TestGetRetryPushback(c *C) {
+	re := &http.Response{Header: http.Header{}}
+	_, ok := GetRetryPushback(re)
+	c.Assert(ok, Equals, false)
+
+	for value, expected := range map[string]time.Duration{"250": 250 * time.Millisecond, "-1": -1, "bad": -1} {
+		re.Header.Set("Grpc-Retry-Pushback-Ms", value)
+		d, ok := GetRetryPushback(re)
+		c.Assert(ok, Equals, true)
+		c.Assert(d, Equals, expected)
+	}
+}
+
+func (s *GrpcSuite) TestCodes(c *C) {
+	c.Assert(Unavailable.String(), Equals, "UNAVAILABLE")
+	c.Assert(Code(100).String(), Equals, "Code(100)")
+
+	for status, expected := range map[int]Code{
+		http.StatusBadGateway:            Unavailable,
+		http.StatusServiceUnavailable:    Unavailable,
+		http.StatusTooManyRequests:       ResourceExhausted,
+		http.StatusRequestEntityTooLarge: ResourceExhausted,
+		http.StatusRequestTimeout:        DeadlineExceeded,
+		http.StatusForbidden:             PermissionDenied,
+		http.StatusTeapot:                Unknown,
+	} {
+		c.Assert(FromHttpStatus(status), Equals, expected)
+	}
+}
@@ -12,9 +12,35 @@ const (
 	ProxyAuthorization = "Proxy-Authorization"
 	Te                 = "Te" // canonicalized version of "TE"
 	Trailers           = "Trailers"
+	Trailer            = "Trailer"
 	TransferEncoding   = "Transfer-Encoding"
 	Upgrade            = "Upgrade"
+	GrpcStatus         = "Grpc-Status"
+	GrpcMessage        = "Grpc-Message"
+	GrpcRetryPushback  = "Grpc-Retry-Pushback-Ms"
 	ContentLength      = "Content-Length"
+	RetryAfter         = "Retry-After"
+	IdempotencyKey     = "Idempotency-Key"
+	RateLimitLimit     = "RateLimit-Limit"
+	RateLimitRemaining = "RateLimit-Remaining"
+	RateLimitReset     = "RateLimit-Reset"
+	CacheControl       = "Cache-Control"
+	Pragma             = "Pragma"
+	Expires            = "Expires"
+	Date               = "Date"
+	Age                = "Age"
+	Vary               = "Vary"
+	ETag               = "Etag"
+	LastModified       = "Last-Modified"
+	IfNoneMatch        = "If-None-Match"
+	IfModifiedSince    = "If-Modified-Since"
+	Authorization      = "Authorization"
+	SetCookie          = "Set-Cookie"
+	AcceptEncoding     = "Accept-Encoding"
+	ContentEncoding    = "Content-Encoding"
+	ContentType        = "Content-Type"
+	ContentRange       = "Content-Range"
+	IfMatch            = "If-Match"
 )
 
 // Hop-by-hop headers. These are removed when sent to the backend.
@@ -0,0 +1,217 @@
+// Concurrency limiter that adapts the limit to the latency and failures of the location
+package adaptive
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mailgun/gotools-time"
+
+	"github.com/mailgun/vulcan/errors"
+	"github.com/mailgun/vulcan/headers"
+	"github.com/mailgun/vulcan/limit"
+	"github.com/mailgun/vulcan/netutils"
+	"github.com/mailgun/vulcan/request"
+)
+
+// FailureFn defines whether the attempt is a signal of the overload
+type FailureFn func(a request.Attempt) bool
+
+// Attempt has failed in case of network errors and 5xx responses, cancelled attempts are not failures
+func IsFailure(a request.Attempt) bool {
+	if request.IsCancelled(a) {
+		return false
+	}
+	if a.GetError() != nil {
+		return true
+	}
+	return a.GetResponse() != nil && a.GetResponse().StatusCode >= http.StatusInternalServerError
+}
+
+type Options struct {
+	InitialLimit int64
+	MinLimit     int64
+	MaxLimit     int64
+	// Defaults to AIMD algorithm
+	Algorithm Algorithm
+	// Limit is updated once per window
+	Window time.Duration
+	// Window with less completed attempts does not update the limit
+	MinSamples int
+	IsFailure  FailureFn
+	// Formats the body of the rejected requests, defaults to JSON formatter
+	ErrorFormatter errors.Formatter
+	TimeProvider   timetools.TimeProvider
+}
+
+// AdaptiveLimiter limits the amount of attempts in flight for the location. The limit is recalculated
+// by the algorithm from the latency and failures observed over the window, so the limiter sheds the load
+// before the endpoints collapse. Requests over the limit are rejected with 503 Service Unavailable.
+type AdaptiveLimiter struct {
+	mutex    *sync.Mutex
+	options  Options
+	limit    float64
+	inFlight int64
+
+	windowStart  time.Time
+	window       Sample
+	totalLatency time.Duration
+	minLatency   time.Duration
+}
+
+func NewAdaptiveLimiter(o Options) (*AdaptiveLimiter, error) {
+	o, err := parseOptions(o)
+	if err != nil {
+		return nil, err
+	}
+	return &AdaptiveLimiter{
+		mutex:       &sync.Mutex{},
+		options:     o,
+		limit:       float64(o.InitialLimit),
+		windowStart: o.TimeProvider.UtcNow(),
+	}, nil
+}
+
+func (l *AdaptiveLimiter) GetOptions() Options {
+	return l.options
+}
+
+// Returns the current concurrency limit
+func (l *AdaptiveLimiter) GetLimit() int64 {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return int64(l.limit)
+}
+
+// Returns the amount of attempts in flight
+func (l *AdaptiveLimiter) GetInFlight() int64 {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.inFlight
+}
+
+func (l *AdaptiveLimiter) ProcessRequest(r request.Request) (*http.Response, error) {
+	if !l.acquire() {
+		re := netutils.NewErrorResponse(r.GetHttpRequest(), l.options.ErrorFormatter, errors.FromStatus(http.StatusServiceUnavailable))
+		re.Header.Set(headers.RetryAfter, strconv.FormatInt(int64(math.Ceil(l.options.Window.Seconds())), 10))
+		return re, nil
+	}
+	limit.Admit(r, l, true)
+	return nil, nil
+}
+
+func (l *AdaptiveLimiter) ProcessResponse(r request.Request, a request.Attempt) {
+	if _, ok := limit.TakeAdmission(r, l); !ok {
+		return
+	}
+	l.release(a)
+}
+
+func (l *AdaptiveLimiter) String() string {
+	return fmt.Sprintf("AdaptiveLimiter(%s)", l.options.Algorithm)
+}
+
+func (l *AdaptiveLimiter) acquire() bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.inFlight >= int64(l.limit) {
+		return false
+	}
+	l.inFlight += 1
+	if l.inFlight > l.window.MaxInFlight {
+		l.window.MaxInFlight = l.inFlight
+	}
+	return true
+}
+
+func (l *AdaptiveLimiter) release(a request.Attempt) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.inFlight -= 1
+	if a != nil && !request.IsCoalesced(a) {
+		l.observe(a)
+	}
+
+	now := l.options.TimeProvider.UtcNow()
+	if now.Sub(l.windowStart) < l.options.Window || l.window.Requests < l.options.MinSamples {
+		return
+	}
+	if succeeded := l.window.Requests - l.window.Failures; succeeded > 0 {
+		l.window.Latency = l.totalLatency / time.Duration(succeeded)
+	}
+	l.window.MinLatency = l.minLatency
+	l.limit = math.Max(float64(l.options.MinLimit), math.Min(float64(l.options.MaxLimit), l.options.Algorithm.Update(l.limit, l.window)))
+
+	l.windowStart = now
+	l.window = Sample{MaxInFlight: l.inFlight}
+	l.totalLatency = 0
+}
+
+func (l *AdaptiveLimiter) observe(a request.Attempt) {
+	l.window.Requests += 1
+	if l.options.IsFailure(a) {
+		l.window.Failures += 1
+		return
+	}
+	latency := a.GetDuration()
+	l.totalLatency += latency
+	if latency > 0 && (l.minLatency == 0 || latency < l.minLatency) {
+		l.minLatency = latency
+	}
+}
+
+const (
+	DefaultInitialLimit = 20
+	DefaultMinLimit     = 1
+	DefaultMaxLimit     = 1000
+	DefaultWindow       = time.Second
+	DefaultMinSamples   = 10
+	DefaultIncrease     = 1
+	DefaultBackoff      = 0.9
+)
+
+func parseOptions(o Options) (Options, error) {
+	if o.MinLimit <= 0 {
+		o.MinLimit = DefaultMinLimit
+	}
+	if o.MaxLimit <= 0 {
+		o.MaxLimit = DefaultMaxLimit
+	}
+	if o.InitialLimit <= 0 {
+		o.InitialLimit = DefaultInitialLimit
+		if o.InitialLimit > o.MaxLimit {
+			o.InitialLimit = o.MaxLimit
+		}
+	}
+	if o.MinLimit > o.MaxLimit {
+		return o, fmt.Errorf("Min limit %d is greater than max limit %d", o.MinLimit, o.MaxLimit)
+	}
+	if o.InitialLimit < o.MinLimit || o.InitialLimit > o.MaxLimit {
+		return o, fmt.Errorf("Initial limit %d should be in range [%d, %d]", o.InitialLimit, o.MinLimit, o.MaxLimit)
+	}
+	if o.Algorithm == nil {
+		o.Algorithm = &AIMD{Increase: DefaultIncrease, Backoff: DefaultBackoff}
+	}
+	if o.Window <= 0 {
+		o.Window = DefaultWindow
+	}
+	if o.MinSamples <= 0 {
+		o.MinSamples = DefaultMinSamples
+	}
+	if o.IsFailure == nil {
+		o.IsFailure = IsFailure
+	}
+	if o.ErrorFormatter == nil {
+		o.ErrorFormatter = &errors.JsonFormatter{}
+	}
+	if o.TimeProvider == nil {
+		o.TimeProvider = &timetools.RealTime{}
+	}
+	return o, nil
+}
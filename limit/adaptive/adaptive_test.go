@@ -0,0 +1,174 @@
+package adaptive
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/mailgun/gotools-time"
+	. "gopkg.in/check.v1"
+
+	"github.com/mailgun/vulcan/request"
+)
+
+func TestAdaptive(t *testing.T) { TestingT(t) }
+
+type AdaptiveSuite struct {
+	tm *timetools.FreezedTime
+}
+
+var _ = Suite(&AdaptiveSuite{})
+
+func (s *AdaptiveSuite) SetUpTest(c *C) {
+	s.tm = &timetools.FreezedTime{
+		CurrentTime: time.Date(2012, 3, 4, 5, 6, 7, 0, time.UTC),
+	}
+}
+
+func makeRequest() request.Request {
+	return request.NewBaseRequest(&http.Request{}, 1, nil)
+}
+
+func makeAttempt(statusCode int, latency time.Duration) request.Attempt {
+	return &request.BaseAttempt{Response: &http.Response{StatusCode: statusCode}, Duration: latency}
+}
+
+// Sends requests concurrently and completes them with given status and latency
+func (s *AdaptiveSuite) round(c *C, l *AdaptiveLimiter, concurrency int, statusCode int, latency time.Duration) {
+	requests := make([]request.Request, concurrency)
+	for i := range requests {
+		requests[i] = makeRequest()
+		re, err := l.ProcessRequest(requests[i])
+		c.Assert(re, IsNil)
+		c.Assert(err, IsNil)
+	}
+	s.tm.CurrentTime = s.tm.CurrentTime.Add(latency)
+	for _, r := range requests {
+		l.ProcessResponse(r, makeAttempt(statusCode, latency))
+	}
+}
+
+func (s *AdaptiveSuite) TestRejectOverLimit(c *C) {
+	l, err := NewAdaptiveLimiter(Options{InitialLimit: 2, TimeProvider: s.tm})
+	c.Assert(err, IsNil)
+
+	r1, r2 := makeRequest(), makeRequest()
+	for _, r := range []request.Request{r1, r2} {
+		re, err := l.ProcessRequest(r)
+		c.Assert(re, IsNil)
+		c.Assert(err, IsNil)
+	}
+	c.Assert(l.GetInFlight(), Equals, int64(2))
+
+	r3 := makeRequest()
+	re, err := l.ProcessRequest(r3)
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusServiceUnavailable)
+	c.Assert(re.Header.Get("Retry-After"), Equals, "1")
+
+	// Middleware chain calls ProcessResponse for the rejected request too, it should not release the slot
+	l.ProcessResponse(r3, &request.BaseAttempt{Response: re})
+	c.Assert(l.GetInFlight(), Equals, int64(2))
+
+	l.ProcessResponse(r1, makeAttempt(http.StatusOK, time.Millisecond))
+	c.Assert(l.GetInFlight(), Equals, int64(1))
+
+	re, err = l.ProcessRequest(makeRequest())
+	c.Assert(re, IsNil)
+	c.Assert(err, IsNil)
+}
+
+func (s *AdaptiveSuite) TestAIMD(c *C) {
+	l, err := NewAdaptiveLimiter(Options{InitialLimit: 10, MinSamples: 10, TimeProvider: s.tm})
+	c.Assert(err, IsNil)
+
+	// Healthy window with the limit in use increases the limit
+	s.round(c, l, 10, http.StatusOK, time.Second)
+	c.Assert(l.GetLimit(), Equals, int64(11))
+
+	// Failures decrease it
+	s.round(c, l, 10, http.StatusInternalServerError, time.Second)
+	c.Assert(l.GetLimit(), Equals, int64(9))
+
+	// Limit does not grow when the location does not use it
+	l, err = NewAdaptiveLimiter(Options{InitialLimit: 10, MinSamples: 4, TimeProvider: s.tm})
+	c.Assert(err, IsNil)
+	s.round(c, l, 4, http.StatusOK, time.Second)
+	s.round(c, l, 4, http.StatusOK, time.Second)
+	c.Assert(l.GetLimit(), Equals, int64(10))
+}
+
+func (s *AdaptiveSuite) TestAIMDLatency(c *C) {
+	aimd, err := NewAIMD(1, 0.5, 100*time.Millisecond)
+	c.Assert(err, IsNil)
+
+	l, err := NewAdaptiveLimiter(Options{InitialLimit: 10, MinSamples: 10, Algorithm: aimd, TimeProvider: s.tm})
+	c.Assert(err, IsNil)
+
+	s.round(c, l, 10, http.StatusOK, time.Second)
+	c.Assert(l.GetLimit(), Equals, int64(5))
+}
+
+func (s *AdaptiveSuite) TestGradient(c *C) {
+	gradient, err := NewGradient(1, 0, 1)
+	c.Assert(err, IsNil)
+
+	l, err := NewAdaptiveLimiter(Options{InitialLimit: 10, MinSamples: 10, Algorithm: gradient, TimeProvider: s.tm})
+	c.Assert(err, IsNil)
+
+	s.round(c, l, 10, http.StatusOK, time.Second)
+	c.Assert(l.GetLimit(), Equals, int64(10))
+
+	// Latency has grown 1.25 times, so the limit is scaled down
+	s.round(c, l, 10, http.StatusOK, 1250*time.Millisecond)
+	c.Assert(l.GetLimit(), Equals, int64(8))
+}
+
+func (s *AdaptiveSuite) TestMinMaxLimit(c *C) {
+	l, err := NewAdaptiveLimiter(Options{InitialLimit: 2, MinLimit: 2, MaxLimit: 3, MinSamples: 1, TimeProvider: s.tm})
+	c.Assert(err, IsNil)
+
+	for i := 0; i < 3; i++ {
+		s.round(c, l, int(l.GetLimit()), http.StatusOK, time.Second)
+	}
+	c.Assert(l.GetLimit(), Equals, int64(3))
+
+	for i := 0; i < 3; i++ {
+		s.round(c, l, int(l.GetLimit()), http.StatusBadGateway, time.Second)
+	}
+	c.Assert(l.GetLimit(), Equals, int64(2))
+}
+
+// Limit is not updated till the window is over and has enough samples
+func (s *AdaptiveSuite) TestWindow(c *C) {
+	l, err := NewAdaptiveLimiter(Options{InitialLimit: 4, MinSamples: 8, TimeProvider: s.tm})
+	c.Assert(err, IsNil)
+
+	s.round(c, l, 4, http.StatusOK, time.Second)
+	c.Assert(l.GetLimit(), Equals, int64(4))
+
+	s.round(c, l, 4, http.StatusOK, time.Millisecond)
+	c.Assert(l.GetLimit(), Equals, int64(5))
+}
+
+func (s *AdaptiveSuite) TestInvalidParams(c *C) {
+	params := []Options{
+		{MinLimit: 10, MaxLimit: 5},
+		{InitialLimit: 1, MinLimit: 2},
+		{InitialLimit: 20, MaxLimit: 10},
+	}
+	for _, o := range params {
+		_, err := NewAdaptiveLimiter(o)
+		c.Assert(err, NotNil, Commentf(fmt.Sprintf("%v", o)))
+	}
+
+	_, err := NewAIMD(0, 0.5, 0)
+	c.Assert(err, NotNil)
+	_, err = NewAIMD(1, 1, 0)
+	c.Assert(err, NotNil)
+	_, err = NewGradient(0.5, 0, 1)
+	c.Assert(err, NotNil)
+	_, err = NewGradient(1, 0, 0)
+	c.Assert(err, NotNil)
+}
@@ -0,0 +1,98 @@
+package adaptive
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// Sample summarizes the attempts observed by the limiter over the window
+type Sample struct {
+	Requests    int           // Amount of completed attempts
+	Failures    int           // Amount of failed attempts
+	MaxInFlight int64         // Maximum amount of attempts in flight
+	Latency     time.Duration // Average latency of the attempts
+	MinLatency  time.Duration // Lowest latency observed by the limiter, estimates the latency without load
+}
+
+// Algorithm calculates the new concurrency limit from the current limit and the observed sample
+type Algorithm interface {
+	Update(limit float64, s Sample) float64
+}
+
+// AIMD increases the limit additively while the location is healthy and decreases it
+// multiplicatively once the failures or latency over the threshold are observed
+type AIMD struct {
+	// Added to the limit after the healthy window
+	Increase float64
+	// Limit is multiplied by this value after the window with failures or high latency
+	Backoff float64
+	// Latency that is considered an overload, disabled if 0
+	LatencyThreshold time.Duration
+}
+
+func NewAIMD(increase, backoff float64, latencyThreshold time.Duration) (*AIMD, error) {
+	if increase <= 0 {
+		return nil, fmt.Errorf("Increase should be > 0, got: %f", increase)
+	}
+	if backoff <= 0 || backoff >= 1 {
+		return nil, fmt.Errorf("Backoff should be in range (0, 1), got: %f", backoff)
+	}
+	return &AIMD{Increase: increase, Backoff: backoff, LatencyThreshold: latencyThreshold}, nil
+}
+
+func (a *AIMD) Update(limit float64, s Sample) float64 {
+	if s.Failures > 0 || (a.LatencyThreshold > 0 && s.Latency > a.LatencyThreshold) {
+		return limit * a.Backoff
+	}
+	// Do not grow the limit when the location is not using it
+	if float64(s.MaxInFlight) < limit/2 {
+		return limit
+	}
+	return limit + a.Increase
+}
+
+func (a *AIMD) String() string {
+	return fmt.Sprintf("AIMD(increase=%f, backoff=%f, latency=%s)", a.Increase, a.Backoff, a.LatencyThreshold)
+}
+
+// Gradient compares the latency with the latency without load (Vegas style) and scales the limit
+// by the ratio, allowing some queueing. Limit is decreased twice in case of failures.
+type Gradient struct {
+	// Latency may grow by this factor before the limit is decreased, e.g. 2
+	Tolerance float64
+	// Allowed amount of queued requests added to the limit
+	QueueSize float64
+	// Weight of the new limit, smooths the changes
+	Smoothing float64
+}
+
+func NewGradient(tolerance, queueSize, smoothing float64) (*Gradient, error) {
+	if tolerance < 1 {
+		return nil, fmt.Errorf("Tolerance should be >= 1, got: %f", tolerance)
+	}
+	if queueSize < 0 {
+		return nil, fmt.Errorf("Queue size should be >= 0, got: %f", queueSize)
+	}
+	if smoothing <= 0 || smoothing > 1 {
+		return nil, fmt.Errorf("Smoothing should be in range (0, 1], got: %f", smoothing)
+	}
+	return &Gradient{Tolerance: tolerance, QueueSize: queueSize, Smoothing: smoothing}, nil
+}
+
+func (g *Gradient) Update(limit float64, s Sample) float64 {
+	gradient := 0.5
+	if s.Failures == 0 && s.Latency > 0 {
+		gradient = math.Max(0.5, math.Min(1, g.Tolerance*float64(s.MinLatency)/float64(s.Latency)))
+	}
+	newLimit := limit*gradient + g.QueueSize
+	// Do not grow the limit when the location is not using it
+	if float64(s.MaxInFlight) < limit/2 {
+		newLimit = math.Min(newLimit, limit)
+	}
+	return limit*(1-g.Smoothing) + newLimit*g.Smoothing
+}
+
+func (g *Gradient) String() string {
+	return fmt.Sprintf("Gradient(tolerance=%f, queue=%f, smoothing=%f)", g.Tolerance, g.QueueSize, g.Smoothing)
+}
@@ -0,0 +1,32 @@
+package limit
+
+import (
+	"fmt"
+
+	"github.com/mailgun/vulcan/request"
+)
+
+// Middleware chain calls ProcessResponse for the rejected attempts as well, so the limiters mark
+// the admitted attempts to release only them. Marks are kept per attempt: failover attempts
+// follow each other in the same request, while hedged attempts have their own user data.
+
+// Marks the current attempt of the request as admitted by the limiter, value is returned by TakeAdmission
+func Admit(r request.Request, limiter interface{}, value interface{}) {
+	r.SetUserData(admissionKey(r, limiter), value)
+}
+
+// Returns the value the current attempt has been admitted with and removes the mark,
+// false if the limiter has not admitted the attempt
+func TakeAdmission(r request.Request, limiter interface{}) (interface{}, bool) {
+	key := admissionKey(r, limiter)
+	value, ok := r.GetUserData(key)
+	if !ok {
+		return nil, false
+	}
+	r.DeleteUserData(key)
+	return value, true
+}
+
+func admissionKey(r request.Request, limiter interface{}) string {
+	return fmt.Sprintf("limit.admitted.%p.%d", limiter, len(r.GetAttempts()))
+}
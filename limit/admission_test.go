@@ -0,0 +1,38 @@
+package limit
+
+import (
+	"net/http"
+
+	"github.com/mailgun/vulcan/request"
+	. "gopkg.in/check.v1"
+)
+
+type AdmissionSuite struct {
+}
+
+var _ = Suite(&AdmissionSuite{})
+
+func (s *AdmissionSuite) TestAdmitPerAttempt(c *C) {
+	httpReq, err := http.NewRequest("GET", "http://localhost/", nil)
+	c.Assert(err, IsNil)
+	r := request.NewBaseRequest(httpReq, 1, nil)
+	a, b := &struct{ int }{}, &struct{ int }{}
+
+	Admit(r, a, "first")
+	_, ok := TakeAdmission(r, b)
+	c.Assert(ok, Equals, false)
+
+	// Mark of the previous attempt does not release the failover attempt
+	r.AddAttempt(&request.BaseAttempt{})
+	_, ok = TakeAdmission(r, a)
+	c.Assert(ok, Equals, false)
+
+	Admit(r, a, "second")
+	v, ok := TakeAdmission(r, a)
+	c.Assert(ok, Equals, true)
+	c.Assert(v, Equals, "second")
+
+	// Mark is removed once taken
+	_, ok = TakeAdmission(r, a)
+	c.Assert(ok, Equals, false)
+}
@@ -0,0 +1,198 @@
+// Response bandwidth limiter
+package bandwidth
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+
+	log "github.com/mailgun/gotools-log"
+	"github.com/mailgun/gotools-time"
+	"github.com/mailgun/ttlmap"
+
+	"github.com/mailgun/vulcan/limit"
+	"github.com/mailgun/vulcan/limit/tokenbucket"
+	"github.com/mailgun/vulcan/request"
+)
+
+// BandwidthLimiter shapes the bandwidth of the response bodies per token, e.g. per client ip or API key.
+// Optional total rate caps the bandwidth of all the responses passing through the limiter,
+// e.g. the location's bandwidth. Rates are defined in bytes.
+type BandwidthLimiter struct {
+	mutex   *sync.Mutex
+	mapper  limit.TokenMapperFn
+	rate    tokenbucket.Rate
+	options Options
+	buckets *ttlmap.TtlMap
+	total   *tokenbucket.TokenBucket
+}
+
+type Options struct {
+	// Maximum amount of bytes the token can send at once, defaults to the amount of bytes allowed per rate period
+	Burst int64
+	// Optional cap on the total bandwidth of all tokens
+	TotalRate *tokenbucket.Rate
+	// Maximum amount of bytes all tokens can send at once, defaults to the amount of bytes allowed per total rate period
+	TotalBurst   int64
+	Capacity     int // Maximum amount of simultaneously tracked tokens
+	TimeProvider timetools.TimeProvider
+}
+
+func NewBandwidthLimiter(mapper limit.TokenMapperFn, rate tokenbucket.Rate) (*BandwidthLimiter, error) {
+	return NewBandwidthLimiterWithOptions(mapper, rate, Options{})
+}
+
+func NewBandwidthLimiterWithOptions(mapper limit.TokenMapperFn, rate tokenbucket.Rate, o Options) (*BandwidthLimiter, error) {
+	if mapper == nil {
+		return nil, fmt.Errorf("Provide mapper function")
+	}
+	if rate.Period <= 0 || rate.Units <= 0 {
+		return nil, fmt.Errorf("Invalid rate: %v", rate)
+	}
+	o, err := parseOptions(rate, o)
+	if err != nil {
+		return nil, err
+	}
+	buckets, err := ttlmap.NewMapWithProvider(o.Capacity, o.TimeProvider)
+	if err != nil {
+		return nil, err
+	}
+	var total *tokenbucket.TokenBucket
+	if o.TotalRate != nil {
+		if total, err = tokenbucket.NewTokenBucket(*o.TotalRate, o.TotalBurst, o.TimeProvider); err != nil {
+			return nil, err
+		}
+	}
+	return &BandwidthLimiter{
+		mutex:   &sync.Mutex{},
+		mapper:  mapper,
+		rate:    rate,
+		options: o,
+		buckets: buckets,
+		total:   total,
+	}, nil
+}
+
+func (l *BandwidthLimiter) GetRate() tokenbucket.Rate {
+	return l.rate
+}
+
+func (l *BandwidthLimiter) GetOptions() Options {
+	return l.options
+}
+
+// Bandwidth is limited when the body is read, so the requests always pass
+func (l *BandwidthLimiter) ProcessRequest(r request.Request) (*http.Response, error) {
+	return nil, nil
+}
+
+func (l *BandwidthLimiter) ProcessResponse(r request.Request, a request.Attempt) {
+	if a == nil || a.GetResponse() == nil || a.GetResponse().Body == nil {
+		return
+	}
+	token, err := l.mapper(r)
+	if err != nil {
+		log.Errorf("%s failed to map %s, not limiting the bandwidth: %s", l, r, err)
+		return
+	}
+	bucket, err := l.getBucket(token)
+	if err != nil {
+		log.Errorf("%s failed to create bucket for %s: %s", l, r, err)
+		return
+	}
+	response := a.GetResponse()
+	response.Body = &throttledBody{ReadCloser: response.Body, limiter: l, bucket: bucket}
+}
+
+func (l *BandwidthLimiter) String() string {
+	return fmt.Sprintf("BandwidthLimiter(rate=%d bytes/%s)", l.rate.Units, l.rate.Period)
+}
+
+func (l *BandwidthLimiter) getBucket(token string) (*tokenbucket.TokenBucket, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	bucketI, exists := l.buckets.Get(token)
+	if exists {
+		return bucketI.(*tokenbucket.TokenBucket), nil
+	}
+	bucket, err := tokenbucket.NewTokenBucket(l.rate, l.options.Burst, l.options.TimeProvider)
+	if err != nil {
+		return nil, err
+	}
+	l.buckets.Set(token, bucket, tokenbucket.BucketTtl(l.rate))
+	return bucket, nil
+}
+
+// Returns the maximum amount of bytes that can be read at once
+func (l *BandwidthLimiter) chunkSize() int64 {
+	if l.total != nil && l.options.TotalBurst < l.options.Burst {
+		return l.options.TotalBurst
+	}
+	return l.options.Burst
+}
+
+// Blocks till the bytes are consumed from the token's bucket and from the total bucket
+func (l *BandwidthLimiter) consume(bucket *tokenbucket.TokenBucket, bytes int64) error {
+	if err := l.consumeBucket(bucket, bytes); err != nil {
+		return err
+	}
+	if l.total != nil {
+		return l.consumeBucket(l.total, bytes)
+	}
+	return nil
+}
+
+func (l *BandwidthLimiter) consumeBucket(bucket *tokenbucket.TokenBucket, bytes int64) error {
+	for {
+		l.mutex.Lock()
+		delay, err := bucket.Consume(bytes)
+		l.mutex.Unlock()
+		if err != nil || delay == 0 {
+			return err
+		}
+		l.options.TimeProvider.Sleep(delay)
+	}
+}
+
+// Response body that is read not faster than the limiter allows
+type throttledBody struct {
+	io.ReadCloser
+	limiter *BandwidthLimiter
+	bucket  *tokenbucket.TokenBucket
+}
+
+func (b *throttledBody) Read(p []byte) (int, error) {
+	if max := b.limiter.chunkSize(); int64(len(p)) > max {
+		p = p[:max]
+	}
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		if cerr := b.limiter.consume(b.bucket, int64(n)); cerr != nil {
+			return n, cerr
+		}
+	}
+	return n, err
+}
+
+func parseOptions(rate tokenbucket.Rate, o Options) (Options, error) {
+	if o.Burst <= 0 {
+		o.Burst = rate.Units
+	}
+	if o.TotalRate != nil {
+		if o.TotalRate.Period <= 0 || o.TotalRate.Units <= 0 {
+			return o, fmt.Errorf("Invalid total rate: %v", *o.TotalRate)
+		}
+		if o.TotalBurst <= 0 {
+			o.TotalBurst = o.TotalRate.Units
+		}
+	}
+	if o.Capacity <= 0 {
+		o.Capacity = tokenbucket.DefaultCapacity
+	}
+	if o.TimeProvider == nil {
+		o.TimeProvider = &timetools.RealTime{}
+	}
+	return o, nil
+}
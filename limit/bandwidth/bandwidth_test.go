@@ -0,0 +1,92 @@
+package bandwidth
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mailgun/gotools-time"
+	. "gopkg.in/check.v1"
+
+	"github.com/mailgun/vulcan/limit"
+	"github.com/mailgun/vulcan/limit/tokenbucket"
+	"github.com/mailgun/vulcan/request"
+)
+
+func TestBandwidth(t *testing.T) { TestingT(t) }
+
+type BandwidthSuite struct {
+	tm *timetools.FreezedTime
+}
+
+var _ = Suite(&BandwidthSuite{})
+
+func (s *BandwidthSuite) SetUpTest(c *C) {
+	s.tm = &timetools.FreezedTime{
+		CurrentTime: time.Date(2012, 3, 4, 5, 6, 7, 0, time.UTC),
+	}
+}
+
+// Reads the body of the response proxied through the limiter and returns the time it took
+func (s *BandwidthSuite) download(c *C, l *BandwidthLimiter, ip string, body string) time.Duration {
+	r := &request.BaseRequest{HttpRequest: &http.Request{RemoteAddr: ip}}
+	a := &request.BaseAttempt{Response: &http.Response{Body: ioutil.NopCloser(strings.NewReader(body))}}
+
+	re, err := l.ProcessRequest(r)
+	c.Assert(re, IsNil)
+	c.Assert(err, IsNil)
+	l.ProcessResponse(r, a)
+
+	start := s.tm.UtcNow()
+	out, err := ioutil.ReadAll(a.Response.Body)
+	c.Assert(err, IsNil)
+	c.Assert(string(out), Equals, body)
+	return s.tm.UtcNow().Sub(start)
+}
+
+func (s *BandwidthSuite) TestPerToken(c *C) {
+	l, err := NewBandwidthLimiterWithOptions(
+		limit.RequestToClientIp, tokenbucket.Rate{Units: 10, Period: time.Second}, Options{TimeProvider: s.tm})
+	c.Assert(err, IsNil)
+
+	// The first 10 bytes are sent right away, the rest at 10 bytes/second
+	c.Assert(s.download(c, l, "1.2.3.4", strings.Repeat("a", 30)), Equals, 2*time.Second)
+
+	// Other clients have their own buckets
+	c.Assert(s.download(c, l, "1.2.3.5", strings.Repeat("a", 10)), Equals, time.Duration(0))
+}
+
+func (s *BandwidthSuite) TestTotalRate(c *C) {
+	l, err := NewBandwidthLimiterWithOptions(
+		limit.RequestToClientIp, tokenbucket.Rate{Units: 100, Period: time.Second},
+		Options{TimeProvider: s.tm, TotalRate: &tokenbucket.Rate{Units: 10, Period: time.Second}})
+	c.Assert(err, IsNil)
+
+	c.Assert(s.download(c, l, "1.2.3.4", strings.Repeat("a", 20)), Equals, time.Second)
+
+	// Total bucket is empty, so the other client waits as well
+	c.Assert(s.download(c, l, "1.2.3.5", strings.Repeat("a", 10)), Equals, time.Second)
+}
+
+func (s *BandwidthSuite) TestMapperFailure(c *C) {
+	l, err := NewBandwidthLimiterWithOptions(
+		limit.RequestToClientIp, tokenbucket.Rate{Units: 1, Period: time.Second}, Options{TimeProvider: s.tm})
+	c.Assert(err, IsNil)
+
+	// Responses are not limited in case if the token can't be extracted
+	c.Assert(s.download(c, l, "", strings.Repeat("a", 10)), Equals, time.Duration(0))
+}
+
+func (s *BandwidthSuite) TestInvalidParams(c *C) {
+	_, err := NewBandwidthLimiter(nil, tokenbucket.Rate{Units: 1, Period: time.Second})
+	c.Assert(err, NotNil)
+
+	_, err = NewBandwidthLimiter(limit.RequestToClientIp, tokenbucket.Rate{})
+	c.Assert(err, NotNil)
+
+	_, err = NewBandwidthLimiterWithOptions(
+		limit.RequestToClientIp, tokenbucket.Rate{Units: 1, Period: time.Second}, Options{TotalRate: &tokenbucket.Rate{}})
+	c.Assert(err, NotNil)
+}
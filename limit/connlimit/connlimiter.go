@@ -9,6 +9,7 @@ import (
 	"github.com/mailgun/vulcan/request"
 	"net/http"
 	"sync"
+	"time"
 )
 
 // This limiter tracks concurrent connection per token
@@ -19,6 +20,15 @@ type ConnectionLimiter struct {
 	connections      map[string]int64
 	maxConnections   int64
 	totalConnections int64
+	queue            *limit.Queue
+	errorFormatter   errors.Formatter
+}
+
+type Options struct {
+	// If set, requests over the limit wait in the queue for the connection slot instead of being rejected
+	Queue *limit.QueueOptions
+	// Formats the rejections, if not set, rejections are replied with plain text
+	ErrorFormatter errors.Formatter
 }
 
 func NewClientIpLimiter(maxConnections int64) (*ConnectionLimiter, error) {
@@ -26,50 +36,110 @@ func NewClientIpLimiter(maxConnections int64) (*ConnectionLimiter, error) {
 }
 
 func NewConnectionLimiter(mapper limit.MapperFn, maxConnections int64) (*ConnectionLimiter, error) {
+	return NewConnectionLimiterWithOptions(mapper, maxConnections, Options{})
+}
+
+func NewConnectionLimiterWithOptions(mapper limit.MapperFn, maxConnections int64, o Options) (*ConnectionLimiter, error) {
 	if mapper == nil {
 		return nil, fmt.Errorf("Mapper function can not be nil")
 	}
 	if maxConnections <= 0 {
 		return nil, fmt.Errorf("Max connections should be >= 0")
 	}
+	var queue *limit.Queue
+	if o.Queue != nil {
+		q, err := limit.NewQueue(*o.Queue)
+		if err != nil {
+			return nil, err
+		}
+		queue = q
+	}
 	return &ConnectionLimiter{
 		mutex:          &sync.Mutex{},
 		mapper:         mapper,
 		maxConnections: maxConnections,
 		connections:    make(map[string]int64),
+		queue:          queue,
+		errorFormatter: o.ErrorFormatter,
 	}, nil
 }
 
 func (cl *ConnectionLimiter) ProcessRequest(r request.Request) (*http.Response, error) {
-	cl.mutex.Lock()
-	defer cl.mutex.Unlock()
-
 	token, amount, err := cl.mapper(r)
 	if err != nil {
 		return nil, err
 	}
 
+	if cl.queue == nil {
+		if ok, connections := cl.acquire(token, amount); !ok {
+			return cl.reject(r, connections), nil
+		}
+		limit.Admit(r, cl, &admitted{token: token, amount: amount})
+		return nil, nil
+	}
+
+	var connections int64
+	err = cl.queue.Acquire(r, token, func() (bool, time.Duration, error) {
+		var ok bool
+		ok, connections = cl.acquire(token, amount)
+		return ok, 0, nil
+	})
+	switch err {
+	case nil:
+		limit.Admit(r, cl, &admitted{token: token, amount: amount})
+		return nil, nil
+	case limit.ErrQueueFull, limit.ErrQueueTimeout:
+		return cl.reject(r, connections), nil
+	}
+	return nil, err
+}
+
+// Returns true if the connection slot has been acquired, otherwise returns the current amount of connections
+func (cl *ConnectionLimiter) acquire(token string, amount int64) (bool, int64) {
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+
 	connections := cl.connections[token]
 	if connections >= cl.maxConnections {
-		return netutils.NewTextResponse(
-			r.GetHttpRequest(),
-			errors.StatusTooManyRequests,
-			fmt.Sprintf("Connection limit reached. Max is: %d, yours: %d", cl.maxConnections, connections)), nil
+		return false, connections
 	}
 
 	cl.connections[token] += amount
 	cl.totalConnections += int64(amount)
-	return nil, nil
+	return true, connections
+}
+
+func (cl *ConnectionLimiter) reject(r request.Request, connections int64) *http.Response {
+	message := fmt.Sprintf("Connection limit reached. Max is: %d, yours: %d", cl.GetMaxConnections(), connections)
+	if cl.errorFormatter != nil {
+		return netutils.NewErrorResponse(r.GetHttpRequest(), cl.errorFormatter,
+			&errors.HttpError{StatusCode: errors.StatusTooManyRequests, Body: message})
+	}
+	return netutils.NewTextResponse(r.GetHttpRequest(), errors.StatusTooManyRequests, message)
 }
 
 func (cl *ConnectionLimiter) ProcessResponse(r request.Request, a request.Attempt) {
+	v, ok := limit.TakeAdmission(r, cl)
+	if !ok {
+		return
+	}
+	s := v.(*admitted)
+	cl.release(s.token, s.amount)
+	if cl.queue != nil {
+		cl.queue.Notify(s.token)
+	}
+}
+
+// Connections acquired by the admitted request
+type admitted struct {
+	token  string
+	amount int64
+}
+
+func (cl *ConnectionLimiter) release(token string, amount int64) {
 	cl.mutex.Lock()
 	defer cl.mutex.Unlock()
 
-	token, amount, err := cl.mapper(r)
-	if err != nil {
-		return
-	}
 	cl.connections[token] -= amount
 	cl.totalConnections -= int64(amount)
 
@@ -85,10 +155,28 @@ func (cl *ConnectionLimiter) GetConnectionCount() int64 {
 	return cl.totalConnections
 }
 
+// Returns the stats of the queue, or zero stats if the limiter is not queueing requests
+func (cl *ConnectionLimiter) GetQueueStats() limit.QueueStats {
+	if cl.queue == nil {
+		return limit.QueueStats{}
+	}
+	return cl.queue.GetStats()
+}
+
 func (cl *ConnectionLimiter) GetMaxConnections() int64 {
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
 	return cl.maxConnections
 }
 
 func (cl *ConnectionLimiter) SetMaxConnections(max int64) {
+	cl.mutex.Lock()
+	grown := max > cl.maxConnections
 	cl.maxConnections = max
+	cl.mutex.Unlock()
+
+	// Queued requests wait to be notified, so they take the new slots right away
+	if grown && cl.queue != nil {
+		cl.queue.NotifyAll()
+	}
 }
@@ -1,10 +1,13 @@
 package connlimit
 
 import (
+	"github.com/mailgun/vulcan/grpc"
+	"github.com/mailgun/vulcan/limit"
 	"github.com/mailgun/vulcan/request"
 	. "gopkg.in/check.v1"
 	"net/http"
 	"testing"
+	"time"
 )
 
 func TestConn(t *testing.T) { TestingT(t) }
@@ -92,6 +95,32 @@ func (s *ConnLimiterSuite) TestConnectionCount(c *C) {
 	c.Assert(l.GetConnectionCount(), Equals, int64(0))
 }
 
+// Completion of the rejected request does not release the connection of the admitted one
+func (s *ConnLimiterSuite) TestRejectedRequestDoesNotRelease(c *C) {
+	l, err := NewClientIpLimiter(1)
+	c.Assert(err, IsNil)
+
+	r := makeRequest("1.2.3.4")
+	re, err := l.ProcessRequest(r)
+	c.Assert(re, IsNil)
+	c.Assert(err, IsNil)
+
+	r2 := makeRequest("1.2.3.4")
+	re, err = l.ProcessRequest(r2)
+	c.Assert(re, NotNil)
+	c.Assert(err, IsNil)
+
+	l.ProcessResponse(r2, nil)
+	c.Assert(l.GetConnectionCount(), Equals, int64(1))
+
+	re, err = l.ProcessRequest(makeRequest("1.2.3.4"))
+	c.Assert(re, NotNil)
+	c.Assert(err, IsNil)
+
+	l.ProcessResponse(r, nil)
+	c.Assert(l.GetConnectionCount(), Equals, int64(0))
+}
+
 // We've failed to extract client ip, everything crashes, bam!
 func (s *ConnLimiterSuite) TestFailure(c *C) {
 	l, err := NewClientIpLimiter(1)
@@ -101,6 +130,127 @@ func (s *ConnLimiterSuite) TestFailure(c *C) {
 	c.Assert(re, IsNil)
 }
 
+// Requests over the limit wait in the queue till the connection is released
+func (s *ConnLimiterSuite) TestQueue(c *C) {
+	l, err := NewConnectionLimiterWithOptions(
+		limit.MapClientIp, 1, Options{Queue: &limit.QueueOptions{MaxDepth: 1, MaxWait: time.Second}})
+	c.Assert(err, IsNil)
+
+	r := makeRequest("1.2.3.4")
+	re, err := l.ProcessRequest(r)
+	c.Assert(re, IsNil)
+	c.Assert(err, IsNil)
+
+	done := make(chan *http.Response, 1)
+	go func() {
+		re, _ := l.ProcessRequest(r)
+		done <- re
+	}()
+	for l.GetQueueStats().Depth != 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// Queue is full, so the request is rejected right away
+	re, err = l.ProcessRequest(r)
+	c.Assert(re, NotNil)
+	c.Assert(err, IsNil)
+
+	l.ProcessResponse(r, nil)
+	c.Assert(<-done, IsNil)
+	c.Assert(l.GetConnectionCount(), Equals, int64(1))
+
+	stats := l.GetQueueStats()
+	c.Assert(stats.Served, Equals, int64(1))
+	c.Assert(stats.Rejected, Equals, int64(1))
+}
+
+func (s *ConnLimiterSuite) TestQueueTimeout(c *C) {
+	l, err := NewConnectionLimiterWithOptions(
+		limit.MapClientIp, 1, Options{Queue: &limit.QueueOptions{MaxDepth: 1, MaxWait: time.Millisecond}})
+	c.Assert(err, IsNil)
+
+	r := makeRequest("1.2.3.4")
+	re, err := l.ProcessRequest(r)
+	c.Assert(re, IsNil)
+	c.Assert(err, IsNil)
+
+	re, err = l.ProcessRequest(r)
+	c.Assert(re, NotNil)
+	c.Assert(err, IsNil)
+	c.Assert(l.GetQueueStats().TimedOut, Equals, int64(1))
+}
+
+// Queued requests take the slots added by the new limit
+func (s *ConnLimiterSuite) TestSetMaxConnectionsWakesQueue(c *C) {
+	l, err := NewConnectionLimiterWithOptions(
+		limit.MapClientIp, 1, Options{Queue: &limit.QueueOptions{MaxDepth: 1, MaxWait: time.Minute}})
+	c.Assert(err, IsNil)
+
+	re, err := l.ProcessRequest(makeRequest("1.2.3.4"))
+	c.Assert(re, IsNil)
+	c.Assert(err, IsNil)
+
+	done := make(chan *http.Response, 1)
+	go func() {
+		re, _ := l.ProcessRequest(makeRequest("1.2.3.4"))
+		done <- re
+	}()
+	for l.GetQueueStats().Depth != 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	l.SetMaxConnections(2)
+	select {
+	case re := <-done:
+		c.Assert(re, IsNil)
+	case <-time.After(time.Second):
+		c.Fatalf("Queued request has not been admitted")
+	}
+	c.Assert(l.GetConnectionCount(), Equals, int64(2))
+	c.Assert(l.GetQueueStats().Served, Equals, int64(1))
+}
+
+// Max connections can be updated while the limiter processes requests
+func (s *ConnLimiterSuite) TestSetMaxConnections(c *C) {
+	l, err := NewClientIpLimiter(1)
+	c.Assert(err, IsNil)
+
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 100; i++ {
+			l.SetMaxConnections(int64(i + 1))
+		}
+		close(done)
+	}()
+	for i := 0; i < 100; i++ {
+		r := makeRequest("1.2.3.4")
+		if re, _ := l.ProcessRequest(r); re == nil {
+			l.ProcessResponse(r, nil)
+		}
+	}
+	<-done
+	c.Assert(l.GetMaxConnections(), Equals, int64(100))
+}
+
+// Rejections of gRPC calls are replied with gRPC status by the formatter
+func (s *ConnLimiterSuite) TestErrorFormatter(c *C) {
+	l, err := NewConnectionLimiterWithOptions(limit.MapClientIp, 1, Options{ErrorFormatter: &grpc.Formatter{}})
+	c.Assert(err, IsNil)
+
+	r := makeRequest("1.2.3.4")
+	r.GetHttpRequest().Method = "POST"
+	r.GetHttpRequest().Header = http.Header{"Content-Type": []string{"application/grpc"}}
+
+	re, err := l.ProcessRequest(r)
+	c.Assert(re, IsNil)
+	c.Assert(err, IsNil)
+
+	re, err = l.ProcessRequest(r)
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusOK)
+	c.Assert(re.Header.Get("Grpc-Status"), Equals, "8")
+}
+
 func (s *ConnLimiterSuite) TestWrongParams(c *C) {
 	_, err := NewConnectionLimiter(nil, 1)
 	c.Assert(err, NotNil)
@@ -113,9 +263,5 @@ func (s *ConnLimiterSuite) TestWrongParams(c *C) {
 }
 
 func makeRequest(ip string) request.Request {
-	return &request.BaseRequest{
-		HttpRequest: &http.Request{
-			RemoteAddr: ip,
-		},
-	}
+	return request.NewBaseRequest(&http.Request{RemoteAddr: ip}, 1, nil)
 }
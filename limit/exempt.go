@@ -0,0 +1,97 @@
+package limit
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/mailgun/vulcan/failover"
+	"github.com/mailgun/vulcan/request"
+)
+
+// Function that returns predicate matching requests with client ip in any of the networks,
+// networks are defined in CIDR notation, e.g. "10.0.0.0/8", or as single ip addresses.
+// Other request predicates, e.g. RequestHeaderEq, are defined in the failover package.
+func ClientIpIn(networks ...string) (failover.Predicate, error) {
+	if len(networks) == 0 {
+		return nil, fmt.Errorf("Provide at least one network")
+	}
+	nets := make([]*net.IPNet, len(networks))
+	for i, n := range networks {
+		if !strings.Contains(n, "/") {
+			ip := net.ParseIP(n)
+			if ip == nil {
+				return nil, fmt.Errorf("Invalid ip address: '%s'", n)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				bits = 8 * net.IPv4len
+			}
+			nets[i] = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(n)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid network '%s': %s", n, err)
+		}
+		nets[i] = ipNet
+	}
+	return func(req request.Request) bool {
+		value, err := RequestToClientIp(req)
+		if err != nil {
+			return false
+		}
+		ip := net.ParseIP(value)
+		if ip == nil {
+			return false
+		}
+		for _, n := range nets {
+			if n.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
+
+// ExemptLimiter passes the requests matching the predicate without consulting the wrapped limiter,
+// e.g. to exclude the internal networks from the rate limits
+type ExemptLimiter struct {
+	exempt  failover.Predicate
+	limiter Limiter
+}
+
+func NewExemptLimiter(exempt failover.Predicate, limiter Limiter) (*ExemptLimiter, error) {
+	if exempt == nil {
+		return nil, fmt.Errorf("Provide exemption predicate")
+	}
+	if limiter == nil {
+		return nil, fmt.Errorf("Provide limiter")
+	}
+	return &ExemptLimiter{exempt: exempt, limiter: limiter}, nil
+}
+
+func (l *ExemptLimiter) GetLimiter() Limiter {
+	return l.limiter
+}
+
+func (l *ExemptLimiter) ProcessRequest(r request.Request) (*http.Response, error) {
+	if l.exempt(r) {
+		return nil, nil
+	}
+	return l.limiter.ProcessRequest(r)
+}
+
+// Predicate depends on the request only, so the exempt requests are matched again
+// and never reach the wrapped limiter
+func (l *ExemptLimiter) ProcessResponse(r request.Request, a request.Attempt) {
+	if l.exempt(r) {
+		return
+	}
+	l.limiter.ProcessResponse(r, a)
+}
+
+func (l *ExemptLimiter) String() string {
+	return fmt.Sprintf("ExemptLimiter(%v)", l.limiter)
+}
@@ -0,0 +1,62 @@
+package limit
+
+import (
+	"net/http"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/mailgun/vulcan/failover"
+	"github.com/mailgun/vulcan/request"
+)
+
+type ExemptSuite struct {
+}
+
+var _ = Suite(&ExemptSuite{})
+
+func (s *ExemptSuite) TestExemptRequestsBypassLimiter(c *C) {
+	exempt, err := ClientIpIn("10.0.0.0/8")
+	c.Assert(err, IsNil)
+
+	limiter := &rejectingLimiter{}
+	l, err := NewExemptLimiter(exempt, limiter)
+	c.Assert(err, IsNil)
+
+	r := makeHttpRequest("10.0.0.1:80", "http://a")
+	re, err := l.ProcessRequest(r)
+	c.Assert(err, IsNil)
+	c.Assert(re, IsNil)
+	l.ProcessResponse(r, nil)
+	c.Assert(limiter.requests, Equals, 0)
+	c.Assert(limiter.responses, Equals, 0)
+
+	r = makeHttpRequest("1.2.3.4:80", "http://a")
+	re, err = l.ProcessRequest(r)
+	c.Assert(err, IsNil)
+	c.Assert(re, NotNil)
+	l.ProcessResponse(r, nil)
+	c.Assert(limiter.requests, Equals, 1)
+	c.Assert(limiter.responses, Equals, 1)
+}
+
+func (s *ExemptSuite) TestInvalidParams(c *C) {
+	_, err := NewExemptLimiter(nil, &rejectingLimiter{})
+	c.Assert(err, NotNil)
+
+	_, err = NewExemptLimiter(failover.RequestMethodEq("GET"), nil)
+	c.Assert(err, NotNil)
+}
+
+type rejectingLimiter struct {
+	requests  int
+	responses int
+}
+
+func (l *rejectingLimiter) ProcessRequest(r request.Request) (*http.Response, error) {
+	l.requests += 1
+	return &http.Response{StatusCode: http.StatusTooManyRequests}, nil
+}
+
+func (l *rejectingLimiter) ProcessResponse(r request.Request, a request.Attempt) {
+	l.responses += 1
+}
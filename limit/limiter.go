@@ -14,8 +14,8 @@ type Limiter interface {
 	// will be proxied to the client.
 	// In case if limiter returns an error, it will be treated as a request error and will
 	// potentially activate failure recovery and failover algorithms.
-	// In case if lmimiter wants to delay request, it should return duration > 0
-	// Otherwise limiter should return (0, nil) to allow request to proceed
+	// In case if limiter wants to delay request, it should block the call, e.g. by waiting in the Queue
+	// Otherwise limiter should return (nil, nil) to allow request to proceed
 	middleware.Middleware
 }
 
@@ -100,6 +100,84 @@ func MakeRequestToHeader(header string) TokenMapperFn {
 	}
 }
 
+// RequestToMethod maps request to it's method
+func RequestToMethod(req request.Request) (string, error) {
+	return req.GetHttpRequest().Method, nil
+}
+
+// RequestToPath maps request to the path of it's URL
+func RequestToPath(req request.Request) (string, error) {
+	return req.GetHttpRequest().URL.Path, nil
+}
+
+// MakeRequestToCookie creates a TokenMapper that maps the request to the cookie value, empty string if cookie is missing
+func MakeRequestToCookie(name string) TokenMapperFn {
+	return func(req request.Request) (string, error) {
+		cookie, err := req.GetHttpRequest().Cookie(name)
+		if err != nil {
+			return "", nil
+		}
+		return cookie.Value, nil
+	}
+}
+
+// MakeRequestToQueryParam creates a TokenMapper that maps the request to the value of the query parameter
+func MakeRequestToQueryParam(name string) TokenMapperFn {
+	return func(req request.Request) (string, error) {
+		return req.GetHttpRequest().URL.Query().Get(name), nil
+	}
+}
+
+// MakeRequestToPathParam creates a TokenMapper that maps the request to the path segment
+// captured by the parameter in the pattern, e.g. pattern "/users/<user>/messages" and parameter "user"
+// map path "/users/bob/messages" to "bob". Requests with paths not matching the pattern are mapped to empty string.
+func MakeRequestToPathParam(pattern, param string) (TokenMapperFn, error) {
+	segments := strings.Split(pattern, "/")
+	index := -1
+	for i, s := range segments {
+		if s == "<"+param+">" {
+			index = i
+		}
+	}
+	if index == -1 {
+		return nil, fmt.Errorf("Parameter '%s' is not found in pattern '%s'", param, pattern)
+	}
+	return func(req request.Request) (string, error) {
+		values := strings.Split(req.GetHttpRequest().URL.Path, "/")
+		if len(values) != len(segments) {
+			return "", nil
+		}
+		for i, s := range segments {
+			if !isPathParam(s) && s != values[i] {
+				return "", nil
+			}
+		}
+		return values[index], nil
+	}, nil
+}
+
+func isPathParam(segment string) bool {
+	return len(segment) > 2 && strings.HasPrefix(segment, "<") && strings.HasSuffix(segment, ">")
+}
+
+// Joins the values of the token mappers, e.g. client ip and account header
+func MakeCompositeTokenMapper(mappers ...TokenMapperFn) TokenMapperFn {
+	return func(req request.Request) (string, error) {
+		values := make([]string, len(mappers))
+		for i, m := range mappers {
+			v, err := m(req)
+			if err != nil {
+				return "", err
+			}
+			values[i] = v
+		}
+		return strings.Join(values, CompositeSeparator), nil
+	}
+}
+
+// Separates the values of the composite token
+const CompositeSeparator = "|"
+
 // Converts varaiable string to a mapper function used in limiters
 func MakeTokenMapperFromVariable(variable string) (TokenMapperFn, error) {
 	if variable == "client.ip" {
@@ -108,6 +186,12 @@ func MakeTokenMapperFromVariable(variable string) (TokenMapperFn, error) {
 	if variable == "request.host" {
 		return RequestToHost, nil
 	}
+	if variable == "request.method" {
+		return RequestToMethod, nil
+	}
+	if variable == "request.path" {
+		return RequestToPath, nil
+	}
 	if strings.HasPrefix(variable, "request.header.") {
 		header := strings.TrimPrefix(variable, "request.header.")
 		if len(header) == 0 {
@@ -115,5 +199,19 @@ func MakeTokenMapperFromVariable(variable string) (TokenMapperFn, error) {
 		}
 		return MakeRequestToHeader(header), nil
 	}
+	if strings.HasPrefix(variable, "request.cookie.") {
+		cookie := strings.TrimPrefix(variable, "request.cookie.")
+		if len(cookie) == 0 {
+			return nil, fmt.Errorf("Wrong cookie: %s", cookie)
+		}
+		return MakeRequestToCookie(cookie), nil
+	}
+	if strings.HasPrefix(variable, "request.query.") {
+		param := strings.TrimPrefix(variable, "request.query.")
+		if len(param) == 0 {
+			return nil, fmt.Errorf("Wrong query parameter: %s", param)
+		}
+		return MakeRequestToQueryParam(param), nil
+	}
 	return nil, fmt.Errorf("Unsupported limiting variable: '%s'", variable)
 }
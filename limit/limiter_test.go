@@ -25,6 +25,18 @@ func (s *LimitSuite) TestVariableToMapper(c *C) {
 	c.Assert(err, IsNil)
 	c.Assert(m, NotNil)
 
+	m, err = VariableToMapper("request.cookie.session")
+	c.Assert(err, IsNil)
+	c.Assert(m, NotNil)
+
+	m, err = VariableToMapper("request.query.key")
+	c.Assert(err, IsNil)
+	c.Assert(m, NotNil)
+
+	m, err = VariableToMapper("request.cookie.")
+	c.Assert(err, NotNil)
+	c.Assert(m, IsNil)
+
 	m, err = VariableToMapper("rsom")
 	c.Assert(err, NotNil)
 	c.Assert(m, IsNil)
@@ -0,0 +1,331 @@
+package limit
+
+/*
+Limiter expressions use the go syntax, the same way failover predicates do.
+
+Token expressions map the request to the limiting token:
+
+* client.ip, request.host, request.method, request.path - request variables
+* request.header.X-Account, request.cookie.session, request.query.key - header, cookie and query parameter values
+* request.header("X-Account"), RequestHeader("X-Account"), RequestCookie("session"), QueryParam("key") - the same
+  with arbitrary names, e.g. the ones containing dots
+* PathParam("/users/<user>/messages", "user") - path segment captured by the parameter
+* "global" - constant token, e.g. to limit all requests together
+* client.ip + request.header.X-Account - composite token joining the values of the sub expressions
+
+Amount expressions map the request to the amount of tokens it consumes:
+
+* request.count - always 1
+* request.bytes - size of the request body
+* 10, request.bytes + 100, request.bytes * 2 - constants and arithmetic
+
+Predicates define which requests are exempt from limiting, they use the request predicates of the failover package:
+
+* ClientIpIn("10.0.0.0/8", "127.0.0.1") && !RequestHeaderEq("X-Limit", "always")
+*/
+
+import (
+	"fmt"
+	"go/ast"
+	"go/token"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/mailgun/vulcan/failover"
+	"github.com/mailgun/vulcan/request"
+)
+
+// Parses token expression, e.g. `client.ip + RequestHeader("X-Account")`
+func ParseTokenExpression(in string) (TokenMapperFn, error) {
+	p, expr, err := newExprParser(in)
+	if err != nil {
+		return nil, err
+	}
+	return p.parseToken(expr)
+}
+
+// Parses amount expression, e.g. `request.bytes`
+func ParseAmountExpression(in string) (AmountMapperFn, error) {
+	p, expr, err := newExprParser(in)
+	if err != nil {
+		return nil, err
+	}
+	return p.parseAmount(expr)
+}
+
+// Parses exemption predicate, e.g. `ClientIpIn("10.0.0.0/8") || RequestHeaderEq("X-Internal", "yes")`
+func ParsePredicate(in string) (failover.Predicate, error) {
+	p, expr, err := failover.NewExprParser(in)
+	if err != nil {
+		return nil, err
+	}
+	return p.ParsePredicate(expr, exemptFunctions, nil)
+}
+
+// Predicates that depend on the request only, as the exemptions are checked before the request is proxied
+var exemptFunctions = map[string]interface{}{
+	"ClientIpIn":      ClientIpIn,
+	"RequestHeaderEq": failover.RequestHeaderEq,
+	"RequestMethodEq": failover.RequestMethodEq,
+	"RequestHostEq":   failover.RequestHostEq,
+}
+
+// Parses token and amount expressions into the mapper, empty amount expression counts requests
+func ParseMapper(tokenExpr, amountExpr string) (MapperFn, error) {
+	t, err := ParseTokenExpression(tokenExpr)
+	if err != nil {
+		return nil, err
+	}
+	if amountExpr == "" {
+		return MakeMapper(t, RequestToCount), nil
+	}
+	a, err := ParseAmountExpression(amountExpr)
+	if err != nil {
+		return nil, err
+	}
+	return MakeMapper(t, a), nil
+}
+
+type exprParser struct {
+	*failover.ExprParser
+	// Original expression, the parsed one has masked names
+	in string
+}
+
+func newExprParser(in string) (*exprParser, ast.Expr, error) {
+	fp, expr, err := failover.NewExprParser(maskNames(in))
+	if err != nil {
+		return nil, nil, err
+	}
+	return &exprParser{ExprParser: fp, in: in}, expr, nil
+}
+
+// Header, cookie and query parameter names are not always valid identifiers, e.g. request.header.X-Account,
+// so the hyphens are masked for the go parser and the names are read from the original expression
+var namedVariable = regexp.MustCompile(`request\.(header|cookie|query)\.[A-Za-z0-9_\-]+`)
+
+func maskNames(in string) string {
+	out := []byte(in)
+	for _, m := range namedVariable.FindAllStringIndex(in, -1) {
+		if m[0] > 0 && isVariableChar(in[m[0]-1]) || inLiteral(in, m[0]) {
+			continue
+		}
+		for i := m[0]; i < m[1]; i++ {
+			if out[i] == '-' {
+				out[i] = '_'
+			}
+		}
+	}
+	return string(out)
+}
+
+func isVariableChar(c byte) bool {
+	return c == '.' || c == '_' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+// Returns true if the offset is inside the string literal
+func inLiteral(in string, offset int) bool {
+	var quote byte
+	for i := 0; i < offset; i++ {
+		switch {
+		case quote == 0 && (in[i] == '"' || in[i] == '`'):
+			quote = in[i]
+		case quote == '"' && in[i] == '\\':
+			i++
+		case quote != 0 && in[i] == quote:
+			quote = 0
+		}
+	}
+	return quote != 0
+}
+
+func (p *exprParser) parseToken(node ast.Expr) (TokenMapperFn, error) {
+	switch n := node.(type) {
+	case *ast.BinaryExpr:
+		if n.Op != token.ADD {
+			return nil, p.Errorf(n.OpPos, "unsupported operator: %s", n.Op)
+		}
+		x, err := p.parseToken(n.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := p.parseToken(n.Y)
+		if err != nil {
+			return nil, err
+		}
+		return MakeCompositeTokenMapper(x, y), nil
+	case *ast.SelectorExpr:
+		variable, err := p.getVariable(n)
+		if err != nil {
+			return nil, p.Errorf(n.Pos(), "%s", err)
+		}
+		m, err := MakeTokenMapperFromVariable(variable)
+		if err != nil {
+			return nil, p.Errorf(n.Pos(), "%s", err)
+		}
+		return m, nil
+	case *ast.BasicLit:
+		value, err := p.stringLiteral(n)
+		if err != nil {
+			return nil, err
+		}
+		return func(request.Request) (string, error) { return value, nil }, nil
+	case *ast.CallExpr:
+		name, args, err := p.parseCall(n)
+		if err != nil {
+			return nil, err
+		}
+		m, err := makeTokenMapper(name, args)
+		if err != nil {
+			return nil, p.Errorf(n.Fun.Pos(), "%s", err)
+		}
+		return m, nil
+	case *ast.ParenExpr:
+		return p.parseToken(n.X)
+	}
+	return nil, p.Errorf(node.Pos(), "unsupported %T", node)
+}
+
+func (p *exprParser) parseAmount(node ast.Expr) (AmountMapperFn, error) {
+	switch n := node.(type) {
+	case *ast.BinaryExpr:
+		if n.Op != token.ADD && n.Op != token.MUL {
+			return nil, p.Errorf(n.OpPos, "unsupported operator: %s", n.Op)
+		}
+		x, err := p.parseAmount(n.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := p.parseAmount(n.Y)
+		if err != nil {
+			return nil, err
+		}
+		return joinAmounts(n.Op, x, y), nil
+	case *ast.SelectorExpr:
+		variable, err := p.getVariable(n)
+		if err != nil {
+			return nil, p.Errorf(n.Pos(), "%s", err)
+		}
+		switch variable {
+		case "request.count":
+			return RequestToCount, nil
+		case "request.bytes":
+			return RequestToBytes, nil
+		}
+		return nil, p.Errorf(n.Pos(), "unsupported amount variable: %s", variable)
+	case *ast.BasicLit:
+		if n.Kind != token.INT {
+			return nil, p.Errorf(n.Pos(), "expected integer, got: %s", n.Value)
+		}
+		value, err := strconv.ParseInt(n.Value, 10, 64)
+		if err != nil {
+			return nil, p.Errorf(n.Pos(), "failed to parse amount: %s, error: %s", n.Value, err)
+		}
+		return func(request.Request) (int64, error) { return value, nil }, nil
+	case *ast.ParenExpr:
+		return p.parseAmount(n.X)
+	}
+	return nil, p.Errorf(node.Pos(), "unsupported %T", node)
+}
+
+// Returns function name and it's arguments, all the functions accept string literals only.
+// Function can be a variable as well, e.g. request.header("X-Account")
+func (p *exprParser) parseCall(call *ast.CallExpr) (string, []string, error) {
+	name, err := p.getVariable(call.Fun)
+	if err != nil {
+		return "", nil, p.Errorf(call.Fun.Pos(), "expected identifier, got: %T", call.Fun)
+	}
+	args := make([]string, len(call.Args))
+	for i, n := range call.Args {
+		l, ok := n.(*ast.BasicLit)
+		if !ok {
+			return "", nil, p.Errorf(n.Pos(), "expected literal, got %T", n)
+		}
+		value, err := p.stringLiteral(l)
+		if err != nil {
+			return "", nil, err
+		}
+		args[i] = value
+	}
+	return name, args, nil
+}
+
+func (p *exprParser) stringLiteral(l *ast.BasicLit) (string, error) {
+	if l.Kind != token.STRING {
+		return "", p.Errorf(l.Pos(), "expected string, got: %s", l.Value)
+	}
+	value, err := strconv.Unquote(l.Value)
+	if err != nil {
+		return "", p.Errorf(l.Pos(), "failed to parse argument: %s, error: %s", l.Value, err)
+	}
+	return value, nil
+}
+
+// Converts selector expression, e.g. request.header.Authorization into the variable name.
+// Names are read from the original expression, as the parsed one has masked hyphens
+func (p *exprParser) getVariable(node ast.Expr) (string, error) {
+	parts := []string{}
+	for {
+		switch n := node.(type) {
+		case *ast.SelectorExpr:
+			parts = append([]string{p.in[p.Offset(n.Sel.Pos()):p.Offset(n.Sel.End())]}, parts...)
+			node = n.X
+			continue
+		case *ast.Ident:
+			parts = append([]string{n.Name}, parts...)
+			return strings.Join(parts, "."), nil
+		}
+		return "", fmt.Errorf("expected variable, got: %T", node)
+	}
+}
+
+func makeTokenMapper(name string, args []string) (TokenMapperFn, error) {
+	switch name {
+	case "RequestHeader", "request.header":
+		if err := checkArguments(name, args, 1); err != nil {
+			return nil, err
+		}
+		return MakeRequestToHeader(args[0]), nil
+	case "RequestCookie", "request.cookie":
+		if err := checkArguments(name, args, 1); err != nil {
+			return nil, err
+		}
+		return MakeRequestToCookie(args[0]), nil
+	case "QueryParam", "request.query":
+		if err := checkArguments(name, args, 1); err != nil {
+			return nil, err
+		}
+		return MakeRequestToQueryParam(args[0]), nil
+	case "PathParam":
+		if err := checkArguments(name, args, 2); err != nil {
+			return nil, err
+		}
+		return MakeRequestToPathParam(args[0], args[1])
+	}
+	return nil, fmt.Errorf("unsupported method: %s", name)
+}
+
+func checkArguments(name string, args []string, count int) error {
+	if len(args) != count {
+		return fmt.Errorf("%s expects %d arguments, got %d", name, count, len(args))
+	}
+	return nil
+}
+
+func joinAmounts(op token.Token, a, b AmountMapperFn) AmountMapperFn {
+	return func(r request.Request) (int64, error) {
+		x, err := a(r)
+		if err != nil {
+			return -1, err
+		}
+		y, err := b(r)
+		if err != nil {
+			return -1, err
+		}
+		if op == token.MUL {
+			return x * y, nil
+		}
+		return x + y, nil
+	}
+}
@@ -0,0 +1,189 @@
+package limit
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/mailgun/vulcan/netutils"
+	"github.com/mailgun/vulcan/request"
+)
+
+type ParseSuite struct {
+}
+
+var _ = Suite(&ParseSuite{})
+
+func (s *ParseSuite) TestTokenVariables(c *C) {
+	r := makeHttpRequest("1.2.3.4:5678", "http://example.com/users/bob/messages?key=k1")
+	r.GetHttpRequest().Header.Set("X-Account", "acme")
+	r.GetHttpRequest().AddCookie(&http.Cookie{Name: "session", Value: "s1"})
+
+	tc := []struct {
+		Expr  string
+		Token string
+	}{
+		{Expr: `client.ip`, Token: "1.2.3.4"},
+		{Expr: `request.host`, Token: "example.com"},
+		{Expr: `request.method`, Token: "GET"},
+		{Expr: `request.path`, Token: "/users/bob/messages"},
+		{Expr: `request.header.X_Missing`, Token: ""},
+		{Expr: `RequestHeader("X-Account")`, Token: "acme"},
+		{Expr: `RequestCookie("session")`, Token: "s1"},
+		{Expr: `RequestCookie("missing")`, Token: ""},
+		{Expr: `QueryParam("key")`, Token: "k1"},
+		{Expr: `PathParam("/users/<user>/messages", "user")`, Token: "bob"},
+		{Expr: `PathParam("/accounts/<user>/messages", "user")`, Token: ""},
+		{Expr: `"global"`, Token: "global"},
+		{Expr: `client.ip + RequestHeader("X-Account")`, Token: "1.2.3.4|acme"},
+		{Expr: `(client.ip + request.method) + QueryParam("key")`, Token: "1.2.3.4|GET|k1"},
+		{Expr: `client.ip + request.header.X-Account`, Token: "1.2.3.4|acme"},
+		{Expr: `request.header("X-Account") + request.cookie.session + request.query.key`, Token: "acme|s1|k1"},
+		{Expr: `request.cookie("session") + request.query("key")`, Token: "s1|k1"},
+		{Expr: `request.header.X-Account + "request.header.X-Account"`, Token: "acme|request.header.X-Account"},
+	}
+	for i, t := range tc {
+		comment := Commentf("Case %d: %s", i, t.Expr)
+		m, err := ParseTokenExpression(t.Expr)
+		c.Assert(err, IsNil, comment)
+		token, err := m(r)
+		c.Assert(err, IsNil, comment)
+		c.Assert(token, Equals, t.Token, comment)
+	}
+}
+
+func (s *ParseSuite) TestAmounts(c *C) {
+	body, err := netutils.NewBodyBuffer(strings.NewReader("hello"))
+	c.Assert(err, IsNil)
+	r := request.NewBaseRequest(&http.Request{}, 1, body)
+
+	tc := []struct {
+		Expr   string
+		Amount int64
+	}{
+		{Expr: `request.count`, Amount: 1},
+		{Expr: `request.bytes`, Amount: 5},
+		{Expr: `10`, Amount: 10},
+		{Expr: `request.bytes + 100`, Amount: 105},
+		{Expr: `(request.bytes + 1) * 2`, Amount: 12},
+	}
+	for i, t := range tc {
+		comment := Commentf("Case %d: %s", i, t.Expr)
+		m, err := ParseAmountExpression(t.Expr)
+		c.Assert(err, IsNil, comment)
+		amount, err := m(r)
+		c.Assert(err, IsNil, comment)
+		c.Assert(amount, Equals, t.Amount, comment)
+	}
+}
+
+func (s *ParseSuite) TestMapper(c *C) {
+	m, err := ParseMapper(`client.ip`, ``)
+	c.Assert(err, IsNil)
+
+	token, amount, err := m(makeHttpRequest("1.2.3.4", "http://example.com"))
+	c.Assert(err, IsNil)
+	c.Assert(token, Equals, "1.2.3.4")
+	c.Assert(amount, Equals, int64(1))
+
+	m, err = ParseMapper(`client.ip`, `5`)
+	c.Assert(err, IsNil)
+
+	_, amount, err = m(makeHttpRequest("1.2.3.4", "http://example.com"))
+	c.Assert(err, IsNil)
+	c.Assert(amount, Equals, int64(5))
+}
+
+func (s *ParseSuite) TestPredicates(c *C) {
+	tc := []struct {
+		Expr    string
+		Request request.Request
+		Match   bool
+	}{
+		{Expr: `ClientIpIn("10.0.0.0/8")`, Request: makeHttpRequest("10.1.2.3:80", "http://a"), Match: true},
+		{Expr: `ClientIpIn("10.0.0.0/8")`, Request: makeHttpRequest("11.1.2.3:80", "http://a"), Match: false},
+		{Expr: `ClientIpIn("10.0.0.0/8", "127.0.0.1")`, Request: makeHttpRequest("127.0.0.1:80", "http://a"), Match: true},
+		{Expr: `ClientIpIn("127.0.0.1")`, Request: makeHttpRequest("127.0.0.2:80", "http://a"), Match: false},
+		{Expr: `ClientIpIn("10.0.0.0/8")`, Request: makeHttpRequest("garbage", "http://a"), Match: false},
+		{Expr: `RequestHostEq("a") && RequestMethodEq("GET")`, Request: makeHttpRequest("1.2.3.4", "http://a"), Match: true},
+		{Expr: `RequestHostEq("b") || !RequestMethodEq("POST")`, Request: makeHttpRequest("1.2.3.4", "http://a"), Match: true},
+		{Expr: `RequestHeaderEq("X-Internal", "yes")`, Request: makeHttpRequest("1.2.3.4", "http://a"), Match: false},
+	}
+	for i, t := range tc {
+		comment := Commentf("Case %d: %s", i, t.Expr)
+		p, err := ParsePredicate(t.Expr)
+		c.Assert(err, IsNil, comment)
+		c.Assert(p(t.Request), Equals, t.Match, comment)
+	}
+}
+
+func (s *ParseSuite) TestTokenErrors(c *C) {
+	tc := []struct {
+		Expr  string
+		Error string
+	}{
+		{Expr: `client.port`, Error: "column 1: Unsupported limiting variable: 'client.port'"},
+		{Expr: `client.ip - request.host`, Error: "column 11: unsupported operator: -"},
+		{Expr: `RequestHeader("a", "b")`, Error: "column 1: RequestHeader expects 1 arguments, got 2"},
+		{Expr: `RequestHeader(1)`, Error: "column 15: expected string, got: 1"},
+		{Expr: `RequestHeader(client.ip)`, Error: "column 15: expected literal, got \\*ast.SelectorExpr"},
+		{Expr: `Header("a")`, Error: "column 1: unsupported method: Header"},
+		{Expr: `PathParam("/users/<id>", "user")`, Error: "column 1: Parameter 'user' is not found .*"},
+		{Expr: `client`, Error: "column 1: unsupported \\*ast.Ident"},
+		{Expr: `client.ip +`, Error: ".*expected operand.*"},
+		{Expr: `request.header.X-Account - client.ip`, Error: "column 26: unsupported operator: -"},
+		{Expr: `request.header("a", "b")`, Error: "column 1: request.header expects 1 arguments, got 2"},
+	}
+	for i, t := range tc {
+		comment := Commentf("Case %d: %s", i, t.Expr)
+		m, err := ParseTokenExpression(t.Expr)
+		c.Assert(m, IsNil, comment)
+		c.Assert(err, ErrorMatches, t.Error, comment)
+	}
+}
+
+func (s *ParseSuite) TestAmountErrors(c *C) {
+	for _, expr := range []string{`request.size`, `"1"`, `request.bytes - 1`, `RequestHeader("a")`, `99999999999999999999`} {
+		m, err := ParseAmountExpression(expr)
+		c.Assert(m, IsNil, Commentf(expr))
+		c.Assert(err, NotNil, Commentf(expr))
+	}
+}
+
+func (s *ParseSuite) TestPredicateErrors(c *C) {
+	tc := []struct {
+		Expr  string
+		Error string
+	}{
+		{Expr: `ClientIpIn()`, Error: "column 1: Provide at least one network"},
+		{Expr: `ClientIpIn("10.0.0.0/33")`, Error: "column 1: Invalid network .*"},
+		{Expr: `ClientIpIn("localhost")`, Error: "column 1: Invalid ip address: 'localhost'"},
+		{Expr: `RequestMethodEq("GET") & RequestHostEq("a")`, Error: "column 24: unsupported operator: &"},
+		{Expr: `-RequestMethodEq("GET")`, Error: "column 1: unsupported operator: -"},
+		{Expr: `client.ip`, Error: "column 1: unsupported \\*ast.SelectorExpr"},
+	}
+	for i, t := range tc {
+		comment := Commentf("Case %d: %s", i, t.Expr)
+		p, err := ParsePredicate(t.Expr)
+		c.Assert(p, IsNil, comment)
+		c.Assert(err, ErrorMatches, t.Error, comment)
+	}
+}
+
+func makeHttpRequest(remoteAddr, u string) request.Request {
+	parsed, err := url.Parse(u)
+	if err != nil {
+		panic(err)
+	}
+	return &request.BaseRequest{
+		HttpRequest: &http.Request{
+			Method:     "GET",
+			RemoteAddr: remoteAddr,
+			Host:       parsed.Host,
+			URL:        parsed,
+			Header:     make(http.Header),
+		},
+	}
+}
@@ -0,0 +1,271 @@
+package limit
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mailgun/gotools-time"
+	"github.com/mailgun/vulcan/request"
+)
+
+var (
+	ErrQueueFull    = fmt.Errorf("Limiter queue is full")
+	ErrQueueTimeout = fmt.Errorf("Timed out waiting in limiter queue")
+	ErrClientGone   = fmt.Errorf("Client has disconnected while waiting in limiter queue")
+)
+
+// PriorityFn maps the request to the priority in the queue, requests with higher priority are served first
+type PriorityFn func(r request.Request) (int, error)
+
+// AcquireFn tries to acquire the limiter capacity. Returns true if the request can proceed,
+// otherwise returns time to wait before the next try, or 0 if the request should wait till Notify is called.
+type AcquireFn func() (bool, time.Duration, error)
+
+type QueueOptions struct {
+	// Maximum amount of requests waiting in the queue across all tokens
+	MaxDepth int
+	// Maximum time the request can spend in the queue
+	MaxWait time.Duration
+	// Defines the order of the requests with the same token, FIFO if not set
+	Priority     PriorityFn
+	TimeProvider timetools.TimeProvider
+}
+
+type QueueStats struct {
+	Depth     int           // Amount of requests waiting in the queue
+	Queued    int64         // Total amount of requests that have been queued
+	Served    int64         // Requests that have acquired the capacity after waiting in the queue
+	Rejected  int64         // Requests rejected because the queue was full
+	TimedOut  int64         // Requests that have reached the maximum wait time
+	Dropped   int64         // Requests dropped because the client has disconnected
+	TotalWait time.Duration // Total wait time of the served requests
+	MaxWait   time.Duration // Longest wait time of the served request
+}
+
+// Returns the average wait time of the served requests
+func (s QueueStats) AverageWait() time.Duration {
+	if s.Served == 0 {
+		return 0
+	}
+	return s.TotalWait / time.Duration(s.Served)
+}
+
+// Queue keeps requests that are over the limit waiting for the limiter capacity.
+// Requests with the same token are served one by one in FIFO or priority order,
+// only the request in the head of the token's line tries to acquire the capacity.
+type Queue struct {
+	mutex   *sync.Mutex
+	options QueueOptions
+	lines   map[string]*line
+	depth   int
+	seq     uint64
+	stats   QueueStats
+}
+
+func NewQueue(o QueueOptions) (*Queue, error) {
+	if o.MaxDepth <= 0 {
+		return nil, fmt.Errorf("Queue depth should be > 0, got: %d", o.MaxDepth)
+	}
+	if o.MaxWait <= 0 {
+		o.MaxWait = DefaultQueueMaxWait
+	}
+	if o.TimeProvider == nil {
+		o.TimeProvider = &timetools.RealTime{}
+	}
+	return &Queue{
+		mutex:   &sync.Mutex{},
+		options: o,
+		lines:   make(map[string]*line),
+	}, nil
+}
+
+const DefaultQueueMaxWait = 10 * time.Second
+
+func (q *Queue) GetOptions() QueueOptions {
+	return q.options
+}
+
+func (q *Queue) GetStats() QueueStats {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	stats := q.stats
+	stats.Depth = q.depth
+	return stats
+}
+
+// Acquire tries to acquire the capacity right away, in case of failure puts the request in the queue
+// and waits for its turn. Returns nil if the request can proceed, ErrQueueFull, ErrQueueTimeout
+// or ErrClientGone if the request has been rejected.
+func (q *Queue) Acquire(r request.Request, token string, acquire AcquireFn) error {
+	// Requests should not pass the requests that are already waiting
+	if !q.hasWaiters(token) {
+		ok, _, err := acquire()
+		if err != nil || ok {
+			return err
+		}
+	}
+
+	priority := 0
+	if q.options.Priority != nil {
+		p, err := q.options.Priority(r)
+		if err != nil {
+			return err
+		}
+		priority = p
+	}
+	w, err := q.push(token, priority)
+	if err != nil {
+		return err
+	}
+
+	start := q.options.TimeProvider.UtcNow()
+	deadline := q.options.TimeProvider.After(q.options.MaxWait)
+	var retry <-chan time.Time
+	for {
+		select {
+		case <-w.ready:
+		case <-retry:
+		case <-deadline:
+			q.remove(w, func(s *QueueStats) { s.TimedOut += 1 })
+			return ErrQueueTimeout
+		case <-r.GetHttpRequest().Context().Done():
+			q.remove(w, func(s *QueueStats) { s.Dropped += 1 })
+			return ErrClientGone
+		}
+		retry = nil
+		ok, delay, err := acquire()
+		if err != nil {
+			q.remove(w, nil)
+			return err
+		}
+		if ok {
+			wait := q.options.TimeProvider.UtcNow().Sub(start)
+			q.remove(w, func(s *QueueStats) {
+				s.Served += 1
+				s.TotalWait += wait
+				if wait > s.MaxWait {
+					s.MaxWait = wait
+				}
+			})
+			return nil
+		}
+		if delay > 0 {
+			retry = q.options.TimeProvider.After(delay)
+		}
+	}
+}
+
+// Notify wakes up the request in the head of the token's line, limiters call it once the capacity is released
+func (q *Queue) Notify(token string) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if l, ok := q.lines[token]; ok {
+		l.waiters[0].wake()
+	}
+}
+
+// NotifyAll wakes up the requests in the heads of all the lines, limiters call it once the limit grows
+func (q *Queue) NotifyAll() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	for _, l := range q.lines {
+		l.waiters[0].wake()
+	}
+}
+
+func (q *Queue) hasWaiters(token string) bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	_, ok := q.lines[token]
+	return ok
+}
+
+func (q *Queue) push(token string, priority int) (*waiter, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if q.depth >= q.options.MaxDepth {
+		q.stats.Rejected += 1
+		return nil, ErrQueueFull
+	}
+	q.seq += 1
+	w := &waiter{token: token, priority: priority, seq: q.seq, ready: make(chan struct{}, 1)}
+	l, ok := q.lines[token]
+	if !ok {
+		l = &line{}
+		q.lines[token] = l
+	}
+	head := l.head()
+	l.insert(w)
+	// New head of the line should try to acquire the capacity
+	if l.head() != head {
+		w.wake()
+	}
+	q.depth += 1
+	q.stats.Queued += 1
+	return w, nil
+}
+
+func (q *Queue) remove(w *waiter, update func(*QueueStats)) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if update != nil {
+		update(&q.stats)
+	}
+	q.depth -= 1
+	l := q.lines[w.token]
+	l.remove(w)
+	if len(l.waiters) == 0 {
+		delete(q.lines, w.token)
+		return
+	}
+	// Let the next request in line try
+	l.head().wake()
+}
+
+type waiter struct {
+	token    string
+	priority int
+	seq      uint64
+	ready    chan struct{}
+}
+
+func (w *waiter) wake() {
+	select {
+	case w.ready <- struct{}{}:
+	default:
+	}
+}
+
+// Requests waiting for the same token ordered by priority and arrival
+type line struct {
+	waiters []*waiter
+}
+
+func (l *line) head() *waiter {
+	if len(l.waiters) == 0 {
+		return nil
+	}
+	return l.waiters[0]
+}
+
+func (l *line) insert(w *waiter) {
+	i := sort.Search(len(l.waiters), func(i int) bool {
+		return l.waiters[i].priority < w.priority
+	})
+	l.waiters = append(l.waiters, nil)
+	copy(l.waiters[i+1:], l.waiters[i:])
+	l.waiters[i] = w
+}
+
+func (l *line) remove(w *waiter) {
+	for i, v := range l.waiters {
+		if v == w {
+			l.waiters = append(l.waiters[:i], l.waiters[i+1:]...)
+			return
+		}
+	}
+}
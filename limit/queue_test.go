@@ -0,0 +1,200 @@
+package limit
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/mailgun/vulcan/request"
+	. "gopkg.in/check.v1"
+)
+
+type QueueSuite struct {
+}
+
+var _ = Suite(&QueueSuite{})
+
+// Capacity shared by the requests in tests
+type slots struct {
+	mutex *sync.Mutex
+	free  int
+}
+
+func (s *slots) acquire() (bool, time.Duration, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.free == 0 {
+		return false, 0, nil
+	}
+	s.free -= 1
+	return true, 0, nil
+}
+
+func (s *slots) release(q *Queue, token string) {
+	s.mutex.Lock()
+	s.free += 1
+	s.mutex.Unlock()
+	q.Notify(token)
+}
+
+func (s *QueueSuite) TestAcquireRightAway(c *C) {
+	q, err := NewQueue(QueueOptions{MaxDepth: 1})
+	c.Assert(err, IsNil)
+
+	sl := &slots{mutex: &sync.Mutex{}, free: 1}
+	c.Assert(q.Acquire(makeRequest(), "a", sl.acquire), IsNil)
+	c.Assert(q.GetStats(), DeepEquals, QueueStats{})
+}
+
+func (s *QueueSuite) TestWaitForNotify(c *C) {
+	q, err := NewQueue(QueueOptions{MaxDepth: 10})
+	c.Assert(err, IsNil)
+
+	sl := &slots{mutex: &sync.Mutex{}}
+	done := make(chan error, 1)
+	go func() {
+		done <- q.Acquire(makeRequest(), "a", sl.acquire)
+	}()
+	waitForDepth(c, q, 1)
+
+	sl.release(q, "a")
+	c.Assert(<-done, IsNil)
+
+	stats := q.GetStats()
+	c.Assert(stats.Depth, Equals, 0)
+	c.Assert(stats.Queued, Equals, int64(1))
+	c.Assert(stats.Served, Equals, int64(1))
+}
+
+func (s *QueueSuite) TestRetryAfterDelay(c *C) {
+	q, err := NewQueue(QueueOptions{MaxDepth: 10})
+	c.Assert(err, IsNil)
+
+	tries := 0
+	err = q.Acquire(makeRequest(), "a", func() (bool, time.Duration, error) {
+		tries += 1
+		return tries == 3, time.Millisecond, nil
+	})
+	c.Assert(err, IsNil)
+	c.Assert(tries, Equals, 3)
+}
+
+func (s *QueueSuite) TestFifo(c *C) {
+	q, err := NewQueue(QueueOptions{MaxDepth: 10})
+	c.Assert(err, IsNil)
+	s.checkOrder(c, q, []int{0, 0, 0}, []int{0, 1, 2})
+}
+
+func (s *QueueSuite) TestPriority(c *C) {
+	q, err := NewQueue(QueueOptions{
+		MaxDepth: 10,
+		Priority: func(r request.Request) (int, error) {
+			return len(r.GetHttpRequest().Header.Get("Priority")), nil
+		},
+	})
+	c.Assert(err, IsNil)
+	s.checkOrder(c, q, []int{1, 3, 2, 3}, []int{1, 3, 2, 0})
+}
+
+// Queues requests with given priorities one by one and checks the order they are served
+func (s *QueueSuite) checkOrder(c *C, q *Queue, priorities []int, expected []int) {
+	sl := &slots{mutex: &sync.Mutex{}}
+	served := make(chan int, len(priorities))
+	for i, p := range priorities {
+		r := makeRequest()
+		r.HttpRequest.Header.Set("Priority", string(make([]byte, p)))
+		go func(i int) {
+			c.Assert(q.Acquire(r, "a", sl.acquire), IsNil)
+			served <- i
+		}(i)
+		waitForDepth(c, q, i+1)
+	}
+	for _, e := range expected {
+		sl.release(q, "a")
+		c.Assert(<-served, Equals, e)
+	}
+}
+
+func (s *QueueSuite) TestTokensAreIndependent(c *C) {
+	q, err := NewQueue(QueueOptions{MaxDepth: 10})
+	c.Assert(err, IsNil)
+
+	blocked := &slots{mutex: &sync.Mutex{}}
+	go q.Acquire(makeRequest(), "a", blocked.acquire)
+	waitForDepth(c, q, 1)
+
+	free := &slots{mutex: &sync.Mutex{}, free: 1}
+	c.Assert(q.Acquire(makeRequest(), "b", free.acquire), IsNil)
+}
+
+func (s *QueueSuite) TestQueueFull(c *C) {
+	q, err := NewQueue(QueueOptions{MaxDepth: 1})
+	c.Assert(err, IsNil)
+
+	sl := &slots{mutex: &sync.Mutex{}}
+	done := make(chan error, 1)
+	go func() {
+		done <- q.Acquire(makeRequest(), "a", sl.acquire)
+	}()
+	waitForDepth(c, q, 1)
+
+	c.Assert(q.Acquire(makeRequest(), "b", sl.acquire), Equals, ErrQueueFull)
+	c.Assert(q.GetStats().Rejected, Equals, int64(1))
+
+	sl.release(q, "a")
+	c.Assert(<-done, IsNil)
+}
+
+func (s *QueueSuite) TestTimeout(c *C) {
+	q, err := NewQueue(QueueOptions{MaxDepth: 1, MaxWait: time.Millisecond})
+	c.Assert(err, IsNil)
+
+	sl := &slots{mutex: &sync.Mutex{}}
+	c.Assert(q.Acquire(makeRequest(), "a", sl.acquire), Equals, ErrQueueTimeout)
+
+	stats := q.GetStats()
+	c.Assert(stats.Depth, Equals, 0)
+	c.Assert(stats.TimedOut, Equals, int64(1))
+}
+
+func (s *QueueSuite) TestClientGone(c *C) {
+	q, err := NewQueue(QueueOptions{MaxDepth: 1})
+	c.Assert(err, IsNil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r := makeRequest()
+	r.HttpRequest = r.HttpRequest.WithContext(ctx)
+
+	sl := &slots{mutex: &sync.Mutex{}}
+	done := make(chan error, 1)
+	go func() {
+		done <- q.Acquire(r, "a", sl.acquire)
+	}()
+	waitForDepth(c, q, 1)
+
+	cancel()
+	c.Assert(<-done, Equals, ErrClientGone)
+	c.Assert(q.GetStats().Dropped, Equals, int64(1))
+}
+
+func (s *QueueSuite) TestInvalidParams(c *C) {
+	_, err := NewQueue(QueueOptions{})
+	c.Assert(err, NotNil)
+}
+
+func waitForDepth(c *C, q *Queue, depth int) {
+	for i := 0; i < 1000; i++ {
+		if q.GetStats().Depth == depth {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	c.Fatalf("Queue depth has not reached %d", depth)
+}
+
+func makeRequest() *request.BaseRequest {
+	return &request.BaseRequest{
+		HttpRequest: &http.Request{Header: make(http.Header)},
+	}
+}
@@ -0,0 +1,164 @@
+// Priority based load shedding
+package shedding
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mailgun/vulcan/errors"
+	"github.com/mailgun/vulcan/headers"
+	"github.com/mailgun/vulcan/limit"
+	"github.com/mailgun/vulcan/middleware"
+	"github.com/mailgun/vulcan/netutils"
+	"github.com/mailgun/vulcan/request"
+)
+
+// PriorityMapperFn maps the request to the priority class, 0 is the lowest priority
+type PriorityMapperFn func(r request.Request) (int, error)
+
+// Creates priority mapper from the token mapper, e.g. header, path or API key tier mapper.
+// Tokens missing in the priorities map are mapped to the default priority.
+func MakePriorityMapper(mapper limit.TokenMapperFn, priorities map[string]int, defaultPriority int) PriorityMapperFn {
+	return func(r request.Request) (int, error) {
+		token, err := mapper(r)
+		if err != nil {
+			return -1, err
+		}
+		if p, ok := priorities[token]; ok {
+			return p, nil
+		}
+		return defaultPriority, nil
+	}
+}
+
+type Options struct {
+	// Value of the Retry-After header of the rejected requests, defaults to 1 second
+	RetryAfter time.Duration
+	// Formats the body of the rejected requests, defaults to JSON formatter
+	ErrorFormatter errors.Formatter
+}
+
+// LoadShedder rejects the requests of the lowest priority classes when the location is overloaded.
+// The share of the shed classes follows the overload level reported by the signal: e.g. with 4 classes
+// level 0.1 sheds class 0, level 0.5 sheds classes 0 and 1 and level 1 sheds all the requests.
+// Shed requests are rejected with 503 Service Unavailable.
+type LoadShedder struct {
+	mutex      *sync.Mutex
+	mapper     PriorityMapperFn
+	priorities int
+	signal     Signal
+	options    Options
+	shed       []int64
+}
+
+func NewLoadShedder(mapper PriorityMapperFn, priorities int, signal Signal) (*LoadShedder, error) {
+	return NewLoadShedderWithOptions(mapper, priorities, signal, Options{})
+}
+
+func NewLoadShedderWithOptions(mapper PriorityMapperFn, priorities int, signal Signal, o Options) (*LoadShedder, error) {
+	if mapper == nil {
+		return nil, fmt.Errorf("Provide mapper function")
+	}
+	if priorities <= 0 {
+		return nil, fmt.Errorf("Priorities should be > 0, got: %d", priorities)
+	}
+	if signal == nil {
+		return nil, fmt.Errorf("Provide overload signal")
+	}
+	return &LoadShedder{
+		mutex:      &sync.Mutex{},
+		mapper:     mapper,
+		priorities: priorities,
+		signal:     signal,
+		options:    parseOptions(o),
+		shed:       make([]int64, priorities),
+	}, nil
+}
+
+func (l *LoadShedder) GetOptions() Options {
+	return l.options
+}
+
+// Returns the current overload level
+func (l *LoadShedder) GetLevel() float64 {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.signal.GetLevel()
+}
+
+// Returns the amount of shed requests per priority class
+func (l *LoadShedder) GetShedCounts() []int64 {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	out := make([]int64, len(l.shed))
+	copy(out, l.shed)
+	return out
+}
+
+func (l *LoadShedder) ProcessRequest(r request.Request) (*http.Response, error) {
+	priority, err := l.mapper(r)
+	if err != nil {
+		return nil, err
+	}
+	if priority < 0 || priority >= l.priorities {
+		return nil, fmt.Errorf("Priority %d is out of range [0, %d]", priority, l.priorities-1)
+	}
+	if !l.admit(r, priority) {
+		return l.reject(r), nil
+	}
+	limit.Admit(r, l, true)
+	return nil, nil
+}
+
+func (l *LoadShedder) ProcessResponse(r request.Request, a request.Attempt) {
+	if _, ok := limit.TakeAdmission(r, l); !ok {
+		return
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if o, ok := l.signal.(middleware.Observer); ok {
+		o.ObserveResponse(r, a)
+	}
+}
+
+func (l *LoadShedder) String() string {
+	return fmt.Sprintf("LoadShedder(priorities=%d, signal=%v)", l.priorities, l.signal)
+}
+
+func (l *LoadShedder) admit(r request.Request, priority int) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	shedClasses := int(math.Ceil(l.signal.GetLevel() * float64(l.priorities)))
+	if priority < shedClasses {
+		l.shed[priority] += 1
+		return false
+	}
+	if o, ok := l.signal.(middleware.Observer); ok {
+		o.ObserveRequest(r)
+	}
+	return true
+}
+
+func (l *LoadShedder) reject(r request.Request) *http.Response {
+	re := netutils.NewErrorResponse(r.GetHttpRequest(), l.options.ErrorFormatter, errors.FromStatus(http.StatusServiceUnavailable))
+	re.Header.Set(headers.RetryAfter, strconv.FormatInt(int64(math.Ceil(l.options.RetryAfter.Seconds())), 10))
+	return re
+}
+
+const DefaultRetryAfter = time.Second
+
+func parseOptions(o Options) Options {
+	if o.RetryAfter <= 0 {
+		o.RetryAfter = DefaultRetryAfter
+	}
+	if o.ErrorFormatter == nil {
+		o.ErrorFormatter = &errors.JsonFormatter{}
+	}
+	return o
+}
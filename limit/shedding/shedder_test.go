@@ -0,0 +1,160 @@
+package shedding
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/mailgun/vulcan/errors"
+	"github.com/mailgun/vulcan/limit"
+	"github.com/mailgun/vulcan/request"
+)
+
+func TestShedding(t *testing.T) { TestingT(t) }
+
+type ShedderSuite struct {
+}
+
+var _ = Suite(&ShedderSuite{})
+
+// Signal with the fixed level
+type testSignal struct {
+	level float64
+}
+
+func (s *testSignal) GetLevel() float64 {
+	return s.level
+}
+
+var tiers = MakePriorityMapper(limit.MakeRequestToHeader("X-Tier"), map[string]int{"free": 0, "basic": 1, "pro": 2, "internal": 3}, 0)
+
+func makeRequest(tier string) request.Request {
+	r := request.NewBaseRequest(&http.Request{Header: make(http.Header)}, 1, nil)
+	r.GetHttpRequest().Header.Set("X-Tier", tier)
+	return r
+}
+
+func (s *ShedderSuite) admitted(c *C, l *LoadShedder, tier string) bool {
+	re, err := l.ProcessRequest(makeRequest(tier))
+	c.Assert(err, IsNil)
+	return re == nil
+}
+
+func (s *ShedderSuite) TestLowestPriorityShedFirst(c *C) {
+	signal := &testSignal{}
+	l, err := NewLoadShedder(tiers, 4, signal)
+	c.Assert(err, IsNil)
+
+	tc := []struct {
+		Level    float64
+		Admitted []bool
+	}{
+		{Level: 0, Admitted: []bool{true, true, true, true}},
+		{Level: 0.1, Admitted: []bool{false, true, true, true}},
+		{Level: 0.5, Admitted: []bool{false, false, true, true}},
+		{Level: 0.75, Admitted: []bool{false, false, false, true}},
+		{Level: 1, Admitted: []bool{false, false, false, false}},
+	}
+	for _, t := range tc {
+		signal.level = t.Level
+		for i, tier := range []string{"free", "basic", "pro", "internal"} {
+			c.Assert(s.admitted(c, l, tier), Equals, t.Admitted[i], Commentf("Level %f, tier %s", t.Level, tier))
+		}
+	}
+	c.Assert(l.GetShedCounts(), DeepEquals, []int64{4, 3, 2, 1})
+
+	// Unknown tiers get the lowest priority
+	signal.level = 0.1
+	c.Assert(s.admitted(c, l, "other"), Equals, false)
+}
+
+func (s *ShedderSuite) TestRejectedResponse(c *C) {
+	l, err := NewLoadShedderWithOptions(tiers, 4, &testSignal{level: 1}, Options{RetryAfter: 1500 * time.Millisecond})
+	c.Assert(err, IsNil)
+
+	re, err := l.ProcessRequest(makeRequest("pro"))
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusServiceUnavailable)
+	c.Assert(re.Header.Get("Retry-After"), Equals, "2")
+	body, err := ioutil.ReadAll(re.Body)
+	c.Assert(err, IsNil)
+	c.Assert(string(body), Equals, `{"error":"Service Unavailable"}`)
+}
+
+type textFormatter struct {
+}
+
+func (f *textFormatter) Format(err errors.ProxyError) (int, []byte, string) {
+	return err.GetStatusCode(), []byte(err.Error()), "text/plain"
+}
+
+func (s *ShedderSuite) TestCustomFormatter(c *C) {
+	l, err := NewLoadShedderWithOptions(tiers, 4, &testSignal{level: 1}, Options{ErrorFormatter: &textFormatter{}})
+	c.Assert(err, IsNil)
+
+	re, err := l.ProcessRequest(makeRequest("pro"))
+	c.Assert(err, IsNil)
+	c.Assert(re.Header.Get("Content-Type"), Equals, "text/plain")
+	c.Assert(re.Header.Get("Retry-After"), Equals, "1")
+}
+
+// Signals observe the admitted requests only
+func (s *ShedderSuite) TestInFlightSignal(c *C) {
+	signal, err := NewInFlightSignal(2, 4)
+	c.Assert(err, IsNil)
+	l, err := NewLoadShedder(tiers, 2, signal)
+	c.Assert(err, IsNil)
+
+	requests := []request.Request{}
+	for i := 0; i < 3; i++ {
+		r := makeRequest("basic")
+		re, err := l.ProcessRequest(r)
+		c.Assert(err, IsNil)
+		c.Assert(re, IsNil)
+		requests = append(requests, r)
+	}
+	c.Assert(l.GetLevel(), Equals, 0.5)
+
+	// Free tier is shed, the rejected request does not change the amount of requests in flight
+	r := makeRequest("free")
+	re, err := l.ProcessRequest(r)
+	c.Assert(err, IsNil)
+	c.Assert(re, NotNil)
+	l.ProcessResponse(r, &request.BaseAttempt{Response: re})
+	c.Assert(signal.GetInFlight(), Equals, int64(3))
+
+	for _, r := range requests {
+		l.ProcessResponse(r, &request.BaseAttempt{Response: &http.Response{StatusCode: http.StatusOK}})
+	}
+	c.Assert(signal.GetInFlight(), Equals, int64(0))
+	c.Assert(s.admitted(c, l, "free"), Equals, true)
+}
+
+func (s *ShedderSuite) TestMapperErrors(c *C) {
+	failing := func(r request.Request) (int, error) { return -1, fmt.Errorf("oops") }
+	l, err := NewLoadShedder(failing, 2, &testSignal{})
+	c.Assert(err, IsNil)
+	_, err = l.ProcessRequest(makeRequest("free"))
+	c.Assert(err, NotNil)
+
+	outOfRange := func(r request.Request) (int, error) { return 2, nil }
+	l, err = NewLoadShedder(outOfRange, 2, &testSignal{})
+	c.Assert(err, IsNil)
+	_, err = l.ProcessRequest(makeRequest("free"))
+	c.Assert(err, NotNil)
+}
+
+func (s *ShedderSuite) TestInvalidParams(c *C) {
+	_, err := NewLoadShedder(nil, 2, &testSignal{})
+	c.Assert(err, NotNil)
+
+	_, err = NewLoadShedder(tiers, 0, &testSignal{})
+	c.Assert(err, NotNil)
+
+	_, err = NewLoadShedder(tiers, 2, nil)
+	c.Assert(err, NotNil)
+}
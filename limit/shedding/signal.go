@@ -0,0 +1,201 @@
+package shedding
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/mailgun/gotools-time"
+
+	"github.com/mailgun/vulcan/limit"
+	"github.com/mailgun/vulcan/metrics"
+	"github.com/mailgun/vulcan/middleware"
+	"github.com/mailgun/vulcan/request"
+)
+
+// Signal measures the overload of the location. Signals implementing middleware.Observer
+// are notified about the requests admitted by the shedder. Shedder serializes the calls to the signal.
+type Signal interface {
+	// Returns the overload level in range [0, 1], 0 means that location is healthy,
+	// 1 means that location is overloaded so much that all the requests should be shed
+	GetLevel() float64
+}
+
+// Returns the level of the value growing linearly from 0 at low to 1 at high
+func linearLevel(value, low, high float64) float64 {
+	if value <= low {
+		return 0
+	}
+	if value >= high {
+		return 1
+	}
+	return (value - low) / (high - low)
+}
+
+// InFlightSignal measures the overload by the amount of admitted requests in flight
+type InFlightSignal struct {
+	low      int64
+	high     int64
+	inFlight int64
+}
+
+// Overload starts once more than low requests are in flight and reaches the maximum at high requests
+func NewInFlightSignal(low, high int64) (*InFlightSignal, error) {
+	if low < 0 || high <= low {
+		return nil, fmt.Errorf("Expected 0 <= low < high, got low=%d, high=%d", low, high)
+	}
+	return &InFlightSignal{low: low, high: high}, nil
+}
+
+func (s *InFlightSignal) GetInFlight() int64 {
+	return atomic.LoadInt64(&s.inFlight)
+}
+
+func (s *InFlightSignal) GetLevel() float64 {
+	return linearLevel(float64(s.GetInFlight()), float64(s.low), float64(s.high))
+}
+
+func (s *InFlightSignal) ObserveRequest(r request.Request) {
+	atomic.AddInt64(&s.inFlight, 1)
+}
+
+func (s *InFlightSignal) ObserveResponse(r request.Request, a request.Attempt) {
+	atomic.AddInt64(&s.inFlight, -1)
+}
+
+func (s *InFlightSignal) String() string {
+	return fmt.Sprintf("InFlightSignal(low=%d, high=%d)", s.low, s.high)
+}
+
+// QueueLatencySignal measures the overload by the average time the requests have waited
+// in the limiter's queue during the last interval. Requests timing out in the queue mean the maximum overload.
+type QueueLatencySignal struct {
+	stats        func() limit.QueueStats
+	low          time.Duration
+	high         time.Duration
+	interval     time.Duration
+	timeProvider timetools.TimeProvider
+
+	lastCheck time.Time
+	last      limit.QueueStats
+	level     float64
+}
+
+// Stats function returns the stats of the queue, e.g. connection limiter's GetQueueStats
+func NewQueueLatencySignal(stats func() limit.QueueStats, low, high, interval time.Duration, timeProvider timetools.TimeProvider) (*QueueLatencySignal, error) {
+	if stats == nil {
+		return nil, fmt.Errorf("Provide queue stats function")
+	}
+	if low < 0 || high <= low {
+		return nil, fmt.Errorf("Expected 0 <= low < high, got low=%s, high=%s", low, high)
+	}
+	if interval <= 0 {
+		return nil, fmt.Errorf("Interval should be > 0, got: %s", interval)
+	}
+	if timeProvider == nil {
+		timeProvider = &timetools.RealTime{}
+	}
+	return &QueueLatencySignal{
+		stats:        stats,
+		low:          low,
+		high:         high,
+		interval:     interval,
+		timeProvider: timeProvider,
+		lastCheck:    timeProvider.UtcNow(),
+		last:         stats(),
+	}, nil
+}
+
+// Level is recalculated once per interval
+func (s *QueueLatencySignal) GetLevel() float64 {
+	now := s.timeProvider.UtcNow()
+	if now.Sub(s.lastCheck) < s.interval {
+		return s.level
+	}
+	current := s.stats()
+	served := current.Served - s.last.Served
+	switch {
+	case current.TimedOut > s.last.TimedOut:
+		s.level = 1
+	case served > 0:
+		wait := (current.TotalWait - s.last.TotalWait) / time.Duration(served)
+		s.level = linearLevel(float64(wait), float64(s.low), float64(s.high))
+	default:
+		s.level = 0
+	}
+	s.lastCheck = now
+	s.last = current
+	return s.level
+}
+
+func (s *QueueLatencySignal) String() string {
+	return fmt.Sprintf("QueueLatencySignal(low=%s, high=%s)", s.low, s.high)
+}
+
+// FailRateSignal measures the overload by the fail rate of the location
+type FailRateSignal struct {
+	meter metrics.FailRateMeter
+	low   float64
+	high  float64
+}
+
+// Overload starts once the fail rate is over low and reaches the maximum at high. Meter observes
+// the requests admitted by the shedder, e.g. meter created by metrics.NewLocationRollingMeter.
+func NewFailRateSignal(meter metrics.FailRateMeter, low, high float64) (*FailRateSignal, error) {
+	if meter == nil {
+		return nil, fmt.Errorf("Provide fail rate meter")
+	}
+	if low < 0 || high <= low || high > 1 {
+		return nil, fmt.Errorf("Expected 0 <= low < high <= 1, got low=%f, high=%f", low, high)
+	}
+	return &FailRateSignal{meter: meter, low: low, high: high}, nil
+}
+
+// Location is considered healthy while the meter has not collected enough data
+func (s *FailRateSignal) GetLevel() float64 {
+	if !s.meter.IsReady() {
+		return 0
+	}
+	return linearLevel(s.meter.GetRate(), s.low, s.high)
+}
+
+func (s *FailRateSignal) ObserveRequest(r request.Request) {
+	s.meter.ObserveRequest(r)
+}
+
+func (s *FailRateSignal) ObserveResponse(r request.Request, a request.Attempt) {
+	s.meter.ObserveResponse(r, a)
+}
+
+func (s *FailRateSignal) String() string {
+	return fmt.Sprintf("FailRateSignal(low=%f, high=%f)", s.low, s.high)
+}
+
+// MaxSignal combines signals, the overload level is the maximum level of the signals
+type MaxSignal []Signal
+
+func (m MaxSignal) GetLevel() float64 {
+	level := 0.0
+	for _, s := range m {
+		if l := s.GetLevel(); l > level {
+			level = l
+		}
+	}
+	return level
+}
+
+func (m MaxSignal) ObserveRequest(r request.Request) {
+	for _, s := range m {
+		if o, ok := s.(middleware.Observer); ok {
+			o.ObserveRequest(r)
+		}
+	}
+}
+
+func (m MaxSignal) ObserveResponse(r request.Request, a request.Attempt) {
+	for _, s := range m {
+		if o, ok := s.(middleware.Observer); ok {
+			o.ObserveResponse(r, a)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package shedding
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/mailgun/gotools-time"
+	. "gopkg.in/check.v1"
+
+	"github.com/mailgun/vulcan/endpoint"
+	"github.com/mailgun/vulcan/limit"
+	"github.com/mailgun/vulcan/metrics"
+	"github.com/mailgun/vulcan/request"
+)
+
+type SignalSuite struct {
+	tm *timetools.FreezedTime
+}
+
+var _ = Suite(&SignalSuite{})
+
+func (s *SignalSuite) SetUpTest(c *C) {
+	s.tm = &timetools.FreezedTime{
+		CurrentTime: time.Date(2012, 3, 4, 5, 6, 7, 0, time.UTC),
+	}
+}
+
+func (s *SignalSuite) TestInFlight(c *C) {
+	signal, err := NewInFlightSignal(1, 3)
+	c.Assert(err, IsNil)
+
+	levels := []float64{0, 0.5, 1, 1}
+	for _, level := range levels {
+		signal.ObserveRequest(nil)
+		c.Assert(signal.GetLevel(), Equals, level)
+	}
+	signal.ObserveResponse(nil, nil)
+	c.Assert(signal.GetLevel(), Equals, 1.0)
+
+	_, err = NewInFlightSignal(2, 2)
+	c.Assert(err, NotNil)
+}
+
+func (s *SignalSuite) TestQueueLatency(c *C) {
+	stats := limit.QueueStats{}
+	signal, err := NewQueueLatencySignal(func() limit.QueueStats { return stats }, 100*time.Millisecond, 300*time.Millisecond, time.Second, s.tm)
+	c.Assert(err, IsNil)
+
+	// Level is updated once per interval
+	stats.Served, stats.TotalWait = 2, 400*time.Millisecond
+	c.Assert(signal.GetLevel(), Equals, 0.0)
+	s.tm.CurrentTime = s.tm.CurrentTime.Add(time.Second)
+	c.Assert(signal.GetLevel(), Equals, 0.5)
+
+	// Only the wait of the requests served during the interval counts
+	stats.Served, stats.TotalWait = 3, 500*time.Millisecond
+	s.tm.CurrentTime = s.tm.CurrentTime.Add(time.Second)
+	c.Assert(signal.GetLevel(), Equals, 0.0)
+
+	// Timeouts mean the maximum overload
+	stats.TimedOut = 1
+	s.tm.CurrentTime = s.tm.CurrentTime.Add(time.Second)
+	c.Assert(signal.GetLevel(), Equals, 1.0)
+
+	// Idle queue is healthy
+	s.tm.CurrentTime = s.tm.CurrentTime.Add(time.Second)
+	c.Assert(signal.GetLevel(), Equals, 0.0)
+
+	_, err = NewQueueLatencySignal(nil, 0, time.Second, time.Second, s.tm)
+	c.Assert(err, NotNil)
+}
+
+func (s *SignalSuite) TestFailRate(c *C) {
+	meter, err := metrics.NewLocationRollingMeter(1, time.Second, s.tm, nil)
+	c.Assert(err, IsNil)
+	signal, err := NewFailRateSignal(meter, 0.2, 0.6)
+	c.Assert(err, IsNil)
+
+	// Meter is not ready
+	c.Assert(signal.GetLevel(), Equals, 0.0)
+
+	e := endpoint.MustParseUrl("http://localhost:5000")
+	ok := &request.BaseAttempt{Endpoint: e, Response: &http.Response{StatusCode: http.StatusOK}}
+	failed := &request.BaseAttempt{Endpoint: e, Error: http.ErrHandlerTimeout}
+
+	signal.ObserveResponse(nil, ok)
+	signal.ObserveResponse(nil, failed)
+	c.Assert(signal.GetLevel(), Equals, 0.75)
+
+	_, err = NewFailRateSignal(meter, 0.5, 1.5)
+	c.Assert(err, NotNil)
+}
+
+func (s *SignalSuite) TestMaxSignal(c *C) {
+	inFlight, err := NewInFlightSignal(0, 4)
+	c.Assert(err, IsNil)
+	signal := MaxSignal{inFlight, &testSignal{level: 0.3}}
+
+	c.Assert(signal.GetLevel(), Equals, 0.3)
+	signal.ObserveRequest(nil)
+	signal.ObserveRequest(nil)
+	c.Assert(signal.GetLevel(), Equals, 0.5)
+	signal.ObserveResponse(nil, nil)
+	c.Assert(signal.GetLevel(), Equals, 0.3)
+}
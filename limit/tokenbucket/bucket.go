@@ -48,6 +48,16 @@ func NewTokenBucket(rate Rate, maxTokens int64, timeProvider timetools.TimeProvi
 // In case if tokens to consume is larger than max burst returns -1, error
 // In case if there's not enough tokens, returns time to wait till refill
 func (tb *TokenBucket) Consume(tokens int64) (time.Duration, error) {
+	delay, err := tb.timeToConsume(tokens)
+	if err != nil || delay > 0 {
+		return delay, err
+	}
+	tb.tokens -= tokens
+	return 0, nil
+}
+
+// Same as Consume, but does not consume the tokens
+func (tb *TokenBucket) timeToConsume(tokens int64) (time.Duration, error) {
 	tb.refill()
 	if tokens > tb.maxTokens {
 		return -1, fmt.Errorf("Requested tokens larger than max tokens")
@@ -55,10 +65,21 @@ func (tb *TokenBucket) Consume(tokens int64) (time.Duration, error) {
 	if tb.tokens < tokens {
 		return tb.timeToRefill(tokens), nil
 	}
-	tb.tokens -= tokens
 	return 0, nil
 }
 
+// Returns the amount of tokens available in the bucket
+func (tb *TokenBucket) GetRemaining() int64 {
+	tb.refill()
+	return tb.tokens
+}
+
+// Returns the time after the bucket will be refilled to the maximum
+func (tb *TokenBucket) GetTimeToFull() time.Duration {
+	tb.refill()
+	return tb.timeToRefill(tb.maxTokens)
+}
+
 // Returns the time after the capacity of tokens will reach the
 func (tb *TokenBucket) timeToRefill(tokens int64) time.Duration {
 	missingTokens := tokens - tb.tokens
@@ -0,0 +1,125 @@
+package tokenbucket
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Limit is a rate with its own burst, e.g. 500 requests per minute with burst 499
+// allow all the minute quota to be consumed at once
+type Limit struct {
+	Rate  Rate
+	Burst int64
+}
+
+// Maximum amount of tokens in the bucket
+func (l Limit) MaxTokens() int64 {
+	return l.Burst + 1
+}
+
+func (l Limit) String() string {
+	return fmt.Sprintf("Limit(%d/%s, burst=%d)", l.Rate.Units, l.Rate.Period, l.Burst)
+}
+
+// RateSet is a set of limits the request must pass, e.g. 10 requests per second,
+// 500 requests per minute and 100000 requests per day. Limits are sorted by the period.
+type RateSet []Limit
+
+func NewRateSet(limits ...Limit) (RateSet, error) {
+	if len(limits) == 0 {
+		return nil, fmt.Errorf("Provide at least one limit")
+	}
+	periods := make(map[time.Duration]bool, len(limits))
+	for _, l := range limits {
+		if l.Rate.Period <= 0 || l.Rate.Units <= 0 {
+			return nil, fmt.Errorf("Invalid rate: %v", l.Rate)
+		}
+		if l.Burst < 0 {
+			return nil, fmt.Errorf("Invalid burst, should be >= 0: %d", l.Burst)
+		}
+		if periods[l.Rate.Period] {
+			return nil, fmt.Errorf("Duplicate limit for period %s", l.Rate.Period)
+		}
+		periods[l.Rate.Period] = true
+	}
+	rs := make(RateSet, len(limits))
+	copy(rs, limits)
+	sort.Sort(rs)
+	return rs, nil
+}
+
+func (rs RateSet) String() string {
+	out := make([]string, len(rs))
+	for i, l := range rs {
+		out[i] = l.String()
+	}
+	return fmt.Sprintf("RateSet(%s)", strings.Join(out, ", "))
+}
+
+func (rs RateSet) Len() int {
+	return len(rs)
+}
+
+func (rs RateSet) Less(i, j int) bool {
+	return rs[i].Rate.Period < rs[j].Rate.Period
+}
+
+func (rs RateSet) Swap(i, j int) {
+	rs[i], rs[j] = rs[j], rs[i]
+}
+
+// RateOverrides looks up the rates for the token, e.g. the rates of the API key plan
+type RateOverrides interface {
+	// Returns the rates for the token, or false if the token uses the limiter's default rates
+	GetRates(token string) (RateSet, bool, error)
+}
+
+// RateTable keeps overrides in memory, the table can be updated while the limiter is running
+type RateTable struct {
+	mutex *sync.RWMutex
+	rates map[string]RateSet
+}
+
+func NewRateTable() *RateTable {
+	return &RateTable{
+		mutex: &sync.RWMutex{},
+		rates: make(map[string]RateSet),
+	}
+}
+
+func (t *RateTable) GetRates(token string) (RateSet, bool, error) {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	rs, ok := t.rates[token]
+	return rs, ok, nil
+}
+
+func (t *RateTable) Set(token string, rates RateSet) error {
+	if len(rates) == 0 {
+		return fmt.Errorf("Provide at least one limit")
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.rates[token] = rates
+	return nil
+}
+
+func (t *RateTable) Delete(token string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	delete(t.rates, token)
+}
+
+// Replaces all overrides at once, e.g. after reloading the table from the database
+func (t *RateTable) Replace(rates map[string]RateSet) {
+	copied := make(map[string]RateSet, len(rates))
+	for k, v := range rates {
+		copied[k] = v
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.rates = copied
+}
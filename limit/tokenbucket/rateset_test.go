@@ -0,0 +1,65 @@
+package tokenbucket
+
+import (
+	. "gopkg.in/check.v1"
+	"time"
+)
+
+type RateSetSuite struct {
+}
+
+var _ = Suite(&RateSetSuite{})
+
+func (s *RateSetSuite) TestSortedByPeriod(c *C) {
+	day := Limit{Rate: Rate{Units: 100000, Period: 24 * time.Hour}}
+	second := Limit{Rate: Rate{Units: 10, Period: time.Second}}
+	minute := Limit{Rate: Rate{Units: 500, Period: time.Minute}, Burst: 499}
+
+	rates, err := NewRateSet(day, second, minute)
+	c.Assert(err, IsNil)
+	c.Assert(rates, DeepEquals, RateSet{second, minute, day})
+}
+
+func (s *RateSetSuite) TestInvalidParams(c *C) {
+	_, err := NewRateSet()
+	c.Assert(err, NotNil)
+
+	_, err = NewRateSet(Limit{Rate: Rate{Units: 0, Period: time.Second}})
+	c.Assert(err, NotNil)
+
+	_, err = NewRateSet(Limit{Rate: Rate{Units: 1, Period: time.Second}, Burst: -1})
+	c.Assert(err, NotNil)
+
+	_, err = NewRateSet(
+		Limit{Rate: Rate{Units: 1, Period: time.Second}},
+		Limit{Rate: Rate{Units: 2, Period: time.Second}})
+	c.Assert(err, NotNil)
+}
+
+func (s *RateSetSuite) TestRateTable(c *C) {
+	t := NewRateTable()
+	rates, err := NewRateSet(Limit{Rate: Rate{Units: 1, Period: time.Second}})
+	c.Assert(err, IsNil)
+
+	_, ok, err := t.GetRates("a")
+	c.Assert(err, IsNil)
+	c.Assert(ok, Equals, false)
+
+	c.Assert(t.Set("a", rates), IsNil)
+	out, ok, err := t.GetRates("a")
+	c.Assert(err, IsNil)
+	c.Assert(ok, Equals, true)
+	c.Assert(out, DeepEquals, rates)
+
+	t.Replace(map[string]RateSet{"b": rates})
+	_, ok, _ = t.GetRates("a")
+	c.Assert(ok, Equals, false)
+	_, ok, _ = t.GetRates("b")
+	c.Assert(ok, Equals, true)
+
+	t.Delete("b")
+	_, ok, _ = t.GetRates("b")
+	c.Assert(ok, Equals, false)
+
+	c.Assert(t.Set("a", nil), NotNil)
+}
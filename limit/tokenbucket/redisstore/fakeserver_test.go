@@ -0,0 +1,188 @@
+package redisstore
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Fake Redis server that understands the commands sent by the store and
+// executes the consume script natively
+type fakeServer struct {
+	listener net.Listener
+	mutex    *sync.Mutex
+	buckets  map[string]*fakeBucket
+	// Scripts cached by EVAL, EVALSHA fails with NOSCRIPT until the script is cached
+	scripts map[string]bool
+	// Commands received by the server
+	commands []string
+	conns    []net.Conn
+}
+
+type fakeBucket struct {
+	tokens   int64
+	refilled int64
+}
+
+func newFakeServer() (*fakeServer, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	s := &fakeServer{
+		listener: l,
+		mutex:    &sync.Mutex{},
+		buckets:  make(map[string]*fakeBucket),
+		scripts:  make(map[string]bool),
+	}
+	go s.serve()
+	return s, nil
+}
+
+func (s *fakeServer) addr() string {
+	return s.listener.Addr().String()
+}
+
+// Stops listening and drops all connections
+func (s *fakeServer) close() {
+	s.listener.Close()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, c := range s.conns {
+		c.Close()
+	}
+}
+
+func (s *fakeServer) getCommands() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]string{}, s.commands...)
+}
+
+func (s *fakeServer) serve() {
+	for {
+		c, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.mutex.Lock()
+		s.conns = append(s.conns, c)
+		s.mutex.Unlock()
+		go s.handle(c)
+	}
+}
+
+func (s *fakeServer) handle(c net.Conn) {
+	defer c.Close()
+	r := bufio.NewReader(c)
+	w := bufio.NewWriter(c)
+	for {
+		reply, err := readReply(r)
+		if err != nil {
+			return
+		}
+		items, ok := reply.([]interface{})
+		if !ok || len(items) == 0 {
+			return
+		}
+		args := make([]string, len(items))
+		for i, item := range items {
+			args[i] = string(item.([]byte))
+		}
+		fmt.Fprint(w, s.execute(args))
+		if w.Flush() != nil {
+			return
+		}
+	}
+}
+
+func (s *fakeServer) execute(args []string) string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	cmd := strings.ToUpper(args[0])
+	s.commands = append(s.commands, cmd)
+	switch cmd {
+	case "PING":
+		return "+PONG\r\n"
+	case "EVAL":
+		if args[1] != consumeScript {
+			return "-ERR unknown script\r\n"
+		}
+		s.scripts[scriptSha(args[1])] = true
+	case "EVALSHA":
+		if !s.scripts[args[1]] {
+			return "-NOSCRIPT No matching script. Please use EVAL.\r\n"
+		}
+	default:
+		return fmt.Sprintf("-ERR unknown command '%s'\r\n", args[0])
+	}
+	// EVAL script numkeys keys... tokens now [refill max ttl]...
+	if len(args) < 3 {
+		return "-ERR wrong number of arguments\r\n"
+	}
+	numKeys, err := strconv.Atoi(args[2])
+	if err != nil || len(args) != 3+numKeys+2+numKeys*3 {
+		return "-ERR wrong number of arguments\r\n"
+	}
+	keys := args[3 : 3+numKeys]
+	values := make([]int64, len(args)-3-numKeys)
+	for i, a := range args[3+numKeys:] {
+		v, err := strconv.ParseInt(a, 10, 64)
+		if err != nil {
+			return "-ERR value is not an integer\r\n"
+		}
+		values[i] = v
+	}
+	states := s.consume(keys, values[0], values[1], values[2:])
+	if states == nil {
+		return ":-1\r\n"
+	}
+	reply := fmt.Sprintf("*%d\r\n", len(states))
+	for _, st := range states {
+		reply += fmt.Sprintf("*4\r\n:%d\r\n:%d\r\n:%d\r\n:%d\r\n", st[0], st[1], st[2], st[3])
+	}
+	return reply
+}
+
+// Same algorithm as the consume script, returns nil if the tokens exceed the bucket size
+func (s *fakeServer) consume(keys []string, consume, now int64, params []int64) [][]int64 {
+	buckets := make([]*fakeBucket, len(keys))
+	delays := make([]int64, len(keys))
+	rejected := false
+	for i, key := range keys {
+		refill, max := params[i*3], params[i*3+1]
+		if consume > max {
+			return nil
+		}
+		b, ok := s.buckets[key]
+		if !ok {
+			b = &fakeBucket{tokens: max, refilled: now}
+			s.buckets[key] = b
+		}
+		if added := (now - b.refilled) / refill; added > 0 {
+			b.tokens += added
+			if b.tokens > max {
+				b.tokens = max
+			}
+			b.refilled = now
+		}
+		if b.tokens < consume {
+			delays[i] = (consume - b.tokens) * refill
+			rejected = true
+		}
+		buckets[i] = b
+	}
+	states := make([][]int64, len(keys))
+	for i, b := range buckets {
+		refill, max := params[i*3], params[i*3+1]
+		if !rejected {
+			b.tokens -= consume
+		}
+		states[i] = []int64{delays[i], max, b.tokens, (max - b.tokens) * refill}
+	}
+	return states
+}
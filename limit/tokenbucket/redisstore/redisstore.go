@@ -0,0 +1,395 @@
+// Token bucket store that keeps buckets in Redis, so the limits are shared by multiple proxies
+package redisstore
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/mailgun/gotools-log"
+	"github.com/mailgun/gotools-time"
+
+	"github.com/mailgun/vulcan/limit/tokenbucket"
+)
+
+// Script consumes the tokens from all the buckets atomically, it follows the refill logic of the tokenbucket.TokenBucket.
+// ARGV has the tokens to consume, current time and the refill period, bucket size and ttl for every key.
+// Time values are in microseconds, the script returns the state of every bucket: time to wait till the refill
+// (0 if the tokens have been consumed), bucket size, tokens left and time till the bucket is full,
+// or -1 if the requested amount of tokens exceeds the size of any bucket.
+const consumeScript = `
+local consume = tonumber(ARGV[1])
+local now = tonumber(ARGV[2])
+local buckets = {}
+local rejected = false
+for i = 1, #KEYS do
+  local refill = tonumber(ARGV[i * 3])
+  local max = tonumber(ARGV[i * 3 + 1])
+  local ttl = tonumber(ARGV[i * 3 + 2])
+  if consume > max then
+    return -1
+  end
+  local state = redis.call("HMGET", KEYS[i], "tokens", "refilled")
+  local tokens = tonumber(state[1])
+  local refilled = tonumber(state[2])
+  if tokens == nil or refilled == nil then
+    tokens = max
+    refilled = now
+  end
+  local added = math.floor((now - refilled) / refill)
+  if added > 0 then
+    tokens = math.min(tokens + added, max)
+    refilled = now
+  end
+  local delay = 0
+  if tokens < consume then
+    delay = (consume - tokens) * refill
+    rejected = true
+  end
+  buckets[i] = {delay, max, tokens, refilled, refill, ttl}
+end
+local result = {}
+for i, b in ipairs(buckets) do
+  if not rejected then
+    b[3] = b[3] - consume
+  end
+  redis.call("HMSET", KEYS[i], "tokens", b[3], "refilled", b[4])
+  redis.call("EXPIRE", KEYS[i], b[6])
+  result[i] = {b[1], b[2], b[3], (b[2] - b[3]) * b[5]}
+end
+return result
+`
+
+var consumeScriptSha = scriptSha(consumeScript)
+
+func scriptSha(script string) string {
+	h := sha1.New()
+	h.Write([]byte(script))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+type Options struct {
+	// Prefix added to the bucket keys, allows several limiters to share the same Redis
+	Prefix string
+	// Timeout for the single round trip to Redis, slower calls are treated as failures
+	Timeout time.Duration
+	// Maximum amount of idle connections kept in the pool
+	MaxIdleConns int
+	// After Redis failure, the store serves buckets from the fallback store
+	// for this period of time before trying Redis again
+	RetryPeriod time.Duration
+	// Local store used when Redis is slow or unavailable, defaults to in memory store
+	Fallback tokenbucket.BucketStore
+	// Maximum amount of rejected keys cached locally
+	MaxRejectedKeys int
+	TimeProvider    timetools.TimeProvider
+}
+
+// RedisStore keeps the buckets in Redis and consumes the tokens atomically using Lua script.
+// Keys that are known to be out of tokens are cached locally, so the rejected requests
+// do not hit Redis until the bucket is refilled.
+type RedisStore struct {
+	address string
+	options Options
+	mutex   *sync.Mutex
+	idle    []*conn
+	// Keys that are out of tokens
+	rejected map[string]rejection
+	// Time of the last failure, zero if Redis is healthy
+	failedAt time.Time
+}
+
+func NewRedisStore(address string, o Options) (*RedisStore, error) {
+	if address == "" {
+		return nil, fmt.Errorf("Provide Redis address")
+	}
+	o, err := parseOptions(o)
+	if err != nil {
+		return nil, err
+	}
+	return &RedisStore{
+		address:  address,
+		options:  o,
+		mutex:    &sync.Mutex{},
+		rejected: make(map[string]rejection),
+	}, nil
+}
+
+func (s *RedisStore) Consume(key string, rates tokenbucket.RateSet, tokens int64) (tokenbucket.BucketState, error) {
+	// Validate arguments locally, so invalid calls are not treated as store failures
+	if len(rates) == 0 {
+		return tokenbucket.BucketState{}, fmt.Errorf("Provide at least one limit")
+	}
+	for _, l := range rates {
+		if l.Rate.Period <= 0 || l.Rate.Units <= 0 {
+			return tokenbucket.BucketState{}, fmt.Errorf("Invalid rate: %v", l.Rate)
+		}
+		if tokens > l.MaxTokens() {
+			return tokenbucket.BucketState{}, fmt.Errorf("Requested tokens larger than max tokens")
+		}
+	}
+	now := s.options.TimeProvider.UtcNow()
+	cacheKey := rejectionKey(key, rates)
+	if state, ok := s.getRejected(cacheKey, now); ok {
+		return state, nil
+	}
+	if s.isDown(now) {
+		return s.options.Fallback.Consume(key, rates, tokens)
+	}
+
+	state, err := s.consume(key, rates, tokens, now)
+	if err != nil {
+		log.Errorf("%s failed, falling back to local store: %s", s, err)
+		s.setDown(now)
+		return s.options.Fallback.Consume(key, rates, tokens)
+	}
+	if state.Delay > 0 {
+		s.setRejected(cacheKey, rejection{until: now.Add(state.Delay), full: now.Add(state.Reset), limit: state.Limit})
+	}
+	return state, nil
+}
+
+// Closes idle connections
+func (s *RedisStore) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, c := range s.idle {
+		c.Close()
+	}
+	s.idle = nil
+	return nil
+}
+
+func (s *RedisStore) String() string {
+	return fmt.Sprintf("RedisStore(address=%s)", s.address)
+}
+
+func (s *RedisStore) consume(key string, rates tokenbucket.RateSet, tokens int64, now time.Time) (tokenbucket.BucketState, error) {
+	keys := make([]string, len(rates))
+	args := []string{
+		strconv.FormatInt(tokens, 10),
+		strconv.FormatInt(now.UnixNano()/int64(time.Microsecond), 10),
+	}
+	for i, l := range rates {
+		// Hash tag keeps the buckets of the token in the same slot of Redis cluster
+		keys[i] = s.options.Prefix + tokenbucket.BucketKey("{"+key+"}", l)
+		refill := int64(l.Rate.Period/time.Microsecond) / l.Rate.Units
+		if refill <= 0 {
+			refill = 1
+		}
+		args = append(args,
+			strconv.FormatInt(refill, 10),
+			strconv.FormatInt(l.MaxTokens(), 10),
+			strconv.Itoa(tokenbucket.BucketTtl(l.Rate)))
+	}
+	params := append(append([]string{strconv.Itoa(len(keys))}, keys...), args...)
+
+	reply, err := s.do(append([]string{"EVALSHA", consumeScriptSha}, params...)...)
+	if e, ok := err.(RedisError); ok && strings.HasPrefix(string(e), "NOSCRIPT") {
+		// Script is not cached by the server yet, EVAL caches it for the next calls
+		reply, err = s.do(append([]string{"EVAL", consumeScript}, params...)...)
+	}
+	if err != nil {
+		return tokenbucket.BucketState{}, err
+	}
+	return parseState(reply, len(rates))
+}
+
+// Returns the most restrictive state of the buckets
+func parseState(reply interface{}, buckets int) (tokenbucket.BucketState, error) {
+	if v, ok := reply.(int64); ok && v < 0 {
+		return tokenbucket.BucketState{}, fmt.Errorf("Requested tokens larger than max tokens")
+	}
+	values, ok := reply.([]interface{})
+	if !ok || len(values) != buckets {
+		return tokenbucket.BucketState{}, fmt.Errorf("Unexpected reply: %v", reply)
+	}
+	var state tokenbucket.BucketState
+	for i, v := range values {
+		ints, err := toInts(v, 4)
+		if err != nil {
+			return tokenbucket.BucketState{}, err
+		}
+		current := tokenbucket.BucketState{
+			Delay:     time.Duration(ints[0]) * time.Microsecond,
+			Limit:     ints[1],
+			Remaining: ints[2],
+			Reset:     time.Duration(ints[3]) * time.Microsecond,
+		}
+		if i == 0 || current.MoreRestrictive(state) {
+			state = current
+		}
+	}
+	return state, nil
+}
+
+func toInts(reply interface{}, size int) ([]int64, error) {
+	values, ok := reply.([]interface{})
+	if !ok || len(values) != size {
+		return nil, fmt.Errorf("Unexpected reply: %v", reply)
+	}
+	ints := make([]int64, len(values))
+	for i, v := range values {
+		if ints[i], ok = v.(int64); !ok {
+			return nil, fmt.Errorf("Unexpected reply: %v", reply)
+		}
+	}
+	return ints, nil
+}
+
+// Sends command and reads the reply, connections that failed are not returned to the pool
+func (s *RedisStore) do(args ...string) (interface{}, error) {
+	c, err := s.getConn()
+	if err != nil {
+		return nil, err
+	}
+	c.SetDeadline(time.Now().Add(s.options.Timeout))
+	if err := writeCommand(c.w, args...); err != nil {
+		c.Close()
+		return nil, err
+	}
+	reply, err := readReply(c.r)
+	if _, ok := err.(RedisError); err != nil && !ok {
+		c.Close()
+		return nil, err
+	}
+	s.putConn(c)
+	return reply, err
+}
+
+func (s *RedisStore) getConn() (*conn, error) {
+	s.mutex.Lock()
+	if len(s.idle) != 0 {
+		c := s.idle[len(s.idle)-1]
+		s.idle = s.idle[:len(s.idle)-1]
+		s.mutex.Unlock()
+		return c, nil
+	}
+	s.mutex.Unlock()
+
+	netConn, err := net.DialTimeout("tcp", s.address, s.options.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	return &conn{Conn: netConn, r: bufio.NewReader(netConn), w: bufio.NewWriter(netConn)}, nil
+}
+
+func (s *RedisStore) putConn(c *conn) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if len(s.idle) >= s.options.MaxIdleConns {
+		c.Close()
+		return
+	}
+	s.idle = append(s.idle, c)
+}
+
+func (s *RedisStore) getRejected(key string, now time.Time) (tokenbucket.BucketState, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	r, ok := s.rejected[key]
+	if !ok {
+		return tokenbucket.BucketState{}, false
+	}
+	if !r.until.After(now) {
+		delete(s.rejected, key)
+		return tokenbucket.BucketState{}, false
+	}
+	return tokenbucket.BucketState{Delay: r.until.Sub(now), Limit: r.limit, Reset: r.full.Sub(now)}, true
+}
+
+func (s *RedisStore) setRejected(key string, r rejection) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if len(s.rejected) >= s.options.MaxRejectedKeys {
+		now := s.options.TimeProvider.UtcNow()
+		for k, v := range s.rejected {
+			if !v.until.After(now) {
+				delete(s.rejected, k)
+			}
+		}
+		if len(s.rejected) >= s.options.MaxRejectedKeys {
+			return
+		}
+	}
+	s.rejected[key] = r
+}
+
+// Rejections are cached per token and rate set, so the requests with different limits do not share the cache
+func rejectionKey(key string, rates tokenbucket.RateSet) string {
+	keys := make([]string, len(rates))
+	for i, l := range rates {
+		keys[i] = tokenbucket.BucketKey(key, l)
+	}
+	return strings.Join(keys, ",")
+}
+
+// Rejected key is cached till the refill, the state is computed from the times
+type rejection struct {
+	until time.Time
+	full  time.Time
+	limit int64
+}
+
+func (s *RedisStore) isDown(now time.Time) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return !s.failedAt.IsZero() && now.Sub(s.failedAt) < s.options.RetryPeriod
+}
+
+func (s *RedisStore) setDown(now time.Time) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.failedAt = now
+}
+
+type conn struct {
+	net.Conn
+	r *bufio.Reader
+	w *bufio.Writer
+}
+
+const (
+	DefaultPrefix          = "vulcan:tb:"
+	DefaultTimeout         = 100 * time.Millisecond
+	DefaultMaxIdleConns    = 16
+	DefaultRetryPeriod     = time.Second
+	DefaultMaxRejectedKeys = 65536
+)
+
+func parseOptions(o Options) (Options, error) {
+	if o.Prefix == "" {
+		o.Prefix = DefaultPrefix
+	}
+	if o.Timeout <= 0 {
+		o.Timeout = DefaultTimeout
+	}
+	if o.MaxIdleConns <= 0 {
+		o.MaxIdleConns = DefaultMaxIdleConns
+	}
+	if o.RetryPeriod <= 0 {
+		o.RetryPeriod = DefaultRetryPeriod
+	}
+	if o.MaxRejectedKeys <= 0 {
+		o.MaxRejectedKeys = DefaultMaxRejectedKeys
+	}
+	if o.TimeProvider == nil {
+		o.TimeProvider = &timetools.RealTime{}
+	}
+	if o.Fallback == nil {
+		fallback, err := tokenbucket.NewMemoryStore(tokenbucket.DefaultCapacity, o.TimeProvider)
+		if err != nil {
+			return o, err
+		}
+		o.Fallback = fallback
+	}
+	return o, nil
+}
@@ -0,0 +1,216 @@
+package redisstore
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/mailgun/gotools-time"
+	. "gopkg.in/check.v1"
+
+	"github.com/mailgun/vulcan/limit"
+	"github.com/mailgun/vulcan/limit/tokenbucket"
+	"github.com/mailgun/vulcan/request"
+)
+
+func TestRedisStore(t *testing.T) { TestingT(t) }
+
+type StoreSuite struct {
+	tm     *timetools.FreezedTime
+	server *fakeServer
+}
+
+var _ = Suite(&StoreSuite{})
+
+func (s *StoreSuite) SetUpTest(c *C) {
+	s.tm = &timetools.FreezedTime{
+		CurrentTime: time.Date(2012, 3, 4, 5, 6, 7, 0, time.UTC),
+	}
+	server, err := newFakeServer()
+	c.Assert(err, IsNil)
+	s.server = server
+}
+
+func (s *StoreSuite) TearDownTest(c *C) {
+	s.server.close()
+}
+
+func (s *StoreSuite) newStore(c *C) *RedisStore {
+	store, err := NewRedisStore(s.server.addr(), Options{TimeProvider: s.tm})
+	c.Assert(err, IsNil)
+	return store
+}
+
+var (
+	rate  = tokenbucket.Rate{Units: 1, Period: time.Second}
+	rates = tokenbucket.RateSet{{Rate: rate}}
+)
+
+func (s *StoreSuite) TestConsume(c *C) {
+	store := s.newStore(c)
+	defer store.Close()
+
+	state, err := store.Consume("a", rates, 1)
+	c.Assert(err, IsNil)
+	c.Assert(state, Equals, tokenbucket.BucketState{Delay: 0, Limit: 1, Remaining: 0, Reset: time.Second})
+
+	// Bucket is empty
+	state, err = store.Consume("a", rates, 1)
+	c.Assert(err, IsNil)
+	c.Assert(state.Delay, Equals, time.Second)
+
+	// Other keys have their own buckets
+	state, err = store.Consume("b", rates, 1)
+	c.Assert(err, IsNil)
+	c.Assert(state.Delay, Equals, time.Duration(0))
+
+	// Bucket is refilled a second later
+	s.tm.CurrentTime = s.tm.CurrentTime.Add(time.Second)
+	state, err = store.Consume("a", rates, 1)
+	c.Assert(err, IsNil)
+	c.Assert(state.Delay, Equals, time.Duration(0))
+}
+
+// Tokens are not consumed from the buckets when any of the limits rejects
+func (s *StoreSuite) TestMultipleRates(c *C) {
+	store := s.newStore(c)
+	defer store.Close()
+
+	rs, err := tokenbucket.NewRateSet(
+		tokenbucket.Limit{Rate: tokenbucket.Rate{Units: 10, Period: time.Second}, Burst: 9},
+		tokenbucket.Limit{Rate: tokenbucket.Rate{Units: 3, Period: time.Minute}, Burst: 2})
+	c.Assert(err, IsNil)
+
+	for i := 0; i < 3; i++ {
+		state, err := store.Consume("a", rs, 1)
+		c.Assert(err, IsNil)
+		c.Assert(state.Delay, Equals, time.Duration(0))
+	}
+	state, err := store.Consume("a", rs, 1)
+	c.Assert(err, IsNil)
+	c.Assert(state, Equals, tokenbucket.BucketState{Delay: 20 * time.Second, Limit: 3, Remaining: 0, Reset: time.Minute})
+
+	// Per second bucket still has 7 tokens
+	second, err := tokenbucket.NewRateSet(rs[0])
+	c.Assert(err, IsNil)
+	state, err = store.Consume("a", second, 7)
+	c.Assert(err, IsNil)
+	c.Assert(state.Delay, Equals, time.Duration(0))
+}
+
+func (s *StoreSuite) TestScriptIsCached(c *C) {
+	store := s.newStore(c)
+	defer store.Close()
+
+	for i := 0; i < 2; i++ {
+		_, err := store.Consume("a", tokenbucket.RateSet{{Rate: rate, Burst: 9}}, 1)
+		c.Assert(err, IsNil)
+	}
+	c.Assert(s.server.getCommands(), DeepEquals, []string{"EVALSHA", "EVAL", "EVALSHA"})
+}
+
+// Keys that are out of tokens are rejected locally till the refill
+func (s *StoreSuite) TestRejectedKeysCached(c *C) {
+	store := s.newStore(c)
+	defer store.Close()
+
+	_, err := store.Consume("a", rates, 1)
+	c.Assert(err, IsNil)
+
+	state, err := store.Consume("a", rates, 1)
+	c.Assert(err, IsNil)
+	c.Assert(state.Delay, Equals, time.Second)
+	commands := len(s.server.getCommands())
+
+	s.tm.CurrentTime = s.tm.CurrentTime.Add(time.Second / 2)
+	state, err = store.Consume("a", rates, 1)
+	c.Assert(err, IsNil)
+	c.Assert(state.Delay, Equals, time.Second/2)
+	c.Assert(len(s.server.getCommands()), Equals, commands)
+
+	// Store is asked again once the bucket is refilled
+	s.tm.CurrentTime = s.tm.CurrentTime.Add(time.Second / 2)
+	state, err = store.Consume("a", rates, 1)
+	c.Assert(err, IsNil)
+	c.Assert(state.Delay, Equals, time.Duration(0))
+	c.Assert(len(s.server.getCommands()), Equals, commands+1)
+}
+
+func (s *StoreSuite) TestFallback(c *C) {
+	store := s.newStore(c)
+	defer store.Close()
+
+	_, err := store.Consume("a", rates, 1)
+	c.Assert(err, IsNil)
+
+	s.server.close()
+
+	// Fallback store has its own buckets
+	state, err := store.Consume("a", rates, 1)
+	c.Assert(err, IsNil)
+	c.Assert(state.Delay, Equals, time.Duration(0))
+
+	state, err = store.Consume("a", rates, 1)
+	c.Assert(err, IsNil)
+	c.Assert(state.Delay, Equals, time.Second)
+
+	// Store is tried again after the retry period
+	server, err := newFakeServer()
+	c.Assert(err, IsNil)
+	s.server = server
+	store.address = server.addr()
+
+	s.tm.CurrentTime = s.tm.CurrentTime.Add(DefaultRetryPeriod / 2)
+	_, err = store.Consume("b", rates, 1)
+	c.Assert(err, IsNil)
+	c.Assert(len(server.getCommands()), Equals, 0)
+
+	s.tm.CurrentTime = s.tm.CurrentTime.Add(DefaultRetryPeriod)
+	_, err = store.Consume("b", rates, 1)
+	c.Assert(err, IsNil)
+	c.Assert(len(server.getCommands()), Not(Equals), 0)
+}
+
+func (s *StoreSuite) TestTooManyTokens(c *C) {
+	store := s.newStore(c)
+	defer store.Close()
+
+	_, err := store.Consume("a", rates, 2)
+	c.Assert(err, NotNil)
+	c.Assert(len(s.server.getCommands()), Equals, 0)
+}
+
+func (s *StoreSuite) TestInvalidParams(c *C) {
+	_, err := NewRedisStore("", Options{})
+	c.Assert(err, NotNil)
+}
+
+// Limiters using the same store share the limits
+func (s *StoreSuite) TestSharedLimits(c *C) {
+	limiters := make([]*tokenbucket.TokenLimiter, 2)
+	for i := range limiters {
+		store := s.newStore(c)
+		defer store.Close()
+
+		l, err := tokenbucket.NewTokenLimiterWithOptions(
+			limit.MapClientIp, rate, tokenbucket.Options{TimeProvider: s.tm, Store: store})
+		c.Assert(err, IsNil)
+		limiters[i] = l
+	}
+
+	re, err := limiters[0].ProcessRequest(makeRequest("1.2.3.4"))
+	c.Assert(err, IsNil)
+	c.Assert(re, IsNil)
+
+	re, err = limiters[1].ProcessRequest(makeRequest("1.2.3.4"))
+	c.Assert(err, IsNil)
+	c.Assert(re, NotNil)
+}
+
+func makeRequest(ip string) request.Request {
+	return &request.BaseRequest{
+		HttpRequest: &http.Request{
+			RemoteAddr: ip,
+		},
+	}
+}
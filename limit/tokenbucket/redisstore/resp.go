@@ -0,0 +1,97 @@
+package redisstore
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// Minimal implementation of the Redis serialization protocol (http://redis.io/topics/protocol)
+
+// Error reply returned by the server, connection is still usable after this error
+type RedisError string
+
+func (e RedisError) Error() string {
+	return string(e)
+}
+
+// Writes command as an array of bulk strings
+func writeCommand(w *bufio.Writer, args ...string) error {
+	if _, err := fmt.Fprintf(w, "*%d\r\n", len(args)); err != nil {
+		return err
+	}
+	for _, a := range args {
+		if _, err := fmt.Fprintf(w, "$%d\r\n%s\r\n", len(a), a); err != nil {
+			return err
+		}
+	}
+	return w.Flush()
+}
+
+// Reads the reply, returns string for simple strings, int64 for integers, []byte for bulk strings,
+// []interface{} for arrays and RedisError for error replies.
+func readReply(r *bufio.Reader) (interface{}, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 {
+		return nil, fmt.Errorf("Empty reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, RedisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		size, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if size < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		return buf[:size], nil
+	case '*':
+		size, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if size < 0 {
+			return nil, nil
+		}
+		out := make([]interface{}, size)
+		for i := range out {
+			v, err := readReply(r)
+			// Error replies inside arrays are values, not failures of the whole reply
+			if e, ok := err.(RedisError); ok {
+				out[i] = e
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			out[i] = v
+		}
+		return out, nil
+	}
+	return nil, fmt.Errorf("Unexpected reply: %s", line)
+}
+
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return "", fmt.Errorf("Malformed line: %q", line)
+	}
+	return line[:len(line)-2], nil
+}
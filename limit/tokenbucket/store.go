@@ -0,0 +1,128 @@
+package tokenbucket
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/mailgun/gotools-time"
+	"github.com/mailgun/ttlmap"
+)
+
+// BucketStore keeps token buckets for the limiter, e.g. in memory of the process or
+// in a shared storage, so the limits are enforced across multiple proxies
+type BucketStore interface {
+	// Consumes tokens from the buckets of every limit in the rate set, creates buckets in case if they do not exist.
+	// Tokens are consumed atomically: either from all the buckets or, in case if any of the buckets does not have
+	// enough tokens, from none of them. Follows the TokenBucket.Consume semantics: state has zero delay if tokens
+	// were consumed and time to wait till the refill if there are not enough tokens.
+	Consume(key string, rates RateSet, tokens int64) (BucketState, error)
+}
+
+// State of the most restrictive bucket after the Consume call
+type BucketState struct {
+	Delay     time.Duration // Time to wait till the refill, 0 if the tokens have been consumed
+	Limit     int64         // Size of the bucket
+	Remaining int64         // Tokens left in the bucket
+	Reset     time.Duration // Time till the bucket is refilled to the maximum
+}
+
+// Returns true if the state s is more restrictive than the other: it has longer delay or less tokens left
+func (s BucketState) MoreRestrictive(other BucketState) bool {
+	if s.Delay != other.Delay {
+		return s.Delay > other.Delay
+	}
+	if s.Remaining != other.Remaining {
+		return s.Remaining < other.Remaining
+	}
+	return s.Reset > other.Reset
+}
+
+// MemoryStore keeps buckets in memory of the process and expires inactive buckets
+type MemoryStore struct {
+	mutex        *sync.Mutex
+	buckets      *ttlmap.TtlMap
+	timeProvider timetools.TimeProvider
+}
+
+func NewMemoryStore(capacity int, timeProvider timetools.TimeProvider) (*MemoryStore, error) {
+	if timeProvider == nil {
+		return nil, fmt.Errorf("Supply time provider")
+	}
+	buckets, err := ttlmap.NewMapWithProvider(capacity, timeProvider)
+	if err != nil {
+		return nil, err
+	}
+	return &MemoryStore{
+		mutex:        &sync.Mutex{},
+		buckets:      buckets,
+		timeProvider: timeProvider,
+	}, nil
+}
+
+func (s *MemoryStore) Consume(key string, rates RateSet, tokens int64) (BucketState, error) {
+	if len(rates) == 0 {
+		return BucketState{}, fmt.Errorf("Provide at least one limit")
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	buckets := make([]*TokenBucket, len(rates))
+	for i, l := range rates {
+		b, err := s.getBucket(BucketKey(key, l), l)
+		if err != nil {
+			return BucketState{}, err
+		}
+		buckets[i] = b
+	}
+
+	// Check all the buckets first, so the tokens are not consumed from some buckets when the others reject
+	delays := make([]time.Duration, len(buckets))
+	rejected := false
+	for i, b := range buckets {
+		delay, err := b.timeToConsume(tokens)
+		if err != nil {
+			return BucketState{}, err
+		}
+		delays[i] = delay
+		rejected = rejected || delay > 0
+	}
+
+	var state BucketState
+	for i, b := range buckets {
+		if !rejected {
+			b.tokens -= tokens
+		}
+		current := BucketState{Delay: delays[i], Limit: b.maxTokens, Remaining: b.tokens, Reset: b.GetTimeToFull()}
+		if i == 0 || current.MoreRestrictive(state) {
+			state = current
+		}
+	}
+	return state, nil
+}
+
+func (s *MemoryStore) getBucket(key string, l Limit) (*TokenBucket, error) {
+	bucketI, exists := s.buckets.Get(key)
+	if exists {
+		return bucketI.(*TokenBucket), nil
+	}
+	bucket, err := NewTokenBucket(l.Rate, l.MaxTokens(), s.timeProvider)
+	if err != nil {
+		return nil, err
+	}
+	// We set ttl as 10 times rate period. E.g. if rate is 100 requests/second per client ip
+	// the counters for this ip will expire after 10 seconds of inactivity
+	s.buckets.Set(key, bucket, BucketTtl(l.Rate))
+	return bucket, nil
+}
+
+// Returns the key of the limit's bucket. Limit parameters are part of the key,
+// so the bucket is recreated once the limit of the token changes.
+func BucketKey(key string, l Limit) string {
+	return fmt.Sprintf("%s:%d/%d/%d", key, l.Rate.Units, int64(l.Rate.Period), l.Burst)
+}
+
+// Returns ttl of the inactive bucket in seconds
+func BucketTtl(rate Rate) int {
+	return int(rate.Period/time.Second)*10 + 1
+}
@@ -0,0 +1,79 @@
+package tokenbucket
+
+import (
+	"github.com/mailgun/gotools-time"
+	. "gopkg.in/check.v1"
+	"time"
+)
+
+type StoreSuite struct {
+	tm *timetools.FreezedTime
+}
+
+var _ = Suite(&StoreSuite{})
+
+func (s *StoreSuite) SetUpTest(c *C) {
+	s.tm = &timetools.FreezedTime{
+		CurrentTime: time.Date(2012, 3, 4, 5, 6, 7, 0, time.UTC),
+	}
+}
+
+func (s *StoreSuite) TestConsumeState(c *C) {
+	store, err := NewMemoryStore(DefaultCapacity, s.tm)
+	c.Assert(err, IsNil)
+
+	rates, err := NewRateSet(Limit{Rate: Rate{Units: 1, Period: time.Second}, Burst: 2})
+	c.Assert(err, IsNil)
+
+	state, err := store.Consume("a", rates, 1)
+	c.Assert(err, IsNil)
+	c.Assert(state, Equals, BucketState{Delay: 0, Limit: 3, Remaining: 2, Reset: time.Second})
+
+	state, err = store.Consume("a", rates, 2)
+	c.Assert(err, IsNil)
+	c.Assert(state, Equals, BucketState{Delay: 0, Limit: 3, Remaining: 0, Reset: 3 * time.Second})
+
+	state, err = store.Consume("a", rates, 1)
+	c.Assert(err, IsNil)
+	c.Assert(state, Equals, BucketState{Delay: time.Second, Limit: 3, Remaining: 0, Reset: 3 * time.Second})
+
+	_, err = store.Consume("a", rates, 4)
+	c.Assert(err, NotNil)
+}
+
+// Tokens are not consumed from the buckets when any of the limits rejects
+func (s *StoreSuite) TestConsumeAtomically(c *C) {
+	store, err := NewMemoryStore(DefaultCapacity, s.tm)
+	c.Assert(err, IsNil)
+
+	second := Limit{Rate: Rate{Units: 10, Period: time.Second}, Burst: 9}
+	minute := Limit{Rate: Rate{Units: 3, Period: time.Minute}, Burst: 2}
+	rates, err := NewRateSet(minute, second)
+	c.Assert(err, IsNil)
+
+	for i := 0; i < 3; i++ {
+		state, err := store.Consume("a", rates, 1)
+		c.Assert(err, IsNil)
+		c.Assert(state.Delay, Equals, time.Duration(0))
+	}
+
+	// Minute limit is the most restrictive one
+	state, err := store.Consume("a", rates, 1)
+	c.Assert(err, IsNil)
+	c.Assert(state, Equals, BucketState{Delay: 20 * time.Second, Limit: 3, Remaining: 0, Reset: time.Minute})
+
+	// Rejected request has not consumed tokens from the second bucket
+	state, err = store.Consume("a", RateSet{second}, 7)
+	c.Assert(err, IsNil)
+	c.Assert(state.Delay, Equals, time.Duration(0))
+}
+
+func (s *StoreSuite) TestInvalidParams(c *C) {
+	_, err := NewMemoryStore(DefaultCapacity, nil)
+	c.Assert(err, NotNil)
+
+	store, err := NewMemoryStore(DefaultCapacity, s.tm)
+	c.Assert(err, IsNil)
+	_, err = store.Consume("a", nil, 1)
+	c.Assert(err, NotNil)
+}
@@ -4,22 +4,21 @@ package tokenbucket
 import (
 	"fmt"
 	"github.com/mailgun/gotools-time"
-	"github.com/mailgun/ttlmap"
 	"github.com/mailgun/vulcan/errors"
+	"github.com/mailgun/vulcan/headers"
 	"github.com/mailgun/vulcan/limit"
 	"github.com/mailgun/vulcan/netutils"
 	"github.com/mailgun/vulcan/request"
 	"net/http"
-	"sync"
+	"strconv"
 	"time"
 )
 
 type TokenLimiter struct {
-	buckets *ttlmap.TtlMap
-	mutex   *sync.Mutex
 	options Options
 	mapper  limit.MapperFn
-	rate    Rate
+	rates   RateSet
+	queue   *limit.Queue
 }
 
 type Options struct {
@@ -28,6 +27,15 @@ type Options struct {
 	Capacity     int   // Overall capacity (maximum sumultaneuously active tokens)
 	Mapper       limit.MapperFn
 	TimeProvider timetools.TimeProvider
+	Store        BucketStore // Storage for the buckets, defaults to in memory store
+	// If set, requests over the limit wait in the queue for the tokens instead of being rejected
+	Queue *limit.QueueOptions
+	// Formats the body of the rejected requests, defaults to JSON formatter
+	ErrorFormatter errors.Formatter
+	// Adds rate limit headers to the successful responses, rejections always have them
+	ResponseHeaders bool
+	// Looks up the rates for the token, tokens without overrides use the limiter's rates
+	Overrides RateOverrides
 }
 
 func NewTokenLimiter(mapper limit.MapperFn, rate Rate) (*TokenLimiter, error) {
@@ -35,70 +43,179 @@ func NewTokenLimiter(mapper limit.MapperFn, rate Rate) (*TokenLimiter, error) {
 }
 
 func NewTokenLimiterWithOptions(mapper limit.MapperFn, rate Rate, o Options) (*TokenLimiter, error) {
+	rates, err := NewRateSet(Limit{Rate: rate, Burst: o.Burst})
+	if err != nil {
+		return nil, err
+	}
+	return NewTokenLimiterWithRates(mapper, rates, o)
+}
+
+// Creates limiter that requires requests to pass all the limits in the rate set, Burst option is ignored
+func NewTokenLimiterWithRates(mapper limit.MapperFn, rates RateSet, o Options) (*TokenLimiter, error) {
 	if mapper == nil {
 		return nil, fmt.Errorf("Provide mapper function")
 	}
-	options, err := parseOptions(o)
+	// Validate and sort the rates supplied as a literal
+	rates, err := NewRateSet(rates...)
 	if err != nil {
 		return nil, err
 	}
-	buckets, err := ttlmap.NewMapWithProvider(options.Capacity, options.TimeProvider)
+	options, err := parseOptions(o)
 	if err != nil {
 		return nil, err
 	}
 
+	var queue *limit.Queue
+	if options.Queue != nil {
+		queueOptions := *options.Queue
+		if queueOptions.TimeProvider == nil {
+			queueOptions.TimeProvider = options.TimeProvider
+		}
+		if queue, err = limit.NewQueue(queueOptions); err != nil {
+			return nil, err
+		}
+	}
+
 	return &TokenLimiter{
-		rate:    rate,
+		rates:   rates,
 		mapper:  mapper,
 		options: options,
-		mutex:   &sync.Mutex{},
-		buckets: buckets,
+		queue:   queue,
 	}, nil
 }
 
+// Returns the rate with the shortest period
 func (tl *TokenLimiter) GetRate() Rate {
-	return tl.rate
+	return tl.rates[0].Rate
+}
+
+func (tl *TokenLimiter) GetRates() RateSet {
+	return tl.rates
 }
 
+// Returns the burst of the rate with the shortest period
 func (tl *TokenLimiter) GetBurst() int64 {
-	return tl.options.Burst
+	return tl.rates[0].Burst
 }
 
 func (tl *TokenLimiter) GetCapacity() int {
 	return tl.options.Capacity
 }
 
-func (tl *TokenLimiter) ProcessRequest(r request.Request) (*http.Response, error) {
-	tl.mutex.Lock()
-	defer tl.mutex.Unlock()
+func (tl *TokenLimiter) GetStore() BucketStore {
+	return tl.options.Store
+}
 
+func (tl *TokenLimiter) ProcessRequest(r request.Request) (*http.Response, error) {
 	token, amount, err := tl.mapper(r)
 	if err != nil {
 		return nil, err
 	}
 
-	bucketI, exists := tl.buckets.Get(token)
-	if !exists {
-		bucketI, err = NewTokenBucket(tl.rate, tl.options.Burst+1, tl.options.TimeProvider)
+	rates, err := tl.getRates(token)
+	if err != nil {
+		return nil, err
+	}
+
+	var state *BucketState
+	consume := func() (bool, time.Duration, error) {
+		s, err := tl.options.Store.Consume(token, rates, amount)
 		if err != nil {
+			return false, 0, err
+		}
+		state = &s
+		return s.Delay == 0, s.Delay, nil
+	}
+
+	if tl.queue == nil {
+		ok, _, err := consume()
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return tl.reject(r, state), nil
+		}
+	} else {
+		switch err := tl.queue.Acquire(r, token, consume); err {
+		case nil:
+		case limit.ErrQueueFull, limit.ErrQueueTimeout:
+			// State is nil in case if the queue was full before the request could try the bucket
+			return tl.reject(r, state), nil
+		default:
 			return nil, err
 		}
-		// We set ttl as 10 times rate period. E.g. if rate is 100 requests/second per client ip
-		// the counters for this ip will expire after 10 seconds of inactivity
-		tl.buckets.Set(token, bucketI, int(tl.rate.Period/time.Second)*10+1)
 	}
-	bucket := bucketI.(*TokenBucket)
-	delay, err := bucket.Consume(amount)
+
+	if tl.options.ResponseHeaders {
+		r.SetUserData(tl.userDataKey(), state)
+	}
+	return nil, nil
+}
+
+func (tl *TokenLimiter) getRates(token string) (RateSet, error) {
+	if tl.options.Overrides == nil {
+		return tl.rates, nil
+	}
+	rates, ok, err := tl.options.Overrides.GetRates(token)
 	if err != nil {
 		return nil, err
 	}
-	if delay > 0 {
-		return netutils.NewTextResponse(r.GetHttpRequest(), errors.StatusTooManyRequests, "Too many requests"), nil
+	if !ok {
+		return tl.rates, nil
 	}
-	return nil, nil
+	return rates, nil
+}
+
+// Formats the rejection with the error formatter, adds rate limit headers and Retry-After if the bucket state is known
+func (tl *TokenLimiter) reject(r request.Request, state *BucketState) *http.Response {
+	re := netutils.NewErrorResponse(r.GetHttpRequest(), tl.options.ErrorFormatter,
+		&errors.HttpError{StatusCode: errors.StatusTooManyRequests, Body: "Too many requests"})
+	if state != nil {
+		tl.setHeaders(re.Header, state)
+		re.Header.Set(headers.RetryAfter, strconv.FormatInt(ceilSeconds(state.Delay), 10))
+	}
+	return re
+}
+
+// Sets the headers defined in https://tools.ietf.org/html/draft-ietf-httpapi-ratelimit-headers for the most
+// restrictive bucket, the limit is the size of the bucket and reset is the time till the bucket is full
+func (tl *TokenLimiter) setHeaders(h http.Header, state *BucketState) {
+	h.Set(headers.RateLimitLimit, strconv.FormatInt(state.Limit, 10))
+	h.Set(headers.RateLimitRemaining, strconv.FormatInt(state.Remaining, 10))
+	h.Set(headers.RateLimitReset, strconv.FormatInt(ceilSeconds(state.Reset), 10))
+}
+
+// Requests keep the bucket state under this key till the response is received
+func (tl *TokenLimiter) userDataKey() string {
+	return fmt.Sprintf("tokenbucket.state.%p", tl)
+}
+
+func ceilSeconds(d time.Duration) int64 {
+	return int64((d + time.Second - 1) / time.Second)
+}
+
+// Returns the stats of the queue, or zero stats if the limiter is not queueing requests
+func (tl *TokenLimiter) GetQueueStats() limit.QueueStats {
+	if tl.queue == nil {
+		return limit.QueueStats{}
+	}
+	return tl.queue.GetStats()
 }
 
 func (tl *TokenLimiter) ProcessResponse(r request.Request, a request.Attempt) {
+	if !tl.options.ResponseHeaders {
+		return
+	}
+	key := tl.userDataKey()
+	state, ok := r.GetUserData(key)
+	if !ok {
+		return
+	}
+	r.DeleteUserData(key)
+	if a == nil || a.GetResponse() == nil {
+		return
+	}
+	tl.setHeaders(a.GetResponse().Header, state.(*BucketState))
 }
 
 // Check arguments and initialize defaults
@@ -109,6 +226,16 @@ func parseOptions(o Options) (Options, error) {
 	if o.TimeProvider == nil {
 		o.TimeProvider = &timetools.RealTime{}
 	}
+	if o.ErrorFormatter == nil {
+		o.ErrorFormatter = &errors.JsonFormatter{}
+	}
+	if o.Store == nil {
+		store, err := NewMemoryStore(o.Capacity, o.TimeProvider)
+		if err != nil {
+			return o, err
+		}
+		o.Store = store
+	}
 	return o, nil
 }
 
@@ -5,6 +5,7 @@ import (
 	. "github.com/mailgun/vulcan/limit"
 	"github.com/mailgun/vulcan/request"
 	. "gopkg.in/check.v1"
+	"io/ioutil"
 	"net/http"
 	"time"
 )
@@ -100,6 +101,134 @@ func (s *LimiterSuite) TestExpiration(c *C) {
 	c.Assert(re, IsNil)
 }
 
+func (s *LimiterSuite) TestRejectionHeaders(c *C) {
+	l, err := NewTokenLimiterWithOptions(
+		MapClientIp, Rate{Units: 1, Period: 10 * time.Second}, Options{TimeProvider: s.tm, Burst: 1})
+	c.Assert(err, IsNil)
+
+	for i := 0; i < 2; i++ {
+		re, err := l.ProcessRequest(makeRequest("1.2.3.4"))
+		c.Assert(re, IsNil)
+		c.Assert(err, IsNil)
+	}
+
+	re, err := l.ProcessRequest(makeRequest("1.2.3.4"))
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, 429)
+	c.Assert(re.Header.Get("Content-Type"), Equals, "application/json")
+	c.Assert(re.Header.Get("Retry-After"), Equals, "10")
+	c.Assert(re.Header.Get("RateLimit-Limit"), Equals, "2")
+	c.Assert(re.Header.Get("RateLimit-Remaining"), Equals, "0")
+	c.Assert(re.Header.Get("RateLimit-Reset"), Equals, "20")
+
+	body, err := ioutil.ReadAll(re.Body)
+	c.Assert(err, IsNil)
+	c.Assert(string(body), Equals, `{"error":"Too many requests"}`)
+}
+
+func (s *LimiterSuite) TestResponseHeaders(c *C) {
+	l, err := NewTokenLimiterWithOptions(
+		MapClientIp, Rate{Units: 1, Period: time.Second}, Options{TimeProvider: s.tm, Burst: 4, ResponseHeaders: true})
+	c.Assert(err, IsNil)
+
+	r := request.NewBaseRequest(&http.Request{RemoteAddr: "1.2.3.4"}, 1, nil)
+	re, err := l.ProcessRequest(r)
+	c.Assert(re, IsNil)
+	c.Assert(err, IsNil)
+
+	response := &http.Response{Header: make(http.Header)}
+	l.ProcessResponse(r, &request.BaseAttempt{Response: response})
+	c.Assert(response.Header.Get("RateLimit-Limit"), Equals, "5")
+	c.Assert(response.Header.Get("RateLimit-Remaining"), Equals, "4")
+	c.Assert(response.Header.Get("RateLimit-Reset"), Equals, "1")
+	c.Assert(response.Header.Get("Retry-After"), Equals, "")
+}
+
+// Request has to pass all the rates in the set
+func (s *LimiterSuite) TestRates(c *C) {
+	rates, err := NewRateSet(
+		Limit{Rate: Rate{Units: 10, Period: time.Second}, Burst: 9},
+		Limit{Rate: Rate{Units: 2, Period: time.Minute}, Burst: 1})
+	c.Assert(err, IsNil)
+
+	l, err := NewTokenLimiterWithRates(MapClientIp, rates, Options{TimeProvider: s.tm})
+	c.Assert(err, IsNil)
+
+	for i := 0; i < 2; i++ {
+		re, err := l.ProcessRequest(makeRequest("1.2.3.4"))
+		c.Assert(re, IsNil)
+		c.Assert(err, IsNil)
+	}
+
+	re, err := l.ProcessRequest(makeRequest("1.2.3.4"))
+	c.Assert(err, IsNil)
+	c.Assert(re, NotNil)
+	c.Assert(re.Header.Get("RateLimit-Limit"), Equals, "2")
+	c.Assert(re.Header.Get("Retry-After"), Equals, "30")
+}
+
+func (s *LimiterSuite) TestOverrides(c *C) {
+	table := NewRateTable()
+	premium, err := NewRateSet(Limit{Rate: Rate{Units: 1, Period: time.Second}, Burst: 1})
+	c.Assert(err, IsNil)
+	c.Assert(table.Set("1.2.3.4", premium), IsNil)
+
+	l, err := NewTokenLimiterWithOptions(
+		MapClientIp, Rate{Units: 1, Period: time.Second}, Options{TimeProvider: s.tm, Overrides: table})
+	c.Assert(err, IsNil)
+
+	// Premium client has bigger burst
+	for i := 0; i < 2; i++ {
+		re, err := l.ProcessRequest(makeRequest("1.2.3.4"))
+		c.Assert(re, IsNil)
+		c.Assert(err, IsNil)
+	}
+
+	// Other clients use the default rate
+	re, err := l.ProcessRequest(makeRequest("1.2.3.5"))
+	c.Assert(re, IsNil)
+	c.Assert(err, IsNil)
+
+	re, err = l.ProcessRequest(makeRequest("1.2.3.5"))
+	c.Assert(re, NotNil)
+	c.Assert(err, IsNil)
+}
+
+// Requests over the limit wait in the queue for the refill
+func (s *LimiterSuite) TestQueue(c *C) {
+	l, err := NewTokenLimiterWithOptions(
+		MapClientIp, Rate{Units: 50, Period: time.Second},
+		Options{Queue: &QueueOptions{MaxDepth: 10, MaxWait: time.Second}})
+	c.Assert(err, IsNil)
+
+	for i := 0; i < 3; i++ {
+		re, err := l.ProcessRequest(makeRequest("1.2.3.4"))
+		c.Assert(re, IsNil)
+		c.Assert(err, IsNil)
+	}
+
+	stats := l.GetQueueStats()
+	c.Assert(stats.Queued, Equals, int64(2))
+	c.Assert(stats.Served, Equals, int64(2))
+	c.Assert(stats.MaxWait > 0, Equals, true)
+}
+
+func (s *LimiterSuite) TestQueueTimeout(c *C) {
+	l, err := NewTokenLimiterWithOptions(
+		MapClientIp, Rate{Units: 1, Period: time.Minute},
+		Options{Queue: &QueueOptions{MaxDepth: 10, MaxWait: time.Millisecond}})
+	c.Assert(err, IsNil)
+
+	re, err := l.ProcessRequest(makeRequest("1.2.3.4"))
+	c.Assert(re, IsNil)
+	c.Assert(err, IsNil)
+
+	re, err = l.ProcessRequest(makeRequest("1.2.3.4"))
+	c.Assert(re, NotNil)
+	c.Assert(err, IsNil)
+	c.Assert(l.GetQueueStats().TimedOut, Equals, int64(1))
+}
+
 func makeRequest(ip string) request.Request {
 	return &request.BaseRequest{
 		HttpRequest: &http.Request{
@@ -263,6 +263,24 @@ func (r *RoundRobin) RemoveEndpoint(endpoint Endpoint) error {
 	return nil
 }
 
+// Changes the weight of the endpoint, weight 0 stops the new requests to the endpoint, e.g. while it's draining
+func (r *RoundRobin) SetEndpointWeight(endpoint Endpoint, weight int) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if weight < 0 {
+		return fmt.Errorf("Weight should be >=0")
+	}
+	e, _ := r.findEndpointByUrl(endpoint.GetUrl())
+	if e == nil {
+		return fmt.Errorf("Endpoint not found")
+	}
+	e.weight = weight
+	e.effectiveWeight = weight
+	r.resetState()
+	return nil
+}
+
 func (rr *RoundRobin) ProcessRequest(Request) (*http.Response, error) {
 	return nil, nil
 }
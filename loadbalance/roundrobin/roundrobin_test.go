@@ -152,6 +152,36 @@ func (s *RoundRobinSuite) TestRemoveEndpoint(c *C) {
 	c.Assert(u, Equals, uA)
 }
 
+func (s *RoundRobinSuite) TestSetEndpointWeight(c *C) {
+	r := s.newRR()
+
+	uA := MustParseUrl("http://localhost:5000")
+	uB := MustParseUrl("http://localhost:5001")
+	r.AddEndpoint(uA)
+	r.AddEndpoint(uB)
+
+	// Endpoint with 0 weight gets no requests
+	c.Assert(r.SetEndpointWeight(uB, 0), IsNil)
+	for i := 0; i < 3; i++ {
+		u, err := r.NextEndpoint(s.req)
+		c.Assert(err, IsNil)
+		c.Assert(u, Equals, uA)
+	}
+	c.Assert(r.FindEndpointById(uB.GetId()).GetOriginalWeight(), Equals, 0)
+
+	c.Assert(r.SetEndpointWeight(uA, 0), IsNil)
+	_, err := r.NextEndpoint(s.req)
+	c.Assert(err, NotNil)
+
+	c.Assert(r.SetEndpointWeight(uB, 2), IsNil)
+	u, err := r.NextEndpoint(s.req)
+	c.Assert(err, IsNil)
+	c.Assert(u, Equals, uB)
+
+	c.Assert(r.SetEndpointWeight(uB, -1), NotNil)
+	c.Assert(r.SetEndpointWeight(MustParseUrl("http://localhost:5002"), 1), NotNil)
+}
+
 func (s *RoundRobinSuite) TestAddSameEndpoint(c *C) {
 	r := s.newRR()
 
@@ -0,0 +1,210 @@
+package httploc
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	timetools "github.com/mailgun/gotools-time"
+
+	"github.com/mailgun/vulcan/dialer"
+	"github.com/mailgun/vulcan/endpoint"
+	"github.com/mailgun/vulcan/netutils"
+)
+
+// Dials the endpoints with the location's dialer, unix socket endpoints are dialed by the socket path.
+// Connections are tracked per endpoint, and the pre-warmed connections are handed out before dialing the new ones.
+type endpointDialer struct {
+	dialer    dialer.Dialer
+	timeout   time.Duration
+	keepAlive KeepAlive
+	tp        timetools.TimeProvider
+	conns     *connTracker
+	mutex     *sync.Mutex
+	prewarmed map[string][]*trackedConn
+}
+
+func newEndpointDialer(o Options, conns *connTracker) *endpointDialer {
+	d := &endpointDialer{
+		dialer:    o.Dialer,
+		timeout:   o.Timeouts.Dial,
+		keepAlive: o.KeepAlive,
+		tp:        o.TimeProvider,
+		conns:     conns,
+		mutex:     &sync.Mutex{},
+		prewarmed: make(map[string][]*trackedConn),
+	}
+	if d.dialer == nil {
+		d.dialer = &net.Dialer{
+			Timeout:   o.Timeouts.Dial,
+			KeepAlive: o.KeepAlive.Period,
+		}
+	}
+	return d
+}
+
+func (d *endpointDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	e, _ := ctx.Value(endpointKey{}).(endpoint.Endpoint)
+	id := addr
+	if e != nil {
+		id = e.GetId()
+		if e.GetUrl().Scheme == netutils.UnixScheme {
+			network, addr = "unix", e.GetUrl().Path
+		}
+	}
+	if conn := d.takePrewarmed(id); conn != nil {
+		return conn, nil
+	}
+	return d.dial(ctx, id, network, addr)
+}
+
+func (d *endpointDialer) dial(ctx context.Context, id, network, addr string) (*trackedConn, error) {
+	ctx, cancel := context.WithTimeout(ctx, d.timeout)
+	defer cancel()
+	stats := d.conns.get(id)
+	stats.dialed()
+	conn, err := d.dialer.DialContext(ctx, network, addr)
+	if err != nil {
+		stats.dialFailed()
+		return nil, err
+	}
+	return newTrackedConn(conn, stats, d.lifetime()), nil
+}
+
+// Picks the lifetime of the new connection, jitter makes the connections dialed at the same time expire at different times
+func (d *endpointDialer) lifetime() time.Time {
+	lifetime := d.keepAlive.MaxConnLifetime
+	if lifetime <= 0 {
+		return time.Time{}
+	}
+	if jitter := d.keepAlive.MaxConnLifetimeJitter; jitter > 0 {
+		lifetime -= time.Duration(rand.Int63n(int64(jitter)))
+	}
+	return d.tp.UtcNow().Add(lifetime)
+}
+
+// Dials the connections to the endpoint until there are KeepAlive.PrewarmConnsPerHost connections waiting
+func (d *endpointDialer) prewarm(e endpoint.Endpoint) error {
+	network, addr := "tcp", hostWithPort(e.GetUrl())
+	if e.GetUrl().Scheme == netutils.UnixScheme {
+		network, addr = "unix", e.GetUrl().Path
+	}
+	for {
+		d.mutex.Lock()
+		count := len(d.prewarmed[e.GetId()])
+		d.mutex.Unlock()
+		if count >= d.keepAlive.PrewarmConnsPerHost {
+			return nil
+		}
+		conn, err := d.dial(context.Background(), e.GetId(), network, addr)
+		if err != nil {
+			return fmt.Errorf("Failed to pre-warm connection to %s: %s", e, err)
+		}
+		conn.prewarmed = d.tp.UtcNow()
+		d.mutex.Lock()
+		d.prewarmed[e.GetId()] = append(d.prewarmed[e.GetId()], conn)
+		conn.expiry = time.AfterFunc(d.prewarmedTimeout(conn), func() { d.expirePrewarmed(e.GetId(), conn) })
+		d.mutex.Unlock()
+	}
+}
+
+// Returns the time the pre-warmed connection waits to be picked up: the idle timeout, or less if the connection expires earlier
+func (d *endpointDialer) prewarmedTimeout(conn *trackedConn) time.Duration {
+	timeout := d.keepAlive.IdleConnTimeout
+	if !conn.expires.IsZero() {
+		if lifetime := conn.expires.Sub(conn.prewarmed); lifetime < timeout {
+			timeout = lifetime
+		}
+	}
+	return timeout
+}
+
+// Closes the pre-warmed connection that has not been picked up in time, so it does not hold the endpoint's resources
+func (d *endpointDialer) expirePrewarmed(id string, conn *trackedConn) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	conns := d.prewarmed[id]
+	for i, c := range conns {
+		if c == conn {
+			d.setPrewarmed(id, append(conns[:i:i], conns[i+1:]...))
+			conn.Close()
+			return
+		}
+	}
+}
+
+// Returns the oldest pre-warmed connection, connections that waited for longer than the idle timeout are closed
+func (d *endpointDialer) takePrewarmed(id string) *trackedConn {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	conns := d.prewarmed[id]
+	for len(conns) != 0 {
+		conn := conns[0]
+		conns = conns[1:]
+		conn.expiry.Stop()
+		now := d.tp.UtcNow()
+		if now.Sub(conn.prewarmed) < d.keepAlive.IdleConnTimeout && !conn.expired(now) {
+			d.setPrewarmed(id, conns)
+			return conn
+		}
+		conn.Close()
+	}
+	d.setPrewarmed(id, conns)
+	return nil
+}
+
+func (d *endpointDialer) setPrewarmed(id string, conns []*trackedConn) {
+	if len(conns) == 0 {
+		delete(d.prewarmed, id)
+	} else {
+		d.prewarmed[id] = conns
+	}
+}
+
+// Closes the pre-warmed connections, called when the dialer is replaced
+func (d *endpointDialer) close() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	for id, conns := range d.prewarmed {
+		for _, conn := range conns {
+			conn.expiry.Stop()
+			conn.Close()
+		}
+		delete(d.prewarmed, id)
+	}
+}
+
+func hostWithPort(u *url.URL) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	if u.Scheme == "https" {
+		return net.JoinHostPort(u.Hostname(), "443")
+	}
+	return net.JoinHostPort(u.Hostname(), "80")
+}
+
+type endpointKey struct {
+}
+
+// Lets the dialer know the endpoint the connection is dialed for. Requests to the unix socket endpoints
+// are sent as http requests to the placeholder host unique for the socket, so the connections to different sockets
+// are not mixed in the pool, while the dialer gets the path from the endpoint
+func withEndpoint(req *http.Request, e endpoint.Endpoint) *http.Request {
+	if e.GetUrl().Scheme == netutils.UnixScheme {
+		h := fnv.New64a()
+		h.Write([]byte(e.GetUrl().Path))
+		req.URL.Scheme = "http"
+		req.URL.Host = fmt.Sprintf("unix-%x", h.Sum64())
+		if req.Host == "" {
+			req.Host = "localhost"
+		}
+	}
+	return req.WithContext(context.WithValue(req.Context(), endpointKey{}, e))
+}
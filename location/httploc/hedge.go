@@ -0,0 +1,393 @@
+package httploc
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/mailgun/gotools-log"
+
+	"github.com/mailgun/vulcan/endpoint"
+	"github.com/mailgun/vulcan/failover"
+	"github.com/mailgun/vulcan/netutils"
+	"github.com/mailgun/vulcan/request"
+)
+
+// Hedging sends a second attempt to another endpoint in case if the first attempt
+// has not replied in time. The first successful response wins, the other attempt is cancelled.
+type Hedging struct {
+	// Fixed delay before sending the hedged attempt. If not set, the delay is
+	// calculated as a percentile of the latencies observed by this location.
+	Delay time.Duration
+	// Percentile of the observed latencies used as a delay, e.g. 95
+	Percentile float64
+	// Location won't hedge requests until it observes this amount of successful attempts
+	MinSamples int
+	// Maximum amount of hedged attempts in flight for this location
+	MaxInFlight int64
+	// Predicate that defines what requests can be hedged, defaults to GET requests.
+	// Note that only requests without body are hedged, as the body can't be read concurrently.
+	ShouldHedge failover.Predicate
+}
+
+const (
+	DefaultHedgingPercentile  = 95
+	DefaultHedgingMinSamples  = 100
+	DefaultHedgingMaxInFlight = 10
+	// Amount of latency samples kept to calculate the percentiles
+	latencyWindow = 1000
+)
+
+func parseHedging(h *Hedging) (*Hedging, error) {
+	if h == nil {
+		return nil, nil
+	}
+	// Copy so we don't modify the options supplied by the caller
+	out := *h
+	if out.Percentile == 0 {
+		out.Percentile = DefaultHedgingPercentile
+	}
+	if out.Percentile < 0 || out.Percentile > 100 {
+		return nil, fmt.Errorf("Hedging percentile should be in range (0, 100], got: %f", out.Percentile)
+	}
+	if out.MinSamples <= 0 {
+		out.MinSamples = DefaultHedgingMinSamples
+	}
+	if out.MaxInFlight <= 0 {
+		out.MaxInFlight = DefaultHedgingMaxInFlight
+	}
+	if out.ShouldHedge == nil {
+		out.ShouldHedge = failover.RequestMethodEq("GET")
+	}
+	return &out, nil
+}
+
+// Only the first attempt of the requests without body can be hedged
+func (l *HttpLocation) shouldHedge(o *Options, req request.Request) bool {
+	if o.Hedging == nil || len(req.GetAttempts()) != 0 || !o.Hedging.ShouldHedge(req) {
+		return false
+	}
+	size, err := req.GetBody().TotalSize()
+	return err == nil && size == 0
+}
+
+func (l *HttpLocation) hedgeDelay(o *Options) (time.Duration, bool) {
+	if o.Hedging.Delay > 0 {
+		return o.Hedging.Delay, true
+	}
+	return l.latencies.percentile(o.Hedging.Percentile, o.Hedging.MinSamples)
+}
+
+// Returns the amount of hedged attempts in flight
+func (l *HttpLocation) GetHedgesInFlight() int64 {
+	return atomic.LoadInt64(&l.hedges)
+}
+
+type attemptResult struct {
+	req      *attemptRequest
+	response *http.Response
+	err      error
+}
+
+// Proxies the request to the endpoint and, in case if it takes too long, sends another attempt
+// to the different endpoint. Finished attempts are recorded in the request, the winning attempt goes last,
+// while the attempt cancelled in favor of the winner is not recorded.
+func (l *HttpLocation) hedgedRoundTrip(tr *http.Transport, o *Options, originalRequest *http.Request, e endpoint.Endpoint, req request.Request) (*http.Response, error) {
+	delay, ok := l.hedgeDelay(o)
+	if !ok {
+		return l.proxyToEndpoint(tr, o, e, req)
+	}
+
+	results := make(chan *attemptResult, 2)
+	primary := newAttemptRequest(req, req.GetHttpRequest(), req.GetBody())
+	l.startAttempt(tr, o, e, primary, results)
+
+	select {
+	case r := <-results:
+		return l.finishHedging(req, r)
+	case <-o.TimeProvider.After(delay):
+	}
+
+	hedge := l.startHedge(tr, o, originalRequest, e, req, results)
+	if hedge == nil {
+		return l.finishHedging(req, <-results)
+	}
+	defer atomic.AddInt64(&l.hedges, -1)
+
+	first := <-results
+	if first.err != nil || first.response == nil {
+		// The first attempt to finish has failed, give a chance to the other one
+		return l.finishHedging(req, first, <-results)
+	}
+	// We have a winner, cancel the other attempt and wait for it to finish
+	if first.req == primary {
+		hedge.abandon()
+	} else {
+		primary.abandon()
+	}
+	loser := <-results
+	if loser.response != nil {
+		loser.response.Body.Close()
+	}
+	return l.finishHedging(req, loser, first)
+}
+
+// Starts hedged attempt, returns nil in case if there are too many hedges in flight
+// or the load balancer can't offer another endpoint
+func (l *HttpLocation) startHedge(tr *http.Transport, o *Options, originalRequest *http.Request, e endpoint.Endpoint, req request.Request, results chan *attemptResult) *attemptRequest {
+	if atomic.AddInt64(&l.hedges, 1) > o.Hedging.MaxInFlight {
+		atomic.AddInt64(&l.hedges, -1)
+		return nil
+	}
+
+	// Let the load balancer know that the first endpoint has been already tried
+	selector := newAttemptRequest(req, originalRequest, nil)
+	selector.attempts = []request.Attempt{&request.BaseAttempt{Endpoint: e}}
+	hedgeEndpoint, err := l.loadBalancer.NextEndpoint(selector)
+	if err != nil || hedgeEndpoint.GetId() == e.GetId() {
+		atomic.AddInt64(&l.hedges, -1)
+		return nil
+	}
+
+	// Hedged requests have no body, so each attempt can have a separate empty reader
+	body := netutils.NewMultiReaderSeeker(0, nil, bytes.NewReader(nil))
+	hedge := newAttemptRequest(req, l.copyRequest(originalRequest, body, hedgeEndpoint), body)
+	log.Infof("%s hedging to %s", req, hedgeEndpoint)
+	l.startAttempt(tr, o, hedgeEndpoint, hedge, results)
+	return hedge
+}
+
+func (l *HttpLocation) startAttempt(tr *http.Transport, o *Options, e endpoint.Endpoint, req *attemptRequest, results chan *attemptResult) {
+	ctx, cancel := context.WithCancel(req.httpRequest.Context())
+	req.httpRequest = req.httpRequest.WithContext(ctx)
+	req.cancel = cancel
+	go func() {
+		response, err := l.proxyToEndpoint(tr, o, e, req)
+		if response != nil {
+			// Keep the attempt context alive until the response body is consumed
+			response.Body = &cancelOnClose{ReadCloser: response.Body, cancel: cancel}
+		} else {
+			cancel()
+		}
+		results <- &attemptResult{req: req, response: response, err: err}
+	}()
+}
+
+// Records the attempts in the parent request and returns the result of the last one,
+// the user data of the last attempt is kept in the parent request
+func (l *HttpLocation) finishHedging(req request.Request, results ...*attemptResult) (*http.Response, error) {
+	for _, r := range results {
+		for _, a := range r.req.attempts {
+			req.AddAttempt(a)
+		}
+	}
+	last := results[len(results)-1]
+	last.req.mergeUserData()
+	req.SetHttpRequest(last.req.httpRequest)
+	return last.response, last.err
+}
+
+// attemptRequest isolates concurrent attempt from the parent request. It has its own http request,
+// body, attempts and user data, while sharing the id with the parent. Middlewares of both attempts
+// keep their state in the user data at the same time, so the attempt sees the parent's user data,
+// but its changes stay in the attempt until it's merged into the parent.
+type attemptRequest struct {
+	request.Request
+	httpRequest *http.Request
+	body        netutils.MultiReader
+	attempts    []request.Attempt
+	cancel      context.CancelFunc
+	// Set once the other attempt has won and this one is cancelled
+	abandoned     int32
+	userDataMutex *sync.RWMutex
+	userData      map[string]interface{}
+	// Keys deleted by the attempt, so the parent's values are not visible anymore
+	deleted map[string]bool
+}
+
+func newAttemptRequest(parent request.Request, r *http.Request, body netutils.MultiReader) *attemptRequest {
+	return &attemptRequest{
+		Request:       parent,
+		httpRequest:   r,
+		body:          body,
+		userDataMutex: &sync.RWMutex{},
+		userData:      make(map[string]interface{}),
+		deleted:       make(map[string]bool),
+	}
+}
+
+// Cancels the attempt that has lost the race
+func (r *attemptRequest) abandon() {
+	atomic.StoreInt32(&r.abandoned, 1)
+	r.cancel()
+}
+
+// Returns true if the attempt has failed because it was cancelled after the other attempt had won
+func isAbandoned(req request.Request, a *request.BaseAttempt) bool {
+	r, ok := req.(*attemptRequest)
+	return ok && a.GetError() != nil && atomic.LoadInt32(&r.abandoned) == 1
+}
+
+func (r *attemptRequest) String() string {
+	return fmt.Sprintf("Request(id=%d, method=%s, url=%s, attempts=%d)", r.GetId(), r.httpRequest.Method, r.httpRequest.URL.String(), len(r.GetAttempts()))
+}
+
+func (r *attemptRequest) GetHttpRequest() *http.Request {
+	return r.httpRequest
+}
+
+func (r *attemptRequest) SetHttpRequest(hr *http.Request) {
+	r.httpRequest = hr
+}
+
+func (r *attemptRequest) GetBody() netutils.MultiReader {
+	return r.body
+}
+
+func (r *attemptRequest) SetBody(b netutils.MultiReader) {
+	r.body = b
+}
+
+func (r *attemptRequest) AddAttempt(a request.Attempt) {
+	r.attempts = append(r.attempts, a)
+}
+
+func (r *attemptRequest) GetAttempts() []request.Attempt {
+	return append(r.Request.GetAttempts(), r.attempts...)
+}
+
+func (r *attemptRequest) GetLastAttempt() request.Attempt {
+	if len(r.attempts) != 0 {
+		return r.attempts[len(r.attempts)-1]
+	}
+	return r.Request.GetLastAttempt()
+}
+
+func (r *attemptRequest) SetUserData(key string, baton interface{}) {
+	r.userDataMutex.Lock()
+	defer r.userDataMutex.Unlock()
+	r.userData[key] = baton
+	delete(r.deleted, key)
+}
+
+func (r *attemptRequest) GetUserData(key string) (interface{}, bool) {
+	r.userDataMutex.RLock()
+	baton, ok := r.userData[key]
+	deleted := r.deleted[key]
+	r.userDataMutex.RUnlock()
+	if ok || deleted {
+		return baton, ok
+	}
+	return r.Request.GetUserData(key)
+}
+
+func (r *attemptRequest) DeleteUserData(key string) {
+	r.userDataMutex.Lock()
+	defer r.userDataMutex.Unlock()
+	delete(r.userData, key)
+	r.deleted[key] = true
+}
+
+// Applies the changes of the user data made by the attempt to the parent request
+func (r *attemptRequest) mergeUserData() {
+	r.userDataMutex.RLock()
+	defer r.userDataMutex.RUnlock()
+	for key := range r.deleted {
+		r.Request.DeleteUserData(key)
+	}
+	for key, baton := range r.userData {
+		r.Request.SetUserData(key, baton)
+	}
+}
+
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
+
+// Keeps a window of the latest successful attempt durations
+type latencyTracker struct {
+	mutex   *sync.Mutex
+	samples []time.Duration
+	next    int
+	// Percentiles are recalculated once the window has been refreshed enough
+	changes int
+	cached  map[float64]time.Duration
+}
+
+func newLatencyTracker() *latencyTracker {
+	return &latencyTracker{
+		mutex:   &sync.Mutex{},
+		samples: make([]time.Duration, 0, latencyWindow),
+		cached:  make(map[float64]time.Duration),
+	}
+}
+
+func (t *latencyTracker) observe(d time.Duration) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if len(t.samples) < latencyWindow {
+		t.samples = append(t.samples, d)
+	} else {
+		t.samples[t.next] = d
+		t.next = (t.next + 1) % latencyWindow
+	}
+	t.changes += 1
+}
+
+// Returns false if there are not enough samples to calculate the percentile
+func (t *latencyTracker) percentile(p float64, minSamples int) (time.Duration, bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if len(t.samples) < minSamples || len(t.samples) == 0 {
+		return 0, false
+	}
+	if value, ok := t.cached[p]; ok && t.changes < latencyWindow/10 {
+		return value, true
+	}
+	if t.changes != 0 {
+		t.cached = make(map[float64]time.Duration)
+		t.changes = 0
+	}
+	sorted := make([]time.Duration, len(t.samples))
+	copy(sorted, t.samples)
+	sort.Sort(durations(sorted))
+
+	index := int(float64(len(sorted))*p/100+0.5) - 1
+	if index < 0 {
+		index = 0
+	}
+	if index >= len(sorted) {
+		index = len(sorted) - 1
+	}
+	t.cached[p] = sorted[index]
+	return sorted[index], true
+}
+
+type durations []time.Duration
+
+func (d durations) Len() int {
+	return len(d)
+}
+
+func (d durations) Less(i, j int) bool {
+	return d[i] < d[j]
+}
+
+func (d durations) Swap(i, j int) {
+	d[i], d[j] = d[j], d[i]
+}
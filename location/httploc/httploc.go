@@ -3,22 +3,26 @@ package httploc
 
 import (
 	"fmt"
-	"net"
+	"io/ioutil"
 	"net/http"
 	"os"
+	"reflect"
 	"sync"
 	"time"
 
 	log "github.com/mailgun/gotools-log"
 	timetools "github.com/mailgun/gotools-time"
 
+	"github.com/mailgun/vulcan/dialer"
 	"github.com/mailgun/vulcan/endpoint"
 	"github.com/mailgun/vulcan/errors"
 	"github.com/mailgun/vulcan/failover"
+	"github.com/mailgun/vulcan/grpc"
 	"github.com/mailgun/vulcan/loadbalance"
 	"github.com/mailgun/vulcan/middleware"
 	"github.com/mailgun/vulcan/netutils"
 	"github.com/mailgun/vulcan/request"
+	"github.com/mailgun/vulcan/retry"
 )
 
 // Location with built in failover and load balancing support
@@ -27,6 +31,10 @@ type HttpLocation struct {
 	id string
 	// Transport with customized timeouts
 	transport *http.Transport
+	// Dialer of the transport, keeps the pre-warmed connections
+	dialer *endpointDialer
+	// Connections of the endpoints, survives the transport changes
+	conns *connTracker
 	// Load balancer controls endpoints for this location
 	loadBalancer loadbalance.LoadBalancer
 	// Timeouts, failover and other optional settings
@@ -37,6 +45,10 @@ type HttpLocation struct {
 	observerChain *middleware.ObserverChain
 	// Mutex controls the changes on the Transport and connection options
 	mutex *sync.RWMutex
+	// Latencies of the successful attempts, used to calculate hedging delays
+	latencies *latencyTracker
+	// Amount of hedged attempts in flight
+	hedges int64
 }
 
 type Timeouts struct {
@@ -53,12 +65,51 @@ type KeepAlive struct {
 	Period time.Duration
 	// How many idle connections will be kept per host
 	MaxIdleConnsPerHost int
+	// Limits the connections per host, including the ones serving requests, requests over the limit
+	// wait for the connection to free up, no limit if 0
+	MaxConnsPerHost int
+	// How long the idle connection is kept open before it's closed
+	IdleConnTimeout time.Duration
+	// Connections older than that are closed once they finish serving the request,
+	// so the load is rebalanced after the new endpoints are added. Connections live forever if 0
+	MaxConnLifetime time.Duration
+	// Connections are recycled up to this much earlier, so the connections dialed together don't expire
+	// at the same time, defaults to the tenth of MaxConnLifetime
+	MaxConnLifetimeJitter time.Duration
+	// How many connections are dialed to each endpoint in advance by Prewarm
+	PrewarmConnsPerHost int
+}
+
+// Protocol spoken to the endpoints
+type Protocol int
+
+const (
+	// HTTP/1.1 only
+	HTTP1 Protocol = iota
+	// HTTP/2 for https endpoints if they agree on it in the TLS handshake, HTTP/1.1 otherwise
+	HTTP2
+	// HTTP/2 only, cleartext HTTP/2 (h2c) with prior knowledge for http endpoints, so they have to support it
+	H2C
+)
+
+func (p Protocol) String() string {
+	switch p {
+	case HTTP1:
+		return "HTTP/1.1"
+	case HTTP2:
+		return "HTTP/2"
+	case H2C:
+		return "h2c"
+	}
+	return fmt.Sprintf("Protocol(%d)", int(p))
 }
 
 // Limits contains various limits one can supply for a location.
 type Limits struct {
 	MaxMemBodyBytes int64 // Maximum size to keep in memory before buffering to disk
 	MaxBodyBytes    int64 // Maximum size of a request body in bytes
+	// Memory and disk space for the request bodies, can be shared by locations to cap the total usage
+	BodyStorage netutils.BufferStorage
 }
 
 // Additional options to control this location, such as timeouts
@@ -70,6 +121,18 @@ type Options struct {
 	Limits Limits
 	// Predicate that defines when requests are allowed to failover
 	ShouldFailover failover.Predicate
+	// Optional policy that controls backoff and budget of the failover attempts,
+	// if not set, requests fail over immediately
+	RetryPolicy retry.Policy
+	// Optional settings for hedged requests, if not set, requests are not hedged
+	Hedging *Hedging
+	// Optional TLS settings for https endpoints, if not set, endpoints are verified with the system roots
+	TLS *TLS
+	// Protocol spoken to the endpoints, defaults to HTTP/1.1
+	Protocol Protocol
+	// Optional dialer connecting to the endpoints, e.g. through the proxy, if not set,
+	// connections are dialed directly with the dial timeout and keepalive period
+	Dialer dialer.Dialer
 	// Used in forwarding headers
 	Hostname string
 	// In this case appends new forward info to the existing header
@@ -90,6 +153,11 @@ func NewLocationWithOptions(id string, loadBalancer loadbalance.LoadBalancer, o
 	if err != nil {
 		return nil, err
 	}
+	conns := newConnTracker()
+	transport, dialer, err := newTransport(o, conns)
+	if err != nil {
+		return nil, err
+	}
 
 	observerChain := middleware.NewObserverChain()
 	observerChain.Add(BalancerId, loadBalancer)
@@ -102,13 +170,17 @@ func NewLocationWithOptions(id string, loadBalancer loadbalance.LoadBalancer, o
 		id:              id,
 		loadBalancer:    loadBalancer,
 		options:         o,
-		transport:       newTransport(o),
+		transport:       transport,
+		dialer:          dialer,
+		conns:           conns,
 		middlewareChain: middlewareChain,
 		observerChain:   observerChain,
 		mutex:           &sync.RWMutex{},
+		latencies:       newLatencyTracker(),
 	}, nil
 }
 
+// Updates the options, transport and its connection pool are kept unless the connection settings change
 func (l *HttpLocation) SetOptions(o Options) error {
 	options, err := parseOptions(o)
 	if err != nil {
@@ -117,11 +189,20 @@ func (l *HttpLocation) SetOptions(o Options) error {
 	l.mutex.Lock()
 	defer l.mutex.Unlock()
 
+	var transport *http.Transport
+	var dialer *endpointDialer
+	if !sameConnectionSettings(l.options, options) {
+		if transport, dialer, err = newTransport(options, l.conns); err != nil {
+			return err
+		}
+	}
 	if err := l.middlewareChain.Update(RewriterId, -2, &Rewriter{TrustForwardHeader: o.TrustForwardHeader, Hostname: o.Hostname}); err != nil {
 		return err
 	}
 	l.options = options
-	l.setTransport(newTransport(options))
+	if transport != nil {
+		l.setTransport(transport, dialer)
+	}
 	return nil
 }
 
@@ -137,11 +218,35 @@ func (l *HttpLocation) GetOptionsAndTransport() (Options, *http.Transport) {
 	return l.options, l.transport
 }
 
-func (l *HttpLocation) setTransport(tr *http.Transport) {
+func (l *HttpLocation) setTransport(tr *http.Transport, d *endpointDialer) {
 	if l.transport != nil {
 		go l.transport.CloseIdleConnections()
 	}
+	if l.dialer != nil {
+		go l.dialer.close()
+	}
 	l.transport = tr
+	l.dialer = d
+}
+
+// Returns the connection pool statistics by the endpoint id
+func (l *HttpLocation) GetPoolStats() map[string]PoolStats {
+	return l.conns.stats()
+}
+
+// Dials KeepAlive.PrewarmConnsPerHost connections to each of the endpoints in advance, so the first requests
+// don't wait for the connections to be established. Pre-warmed connections not picked up within IdleConnTimeout
+// are closed. TLS handshake is done once the connection is picked up.
+func (l *HttpLocation) Prewarm(endpoints ...endpoint.Endpoint) error {
+	l.mutex.RLock()
+	d := l.dialer
+	l.mutex.RUnlock()
+	for _, e := range endpoints {
+		if err := d.prewarm(e); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (l *HttpLocation) GetMiddlewareChain() *middleware.MiddlewareChain {
@@ -168,12 +273,28 @@ func (l *HttpLocation) RoundTrip(req request.Request) (*http.Response, error) {
 	// to read into memory and disk. This reader returns anerror if the total request size exceeds the
 	// prefefined MaxSizeBytes. This can occur if we got chunked request, in this case ContentLength would be set to -1
 	// and the reader would be unbounded bufio in the http.Server
-	body, err := netutils.NewBodyBufferWithOptions(originalRequest.Body, netutils.BodyBufferOptions{
-		MemBufferBytes: o.Limits.MaxMemBodyBytes,
-		MaxSizeBytes:   o.Limits.MaxBodyBytes,
-	})
-	if err != nil {
-		return nil, err
+	// Body read by the enclosing location, e.g. shadow location, is reused and released by its owner
+	if body := req.GetBody(); body != nil {
+		if err := checkBodySize(&o, body); err != nil {
+			return nil, err
+		}
+		return l.proxyWithFailover(tr, o, originalRequest, req)
+	}
+
+	var body netutils.MultiReader
+	var err error
+	if grpc.IsGrpcRequest(originalRequest) {
+		// gRPC calls can stream in both directions, so they are passed through as they arrive
+		body = netutils.NewStreamReader(originalRequest.Body, originalRequest.ContentLength)
+	} else {
+		body, err = netutils.NewBodyBufferWithOptions(originalRequest.Body, netutils.BodyBufferOptions{
+			MemBufferBytes: o.Limits.MaxMemBodyBytes,
+			MaxSizeBytes:   o.Limits.MaxBodyBytes,
+			Storage:        o.Limits.BodyStorage,
+		})
+		if err != nil {
+			return nil, err
+		}
 	}
 	if body == nil {
 		return nil, fmt.Errorf("Empty body")
@@ -182,7 +303,23 @@ func (l *HttpLocation) RoundTrip(req request.Request) (*http.Response, error) {
 	// Set request body to buffered reader that can replay the read and execute Seek
 	req.SetBody(body)
 	// Note that we don't change the original request Body as it's handled by the http server
-	defer body.Close()
+
+	response, err := l.proxyWithFailover(tr, o, originalRequest, req)
+	// Transport can keep reading the body after it has returned the response, e.g. HTTP/2 streams,
+	// so the buffer is released once the response is closed
+	if response != nil {
+		response.Body = &closeBodyOnClose{ReadCloser: response.Body, body: body}
+	} else {
+		body.Close()
+	}
+	return response, err
+}
+
+// Proxies the request to the endpoints chosen by the load balancer until the failover predicate gives up
+func (l *HttpLocation) proxyWithFailover(tr *http.Transport, o Options, originalRequest *http.Request, req request.Request) (*http.Response, error) {
+	if o.RetryPolicy != nil {
+		o.RetryPolicy.ObserveRequest(req)
+	}
 
 	for {
 		_, err := req.GetBody().Seek(0, 0)
@@ -202,17 +339,58 @@ func (l *HttpLocation) RoundTrip(req request.Request) (*http.Response, error) {
 
 		// In case if error is not nil, we allow load balancer to choose the next endpoint
 		// e.g. to do request failover. Nil error means that we got proxied the request successfully.
-		response, err := l.proxyToEndpoint(tr, &o, endpoint, req)
-		if o.ShouldFailover(req) {
-			continue
+		var response *http.Response
+		if l.shouldHedge(&o, req) {
+			response, err = l.hedgedRoundTrip(tr, &o, originalRequest, endpoint, req)
 		} else {
+			response, err = l.proxyToEndpoint(tr, &o, endpoint, req)
+		}
+		if !o.ShouldFailover(req) {
+			return response, err
+		}
+		// Streamed body can't be replayed once the endpoint has read it
+		if _, seekErr := req.GetBody().Seek(0, 0); seekErr != nil {
 			return response, err
 		}
+		delay := time.Duration(0)
+		if o.RetryPolicy != nil {
+			var ok bool
+			if delay, ok = o.RetryPolicy.NextDelay(req); !ok {
+				return response, err
+			}
+		}
+		// We are not going to use this response, release the connection
+		if response != nil {
+			response.Body.Close()
+		}
+		if delay > 0 {
+			// Client may give up while we are waiting, there's no one to retry for then
+			select {
+			case <-o.TimeProvider.After(delay):
+			case <-originalRequest.Context().Done():
+				return nil, originalRequest.Context().Err()
+			}
+		}
 	}
 	log.Errorf("All endpoints failed!")
 	return nil, fmt.Errorf("All endpoints failed")
 }
 
+// Body buffered by the enclosing location was not limited by this location's settings
+func checkBodySize(o *Options, body netutils.MultiReader) error {
+	if o.Limits.MaxBodyBytes <= 0 {
+		return nil
+	}
+	size, err := body.TotalSize()
+	if err != nil {
+		return err
+	}
+	if size > o.Limits.MaxBodyBytes {
+		return &netutils.MaxSizeReachedError{MaxSize: o.Limits.MaxBodyBytes}
+	}
+	return nil
+}
+
 func (l *HttpLocation) GetLoadBalancer() loadbalance.LoadBalancer {
 	return l.loadBalancer
 }
@@ -236,13 +414,23 @@ func (l *HttpLocation) isRequestOverLimit(req request.Request) bool {
 }
 
 // Proxy the request to the given endpoint, execute observers and middlewares chains
-func (l *HttpLocation) proxyToEndpoint(tr *http.Transport, o *Options, endpoint endpoint.Endpoint, req request.Request) (*http.Response, error) {
+func (l *HttpLocation) proxyToEndpoint(tr *http.Transport, o *Options, endpoint endpoint.Endpoint, req request.Request) (response *http.Response, err error) {
 
 	a := &request.BaseAttempt{Endpoint: endpoint}
 
 	l.observerChain.ObserveRequest(req)
-	defer l.observerChain.ObserveResponse(req, a)
-	defer req.AddAttempt(a)
+	defer func() {
+		// Attempt cancelled in favor of the hedged one is not a failover attempt
+		if !a.Cancelled {
+			req.AddAttempt(a)
+		}
+		l.observerChain.ObserveResponse(req, a)
+	}()
+	// Middlewares are allowed to replace the response or error of the attempt when the chain is unwound,
+	// e.g. cache replaces 304 Not Modified response with the cached one
+	defer func() {
+		response, err = a.Response, a.Error
+	}()
 
 	it := l.middlewareChain.GetIter()
 	defer l.unwindIter(it, req, a)
@@ -252,15 +440,30 @@ func (l *HttpLocation) proxyToEndpoint(tr *http.Transport, o *Options, endpoint
 		if a.Response != nil || a.Error != nil {
 			// Move the iterator forward to count it again once we unwind the chain
 			it.Next()
-			log.Errorf("Midleware intercepted request with response=%s, error=%s", a.Response.Status, a.Error)
+			// Cache hits and coalesced requests are served by the middlewares all the time, so only rejections are logged
+			if a.Error != nil {
+				log.Errorf("Middleware intercepted request with error=%s", a.Error)
+			} else if a.Response.StatusCode >= http.StatusBadRequest {
+				log.Infof("Middleware intercepted request with response=%s", a.Response.Status)
+			}
 			return a.Response, a.Error
 		}
 	}
 
-	// Forward the request and mirror the response
+	// Forward the request and mirror the response, connection serves the request until the response body is consumed
+	httpReq, use := trackConn(req.GetHttpRequest(), o.TimeProvider.UtcNow)
 	start := o.TimeProvider.UtcNow()
-	a.Response, a.Error = tr.RoundTrip(req.GetHttpRequest())
+	a.Response, a.Error = tr.RoundTrip(httpReq)
 	a.Duration = o.TimeProvider.UtcNow().Sub(start)
+	a.Cancelled = isAbandoned(req, a)
+	if a.Response != nil {
+		a.Response.Body = &releaseOnClose{ReadCloser: a.Response.Body, use: use}
+	} else {
+		use.release()
+	}
+	if o.Hedging != nil && a.Error == nil {
+		l.latencies.observe(a.Duration)
+	}
 	return a.Response, a.Error
 }
 
@@ -268,13 +471,18 @@ func (l *HttpLocation) copyRequest(req *http.Request, body netutils.MultiReader,
 	outReq := new(http.Request)
 	*outReq = *req // includes shallow copies of maps, but we handle this below
 
-	// Set the body to the enhanced body that can be re-read multiple times and buffered to disk
-	outReq.Body = body
+	// Set the body to the enhanced body that can be re-read multiple times and buffered to disk.
+	// Transport closes the request body, while the buffer is released by its owner only
+	outReq.Body = ioutil.NopCloser(body)
 
+	// Copy the url, as concurrent attempts can be sent to different endpoints
+	outReq.URL = netutils.CopyUrl(req.URL)
 	outReq.URL.Scheme = endpoint.GetUrl().Scheme
 	outReq.URL.Host = endpoint.GetUrl().Host
 	outReq.URL.RawQuery = req.URL.RawQuery
+	outReq = withEndpoint(outReq, endpoint)
 
+	// Transport picks the protocol on its own, HTTP/2 clients and endpoints don't mind these
 	outReq.Proto = "HTTP/1.1"
 	outReq.ProtoMajor = 1
 	outReq.ProtoMinor = 1
@@ -294,6 +502,7 @@ const (
 	DefaultTlsHandshakeTimeout = time.Duration(10) * time.Second
 	DefaultKeepAlivePeriod     = time.Duration(30) * time.Second
 	DefaultMaxIdleConnsPerHost = 2
+	DefaultIdleConnTimeout     = time.Duration(90) * time.Second
 )
 
 func parseOptions(o Options) (Options, error) {
@@ -315,6 +524,20 @@ func parseOptions(o Options) (Options, error) {
 	if o.KeepAlive.MaxIdleConnsPerHost <= 0 {
 		o.KeepAlive.MaxIdleConnsPerHost = DefaultMaxIdleConnsPerHost
 	}
+	if o.KeepAlive.IdleConnTimeout <= time.Duration(0) {
+		o.KeepAlive.IdleConnTimeout = DefaultIdleConnTimeout
+	}
+	if o.KeepAlive.MaxConnsPerHost < 0 || o.KeepAlive.PrewarmConnsPerHost < 0 || o.KeepAlive.MaxConnLifetime < 0 {
+		return o, fmt.Errorf("Connection limits and lifetime can't be negative")
+	}
+	if o.KeepAlive.MaxConnLifetime > 0 {
+		if o.KeepAlive.MaxConnLifetimeJitter <= 0 {
+			o.KeepAlive.MaxConnLifetimeJitter = o.KeepAlive.MaxConnLifetime / 10
+		}
+		if o.KeepAlive.MaxConnLifetimeJitter >= o.KeepAlive.MaxConnLifetime {
+			return o, fmt.Errorf("MaxConnLifetimeJitter should be less than MaxConnLifetime")
+		}
+	}
 
 	if o.Hostname == "" {
 		h, err := os.Hostname()
@@ -325,6 +548,19 @@ func parseOptions(o Options) (Options, error) {
 	if o.TimeProvider == nil {
 		o.TimeProvider = &timetools.RealTime{}
 	}
+	hedging, err := parseHedging(o.Hedging)
+	if err != nil {
+		return o, err
+	}
+	o.Hedging = hedging
+	tls, err := parseTLS(o.TLS)
+	if err != nil {
+		return o, err
+	}
+	o.TLS = tls
+	if o.Protocol < HTTP1 || o.Protocol > H2C {
+		return o, fmt.Errorf("Unsupported protocol: %s", o.Protocol)
+	}
 	if o.ShouldFailover == nil {
 		// Failover on errors for 2 times maximum on GET requests only.
 		o.ShouldFailover = failover.And(failover.AttemptsLe(2), failover.IsNetworkError, failover.RequestMethodEq("GET"))
@@ -332,15 +568,71 @@ func parseOptions(o Options) (Options, error) {
 	return o, nil
 }
 
-func newTransport(o Options) *http.Transport {
-	return &http.Transport{
-		Dial: (&net.Dialer{
-			Timeout:   o.Timeouts.Dial,
-			KeepAlive: o.KeepAlive.Period,
-		}).Dial,
+func newTransport(o Options, conns *connTracker) (*http.Transport, *endpointDialer, error) {
+	d := newEndpointDialer(o, conns)
+	tr := &http.Transport{
+		DialContext:           d.DialContext,
 		ResponseHeaderTimeout: o.Timeouts.Read,
 		TLSHandshakeTimeout:   o.Timeouts.TlsHandshake,
+		MaxIdleConnsPerHost:   o.KeepAlive.MaxIdleConnsPerHost,
+		MaxConnsPerHost:       o.KeepAlive.MaxConnsPerHost,
+		IdleConnTimeout:       o.KeepAlive.IdleConnTimeout,
+		Protocols:             newProtocols(o.Protocol),
+	}
+	if o.TLS != nil {
+		td, err := newTlsDialer(o.TLS, d, o.Timeouts.TlsHandshake, o.TimeProvider, nextProtos(o.Protocol))
+		if err != nil {
+			return nil, nil, err
+		}
+		tr.DialTLSContext = td.DialTLSContext
+	}
+	return tr, d, nil
+}
+
+// Tells if the transport built for the options can be kept, so the connections are not dropped
+func sameConnectionSettings(a, b Options) bool {
+	if a.Timeouts != b.Timeouts || a.KeepAlive != b.KeepAlive || a.Protocol != b.Protocol || !sameDialer(a.Dialer, b.Dialer) {
+		return false
+	}
+	if a.TLS == nil || b.TLS == nil {
+		return a.TLS == b.TLS
 	}
+	return reflect.DeepEqual(*a.TLS, *b.TLS)
+}
+
+// Dialers of the incomparable types, e.g. structs with the func fields, are never the same, as comparing them panics
+func sameDialer(a, b dialer.Dialer) bool {
+	va, vb := reflect.ValueOf(a), reflect.ValueOf(b)
+	if !va.IsValid() || !vb.IsValid() {
+		return va.IsValid() == vb.IsValid()
+	}
+	return va.Type() == vb.Type() && va.Comparable() && vb.Comparable() && va.Equal(vb)
+}
+
+func newProtocols(p Protocol) *http.Protocols {
+	protocols := &http.Protocols{}
+	switch p {
+	case HTTP1:
+		protocols.SetHTTP1(true)
+	case HTTP2:
+		protocols.SetHTTP1(true)
+		protocols.SetHTTP2(true)
+	case H2C:
+		protocols.SetHTTP2(true)
+		protocols.SetUnencryptedHTTP2(true)
+	}
+	return protocols
+}
+
+// Protocols offered to the https endpoints in the TLS handshake (ALPN)
+func nextProtos(p Protocol) []string {
+	switch p {
+	case HTTP2:
+		return []string{"h2", "http/1.1"}
+	case H2C:
+		return []string{"h2"}
+	}
+	return nil
 }
 
 const (
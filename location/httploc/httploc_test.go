@@ -2,23 +2,36 @@ package httploc
 
 import (
 	"bufio"
+	"context"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	timetools "github.com/mailgun/gotools-time"
 	"github.com/mailgun/vulcan"
+	"github.com/mailgun/vulcan/dialer"
 	. "github.com/mailgun/vulcan/endpoint"
+	"github.com/mailgun/vulcan/failover"
+	"github.com/mailgun/vulcan/grpc"
 	"github.com/mailgun/vulcan/headers"
+	"github.com/mailgun/vulcan/limit"
+	"github.com/mailgun/vulcan/limit/adaptive"
+	"github.com/mailgun/vulcan/limit/connlimit"
 	. "github.com/mailgun/vulcan/loadbalance"
 	"github.com/mailgun/vulcan/loadbalance/roundrobin"
+	"github.com/mailgun/vulcan/metrics"
 	. "github.com/mailgun/vulcan/middleware"
 	"github.com/mailgun/vulcan/netutils"
 	. "github.com/mailgun/vulcan/request"
+	"github.com/mailgun/vulcan/retry"
 	. "github.com/mailgun/vulcan/route"
 	. "github.com/mailgun/vulcan/testutils"
 	. "gopkg.in/check.v1"
@@ -167,6 +180,29 @@ func (s *LocSuite) TestLimitReached(c *C) {
 	c.Assert(response.StatusCode, Equals, http.StatusRequestEntityTooLarge)
 }
 
+func (s *LocSuite) TestBodyStorageLimitReached(c *C) {
+	server := NewTestServer(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("Hi, I'm endpoint!"))
+	})
+	defer server.Close()
+
+	location, proxy := s.newProxyWithParams(s.newRoundRobin(server.URL), 0, 0, 4, 1024)
+	defer proxy.Close()
+
+	storage, err := netutils.NewLocalStorage(netutils.LocalStorageOptions{Dir: c.MkDir(), MaxDiskBytes: 8})
+	c.Assert(err, IsNil)
+	options := location.GetOptions()
+	options.Limits.BodyStorage = storage
+	c.Assert(location.SetOptions(options), IsNil)
+
+	response, _ := Get(c, proxy.URL, s.authHeaders, "Hello, this request is longer than 12 bytes")
+	c.Assert(response.StatusCode, Equals, http.StatusInsufficientStorage)
+
+	response, _ = Get(c, proxy.URL, s.authHeaders, "Hello")
+	c.Assert(response.StatusCode, Equals, http.StatusOK)
+	c.Assert(storage.GetDiskUsed(), Equals, int64(0))
+}
+
 func (s *LocSuite) TestChunkedEncodingLimitReached(c *C) {
 	server := NewTestServer(func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte("Hi, I'm endpoint"))
@@ -248,6 +284,102 @@ func (s *LocSuite) TestFailover(c *C) {
 	c.Assert(string(bodyBytes), Equals, "Hi, I'm endpoint")
 }
 
+// Make sure retry policy delays the failover attempt as requested by the upstream
+func (s *LocSuite) TestFailoverRetryAfter(c *C) {
+	unavailable := NewTestServer(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "2")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	defer unavailable.Close()
+
+	server := NewTestServer(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("Hi, I'm endpoint"))
+	})
+	defer server.Close()
+
+	tm := &timetools.FreezedTime{CurrentTime: s.tm.CurrentTime}
+	policy, err := retry.NewPolicy(retry.Options{TimeProvider: tm})
+	c.Assert(err, IsNil)
+
+	location, err := NewLocationWithOptions("dummy", s.newRoundRobin(unavailable.URL, server.URL), Options{
+		ShouldFailover: failover.And(failover.AttemptsLe(1), failover.ResponseCodeEq(http.StatusServiceUnavailable)),
+		RetryPolicy:    policy,
+		TimeProvider:   tm,
+	})
+	c.Assert(err, IsNil)
+	proxy, err := vulcan.NewProxy(&ConstRouter{Location: location})
+	c.Assert(err, IsNil)
+	proxyServer := httptest.NewServer(proxy)
+	defer proxyServer.Close()
+
+	response, bodyBytes := Get(c, proxyServer.URL, s.authHeaders, "hello!")
+	c.Assert(response.StatusCode, Equals, http.StatusOK)
+	c.Assert(string(bodyBytes), Equals, "Hi, I'm endpoint")
+	c.Assert(tm.CurrentTime.Sub(s.tm.CurrentTime), Equals, 2*time.Second)
+}
+
+// Make sure location stops waiting for the retry once the client is gone
+func (s *LocSuite) TestFailoverRetryAfterClientGone(c *C) {
+	unavailable := NewTestServer(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "2")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	defer unavailable.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	tm := &cancelingTime{FreezedTime: timetools.FreezedTime{CurrentTime: s.tm.CurrentTime}, cancel: cancel}
+	policy, err := retry.NewPolicy(retry.Options{TimeProvider: tm})
+	c.Assert(err, IsNil)
+
+	location, err := NewLocationWithOptions("dummy", s.newRoundRobin(unavailable.URL), Options{
+		ShouldFailover: failover.And(failover.AttemptsLe(1), failover.ResponseCodeEq(http.StatusServiceUnavailable)),
+		RetryPolicy:    policy,
+		TimeProvider:   tm,
+	})
+	c.Assert(err, IsNil)
+
+	req, err := http.NewRequest("GET", unavailable.URL, strings.NewReader(""))
+	c.Assert(err, IsNil)
+	response, err := location.RoundTrip(NewBaseRequest(req.WithContext(ctx), 1, nil))
+	c.Assert(response, IsNil)
+	c.Assert(err, Equals, context.Canceled)
+}
+
+// Make sure the body buffer is not released when the transport closes the request body of the failed attempt
+func (s *LocSuite) TestFailoverReplaysPooledBody(c *C) {
+	unavailable := NewTestServer(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	defer unavailable.Close()
+
+	local, err := netutils.NewLocalStorage(netutils.LocalStorageOptions{Dir: c.MkDir()})
+	c.Assert(err, IsNil)
+	storage := &freeRecorder{BufferStorage: local}
+	server := NewTestServer(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Header().Set("X-Freed", fmt.Sprintf("%d", storage.getFreed()))
+		w.Write(body)
+	})
+	defer server.Close()
+
+	location, err := NewLocationWithOptions("dummy", s.newRoundRobin(unavailable.URL, server.URL), Options{
+		ShouldFailover: failover.And(failover.AttemptsLe(1), failover.ResponseCodeEq(http.StatusServiceUnavailable)),
+		Limits:         Limits{BodyStorage: storage},
+	})
+	c.Assert(err, IsNil)
+	proxy, err := vulcan.NewProxy(&ConstRouter{Location: location})
+	c.Assert(err, IsNil)
+	proxyServer := httptest.NewServer(proxy)
+	defer proxyServer.Close()
+
+	response, bodyBytes := Get(c, proxyServer.URL, s.authHeaders, "hello!")
+	c.Assert(response.StatusCode, Equals, http.StatusOK)
+	c.Assert(string(bodyBytes), Equals, "hello!")
+	c.Assert(response.Header.Get("X-Freed"), Equals, "0")
+	c.Assert(storage.getFreed(), Equals, 1)
+}
+
 // Test scenario when middleware intercepts the request
 func (s *LocSuite) TestMiddlewareInterceptsRequest(c *C) {
 	server := NewTestServer(func(w http.ResponseWriter, r *http.Request) {
@@ -457,3 +589,369 @@ func (s *LocSuite) TestFailoverHeaders(c *C) {
 	c.Assert(response.StatusCode, Equals, http.StatusOK)
 	c.Assert(finalHeaders, DeepEquals, []string{"call"})
 }
+
+// Slow endpoint does not reply in time, so the request gets hedged to the fast endpoint
+func (s *LocSuite) TestHedging(c *C) {
+	slow := NewTestServer(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+		}
+		w.Write([]byte("Hi, I'm slow endpoint"))
+	})
+	defer slow.Close()
+
+	fast := NewTestServer(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("Hi, I'm fast endpoint"))
+	})
+	defer fast.Close()
+
+	location, err := NewLocationWithOptions("dummy", s.newRoundRobin(slow.URL, fast.URL), Options{
+		Hedging: &Hedging{Delay: 10 * time.Millisecond},
+	})
+	c.Assert(err, IsNil)
+	// Cancelled attempt should not count as the failure
+	meter, err := metrics.NewLocationRollingMeter(10, time.Second, s.tm, metrics.IsNetworkError)
+	c.Assert(err, IsNil)
+	location.GetObserverChain().Add("meter", meter)
+
+	httpReq, err := http.NewRequest("GET", "http://localhost/", strings.NewReader(""))
+	c.Assert(err, IsNil)
+	req := NewBaseRequest(httpReq, 1, nil)
+
+	response, err := location.RoundTrip(req)
+	c.Assert(err, IsNil)
+	bodyBytes, err := ioutil.ReadAll(response.Body)
+	response.Body.Close()
+	c.Assert(err, IsNil)
+	c.Assert(string(bodyBytes), Equals, "Hi, I'm fast endpoint")
+
+	// Only the winner is recorded, the cancelled attempt is not a failover attempt
+	c.Assert(len(req.GetAttempts()), Equals, 1)
+	c.Assert(req.GetLastAttempt().GetEndpoint().GetUrl().String(), Equals, fast.URL)
+	c.Assert(meter.FailureCount(), Equals, int64(0))
+	c.Assert(meter.SuccessCount(), Equals, int64(1))
+	c.Assert(location.GetHedgesInFlight(), Equals, int64(0))
+}
+
+// Both attempts pass the limiters, each one releases its own slot
+func (s *LocSuite) TestHedgingReleasesLimiters(c *C) {
+	slow := NewTestServer(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+		}
+		w.Write([]byte("Hi, I'm slow endpoint"))
+	})
+	defer slow.Close()
+
+	fast := NewTestServer(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("Hi, I'm fast endpoint"))
+	})
+	defer fast.Close()
+
+	location, err := NewLocationWithOptions("dummy", s.newRoundRobin(slow.URL, fast.URL), Options{
+		Hedging: &Hedging{Delay: 10 * time.Millisecond},
+	})
+	c.Assert(err, IsNil)
+	cl, err := connlimit.NewConnectionLimiter(limit.MapClientIp, 10)
+	c.Assert(err, IsNil)
+	location.GetMiddlewareChain().Add("connlimit", 0, cl)
+	al, err := adaptive.NewAdaptiveLimiter(adaptive.Options{})
+	c.Assert(err, IsNil)
+	location.GetMiddlewareChain().Add("adaptive", 1, al)
+
+	httpReq, err := http.NewRequest("GET", "http://localhost/", strings.NewReader(""))
+	c.Assert(err, IsNil)
+	httpReq.RemoteAddr = "127.0.0.1:5000"
+	req := NewBaseRequest(httpReq, 1, nil)
+
+	response, err := location.RoundTrip(req)
+	c.Assert(err, IsNil)
+	bodyBytes, err := ioutil.ReadAll(response.Body)
+	response.Body.Close()
+	c.Assert(err, IsNil)
+	c.Assert(string(bodyBytes), Equals, "Hi, I'm fast endpoint")
+
+	c.Assert(cl.GetConnectionCount(), Equals, int64(0))
+	c.Assert(al.GetInFlight(), Equals, int64(0))
+}
+
+// Requests with body are never hedged
+func (s *LocSuite) TestHedgingSkipsRequestsWithBody(c *C) {
+	server := NewTestServer(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(20 * time.Millisecond)
+		w.Write([]byte("Hi, I'm endpoint"))
+	})
+	defer server.Close()
+
+	location, err := NewLocationWithOptions("dummy", s.newRoundRobin(server.URL, "http://localhost:63999"), Options{
+		Hedging: &Hedging{Delay: time.Millisecond},
+	})
+	c.Assert(err, IsNil)
+
+	httpReq, err := http.NewRequest("GET", "http://localhost/", strings.NewReader("hello!"))
+	c.Assert(err, IsNil)
+	req := NewBaseRequest(httpReq, 1, nil)
+
+	response, err := location.RoundTrip(req)
+	c.Assert(err, IsNil)
+	response.Body.Close()
+	c.Assert(len(req.GetAttempts()), Equals, 1)
+}
+
+func (s *LocSuite) TestLatencyPercentile(c *C) {
+	t := newLatencyTracker()
+
+	_, ok := t.percentile(95, 10)
+	c.Assert(ok, Equals, false)
+
+	for i := 1; i <= 100; i++ {
+		t.observe(time.Duration(i) * time.Millisecond)
+	}
+	p, ok := t.percentile(95, 10)
+	c.Assert(ok, Equals, true)
+	c.Assert(p, Equals, 95*time.Millisecond)
+
+	p, ok = t.percentile(50, 10)
+	c.Assert(ok, Equals, true)
+	c.Assert(p, Equals, 50*time.Millisecond)
+}
+
+// Endpoint speaking cleartext HTTP/2 that replies with the protocol of the request and trailers
+func newH2cServer() *httptest.Server {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Trailer", "Grpc-Status")
+		w.Write([]byte(r.Proto + " " + r.Header.Get("Te")))
+		w.Header().Set("Grpc-Status", "0")
+		w.Header().Set(http.TrailerPrefix+"Grpc-Message", "ok")
+	}))
+	server.Config.Protocols = &http.Protocols{}
+	server.Config.Protocols.SetHTTP1(true)
+	server.Config.Protocols.SetUnencryptedHTTP2(true)
+	server.Start()
+	return server
+}
+
+func (s *LocSuite) TestH2C(c *C) {
+	server := newH2cServer()
+	defer server.Close()
+
+	location, err := NewLocationWithOptions("dummy", s.newRoundRobin(server.URL), Options{Protocol: H2C})
+	c.Assert(err, IsNil)
+	proxyHandler, err := vulcan.NewProxy(&ConstRouter{Location: location})
+	c.Assert(err, IsNil)
+	proxy := httptest.NewServer(proxyHandler)
+	defer proxy.Close()
+
+	response, body := Get(c, proxy.URL, http.Header{"Te": []string{"trailers"}}, "")
+	c.Assert(response.StatusCode, Equals, http.StatusOK)
+	c.Assert(string(body), Equals, "HTTP/2.0 trailers")
+	c.Assert(response.Trailer.Get("Grpc-Status"), Equals, "0")
+	c.Assert(response.Trailer.Get("Grpc-Message"), Equals, "ok")
+}
+
+// Plain http endpoints are talked to over HTTP/1.1 unless h2c is chosen
+func (s *LocSuite) TestHTTP2OverPlainHttp(c *C) {
+	server := newH2cServer()
+	defer server.Close()
+
+	for _, protocol := range []Protocol{HTTP1, HTTP2} {
+		location, err := NewLocationWithOptions("dummy", s.newRoundRobin(server.URL), Options{Protocol: protocol})
+		c.Assert(err, IsNil)
+		proxyHandler, err := vulcan.NewProxy(&ConstRouter{Location: location})
+		c.Assert(err, IsNil)
+		proxy := httptest.NewServer(proxyHandler)
+
+		response, body := Get(c, proxy.URL, http.Header{"Te": []string{"gzip"}}, "")
+		proxy.Close()
+		c.Assert(string(body), Equals, "HTTP/1.1 ")
+		c.Assert(response.Trailer.Get("Grpc-Status"), Equals, "0")
+	}
+}
+
+func (s *LocSuite) TestInvalidProtocol(c *C) {
+	_, err := NewLocationWithOptions("dummy", s.newRoundRobin(), Options{Protocol: Protocol(10)})
+	c.Assert(err, NotNil)
+}
+
+// gRPC calls are streamed to the endpoint without buffering
+func (s *LocSuite) TestGrpcStreaming(c *C) {
+	received := make(chan string, 1)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		first := make([]byte, 5)
+		_, err := io.ReadFull(r.Body, first)
+		c.Assert(err, IsNil)
+		received <- string(first)
+		rest, err := ioutil.ReadAll(r.Body)
+		c.Assert(err, IsNil)
+		w.Header().Set("Trailer", "Grpc-Status")
+		w.Write(append(first, rest...))
+		w.Header().Set("Grpc-Status", "0")
+	}))
+	server.Config.Protocols = &http.Protocols{}
+	server.Config.Protocols.SetUnencryptedHTTP2(true)
+	server.Start()
+	defer server.Close()
+
+	location, err := NewLocationWithOptions("dummy", s.newRoundRobin(server.URL), Options{Protocol: H2C})
+	c.Assert(err, IsNil)
+	proxyHandler, err := vulcan.NewProxyWithOptions(&ConstRouter{Location: location}, vulcan.Options{ErrorFormatter: &grpc.Formatter{}})
+	c.Assert(err, IsNil)
+	proxy := httptest.NewServer(proxyHandler)
+	defer proxy.Close()
+
+	reader, writer := io.Pipe()
+	req, err := http.NewRequest("POST", proxy.URL+"/helloworld.Greeter/SayHello", reader)
+	c.Assert(err, IsNil)
+	req.Header.Set("Content-Type", "application/grpc")
+	type result struct {
+		re   *http.Response
+		body string
+		err  error
+	}
+	results := make(chan result, 1)
+	go func() {
+		re, err := http.DefaultClient.Do(req)
+		if err != nil {
+			results <- result{err: err}
+			return
+		}
+		defer re.Body.Close()
+		body, err := ioutil.ReadAll(re.Body)
+		results <- result{re: re, body: string(body), err: err}
+	}()
+
+	// Endpoint gets the first message while the client is still sending the request
+	writer.Write([]byte("first"))
+	select {
+	case first := <-received:
+		c.Assert(first, Equals, "first")
+	case <-time.After(5 * time.Second):
+		c.Fatalf("Request body has not been streamed")
+	}
+	writer.Write([]byte("second"))
+	writer.Close()
+
+	r := <-results
+	c.Assert(r.err, IsNil)
+	c.Assert(r.body, Equals, "firstsecond")
+	c.Assert(r.re.Trailer.Get("Grpc-Status"), Equals, "0")
+}
+
+// Proxy errors are replied to gRPC clients as trailers-only responses
+func (s *LocSuite) TestGrpcError(c *C) {
+	location, err := NewLocation("dummy", s.newRoundRobin("http://localhost:63999"))
+	c.Assert(err, IsNil)
+	proxyHandler, err := vulcan.NewProxyWithOptions(&ConstRouter{Location: location}, vulcan.Options{ErrorFormatter: &grpc.Formatter{}})
+	c.Assert(err, IsNil)
+	proxy := httptest.NewServer(proxyHandler)
+	defer proxy.Close()
+
+	re, err := http.Post(proxy.URL+"/helloworld.Greeter/SayHello", "application/grpc", strings.NewReader("hello"))
+	c.Assert(err, IsNil)
+	re.Body.Close()
+	c.Assert(re.StatusCode, Equals, http.StatusOK)
+	c.Assert(re.Header.Get("Grpc-Status"), Equals, "14")
+
+	// Other requests get the usual errors
+	re, _ = Get(c, proxy.URL, nil, "")
+	c.Assert(re.StatusCode, Equals, http.StatusBadGateway)
+}
+
+func (s *LocSuite) TestUnixSocket(c *C) {
+	path := filepath.Join(c.MkDir(), "app.sock")
+	listener, err := net.Listen("unix", path)
+	c.Assert(err, IsNil)
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(fmt.Sprintf("hi, %s%s", r.Host, r.URL.Path)))
+	})}
+	go server.Serve(listener)
+	defer server.Close()
+
+	_, proxy := s.newProxy(s.newRoundRobin("unix://" + path))
+	defer proxy.Close()
+
+	response, body := Get(c, proxy.URL+"/path", nil, "")
+	c.Assert(response.StatusCode, Equals, http.StatusOK)
+	c.Assert(string(body), Equals, fmt.Sprintf("hi, %s/path", proxy.Listener.Addr()))
+}
+
+func (s *LocSuite) TestUnixSocketH2C(c *C) {
+	path := filepath.Join(c.MkDir(), "app.sock")
+	listener, err := net.Listen("unix", path)
+	c.Assert(err, IsNil)
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Proto))
+	})}
+	server.Protocols = &http.Protocols{}
+	server.Protocols.SetUnencryptedHTTP2(true)
+	go server.Serve(listener)
+	defer server.Close()
+
+	location, err := NewLocationWithOptions("dummy", s.newRoundRobin("unix://"+path), Options{Protocol: H2C})
+	c.Assert(err, IsNil)
+	proxyHandler, err := vulcan.NewProxy(&ConstRouter{Location: location})
+	c.Assert(err, IsNil)
+	proxy := httptest.NewServer(proxyHandler)
+	defer proxy.Close()
+
+	response, body := Get(c, proxy.URL, nil, "")
+	c.Assert(response.StatusCode, Equals, http.StatusOK)
+	c.Assert(string(body), Equals, "HTTP/2.0")
+}
+
+func (s *LocSuite) TestCustomDialer(c *C) {
+	pipe := dialer.NewPipeListener()
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hi, pipe"))
+	})}
+	go server.Serve(pipe)
+	defer server.Close()
+
+	location, err := NewLocationWithOptions("dummy", s.newRoundRobin("http://endpoint.invalid"), Options{Dialer: pipe})
+	c.Assert(err, IsNil)
+	proxyHandler, err := vulcan.NewProxy(&ConstRouter{Location: location})
+	c.Assert(err, IsNil)
+	proxy := httptest.NewServer(proxyHandler)
+	defer proxy.Close()
+
+	response, body := Get(c, proxy.URL, nil, "")
+	c.Assert(response.StatusCode, Equals, http.StatusOK)
+	c.Assert(string(body), Equals, "hi, pipe")
+}
+
+// Counts the memory buffers released by the body buffers
+type freeRecorder struct {
+	netutils.BufferStorage
+	freed int32
+}
+
+func (f *freeRecorder) NewMemoryBuffer() netutils.MemoryBuffer {
+	return &recordedBuffer{MemoryBuffer: f.BufferStorage.NewMemoryBuffer(), freed: &f.freed}
+}
+
+func (f *freeRecorder) getFreed() int {
+	return int(atomic.LoadInt32(&f.freed))
+}
+
+type recordedBuffer struct {
+	netutils.MemoryBuffer
+	freed *int32
+}
+
+func (b *recordedBuffer) Free() {
+	atomic.AddInt32(b.freed, 1)
+	b.MemoryBuffer.Free()
+}
+
+// Cancels the request instead of letting the time pass
+type cancelingTime struct {
+	timetools.FreezedTime
+	cancel context.CancelFunc
+}
+
+func (t *cancelingTime) After(time.Duration) <-chan time.Time {
+	t.cancel()
+	return make(chan time.Time)
+}
@@ -0,0 +1,248 @@
+package httploc
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Connection pool statistics of the endpoint
+type PoolStats struct {
+	// Connections serving the requests
+	Active int64
+	// Open connections waiting for the requests, including the pre-warmed ones
+	Idle int64
+	// Connections dialed to the endpoint
+	Dials int64
+	// Dials that have failed
+	DialErrors int64
+}
+
+// Tracks the connections of the location's endpoints. Tracker outlives the transports,
+// so the connections of the replaced transport are accounted until they are closed.
+type connTracker struct {
+	mutex     *sync.Mutex
+	endpoints map[string]*endpointConns
+}
+
+func newConnTracker() *connTracker {
+	return &connTracker{
+		mutex:     &sync.Mutex{},
+		endpoints: make(map[string]*endpointConns),
+	}
+}
+
+func (t *connTracker) get(id string) *endpointConns {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	e, ok := t.endpoints[id]
+	if !ok {
+		e = &endpointConns{}
+		t.endpoints[id] = e
+	}
+	return e
+}
+
+// Returns the statistics by the endpoint id
+func (t *connTracker) stats() map[string]PoolStats {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	out := make(map[string]PoolStats, len(t.endpoints))
+	for id, e := range t.endpoints {
+		out[id] = PoolStats{
+			Active:     atomic.LoadInt64(&e.active),
+			Idle:       atomic.LoadInt64(&e.idle),
+			Dials:      atomic.LoadInt64(&e.dials),
+			DialErrors: atomic.LoadInt64(&e.dialErrors),
+		}
+	}
+	return out
+}
+
+type endpointConns struct {
+	active     int64
+	idle       int64
+	dials      int64
+	dialErrors int64
+}
+
+func (e *endpointConns) dialed() {
+	atomic.AddInt64(&e.dials, 1)
+}
+
+func (e *endpointConns) dialFailed() {
+	atomic.AddInt64(&e.dialErrors, 1)
+}
+
+// Connection that knows whether it's serving the requests. Connections past their lifetime are closed
+// once they finish serving the requests, so the transport dials the new ones, possibly to the new endpoints.
+type trackedConn struct {
+	net.Conn
+	mutex    *sync.Mutex
+	stats    *endpointConns
+	requests int
+	closed   bool
+	// Zero if connection lives as long as the endpoint keeps it open
+	expires time.Time
+	// Time the connection has been pre-warmed at
+	prewarmed time.Time
+	// Closes the pre-warmed connection if it's not picked up in time
+	expiry *time.Timer
+}
+
+func newTrackedConn(conn net.Conn, stats *endpointConns, expires time.Time) *trackedConn {
+	atomic.AddInt64(&stats.idle, 1)
+	return &trackedConn{
+		Conn:    conn,
+		mutex:   &sync.Mutex{},
+		stats:   stats,
+		expires: expires,
+	}
+}
+
+func (c *trackedConn) acquire() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.closed {
+		return
+	}
+	if c.requests == 0 {
+		atomic.AddInt64(&c.stats.idle, -1)
+		atomic.AddInt64(&c.stats.active, 1)
+	}
+	c.requests += 1
+}
+
+func (c *trackedConn) release(now time.Time) {
+	c.mutex.Lock()
+	if c.closed || c.requests == 0 {
+		c.mutex.Unlock()
+		return
+	}
+	c.requests -= 1
+	if c.requests != 0 {
+		c.mutex.Unlock()
+		return
+	}
+	atomic.AddInt64(&c.stats.active, -1)
+	atomic.AddInt64(&c.stats.idle, 1)
+	c.mutex.Unlock()
+
+	if c.expired(now) {
+		c.Close()
+	}
+}
+
+func (c *trackedConn) expired(now time.Time) bool {
+	return !c.expires.IsZero() && !now.Before(c.expires)
+}
+
+func (c *trackedConn) Close() error {
+	c.mutex.Lock()
+	if !c.closed {
+		c.closed = true
+		if c.requests == 0 {
+			atomic.AddInt64(&c.stats.idle, -1)
+		} else {
+			atomic.AddInt64(&c.stats.active, -1)
+		}
+	}
+	c.mutex.Unlock()
+	return c.Conn.Close()
+}
+
+// Finds the tracked connection underneath the connection handed out by the transport
+func unwrapConn(conn net.Conn) *trackedConn {
+	switch c := conn.(type) {
+	case *trackedConn:
+		return c
+	case *tls.Conn:
+		if t, ok := c.NetConn().(*trackedConn); ok {
+			return t
+		}
+	}
+	return nil
+}
+
+// Connection serving the request, learned from the transport with the client trace.
+// Connection is serving the request until the response body is read or closed.
+type connUse struct {
+	mutex *sync.Mutex
+	conn  *trackedConn
+	done  bool
+	now   func() time.Time
+}
+
+// Returns the request that tracks the connection serving it
+func trackConn(req *http.Request, now func() time.Time) (*http.Request, *connUse) {
+	u := &connUse{mutex: &sync.Mutex{}, now: now}
+	trace := &httptrace.ClientTrace{GotConn: u.gotConn}
+	return req.WithContext(httptrace.WithClientTrace(req.Context(), trace)), u
+}
+
+func (u *connUse) gotConn(info httptrace.GotConnInfo) {
+	conn := unwrapConn(info.Conn)
+	if conn == nil {
+		return
+	}
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	if u.done {
+		return
+	}
+	// Transport may retry the request on another connection
+	if u.conn != nil {
+		u.conn.release(u.now())
+	}
+	conn.acquire()
+	u.conn = conn
+}
+
+func (u *connUse) release() {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	if u.done {
+		return
+	}
+	u.done = true
+	if u.conn != nil {
+		u.conn.release(u.now())
+	}
+}
+
+// Releases the connection once the response body is read or closed
+type releaseOnClose struct {
+	io.ReadCloser
+	use *connUse
+}
+
+func (r *releaseOnClose) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if err != nil {
+		r.use.release()
+	}
+	return n, err
+}
+
+func (r *releaseOnClose) Close() error {
+	err := r.ReadCloser.Close()
+	r.use.release()
+	return err
+}
+
+// Closes the request body once the response is closed
+type closeBodyOnClose struct {
+	io.ReadCloser
+	body io.Closer
+}
+
+func (r *closeBodyOnClose) Close() error {
+	err := r.ReadCloser.Close()
+	r.body.Close()
+	return err
+}
@@ -0,0 +1,275 @@
+package httploc
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	timetools "github.com/mailgun/gotools-time"
+	"github.com/mailgun/vulcan"
+	. "github.com/mailgun/vulcan/endpoint"
+	. "github.com/mailgun/vulcan/loadbalance"
+	"github.com/mailgun/vulcan/loadbalance/roundrobin"
+	. "github.com/mailgun/vulcan/route"
+	. "github.com/mailgun/vulcan/testutils"
+	. "gopkg.in/check.v1"
+)
+
+type PoolSuite struct {
+	tm *timetools.FreezedTime
+}
+
+var _ = Suite(&PoolSuite{})
+
+func (s *PoolSuite) SetUpTest(c *C) {
+	s.tm = &timetools.FreezedTime{
+		CurrentTime: time.Date(2012, 3, 4, 5, 6, 7, 0, time.UTC),
+	}
+}
+
+func (s *PoolSuite) newLocation(c *C, endpointUrl string, o Options) (*HttpLocation, *httptest.Server) {
+	rr, err := roundrobin.NewRoundRobinWithOptions(roundrobin.Options{TimeProvider: s.tm})
+	c.Assert(err, IsNil)
+	c.Assert(rr.AddEndpoint(MustParseUrl(endpointUrl)), IsNil)
+	return s.newLocationWithBalancer(c, rr, o)
+}
+
+func (s *PoolSuite) newLocationWithBalancer(c *C, lb LoadBalancer, o Options) (*HttpLocation, *httptest.Server) {
+	o.TimeProvider = s.tm
+	location, err := NewLocationWithOptions("dummy", lb, o)
+	c.Assert(err, IsNil)
+	proxy, err := vulcan.NewProxy(&ConstRouter{Location: location})
+	c.Assert(err, IsNil)
+	return location, httptest.NewServer(proxy)
+}
+
+// Connections are released asynchronously once the proxy finishes with the response body
+func (s *PoolSuite) assertStats(c *C, l *HttpLocation, id string, expected PoolStats) {
+	var stats PoolStats
+	for i := 0; i < 100; i++ {
+		if stats = l.GetPoolStats()[id]; stats == expected {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Assert(stats, Equals, expected)
+}
+
+func (s *PoolSuite) TestStats(c *C) {
+	server := NewTestServer(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hi"))
+	})
+	defer server.Close()
+
+	location, proxy := s.newLocation(c, server.URL, Options{})
+	defer proxy.Close()
+
+	for i := 0; i < 3; i++ {
+		response, body := Get(c, proxy.URL, nil, "")
+		c.Assert(response.StatusCode, Equals, http.StatusOK)
+		c.Assert(string(body), Equals, "hi")
+	}
+	s.assertStats(c, location, MustParseUrl(server.URL).GetId(), PoolStats{Idle: 1, Dials: 1})
+}
+
+func (s *PoolSuite) TestStatsActive(c *C) {
+	entered, unblock := make(chan bool), make(chan bool)
+	server := NewTestServer(func(w http.ResponseWriter, r *http.Request) {
+		entered <- true
+		<-unblock
+		w.Write([]byte("hi"))
+	})
+	defer server.Close()
+
+	location, proxy := s.newLocation(c, server.URL, Options{})
+	defer proxy.Close()
+
+	done := make(chan bool)
+	go func() {
+		Get(c, proxy.URL, nil, "")
+		done <- true
+	}()
+	<-entered
+	id := MustParseUrl(server.URL).GetId()
+	s.assertStats(c, location, id, PoolStats{Active: 1, Dials: 1})
+	close(unblock)
+	<-done
+	s.assertStats(c, location, id, PoolStats{Idle: 1, Dials: 1})
+}
+
+func (s *PoolSuite) TestDialErrors(c *C) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	endpointUrl := "http://" + listener.Addr().String()
+	listener.Close()
+
+	location, proxy := s.newLocation(c, endpointUrl, Options{})
+	defer proxy.Close()
+
+	response, _ := Get(c, proxy.URL, nil, "")
+	c.Assert(response.StatusCode, Equals, http.StatusBadGateway)
+	stats := location.GetPoolStats()[MustParseUrl(endpointUrl).GetId()]
+	c.Assert(stats.DialErrors, Not(Equals), int64(0))
+	c.Assert(stats.Dials, Equals, stats.DialErrors)
+}
+
+func (s *PoolSuite) TestMaxConnLifetime(c *C) {
+	server := NewTestServer(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hi"))
+	})
+	defer server.Close()
+
+	location, proxy := s.newLocation(c, server.URL, Options{
+		KeepAlive: KeepAlive{MaxConnLifetime: time.Minute, MaxConnLifetimeJitter: time.Second},
+	})
+	defer proxy.Close()
+	id := MustParseUrl(server.URL).GetId()
+
+	Get(c, proxy.URL, nil, "")
+	Get(c, proxy.URL, nil, "")
+	s.assertStats(c, location, id, PoolStats{Idle: 1, Dials: 1})
+
+	// Expired connection serves the request it got and is closed afterwards
+	s.tm.CurrentTime = s.tm.CurrentTime.Add(time.Minute)
+	Get(c, proxy.URL, nil, "")
+	s.assertStats(c, location, id, PoolStats{Dials: 1})
+
+	response, body := Get(c, proxy.URL, nil, "")
+	c.Assert(response.StatusCode, Equals, http.StatusOK)
+	c.Assert(string(body), Equals, "hi")
+	s.assertStats(c, location, id, PoolStats{Idle: 1, Dials: 2})
+}
+
+func (s *PoolSuite) TestPrewarm(c *C) {
+	server := NewTestServer(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hi"))
+	})
+	defer server.Close()
+
+	location, proxy := s.newLocation(c, server.URL, Options{
+		KeepAlive: KeepAlive{PrewarmConnsPerHost: 2, IdleConnTimeout: time.Minute},
+	})
+	defer proxy.Close()
+	e := MustParseUrl(server.URL)
+
+	c.Assert(location.Prewarm(e), IsNil)
+	s.assertStats(c, location, e.GetId(), PoolStats{Idle: 2, Dials: 2})
+
+	// Already pre-warmed
+	c.Assert(location.Prewarm(e), IsNil)
+	s.assertStats(c, location, e.GetId(), PoolStats{Idle: 2, Dials: 2})
+
+	response, body := Get(c, proxy.URL, nil, "")
+	c.Assert(response.StatusCode, Equals, http.StatusOK)
+	c.Assert(string(body), Equals, "hi")
+	s.assertStats(c, location, e.GetId(), PoolStats{Idle: 2, Dials: 2})
+
+	// Pre-warmed connection waited for too long, so it's closed and the new one is dialed
+	s.tm.CurrentTime = s.tm.CurrentTime.Add(2 * time.Minute)
+	_, tr := location.GetOptionsAndTransport()
+	tr.CloseIdleConnections()
+	Get(c, proxy.URL, nil, "")
+	s.assertStats(c, location, e.GetId(), PoolStats{Idle: 1, Dials: 3})
+}
+
+func (s *PoolSuite) TestPrewarmedExpire(c *C) {
+	server := NewTestServer(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hi"))
+	})
+	defer server.Close()
+
+	location, proxy := s.newLocation(c, server.URL, Options{
+		KeepAlive: KeepAlive{PrewarmConnsPerHost: 2, IdleConnTimeout: 50 * time.Millisecond},
+	})
+	defer proxy.Close()
+	e := MustParseUrl(server.URL)
+
+	// Connections that are not picked up are closed without waiting for the next request
+	c.Assert(location.Prewarm(e), IsNil)
+	s.assertStats(c, location, e.GetId(), PoolStats{Idle: 0, Dials: 2})
+}
+
+func (s *PoolSuite) TestPrewarmFailure(c *C) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	endpointUrl := "http://" + listener.Addr().String()
+	listener.Close()
+
+	location, proxy := s.newLocation(c, endpointUrl, Options{KeepAlive: KeepAlive{PrewarmConnsPerHost: 1}})
+	defer proxy.Close()
+	c.Assert(location.Prewarm(MustParseUrl(endpointUrl)), NotNil)
+}
+
+func (s *PoolSuite) TestSetOptionsKeepsPool(c *C) {
+	server := NewTestServer(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hi"))
+	})
+	defer server.Close()
+
+	location, proxy := s.newLocation(c, server.URL, Options{})
+	defer proxy.Close()
+	id := MustParseUrl(server.URL).GetId()
+
+	Get(c, proxy.URL, nil, "")
+	_, tr := location.GetOptionsAndTransport()
+
+	// Limits don't affect the connections, so the pool is kept
+	c.Assert(location.SetOptions(Options{TimeProvider: s.tm, Limits: Limits{MaxBodyBytes: 1024}}), IsNil)
+	_, newTr := location.GetOptionsAndTransport()
+	c.Assert(newTr == tr, Equals, true)
+	Get(c, proxy.URL, nil, "")
+	s.assertStats(c, location, id, PoolStats{Idle: 1, Dials: 1})
+
+	// New connection settings require new transport, old connections are closed
+	c.Assert(location.SetOptions(Options{TimeProvider: s.tm, KeepAlive: KeepAlive{MaxConnsPerHost: 10}}), IsNil)
+	_, newTr = location.GetOptionsAndTransport()
+	c.Assert(newTr != tr, Equals, true)
+	c.Assert(newTr.MaxConnsPerHost, Equals, 10)
+	Get(c, proxy.URL, nil, "")
+	s.assertStats(c, location, id, PoolStats{Idle: 1, Dials: 2})
+}
+
+// Dialer of the incomparable type
+type funcDialer struct {
+	dial func(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+func (d funcDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return d.dial(ctx, network, addr)
+}
+
+func (s *PoolSuite) TestSetOptionsIncomparableDialer(c *C) {
+	server := NewTestServer(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hi"))
+	})
+	defer server.Close()
+
+	d := funcDialer{dial: (&net.Dialer{}).DialContext}
+	location, proxy := s.newLocation(c, server.URL, Options{Dialer: d})
+	defer proxy.Close()
+	_, tr := location.GetOptionsAndTransport()
+
+	// Dialers can't be compared, so the transport is replaced
+	c.Assert(location.SetOptions(Options{TimeProvider: s.tm, Dialer: d}), IsNil)
+	_, newTr := location.GetOptionsAndTransport()
+	c.Assert(newTr != tr, Equals, true)
+	response, body := Get(c, proxy.URL, nil, "")
+	c.Assert(response.StatusCode, Equals, http.StatusOK)
+	c.Assert(string(body), Equals, "hi")
+}
+
+func (s *PoolSuite) TestInvalidOptions(c *C) {
+	rr, err := roundrobin.NewRoundRobin()
+	c.Assert(err, IsNil)
+	for _, k := range []KeepAlive{
+		{MaxConnsPerHost: -1},
+		{PrewarmConnsPerHost: -1},
+		{MaxConnLifetime: -1},
+		{MaxConnLifetime: time.Second, MaxConnLifetimeJitter: time.Second},
+	} {
+		_, err := NewLocationWithOptions("dummy", rr, Options{KeepAlive: k})
+		c.Assert(err, NotNil, Commentf("%v", k))
+	}
+}
@@ -43,7 +43,12 @@ func (rw *Rewriter) ProcessRequest(r request.Request) (*http.Response, error) {
 
 	// Remove hop-by-hop headers to the backend.  Especially important is "Connection" because we want a persistent
 	// connection, regardless of what the client sent to us.
+	acceptsTrailers := hasToken(req.Header[headers.Te], "trailers")
 	netutils.RemoveHeaders(headers.HopHeaders, req.Header)
+	// "TE: trailers" is the only TE allowed in HTTP/2, it tells that the client accepts trailers and gRPC requires it
+	if acceptsTrailers {
+		req.Header.Set(headers.Te, "trailers")
+	}
 
 	// We need to set ContentLength based on known request size. The incoming request may have been
 	// set without content length or using chunked TransferEncoding
@@ -58,5 +63,17 @@ func (rw *Rewriter) ProcessRequest(r request.Request) (*http.Response, error) {
 	return nil, nil
 }
 
+// Checks if the comma separated header values contain the token
+func hasToken(values []string, token string) bool {
+	for _, v := range values {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 func (tl *Rewriter) ProcessResponse(r request.Request, a request.Attempt) {
 }
@@ -0,0 +1,202 @@
+package httploc
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/mailgun/gotools-log"
+	timetools "github.com/mailgun/gotools-time"
+
+	"github.com/mailgun/vulcan/dialer"
+)
+
+// TLS controls the connections to the https endpoints. Certificate files are checked for changes
+// and reloaded on the fly, so the rotated certificates are picked up without dropping the requests in flight.
+type TLS struct {
+	// PEM file with the CA certificates verifying the endpoints, system roots are used if not set
+	CAFile string
+	// PEM files with the client certificate and key presented to the endpoints for mutual TLS
+	CertFile string
+	KeyFile  string
+	// Overrides the server name used for SNI and certificate verification, defaults to the endpoint host
+	ServerName string
+	// Minimum TLS version, e.g. tls.VersionTLS12
+	MinVersion uint16
+	// Allowed cipher suites, Go defaults are used if not set
+	CipherSuites []uint16
+	// Skips the verification of the endpoints certificates, use for development only
+	InsecureSkipVerify bool
+	// How often the certificate files are checked for changes
+	ReloadInterval time.Duration
+}
+
+const DefaultTlsReloadInterval = 10 * time.Second
+
+func parseTLS(t *TLS) (*TLS, error) {
+	if t == nil {
+		return nil, nil
+	}
+	// Copy so we don't modify the options supplied by the caller
+	out := *t
+	if (out.CertFile == "") != (out.KeyFile == "") {
+		return nil, fmt.Errorf("Provide both certificate and key files")
+	}
+	if out.ReloadInterval <= 0 {
+		out.ReloadInterval = DefaultTlsReloadInterval
+	}
+	return &out, nil
+}
+
+// Dials TLS connections to the endpoints with the certificates loaded from the files,
+// files are checked for changes and reloaded when the new connections are established
+type tlsDialer struct {
+	mutex            *sync.RWMutex
+	settings         TLS
+	dialer           dialer.Dialer
+	handshakeTimeout time.Duration
+	tp               timetools.TimeProvider
+	nextProtos       []string
+	roots            *x509.CertPool
+	certs            []tls.Certificate
+	modTimes         map[string]time.Time
+	lastCheck        time.Time
+}
+
+// Creates the dialer for the settings, returns error if the certificate files can not be loaded
+// nextProtos are the protocols offered to the endpoints, e.g. "h2"
+func newTlsDialer(t *TLS, dialer dialer.Dialer, handshakeTimeout time.Duration, tp timetools.TimeProvider, nextProtos []string) (*tlsDialer, error) {
+	d := &tlsDialer{
+		mutex:            &sync.RWMutex{},
+		settings:         *t,
+		dialer:           dialer,
+		handshakeTimeout: handshakeTimeout,
+		tp:               tp,
+		nextProtos:       nextProtos,
+		lastCheck:        tp.UtcNow(),
+	}
+	if err := d.load(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+func (d *tlsDialer) DialTLSContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	d.reload()
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := d.dialer.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, d.handshakeTimeout)
+	defer cancel()
+
+	tlsConn := tls.Client(conn, d.config(host))
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// Returns the config for the connection to the host with the current certificates
+func (d *tlsDialer) config(host string) *tls.Config {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+
+	serverName := d.settings.ServerName
+	if serverName == "" {
+		serverName = host
+	}
+	return &tls.Config{
+		ServerName:         serverName,
+		RootCAs:            d.roots,
+		Certificates:       d.certs,
+		MinVersion:         d.settings.MinVersion,
+		CipherSuites:       d.settings.CipherSuites,
+		InsecureSkipVerify: d.settings.InsecureSkipVerify,
+		NextProtos:         d.nextProtos,
+	}
+}
+
+func (d *tlsDialer) files() []string {
+	files := []string{}
+	for _, path := range []string{d.settings.CAFile, d.settings.CertFile, d.settings.KeyFile} {
+		if path != "" {
+			files = append(files, path)
+		}
+	}
+	return files
+}
+
+// Loads the certificates from the files
+func (d *tlsDialer) load() error {
+	modTimes := make(map[string]time.Time)
+	for _, path := range d.files() {
+		info, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		modTimes[path] = info.ModTime()
+	}
+	var roots *x509.CertPool
+	if d.settings.CAFile != "" {
+		data, err := ioutil.ReadFile(d.settings.CAFile)
+		if err != nil {
+			return err
+		}
+		roots = x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(data) {
+			return fmt.Errorf("No certificates found in %s", d.settings.CAFile)
+		}
+	}
+	var certs []tls.Certificate
+	if d.settings.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(d.settings.CertFile, d.settings.KeyFile)
+		if err != nil {
+			return err
+		}
+		certs = []tls.Certificate{cert}
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.roots, d.certs, d.modTimes = roots, certs, modTimes
+	return nil
+}
+
+// Reloads the certificates if the reload interval has passed and any of the files has changed.
+// Failed reload keeps the previous certificates.
+func (d *tlsDialer) reload() {
+	now := d.tp.UtcNow()
+	d.mutex.Lock()
+	if now.Sub(d.lastCheck) < d.settings.ReloadInterval {
+		d.mutex.Unlock()
+		return
+	}
+	d.lastCheck = now
+	changed := false
+	for path, modTime := range d.modTimes {
+		if info, err := os.Stat(path); err != nil || !info.ModTime().Equal(modTime) {
+			changed = true
+		}
+	}
+	d.mutex.Unlock()
+
+	if !changed {
+		return
+	}
+	if err := d.load(); err != nil {
+		log.Errorf("Failed to reload TLS certificates, keeping the previous ones: %s", err)
+		return
+	}
+	log.Infof("Reloaded TLS certificates from %v", d.files())
+}
@@ -0,0 +1,272 @@
+package httploc
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"time"
+
+	timetools "github.com/mailgun/gotools-time"
+	"github.com/mailgun/vulcan"
+	. "github.com/mailgun/vulcan/route"
+	. "github.com/mailgun/vulcan/testutils"
+	. "gopkg.in/check.v1"
+)
+
+type TlsSuite struct {
+	dir string
+	tm  *timetools.FreezedTime
+}
+
+var _ = Suite(&TlsSuite{})
+
+func (s *TlsSuite) SetUpTest(c *C) {
+	s.dir = c.MkDir()
+	s.tm = &timetools.FreezedTime{CurrentTime: time.Date(2012, 3, 4, 5, 6, 7, 0, time.UTC)}
+}
+
+// Certificate with the key, signed by the parent or self signed
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+func newTestCert(c *C, name string, parent *testCert, isCA bool) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, IsNil)
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	c.Assert(err, IsNil)
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IsCA:                  isCA,
+		BasicConstraintsValid: true,
+	}
+	if !isCA {
+		template.DNSNames = []string{name}
+	}
+	if name == "localhost" {
+		template.IPAddresses = []net.IP{net.ParseIP("127.0.0.1")}
+	}
+	signer, signerKey := template, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	c.Assert(err, IsNil)
+	cert, err := x509.ParseCertificate(der)
+	c.Assert(err, IsNil)
+	return &testCert{cert: cert, key: key, der: der}
+}
+
+func (t *testCert) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{t.der}, PrivateKey: t.key}
+}
+
+// Writes certificate and key to the files, returns their paths
+func (s *TlsSuite) writeCert(c *C, name string, t *testCert) (string, string) {
+	certPath, keyPath := filepath.Join(s.dir, name+".crt"), filepath.Join(s.dir, name+".key")
+	err := ioutil.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: t.der}), 0600)
+	c.Assert(err, IsNil)
+	keyDer, err := x509.MarshalECPrivateKey(t.key)
+	c.Assert(err, IsNil)
+	err = ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	c.Assert(err, IsNil)
+	return certPath, keyPath
+}
+
+// Starts the https server with the certificate, requiring the client certificates signed by the clientCA if set
+func newTlsServer(cert *testCert, clientCA *testCert) *httptest.Server {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hi, tls"))
+	}))
+	server.TLS = &tls.Config{Certificates: []tls.Certificate{cert.tlsCertificate()}}
+	if clientCA != nil {
+		pool := x509.NewCertPool()
+		pool.AddCert(clientCA.cert)
+		server.TLS.ClientCAs = pool
+		server.TLS.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	server.StartTLS()
+	return server
+}
+
+func (s *TlsSuite) newProxy(c *C, server *httptest.Server, t *TLS) *httptest.Server {
+	_, proxy := s.newLocation(c, server, t)
+	return proxy
+}
+
+func (s *TlsSuite) newLocation(c *C, server *httptest.Server, t *TLS) (*HttpLocation, *httptest.Server) {
+	rr := (&LocSuite{tm: s.tm}).newRoundRobin(server.URL)
+	location, err := NewLocationWithOptions("dummy", rr, Options{TLS: t, TimeProvider: s.tm})
+	c.Assert(err, IsNil)
+	proxy, err := vulcan.NewProxy(&ConstRouter{Location: location})
+	c.Assert(err, IsNil)
+	return location, httptest.NewServer(proxy)
+}
+
+func (s *TlsSuite) TestPrivateCA(c *C) {
+	ca := newTestCert(c, "ca", nil, true)
+	server := newTlsServer(newTestCert(c, "localhost", ca, false), nil)
+	defer server.Close()
+	caPath, _ := s.writeCert(c, "ca", ca)
+
+	proxy := s.newProxy(c, server, &TLS{CAFile: caPath})
+	defer proxy.Close()
+	re, body := Get(c, proxy.URL, nil, "")
+	c.Assert(re.StatusCode, Equals, http.StatusOK)
+	c.Assert(string(body), Equals, "hi, tls")
+
+	// System roots don't trust the private CA
+	untrusted := s.newProxy(c, server, &TLS{})
+	defer untrusted.Close()
+	re, _ = Get(c, untrusted.URL, nil, "")
+	c.Assert(re.StatusCode, Equals, http.StatusBadGateway)
+
+	insecure := s.newProxy(c, server, &TLS{InsecureSkipVerify: true})
+	defer insecure.Close()
+	re, _ = Get(c, insecure.URL, nil, "")
+	c.Assert(re.StatusCode, Equals, http.StatusOK)
+}
+
+func (s *TlsSuite) TestServerName(c *C) {
+	ca := newTestCert(c, "ca", nil, true)
+	cert := newTestCert(c, "backend.local", ca, false)
+
+	var serverName string
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serverName = r.TLS.ServerName
+	}))
+	server.TLS = &tls.Config{Certificates: []tls.Certificate{cert.tlsCertificate()}}
+	server.StartTLS()
+	defer server.Close()
+	caPath, _ := s.writeCert(c, "ca", ca)
+
+	mismatch := s.newProxy(c, server, &TLS{CAFile: caPath})
+	defer mismatch.Close()
+	re, _ := Get(c, mismatch.URL, nil, "")
+	c.Assert(re.StatusCode, Equals, http.StatusBadGateway)
+
+	proxy := s.newProxy(c, server, &TLS{CAFile: caPath, ServerName: "backend.local"})
+	defer proxy.Close()
+	re, _ = Get(c, proxy.URL, nil, "")
+	c.Assert(re.StatusCode, Equals, http.StatusOK)
+	c.Assert(serverName, Equals, "backend.local")
+}
+
+func (s *TlsSuite) TestClientCertificate(c *C) {
+	ca := newTestCert(c, "ca", nil, true)
+	clientCA := newTestCert(c, "client-ca", nil, true)
+	server := newTlsServer(newTestCert(c, "localhost", ca, false), clientCA)
+	defer server.Close()
+	caPath, _ := s.writeCert(c, "ca", ca)
+	certPath, keyPath := s.writeCert(c, "client", newTestCert(c, "client", clientCA, false))
+
+	proxy := s.newProxy(c, server, &TLS{CAFile: caPath, CertFile: certPath, KeyFile: keyPath})
+	defer proxy.Close()
+	re, _ := Get(c, proxy.URL, nil, "")
+	c.Assert(re.StatusCode, Equals, http.StatusOK)
+
+	anonymous := s.newProxy(c, server, &TLS{CAFile: caPath})
+	defer anonymous.Close()
+	re, _ = Get(c, anonymous.URL, nil, "")
+	c.Assert(re.StatusCode, Equals, http.StatusBadGateway)
+}
+
+func (s *TlsSuite) TestReload(c *C) {
+	ca := newTestCert(c, "ca", nil, true)
+	server := newTlsServer(newTestCert(c, "localhost", ca, false), nil)
+	defer server.Close()
+
+	// Start with the wrong CA
+	caPath, _ := s.writeCert(c, "ca", newTestCert(c, "other-ca", nil, true))
+	location, proxy := s.newLocation(c, server, &TLS{CAFile: caPath, ReloadInterval: time.Minute})
+	defer proxy.Close()
+	re, _ := Get(c, proxy.URL, nil, "")
+	c.Assert(re.StatusCode, Equals, http.StatusBadGateway)
+
+	s.writeCert(c, "ca", ca)
+	future := time.Now().Add(time.Hour)
+	c.Assert(os.Chtimes(caPath, future, future), IsNil)
+
+	// Files are not checked before the reload interval passes
+	re, _ = Get(c, proxy.URL, nil, "")
+	c.Assert(re.StatusCode, Equals, http.StatusBadGateway)
+
+	s.tm.CurrentTime = s.tm.CurrentTime.Add(time.Minute)
+	re, _ = Get(c, proxy.URL, nil, "")
+	c.Assert(re.StatusCode, Equals, http.StatusOK)
+
+	// Broken file keeps the previous certificates
+	c.Assert(ioutil.WriteFile(caPath, []byte("garbage"), 0600), IsNil)
+	future = future.Add(time.Hour)
+	c.Assert(os.Chtimes(caPath, future, future), IsNil)
+	s.tm.CurrentTime = s.tm.CurrentTime.Add(time.Minute)
+	_, tr := location.GetOptionsAndTransport()
+	tr.CloseIdleConnections()
+	re, _ = Get(c, proxy.URL, nil, "")
+	c.Assert(re.StatusCode, Equals, http.StatusOK)
+}
+
+func (s *TlsSuite) TestInvalidOptions(c *C) {
+	rr := (&LocSuite{tm: s.tm}).newRoundRobin("https://localhost:5000")
+	certPath, _ := s.writeCert(c, "client", newTestCert(c, "client", nil, false))
+
+	for _, t := range []*TLS{
+		{CertFile: certPath},
+		{CAFile: filepath.Join(s.dir, "missing.crt")},
+		{CAFile: certPath + ".missing"},
+	} {
+		_, err := NewLocationWithOptions("dummy", rr, Options{TLS: t})
+		c.Assert(err, NotNil)
+	}
+
+	garbage := filepath.Join(s.dir, "garbage.crt")
+	c.Assert(ioutil.WriteFile(garbage, []byte("garbage"), 0600), IsNil)
+	_, err := NewLocationWithOptions("dummy", rr, Options{TLS: &TLS{CAFile: garbage}})
+	c.Assert(err, NotNil)
+}
+
+func (s *TlsSuite) TestHTTP2(c *C) {
+	ca := newTestCert(c, "ca", nil, true)
+	caPath, _ := s.writeCert(c, "ca", ca)
+	cert := newTestCert(c, "localhost", ca, false)
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Proto))
+	}))
+	server.EnableHTTP2 = true
+	server.TLS = &tls.Config{Certificates: []tls.Certificate{cert.tlsCertificate()}}
+	server.StartTLS()
+	defer server.Close()
+
+	for protocol, expected := range map[Protocol]string{HTTP1: "HTTP/1.1", HTTP2: "HTTP/2.0", H2C: "HTTP/2.0"} {
+		rr := (&LocSuite{tm: s.tm}).newRoundRobin(server.URL)
+		location, err := NewLocationWithOptions("dummy", rr, Options{TLS: &TLS{CAFile: caPath}, Protocol: protocol, TimeProvider: s.tm})
+		c.Assert(err, IsNil)
+		proxyHandler, err := vulcan.NewProxy(&ConstRouter{Location: location})
+		c.Assert(err, IsNil)
+		proxy := httptest.NewServer(proxyHandler)
+
+		re, body := Get(c, proxy.URL, nil, "")
+		proxy.Close()
+		c.Assert(re.StatusCode, Equals, http.StatusOK)
+		c.Assert(string(body), Equals, expected, Commentf("Protocol %s", protocol))
+	}
+}
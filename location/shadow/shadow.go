@@ -0,0 +1,435 @@
+// Location that mirrors a sample of requests to the shadow location
+package shadow
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	log "github.com/mailgun/gotools-log"
+
+	"github.com/mailgun/vulcan/errors"
+	"github.com/mailgun/vulcan/grpc"
+	"github.com/mailgun/vulcan/location"
+	"github.com/mailgun/vulcan/netutils"
+	"github.com/mailgun/vulcan/request"
+)
+
+// ShadowLocation round trips requests to the primary location and sends
+// copies of the sampled requests to the shadow location. Shadow requests are fire and forget,
+// their responses and errors are never returned to the client.
+type ShadowLocation struct {
+	// Location that serves the client requests
+	primary location.Location
+	// Location that receives mirrored requests
+	shadow location.Location
+	// Sampling, limits and diffing settings
+	options Options
+	// Amount of shadow requests in flight
+	inFlight int64
+}
+
+// DiffFn is called when the shadow response differs from the primary response
+type DiffFn func(r request.Request, d *Diff)
+
+type Options struct {
+	// Fraction of the requests to mirror, in range (0, 1]. Defaults to 1 - mirror every request
+	SampleRate float64
+	// Maximum amount of shadow requests in flight, requests above the limit will not be mirrored
+	MaxInFlight int64
+	// Headers added to every mirrored request, so shadow endpoints can tell them apart
+	Headers http.Header
+	// Maximum size to keep in memory before buffering the request body to disk
+	MaxMemBodyBytes int64
+	// Maximum size of the request body buffered for mirroring, larger requests are rejected. Unlimited if not set
+	MaxBodyBytes int64
+	// Memory and disk space for the request bodies, defaults to the system temp directory without limits
+	BodyStorage netutils.BufferStorage
+	// Optional callback, if set, primary and shadow responses are compared and the differences are reported
+	OnDiff DiffFn
+	// Maximum amount of response body bytes to compare
+	MaxDiffBodyBytes int64
+	// Headers ignored when comparing responses
+	IgnoreHeaders []string
+	// Time to wait for the primary response to be closed and for the shadow response, defaults to 30 seconds
+	MirrorTimeout time.Duration
+}
+
+func NewShadowLocation(primary, shadow location.Location) (*ShadowLocation, error) {
+	return NewShadowLocationWithOptions(primary, shadow, Options{})
+}
+
+func NewShadowLocationWithOptions(primary, shadow location.Location, o Options) (*ShadowLocation, error) {
+	if primary == nil || shadow == nil {
+		return nil, fmt.Errorf("Provide primary and shadow locations")
+	}
+	o, err := parseOptions(o)
+	if err != nil {
+		return nil, err
+	}
+	return &ShadowLocation{
+		primary: primary,
+		shadow:  shadow,
+		options: o,
+	}, nil
+}
+
+func (s *ShadowLocation) GetId() string {
+	return s.primary.GetId()
+}
+
+func (s *ShadowLocation) GetPrimary() location.Location {
+	return s.primary
+}
+
+func (s *ShadowLocation) GetShadow() location.Location {
+	return s.shadow
+}
+
+func (s *ShadowLocation) GetOptions() Options {
+	return s.options
+}
+
+// Returns the amount of shadow requests in flight
+func (s *ShadowLocation) GetInFlight() int64 {
+	return atomic.LoadInt64(&s.inFlight)
+}
+
+func (s *ShadowLocation) RoundTrip(req request.Request) (*http.Response, error) {
+	originalRequest := req.GetHttpRequest()
+
+	// gRPC calls can stream in both directions, so they are never buffered for mirroring
+	if grpc.IsGrpcRequest(originalRequest) || !s.acquire() {
+		return s.primary.RoundTrip(req)
+	}
+
+	// Check request size first, if that exceeds the limit, we don't bother reading the request
+	if s.options.MaxBodyBytes > 0 && originalRequest.ContentLength > s.options.MaxBodyBytes {
+		s.release()
+		return nil, errors.FromStatus(http.StatusRequestEntityTooLarge)
+	}
+
+	// Read the body once, so the same copy is used by the primary location
+	// and replayed to the shadow location after the primary location is done with it.
+	body, err := netutils.NewBodyBufferWithOptions(originalRequest.Body, netutils.BodyBufferOptions{
+		MemBufferBytes: s.options.MaxMemBodyBytes,
+		MaxSizeBytes:   s.options.MaxBodyBytes,
+		Storage:        s.options.BodyStorage,
+	})
+	if err == nil {
+		err = s.checkBodySize(body)
+		if err != nil {
+			body.Close()
+		}
+	}
+	if err != nil {
+		s.release()
+		return nil, err
+	}
+
+	shadowRequest := s.copyRequest(originalRequest, body)
+
+	// Note that we don't change the original request Body as it's handled by the http server
+	primaryRequest := new(http.Request)
+	*primaryRequest = *originalRequest
+	primaryRequest.Body = ioutil.NopCloser(body)
+	req.SetHttpRequest(primaryRequest)
+	req.SetBody(body)
+
+	response, err := s.primary.RoundTrip(req)
+
+	// Primary location may read the body until its response is closed, so the body
+	// is released once both the primary response and the shadow request are done
+	shared := &sharedBody{MultiReader: body, refs: 2}
+	primaryResult := make(chan *ResponseSnapshot, 1)
+	if response != nil {
+		max := int64(0)
+		if s.options.OnDiff != nil {
+			max = s.options.MaxDiffBodyBytes
+		}
+		response.Body = &capturingReader{
+			ReadCloser: response.Body,
+			max:        max,
+			snapshot:   &ResponseSnapshot{StatusCode: response.StatusCode, Header: copyHeader(response.Header)},
+			done:       primaryResult,
+			body:       shared,
+		}
+	} else {
+		primaryResult <- &ResponseSnapshot{Error: err}
+		shared.release()
+	}
+
+	go s.mirror(request.NewBaseRequest(shadowRequest, req.GetId(), nil), shared, primaryResult)
+	return response, err
+}
+
+// Body that fits into the memory buffer is not checked against the max size by the buffer itself
+func (s *ShadowLocation) checkBodySize(body netutils.MultiReader) error {
+	if s.options.MaxBodyBytes <= 0 {
+		return nil
+	}
+	size, err := body.TotalSize()
+	if err != nil {
+		return err
+	}
+	if size > s.options.MaxBodyBytes {
+		return &netutils.MaxSizeReachedError{MaxSize: s.options.MaxBodyBytes}
+	}
+	return nil
+}
+
+func (s *ShadowLocation) mirror(req request.Request, body *sharedBody, primaryResult chan *ResponseSnapshot) {
+	defer s.release()
+	defer body.release()
+
+	timeout := time.NewTimer(s.options.MirrorTimeout)
+	defer timeout.Stop()
+
+	var primarySnapshot *ResponseSnapshot
+	select {
+	case primarySnapshot = <-primaryResult:
+	case <-timeout.C:
+		log.Errorf("%s primary response was not closed in %s, dropping shadow request", req, s.options.MirrorTimeout)
+		return
+	}
+
+	if _, err := body.Seek(0, 0); err != nil {
+		log.Errorf("%s failed to replay body: %s", req, err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.options.MirrorTimeout)
+	defer cancel()
+	req.SetHttpRequest(req.GetHttpRequest().WithContext(ctx))
+
+	response, err := s.shadow.RoundTrip(req)
+	shadowSnapshot := &ResponseSnapshot{Error: err}
+	if response != nil {
+		shadowSnapshot.StatusCode = response.StatusCode
+		shadowSnapshot.Header = copyHeader(response.Header)
+		shadowSnapshot.Body, _ = ioutil.ReadAll(io.LimitReader(response.Body, s.options.MaxDiffBodyBytes))
+		io.Copy(ioutil.Discard, response.Body)
+		response.Body.Close()
+	} else if err != nil {
+		log.Errorf("%s shadow location failed: %s", req, err)
+	}
+
+	if s.options.OnDiff == nil {
+		return
+	}
+	diff := &Diff{
+		Primary:       primarySnapshot,
+		Shadow:        shadowSnapshot,
+		ignoreHeaders: s.options.IgnoreHeaders,
+	}
+	if diff.Differs() {
+		s.options.OnDiff(req, diff)
+	}
+}
+
+func (s *ShadowLocation) acquire() bool {
+	if s.options.SampleRate < 1 && rand.Float64() >= s.options.SampleRate {
+		return false
+	}
+	if atomic.AddInt64(&s.inFlight, 1) > s.options.MaxInFlight {
+		atomic.AddInt64(&s.inFlight, -1)
+		return false
+	}
+	return true
+}
+
+func (s *ShadowLocation) release() {
+	atomic.AddInt64(&s.inFlight, -1)
+}
+
+func (s *ShadowLocation) copyRequest(req *http.Request, body netutils.MultiReader) *http.Request {
+	// Shadow request outlives the client request, so we build a new one
+	// instead of copying the request handled by the http server
+	outReq := &http.Request{
+		Method:     req.Method,
+		URL:        netutils.CopyUrl(req.URL),
+		Proto:      req.Proto,
+		ProtoMajor: req.ProtoMajor,
+		ProtoMinor: req.ProtoMinor,
+		Header:     make(http.Header),
+		// The body is released by the mirroring routine once the shadow location is done
+		Body:          ioutil.NopCloser(body),
+		ContentLength: req.ContentLength,
+		Host:          req.Host,
+		RemoteAddr:    req.RemoteAddr,
+		TLS:           req.TLS,
+	}
+	netutils.CopyHeaders(outReq.Header, req.Header)
+	for k, vv := range s.options.Headers {
+		outReq.Header[k] = vv
+	}
+	return outReq
+}
+
+// ResponseSnapshot captures the parts of the response used for comparison
+type ResponseSnapshot struct {
+	StatusCode int
+	Header     http.Header
+	// Body is truncated to the Options.MaxDiffBodyBytes
+	Body  []byte
+	Error error
+}
+
+// Diff holds primary and shadow responses to the same request
+type Diff struct {
+	Primary       *ResponseSnapshot
+	Shadow        *ResponseSnapshot
+	ignoreHeaders []string
+}
+
+func (d *Diff) String() string {
+	return fmt.Sprintf("Diff(status=%t, headers=%v, body=%t)", d.StatusDiffers(), d.HeaderDiffs(), d.BodyDiffers())
+}
+
+func (d *Diff) Differs() bool {
+	return d.StatusDiffers() || d.BodyDiffers() || len(d.HeaderDiffs()) != 0
+}
+
+func (d *Diff) StatusDiffers() bool {
+	return d.Primary.StatusCode != d.Shadow.StatusCode || (d.Primary.Error == nil) != (d.Shadow.Error == nil)
+}
+
+func (d *Diff) BodyDiffers() bool {
+	return !bytes.Equal(d.Primary.Body, d.Shadow.Body)
+}
+
+// Returns names of the headers that are present in one response and are missing or have different values in another
+func (d *Diff) HeaderDiffs() []string {
+	var out []string
+	seen := make(map[string]bool)
+	for _, h := range []http.Header{d.Primary.Header, d.Shadow.Header} {
+		for k := range h {
+			if seen[k] || d.isIgnored(k) {
+				continue
+			}
+			seen[k] = true
+			if !equalValues(d.Primary.Header[k], d.Shadow.Header[k]) {
+				out = append(out, k)
+			}
+		}
+	}
+	return out
+}
+
+func (d *Diff) isIgnored(header string) bool {
+	for _, h := range d.ignoreHeaders {
+		if http.CanonicalHeaderKey(h) == header {
+			return true
+		}
+	}
+	return false
+}
+
+func equalValues(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func copyHeader(h http.Header) http.Header {
+	out := make(http.Header)
+	netutils.CopyHeaders(out, h)
+	return out
+}
+
+// capturingReader keeps the first bytes of the primary response while it is being proxied to the client
+// and passes the snapshot to the mirroring routine once the response is closed
+type capturingReader struct {
+	io.ReadCloser
+	max      int64
+	buffer   bytes.Buffer
+	snapshot *ResponseSnapshot
+	done     chan *ResponseSnapshot
+	body     *sharedBody
+	closed   bool
+}
+
+func (c *capturingReader) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	if remaining := c.max - int64(c.buffer.Len()); remaining > 0 && n > 0 {
+		if int64(n) < remaining {
+			remaining = int64(n)
+		}
+		c.buffer.Write(p[:remaining])
+	}
+	return n, err
+}
+
+func (c *capturingReader) Close() error {
+	err := c.ReadCloser.Close()
+	if !c.closed {
+		c.closed = true
+		c.snapshot.Body = c.buffer.Bytes()
+		c.done <- c.snapshot
+		c.body.release()
+	}
+	return err
+}
+
+// sharedBody is the request body read by both the primary and the shadow locations,
+// the buffer is closed when the last of them releases it
+type sharedBody struct {
+	netutils.MultiReader
+	refs int32
+}
+
+func (b *sharedBody) release() {
+	if atomic.AddInt32(&b.refs, -1) == 0 {
+		b.MultiReader.Close()
+	}
+}
+
+const (
+	DefaultMaxInFlight      = 1024
+	DefaultMaxDiffBodyBytes = 65536
+	DefaultMirrorTimeout    = 30 * time.Second
+	ShadowHeader            = "X-Vulcan-Shadow"
+)
+
+func parseOptions(o Options) (Options, error) {
+	if o.SampleRate < 0 || o.SampleRate > 1 {
+		return o, fmt.Errorf("Sample rate should be in range (0, 1], got: %f", o.SampleRate)
+	}
+	if o.SampleRate == 0 {
+		o.SampleRate = 1
+	}
+	if o.MaxInFlight <= 0 {
+		o.MaxInFlight = DefaultMaxInFlight
+	}
+	if o.MaxMemBodyBytes <= 0 {
+		o.MaxMemBodyBytes = netutils.DefaultMemBufferBytes
+	}
+	if o.MaxBodyBytes < 0 {
+		return o, fmt.Errorf("Max body bytes should be >= 0, got: %d", o.MaxBodyBytes)
+	}
+	if o.MaxDiffBodyBytes <= 0 {
+		o.MaxDiffBodyBytes = DefaultMaxDiffBodyBytes
+	}
+	if o.MirrorTimeout <= 0 {
+		o.MirrorTimeout = DefaultMirrorTimeout
+	}
+	if o.Headers == nil {
+		o.Headers = http.Header{ShadowHeader: []string{"true"}}
+	}
+	if o.IgnoreHeaders == nil {
+		o.IgnoreHeaders = []string{"Date"}
+	}
+	return o, nil
+}
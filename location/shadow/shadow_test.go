@@ -0,0 +1,358 @@
+package shadow
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mailgun/vulcan"
+	"github.com/mailgun/vulcan/endpoint"
+	"github.com/mailgun/vulcan/loadbalance/roundrobin"
+	. "github.com/mailgun/vulcan/location"
+	"github.com/mailgun/vulcan/location/httploc"
+	"github.com/mailgun/vulcan/netutils"
+	. "github.com/mailgun/vulcan/request"
+	. "github.com/mailgun/vulcan/route"
+	. "github.com/mailgun/vulcan/testutils"
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type ShadowSuite struct {
+}
+
+var _ = Suite(&ShadowSuite{})
+
+type mirrored struct {
+	body   string
+	header string
+}
+
+func (s *ShadowSuite) newProxy(c *C, l Location) *httptest.Server {
+	proxy, err := vulcan.NewProxy(&ConstRouter{Location: l})
+	c.Assert(err, IsNil)
+	return httptest.NewServer(proxy)
+}
+
+func (s *ShadowSuite) newShadowServer(reply string) (*httptest.Server, chan mirrored) {
+	requests := make(chan mirrored, 1)
+	server := NewTestServer(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Write([]byte(reply))
+		requests <- mirrored{body: string(body), header: r.Header.Get(ShadowHeader)}
+	})
+	return server, requests
+}
+
+func (s *ShadowSuite) TestMirrorsRequest(c *C) {
+	primary := NewTestServer(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("Hi, I'm primary"))
+	})
+	defer primary.Close()
+
+	shadow, requests := s.newShadowServer("Hi, I'm shadow")
+	defer shadow.Close()
+
+	l, err := NewShadowLocation(&ConstHttpLocation{Url: primary.URL}, &ConstHttpLocation{Url: shadow.URL})
+	c.Assert(err, IsNil)
+
+	proxy := s.newProxy(c, l)
+	defer proxy.Close()
+
+	response, bodyBytes := Get(c, proxy.URL, nil, "hello!")
+	c.Assert(response.StatusCode, Equals, http.StatusOK)
+	c.Assert(string(bodyBytes), Equals, "Hi, I'm primary")
+
+	select {
+	case m := <-requests:
+		c.Assert(m.body, Equals, "hello!")
+		c.Assert(m.header, Equals, "true")
+	case <-time.After(time.Second):
+		c.Fatalf("Shadow request timed out")
+	}
+}
+
+func (s *ShadowSuite) TestShadowFailureDoesNotAffectClient(c *C) {
+	primary := NewTestServer(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("Hi, I'm primary"))
+	})
+	defer primary.Close()
+
+	l, err := NewShadowLocation(&ConstHttpLocation{Url: primary.URL}, &ConstHttpLocation{Url: "http://localhost:63999"})
+	c.Assert(err, IsNil)
+
+	proxy := s.newProxy(c, l)
+	defer proxy.Close()
+
+	response, bodyBytes := Get(c, proxy.URL, nil, "hello!")
+	c.Assert(response.StatusCode, Equals, http.StatusOK)
+	c.Assert(string(bodyBytes), Equals, "Hi, I'm primary")
+}
+
+func (s *ShadowSuite) TestReportsDiff(c *C) {
+	primary := NewTestServer(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("Hi, I'm primary"))
+	})
+	defer primary.Close()
+
+	shadow, _ := s.newShadowServer("Hi, I'm shadow")
+	defer shadow.Close()
+
+	diffs := make(chan *Diff, 1)
+	l, err := NewShadowLocationWithOptions(
+		&ConstHttpLocation{Url: primary.URL}, &ConstHttpLocation{Url: shadow.URL},
+		Options{
+			OnDiff: func(r Request, d *Diff) {
+				diffs <- d
+			},
+		})
+	c.Assert(err, IsNil)
+
+	proxy := s.newProxy(c, l)
+	defer proxy.Close()
+
+	response, _ := Get(c, proxy.URL, nil, "hello!")
+	c.Assert(response.StatusCode, Equals, http.StatusOK)
+
+	select {
+	case d := <-diffs:
+		c.Assert(d.StatusDiffers(), Equals, false)
+		c.Assert(d.BodyDiffers(), Equals, true)
+		c.Assert(string(d.Primary.Body), Equals, "Hi, I'm primary")
+		c.Assert(string(d.Shadow.Body), Equals, "Hi, I'm shadow")
+	case <-time.After(time.Second):
+		c.Fatalf("Diff was not reported")
+	}
+	c.Assert(l.GetInFlight(), Equals, int64(0))
+}
+
+// Primary location uses the body buffered by the shadow location instead of buffering it again
+func (s *ShadowSuite) TestPrimaryReusesBody(c *C) {
+	primary := NewTestServer(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Write(body)
+	})
+	defer primary.Close()
+
+	shadow, requests := s.newShadowServer("Hi, I'm shadow")
+	defer shadow.Close()
+
+	rr, err := roundrobin.NewRoundRobin()
+	c.Assert(err, IsNil)
+	rr.AddEndpoint(endpoint.MustParseUrl(primary.URL))
+
+	local, err := netutils.NewLocalStorage(netutils.LocalStorageOptions{Dir: c.MkDir()})
+	c.Assert(err, IsNil)
+	storage := &countingStorage{BufferStorage: local}
+	primaryLoc, err := httploc.NewLocationWithOptions("primary", rr, httploc.Options{
+		Limits: httploc.Limits{BodyStorage: storage},
+	})
+	c.Assert(err, IsNil)
+
+	l, err := NewShadowLocation(primaryLoc, &ConstHttpLocation{Url: shadow.URL})
+	c.Assert(err, IsNil)
+
+	proxy := s.newProxy(c, l)
+	defer proxy.Close()
+
+	response, bodyBytes := Get(c, proxy.URL, nil, "hello!")
+	c.Assert(response.StatusCode, Equals, http.StatusOK)
+	c.Assert(string(bodyBytes), Equals, "hello!")
+
+	select {
+	case m := <-requests:
+		c.Assert(m.body, Equals, "hello!")
+	case <-time.After(time.Second):
+		c.Fatalf("Shadow request timed out")
+	}
+	c.Assert(atomic.LoadInt32(&storage.buffers), Equals, int32(0))
+}
+
+// Shadow request is dropped and its slot is released if the primary response is never closed
+func (s *ShadowSuite) TestMirrorTimeout(c *C) {
+	primary := NewTestServer(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("Hi, I'm primary"))
+	})
+	defer primary.Close()
+
+	shadow, requests := s.newShadowServer("Hi, I'm shadow")
+	defer shadow.Close()
+
+	l, err := NewShadowLocationWithOptions(
+		&ConstHttpLocation{Url: primary.URL}, &ConstHttpLocation{Url: shadow.URL}, Options{MirrorTimeout: 10 * time.Millisecond})
+	c.Assert(err, IsNil)
+
+	req, err := http.NewRequest("POST", primary.URL, strings.NewReader("hello!"))
+	c.Assert(err, IsNil)
+	response, err := l.RoundTrip(NewBaseRequest(req, 1, nil))
+	c.Assert(err, IsNil)
+	c.Assert(response.StatusCode, Equals, http.StatusOK)
+
+	for i := 0; i < 100 && l.GetInFlight() != 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Assert(l.GetInFlight(), Equals, int64(0))
+	select {
+	case <-requests:
+		c.Fatalf("Shadow request was not dropped")
+	default:
+	}
+}
+
+// Buffered body is limited, requests over the limit are rejected before reaching the primary location
+func (s *ShadowSuite) TestBodyTooLarge(c *C) {
+	primary := NewTestServer(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("Hi, I'm primary"))
+	})
+	defer primary.Close()
+
+	shadow, requests := s.newShadowServer("Hi, I'm shadow")
+	defer shadow.Close()
+
+	l, err := NewShadowLocationWithOptions(
+		&ConstHttpLocation{Url: primary.URL}, &ConstHttpLocation{Url: shadow.URL}, Options{MaxBodyBytes: 4})
+	c.Assert(err, IsNil)
+
+	proxy := s.newProxy(c, l)
+	defer proxy.Close()
+
+	response, _ := Get(c, proxy.URL, nil, "hello!")
+	c.Assert(response.StatusCode, Equals, http.StatusRequestEntityTooLarge)
+
+	// Chunked request has no content length, so the limit is checked while the body is buffered
+	req, err := http.NewRequest("POST", primary.URL, strings.NewReader("hello!"))
+	c.Assert(err, IsNil)
+	req.ContentLength = -1
+	response, err = l.RoundTrip(NewBaseRequest(req, 1, nil))
+	c.Assert(response, IsNil)
+	c.Assert(err, FitsTypeOf, &netutils.MaxSizeReachedError{})
+
+	c.Assert(l.GetInFlight(), Equals, int64(0))
+	select {
+	case <-requests:
+		c.Fatalf("Request over the limit was mirrored")
+	default:
+	}
+}
+
+// gRPC calls are passed to the primary location as is and never mirrored
+func (s *ShadowSuite) TestGrpcNotMirrored(c *C) {
+	primary := NewTestServer(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("Hi, I'm primary"))
+	})
+	defer primary.Close()
+
+	shadow, requests := s.newShadowServer("Hi, I'm shadow")
+	defer shadow.Close()
+
+	l, err := NewShadowLocation(&ConstHttpLocation{Url: primary.URL}, &ConstHttpLocation{Url: shadow.URL})
+	c.Assert(err, IsNil)
+
+	req, err := http.NewRequest("POST", primary.URL, strings.NewReader("hello!"))
+	c.Assert(err, IsNil)
+	req.Header.Set("Content-Type", "application/grpc")
+	r := NewBaseRequest(req, 1, nil)
+	response, err := l.RoundTrip(r)
+	c.Assert(err, IsNil)
+	c.Assert(response.StatusCode, Equals, http.StatusOK)
+	response.Body.Close()
+
+	c.Assert(r.GetBody(), IsNil)
+	c.Assert(l.GetInFlight(), Equals, int64(0))
+	select {
+	case <-requests:
+		c.Fatalf("gRPC request was mirrored")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// Body stays with the primary location that is still reading it after the shadow request has timed out
+func (s *ShadowSuite) TestMirrorTimeoutKeepsPrimaryBody(c *C) {
+	primary := NewTestServer(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("Hi, I'm primary"))
+	})
+	defer primary.Close()
+
+	shadow, _ := s.newShadowServer("Hi, I'm shadow")
+	defer shadow.Close()
+
+	local, err := netutils.NewLocalStorage(netutils.LocalStorageOptions{Dir: c.MkDir()})
+	c.Assert(err, IsNil)
+	storage := &countingStorage{BufferStorage: local}
+	l, err := NewShadowLocationWithOptions(
+		&ConstHttpLocation{Url: primary.URL}, &ConstHttpLocation{Url: shadow.URL},
+		Options{MirrorTimeout: 10 * time.Millisecond, BodyStorage: storage})
+	c.Assert(err, IsNil)
+
+	req, err := http.NewRequest("POST", primary.URL, strings.NewReader("hello!"))
+	c.Assert(err, IsNil)
+	r := NewBaseRequest(req, 1, nil)
+	response, err := l.RoundTrip(r)
+	c.Assert(err, IsNil)
+
+	for i := 0; i < 100 && l.GetInFlight() != 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Assert(l.GetInFlight(), Equals, int64(0))
+	c.Assert(atomic.LoadInt32(&storage.freed), Equals, int32(0))
+
+	_, err = r.GetBody().Seek(0, 0)
+	c.Assert(err, IsNil)
+	body, err := ioutil.ReadAll(r.GetBody())
+	c.Assert(err, IsNil)
+	c.Assert(string(body), Equals, "hello!")
+
+	response.Body.Close()
+	c.Assert(atomic.LoadInt32(&storage.freed), Equals, int32(1))
+}
+
+func (s *ShadowSuite) TestDiffIgnoresHeaders(c *C) {
+	d := &Diff{
+		Primary:       &ResponseSnapshot{StatusCode: 200, Header: http.Header{"Date": []string{"a"}, "X-A": []string{"b"}}},
+		Shadow:        &ResponseSnapshot{StatusCode: 200, Header: http.Header{"Date": []string{"c"}, "X-B": []string{"b"}}},
+		ignoreHeaders: []string{"date"},
+	}
+	c.Assert(len(d.HeaderDiffs()), Equals, 2)
+	c.Assert(d.Differs(), Equals, true)
+
+	d.Shadow.Header = http.Header{"Date": []string{"c"}, "X-A": []string{"b"}}
+	c.Assert(d.Differs(), Equals, false)
+}
+
+func (s *ShadowSuite) TestInvalidParams(c *C) {
+	_, err := NewShadowLocation(nil, &Loc{})
+	c.Assert(err, NotNil)
+
+	_, err = NewShadowLocationWithOptions(&Loc{}, &Loc{}, Options{SampleRate: 2})
+	c.Assert(err, NotNil)
+
+	_, err = NewShadowLocationWithOptions(&Loc{}, &Loc{}, Options{MaxBodyBytes: -1})
+	c.Assert(err, NotNil)
+}
+
+// Counts the memory buffers requested from and returned to the storage
+type countingStorage struct {
+	netutils.BufferStorage
+	buffers int32
+	freed   int32
+}
+
+func (s *countingStorage) NewMemoryBuffer() netutils.MemoryBuffer {
+	atomic.AddInt32(&s.buffers, 1)
+	return &countingBuffer{MemoryBuffer: s.BufferStorage.NewMemoryBuffer(), storage: s}
+}
+
+type countingBuffer struct {
+	netutils.MemoryBuffer
+	storage *countingStorage
+}
+
+func (b *countingBuffer) Free() {
+	atomic.AddInt32(&b.storage.freed, 1)
+	b.MemoryBuffer.Free()
+}
@@ -39,15 +39,19 @@ type RollingMeter struct {
 }
 
 func NewRollingMeter(endpoint Endpoint, buckets int, resolution time.Duration, timeProvider timetools.TimeProvider, isError FailPredicate) (*RollingMeter, error) {
+	if endpoint == nil {
+		return nil, fmt.Errorf("Select an endpoint")
+	}
+	return newRollingMeter(endpoint, buckets, resolution, timeProvider, isError)
+}
+
+func newRollingMeter(endpoint Endpoint, buckets int, resolution time.Duration, timeProvider timetools.TimeProvider, isError FailPredicate) (*RollingMeter, error) {
 	if buckets <= 0 {
 		return nil, fmt.Errorf("Buckets should be >= 0")
 	}
 	if resolution < time.Second {
 		return nil, fmt.Errorf("Resolution should be larger than a second")
 	}
-	if endpoint == nil {
-		return nil, fmt.Errorf("Select an endpoint")
-	}
 	if isError == nil {
 		isError = IsNetworkError
 	}
@@ -64,6 +68,12 @@ func NewRollingMeter(endpoint Endpoint, buckets int, resolution time.Duration, t
 	}, nil
 }
 
+// Creates meter that calculates the failure rate of all the endpoints of the location,
+// e.g. to detect the overload of the location
+func NewLocationRollingMeter(buckets int, resolution time.Duration, timeProvider timetools.TimeProvider, isError FailPredicate) (*RollingMeter, error) {
+	return newRollingMeter(nil, buckets, resolution, timeProvider, isError)
+}
+
 func (em *RollingMeter) Reset() {
 	em.lastBucket = -1
 	em.countedBuckets = 0
@@ -118,7 +128,7 @@ func (em *RollingMeter) ObserveRequest(r Request) {
 }
 
 func (em *RollingMeter) ObserveResponse(r Request, lastAttempt Attempt) {
-	if lastAttempt == nil || lastAttempt.GetEndpoint() != em.endpoint {
+	if lastAttempt == nil || IsCancelled(lastAttempt) || IsCoalesced(lastAttempt) || (em.endpoint != nil && lastAttempt.GetEndpoint() != em.endpoint) {
 		return
 	}
 	// Cleanup the data that was here in case if endpoint has been inactive for some time
@@ -70,6 +70,23 @@ func (s *FailRateSuite) TestIgnoreOtherEndpoints(c *C) {
 	c.Assert(fr.GetRate(), Equals, 1.0)
 }
 
+// Location meter counts the attempts of all endpoints
+func (s *FailRateSuite) TestLocationMeter(c *C) {
+	e := MustParseUrl("http://localhost:5000")
+	e2 := MustParseUrl("http://localhost:5001")
+
+	fr, err := NewLocationRollingMeter(1, time.Second, s.tm, nil)
+	c.Assert(err, IsNil)
+	fr.ObserveResponse(makeFailRequest(e))
+	fr.ObserveResponse(makeOkRequest(e2))
+
+	c.Assert(fr.IsReady(), Equals, true)
+	c.Assert(fr.GetRate(), Equals, 0.5)
+
+	_, err = NewLocationRollingMeter(0, time.Second, s.tm, nil)
+	c.Assert(err, Not(IsNil))
+}
+
 func (s *FailRateSuite) TestIgnoreRequestsWithoutAttempts(c *C) {
 	e := MustParseUrl("http://localhost:5000")
 
@@ -43,6 +43,23 @@ func (c *MiddlewareChain) Get(id string) Middleware {
 	return nil
 }
 
+// Middleware with its id and priority in the chain
+type MiddlewareEntry struct {
+	Id         string
+	Priority   int
+	Middleware Middleware
+}
+
+// Returns the middlewares in the order they process the requests
+func (c *MiddlewareChain) GetEntries() []MiddlewareEntry {
+	callbacks := c.chain.entries()
+	out := make([]MiddlewareEntry, len(callbacks))
+	for i, cb := range callbacks {
+		out[i] = MiddlewareEntry{Id: cb.id, Priority: cb.priority, Middleware: cb.cb.(Middleware)}
+	}
+	return out
+}
+
 func (c *MiddlewareChain) GetIter() *MiddlewareIter {
 	return &MiddlewareIter{
 		iter: c.chain.getIter(),
@@ -227,6 +244,17 @@ func (c *chain) remove(id string) error {
 	return nil
 }
 
+// Returns copies of the callbacks, as upserts update them in place
+func (c *chain) entries() []callback {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	out := make([]callback, len(c.callbacks))
+	for i, cb := range c.callbacks {
+		out[i] = *cb
+	}
+	return out
+}
+
 // Note that we hold read lock to get access to the current iterator
 func (c *chain) getIter() *iter {
 	c.mutex.RLock()
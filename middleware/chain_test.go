@@ -284,6 +284,26 @@ func (s *ChainSuite) TestMiddlewareChainGet(c *C) {
 	c.Assert(chain.Get("m2"), Equals, m2)
 }
 
+func (s *ChainSuite) TestMiddlewareChainGetEntries(c *C) {
+	chain := NewMiddlewareChain()
+
+	c.Assert(chain.GetEntries(), DeepEquals, []MiddlewareEntry{})
+
+	m1 := &Recorder{}
+	m2 := &Recorder{}
+
+	chain.Add("m1", 1, m1)
+	chain.Add("m2", 0, m2)
+
+	entries := chain.GetEntries()
+	c.Assert(entries, DeepEquals, []MiddlewareEntry{{Id: "m2", Priority: 0, Middleware: m2}, {Id: "m1", Priority: 1, Middleware: m1}})
+
+	// Entries are copies, so upserts don't change them
+	chain.Upsert("m2", 2, m1)
+	c.Assert(entries[0], DeepEquals, MiddlewareEntry{Id: "m2", Priority: 0, Middleware: m2})
+	c.Assert(chain.GetEntries()[1], DeepEquals, MiddlewareEntry{Id: "m2", Priority: 2, Middleware: m1})
+}
+
 func (s *ChainSuite) TestObserverChainGet(c *C) {
 	chain := NewObserverChain()
 
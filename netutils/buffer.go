@@ -4,8 +4,8 @@ import (
 	"bytes"
 	"fmt"
 	"io"
-	"io/ioutil"
-	"os"
+	"sync"
+	"sync/atomic"
 )
 
 // MultiReader provides Read, Close and Seek and TotalSize methods.
@@ -97,6 +97,9 @@ type BodyBufferOptions struct {
 	MemBufferBytes int64
 	// Max size bytes, ignored if set to value <= 0, if request exceeds the specified limit, the reader will fail.
 	MaxSizeBytes int64
+	// Storage provides memory and disk space to the buffer, defaults to the local storage
+	// using the system temp directory without limits
+	Storage BufferStorage
 }
 
 func NewBodyBuffer(input io.Reader) (MultiReader, error) {
@@ -108,27 +111,34 @@ func NewBodyBuffer(input io.Reader) (MultiReader, error) {
 }
 
 func NewBodyBufferWithOptions(input io.Reader, o BodyBufferOptions) (MultiReader, error) {
+	storage := o.Storage
+	if storage == nil {
+		storage = defaultStorage
+	}
 	memReader := &io.LimitedReader{
 		R: input,            // Read from this reader
 		N: o.MemBufferBytes, // Maximum amount of data to read
 	}
 	readers := make([]io.ReadSeeker, 0, 2)
 
-	buffer, err := ioutil.ReadAll(memReader)
-	if err != nil {
+	memory := storage.NewMemoryBuffer()
+	if _, err := io.Copy(memory, memReader); err != nil {
+		memory.Free()
 		return nil, err
 	}
+	buffer := memory.Bytes()
 	readers = append(readers, bytes.NewReader(buffer))
 
-	var file *os.File
+	var file SpillFile
 	// This means that we have exceeded all the memory capacity and we will start buffering the body to disk.
 	totalBytes := int64(len(buffer))
 	if memReader.N <= 0 {
-		file, err = ioutil.TempFile("", "vulcan-bodies-")
+		var err error
+		file, err = storage.NewSpillFile()
 		if err != nil {
+			memory.Free()
 			return nil, err
 		}
-		os.Remove(file.Name())
 
 		readSrc := input
 		if o.MaxSizeBytes > 0 {
@@ -137,6 +147,8 @@ func NewBodyBufferWithOptions(input io.Reader, o BodyBufferOptions) (MultiReader
 
 		writtenBytes, err := io.Copy(file, readSrc)
 		if err != nil {
+			file.Close()
+			memory.Free()
 			return nil, err
 		}
 		totalBytes += writtenBytes
@@ -144,16 +156,58 @@ func NewBodyBufferWithOptions(input io.Reader, o BodyBufferOptions) (MultiReader
 		readers = append(readers, file)
 	}
 
-	var cleanupFn CleanupFunc
-	if file != nil {
-		cleanupFn = func() error {
-			file.Close()
-			return nil
-		}
+	// Memory goes back to the pool, so the second Close must not free it again
+	once := &sync.Once{}
+	cleanupFn := func() error {
+		once.Do(func() {
+			memory.Free()
+			if file != nil {
+				file.Close()
+			}
+		})
+		return nil
 	}
 	return NewMultiReaderSeeker(totalBytes, cleanupFn, readers...), nil
 }
 
+// Reader passing the body through as it arrives without buffering, e.g. for the streaming gRPC calls.
+// The body can be read once, so it can be rewound only until anything has been read.
+type streamReader struct {
+	r      io.Reader
+	length int64
+	read   int64
+}
+
+// Creates the reader of the stream, length is the size of the body or -1 if it's unknown
+func NewStreamReader(r io.Reader, length int64) MultiReader {
+	return &streamReader{r: r, length: length}
+}
+
+func (s *streamReader) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	atomic.AddInt64(&s.read, int64(n))
+	return n, err
+}
+
+// Input stream is owned by the caller, e.g. http server, so it's not closed
+func (s *streamReader) Close() error {
+	return nil
+}
+
+func (s *streamReader) TotalSize() (int64, error) {
+	return s.length, nil
+}
+
+func (s *streamReader) Seek(offset int64, whence int) (int64, error) {
+	if offset != 0 || whence != 0 {
+		return 0, fmt.Errorf("Unsupported seek operation on stream")
+	}
+	if atomic.LoadInt64(&s.read) != 0 {
+		return 0, fmt.Errorf("Stream can't be rewound once it has been read")
+	}
+	return 0, nil
+}
+
 // MaxReader does not allow to read more than Max bytes and returns error if this limit has been exceeded.
 type MaxReader struct {
 	R   io.Reader // underlying reader
@@ -179,5 +233,5 @@ type MaxSizeReachedError struct {
 }
 
 func (e *MaxSizeReachedError) Error() string {
-	return fmt.Sprintf("Maximum size %d was reached")
+	return fmt.Sprintf("Maximum size %d was reached", e.MaxSize)
 }
@@ -112,3 +112,20 @@ func (s *BufferSuite) TestLimitExceeds(c *C) {
 	c.Assert(err, FitsTypeOf, &MaxSizeReachedError{})
 	c.Assert(bb, IsNil)
 }
+
+func (s *BufferSuite) TestStreamReader(c *C) {
+	r := NewStreamReader(bytes.NewBufferString("hello"), -1)
+	l, err := r.TotalSize()
+	c.Assert(err, IsNil)
+	c.Assert(l, Equals, int64(-1))
+
+	// Stream can be rewound until it's read
+	_, err = r.Seek(0, 0)
+	c.Assert(err, IsNil)
+	out, err := ioutil.ReadAll(r)
+	c.Assert(err, IsNil)
+	c.Assert(string(out), Equals, "hello")
+	_, err = r.Seek(0, 0)
+	c.Assert(err, NotNil)
+	c.Assert(r.Close(), IsNil)
+}
@@ -65,12 +65,21 @@ func ParseUrl(inUrl string) (*url.URL, error) {
 		return nil, err
 	}
 
+	// Unix socket urls carry the socket path instead of the host, e.g. unix:///var/run/app.sock
+	if parsedUrl.Scheme == UnixScheme {
+		if parsedUrl.Host != "" || parsedUrl.Path == "" {
+			return nil, fmt.Errorf("Expected unix socket url in form unix:///path/to.sock, got: %s", inUrl)
+		}
+		return parsedUrl, nil
+	}
 	if parsedUrl.Host == "" || parsedUrl.Scheme == "" {
 		return nil, fmt.Errorf("Empty Url is not allowed")
 	}
 	return parsedUrl, nil
 }
 
+const UnixScheme = "unix"
+
 type BasicAuth struct {
 	Username string
 	Password string
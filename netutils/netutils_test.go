@@ -19,6 +19,8 @@ func (s *NetUtilsSuite) TestParseBadUrl(c *C) {
 		"",
 		" some random text ",
 		"http---{}{\\bad bad url",
+		"unix://host/path.sock",
+		"unix://",
 	}
 	for _, badUrl := range badUrls {
 		_, err := ParseUrl(badUrl)
@@ -26,6 +28,13 @@ func (s *NetUtilsSuite) TestParseBadUrl(c *C) {
 	}
 }
 
+func (s *NetUtilsSuite) TestParseUnixUrl(c *C) {
+	u, err := ParseUrl("unix:///var/run/app.sock")
+	c.Assert(err, IsNil)
+	c.Assert(u.Scheme, Equals, UnixScheme)
+	c.Assert(u.Path, Equals, "/var/run/app.sock")
+}
+
 //Just to make sure we don't panic, return err and not
 //username and pass and cover the function
 func (s *NetUtilsSuite) TestParseBadHeaders(c *C) {
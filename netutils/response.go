@@ -6,6 +6,8 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+
+	"github.com/mailgun/vulcan/errors"
 )
 
 func NewHttpResponse(request *http.Request, statusCode int, body []byte, contentType string) *http.Response {
@@ -24,6 +26,15 @@ func NewHttpResponse(request *http.Request, statusCode int, body []byte, content
 	return resp
 }
 
+// Creates the response with the error formatted for the request
+func NewErrorResponse(request *http.Request, f errors.Formatter, err errors.ProxyError) *http.Response {
+	header := make(http.Header)
+	statusCode, body := errors.FormatResponse(f, request, err, header)
+	resp := NewHttpResponse(request, statusCode, body, "")
+	resp.Header = header
+	return resp
+}
+
 func NewTextResponse(request *http.Request, statusCode int, body string) *http.Response {
 	return NewHttpResponse(request, statusCode, []byte(body), "text/plain")
 }
@@ -0,0 +1,267 @@
+package netutils
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// BufferStorage provides memory and disk space to the body buffers
+type BufferStorage interface {
+	// Returns the buffer for the part of the body that is kept in memory
+	NewMemoryBuffer() MemoryBuffer
+	// Creates the file for the part of the body exceeding the memory buffer
+	NewSpillFile() (SpillFile, error)
+}
+
+// MemoryBuffer accounts the memory used by the body
+type MemoryBuffer interface {
+	// Returns MemoryLimitReachedError if the storage is out of memory
+	io.Writer
+	Bytes() []byte
+	// Releases the memory, buffer can not be used after this call
+	Free()
+}
+
+// SpillFile accounts the disk space used by the body
+type SpillFile interface {
+	// Write returns DiskLimitReachedError if the storage is out of disk space
+	io.ReadWriteSeeker
+	// Closes and removes the file, releases the disk space
+	io.Closer
+}
+
+type LocalStorageOptions struct {
+	// Directory for the spill files, defaults to the system temp directory
+	Dir string
+	// Cap on the memory used by all the buffers of this storage, ignored if set to value <= 0
+	MaxMemoryBytes int64
+	// Cap on the disk space used by all the buffers of this storage, ignored if set to value <= 0
+	MaxDiskBytes int64
+	// Memory buffers that have not grown over this size are reused, defaults to 64KB
+	PoolBufferBytes int64
+	// Removes spill files left by the crashed processes, requires dedicated Dir
+	SweepOrphans bool
+}
+
+// LocalStorage keeps bodies in the pooled memory buffers and in the files of the local directory
+type LocalStorage struct {
+	mutex      *sync.Mutex
+	options    LocalStorageOptions
+	pool       *sync.Pool
+	created    time.Time
+	memoryUsed int64
+	diskUsed   int64
+}
+
+const (
+	DefaultPoolBufferBytes = 65536
+	spillFilePrefix        = "vulcan-bodies-"
+)
+
+var defaultStorage = newLocalStorage(LocalStorageOptions{PoolBufferBytes: DefaultPoolBufferBytes})
+
+func NewLocalStorage(o LocalStorageOptions) (*LocalStorage, error) {
+	if o.PoolBufferBytes <= 0 {
+		o.PoolBufferBytes = DefaultPoolBufferBytes
+	}
+	if o.SweepOrphans && o.Dir == "" {
+		return nil, fmt.Errorf("Sweeping orphaned files requires dedicated directory")
+	}
+	if o.Dir != "" {
+		if err := os.MkdirAll(o.Dir, 0700); err != nil {
+			return nil, err
+		}
+	}
+	s := newLocalStorage(o)
+	if o.SweepOrphans {
+		if _, err := s.Sweep(); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func newLocalStorage(o LocalStorageOptions) *LocalStorage {
+	return &LocalStorage{
+		mutex:   &sync.Mutex{},
+		options: o,
+		pool: &sync.Pool{
+			New: func() interface{} { return &bytes.Buffer{} },
+		},
+		created: time.Now(),
+	}
+}
+
+func (s *LocalStorage) GetOptions() LocalStorageOptions {
+	return s.options
+}
+
+// Returns the amount of memory used by the buffers
+func (s *LocalStorage) GetMemoryUsed() int64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.memoryUsed
+}
+
+// Returns the amount of disk space used by the buffers
+func (s *LocalStorage) GetDiskUsed() int64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.diskUsed
+}
+
+// Removes the spill files created before this storage, returns the amount of removed files.
+// Spill files are removed right after creation, so the files left are orphans of the crashed processes.
+func (s *LocalStorage) Sweep() (int, error) {
+	if s.options.Dir == "" {
+		return 0, fmt.Errorf("Sweeping orphaned files requires dedicated directory")
+	}
+	infos, err := ioutil.ReadDir(s.options.Dir)
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	for _, info := range infos {
+		if info.IsDir() || !strings.HasPrefix(info.Name(), spillFilePrefix) || !info.ModTime().Before(s.created) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(s.options.Dir, info.Name())); err != nil && !os.IsNotExist(err) {
+			return removed, err
+		}
+		removed += 1
+	}
+	return removed, nil
+}
+
+func (s *LocalStorage) NewMemoryBuffer() MemoryBuffer {
+	return &memoryBuffer{storage: s, buffer: s.pool.Get().(*bytes.Buffer)}
+}
+
+func (s *LocalStorage) NewSpillFile() (SpillFile, error) {
+	file, err := ioutil.TempFile(s.options.Dir, spillFilePrefix)
+	if err != nil {
+		return nil, err
+	}
+	// Removing the open file makes sure it's gone once the process exits, some platforms do not allow that
+	removed := os.Remove(file.Name()) == nil
+	return &spillFile{File: file, storage: s, removed: removed}, nil
+}
+
+func (s *LocalStorage) reserveMemory(bytes int64) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.options.MaxMemoryBytes > 0 && s.memoryUsed+bytes > s.options.MaxMemoryBytes {
+		return &MemoryLimitReachedError{MaxMemory: s.options.MaxMemoryBytes}
+	}
+	s.memoryUsed += bytes
+	return nil
+}
+
+func (s *LocalStorage) releaseMemory(bytes int64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.memoryUsed -= bytes
+}
+
+func (s *LocalStorage) reserveDisk(bytes int64) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.options.MaxDiskBytes > 0 && s.diskUsed+bytes > s.options.MaxDiskBytes {
+		return &DiskLimitReachedError{MaxDisk: s.options.MaxDiskBytes}
+	}
+	s.diskUsed += bytes
+	return nil
+}
+
+func (s *LocalStorage) releaseDisk(bytes int64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.diskUsed -= bytes
+}
+
+type memoryBuffer struct {
+	storage  *LocalStorage
+	buffer   *bytes.Buffer
+	reserved int64
+}
+
+func (b *memoryBuffer) Write(p []byte) (int, error) {
+	if err := b.storage.reserveMemory(int64(len(p))); err != nil {
+		return 0, err
+	}
+	b.reserved += int64(len(p))
+	return b.buffer.Write(p)
+}
+
+func (b *memoryBuffer) Bytes() []byte {
+	return b.buffer.Bytes()
+}
+
+func (b *memoryBuffer) Free() {
+	b.storage.releaseMemory(b.reserved)
+	b.reserved = 0
+	// Large buffers are left to the garbage collector, so the pool does not keep the memory of the rare large bodies
+	if int64(b.buffer.Cap()) <= b.storage.options.PoolBufferBytes {
+		b.buffer.Reset()
+		b.storage.pool.Put(b.buffer)
+	}
+	b.buffer = nil
+}
+
+type spillFile struct {
+	*os.File
+	storage  *LocalStorage
+	removed  bool
+	reserved int64
+}
+
+func (f *spillFile) Write(p []byte) (int, error) {
+	if err := f.storage.reserveDisk(int64(len(p))); err != nil {
+		return 0, err
+	}
+	f.reserved += int64(len(p))
+	return f.File.Write(p)
+}
+
+// ReadFrom is not promoted from the file, so the writes are always accounted
+func (f *spillFile) ReadFrom(r io.Reader) (int64, error) {
+	return io.Copy(struct{ io.Writer }{f}, r)
+}
+
+func (f *spillFile) Close() error {
+	err := f.File.Close()
+	if !f.removed {
+		if rerr := os.Remove(f.File.Name()); rerr != nil && err == nil {
+			err = rerr
+		}
+		f.removed = true
+	}
+	f.storage.releaseDisk(f.reserved)
+	f.reserved = 0
+	return err
+}
+
+// Storage does not have enough memory to buffer the body, the request should be retried later
+type MemoryLimitReachedError struct {
+	MaxMemory int64
+}
+
+func (e *MemoryLimitReachedError) Error() string {
+	return fmt.Sprintf("Body buffers memory limit %d was reached", e.MaxMemory)
+}
+
+// Storage does not have enough disk space to buffer the body
+type DiskLimitReachedError struct {
+	MaxDisk int64
+}
+
+func (e *DiskLimitReachedError) Error() string {
+	return fmt.Sprintf("Body buffers disk limit %d was reached", e.MaxDisk)
+}
@@ -0,0 +1,127 @@
+package netutils
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+type StorageSuite struct {
+	dir string
+}
+
+var _ = Suite(&StorageSuite{})
+
+func (s *StorageSuite) SetUpTest(c *C) {
+	s.dir = c.MkDir()
+}
+
+func (s *StorageSuite) TestSpillDir(c *C) {
+	storage, err := NewLocalStorage(LocalStorageOptions{Dir: filepath.Join(s.dir, "bodies")})
+	c.Assert(err, IsNil)
+
+	r, hash := createReaderOfSize(1024)
+	bb, err := NewBodyBufferWithOptions(r, BodyBufferOptions{MemBufferBytes: 100, Storage: storage})
+	c.Assert(err, IsNil)
+	c.Assert(storage.GetMemoryUsed(), Equals, int64(100))
+	c.Assert(storage.GetDiskUsed(), Equals, int64(924))
+	c.Assert(hashOfReader(bb), Equals, hash)
+
+	// Spill files are removed right away
+	infos, err := ioutil.ReadDir(filepath.Join(s.dir, "bodies"))
+	c.Assert(err, IsNil)
+	c.Assert(len(infos), Equals, 0)
+
+	c.Assert(bb.Close(), IsNil)
+	c.Assert(storage.GetMemoryUsed(), Equals, int64(0))
+	c.Assert(storage.GetDiskUsed(), Equals, int64(0))
+
+	// Closing twice does not release the space twice
+	c.Assert(bb.Close(), IsNil)
+	c.Assert(storage.GetMemoryUsed(), Equals, int64(0))
+}
+
+func (s *StorageSuite) TestMemoryLimit(c *C) {
+	storage, err := NewLocalStorage(LocalStorageOptions{MaxMemoryBytes: 150})
+	c.Assert(err, IsNil)
+
+	r, _ := createReaderOfSize(100)
+	first, err := NewBodyBufferWithOptions(r, BodyBufferOptions{MemBufferBytes: 1024, Storage: storage})
+	c.Assert(err, IsNil)
+
+	r, _ = createReaderOfSize(100)
+	_, err = NewBodyBufferWithOptions(r, BodyBufferOptions{MemBufferBytes: 1024, Storage: storage})
+	c.Assert(err, FitsTypeOf, &MemoryLimitReachedError{})
+	c.Assert(storage.GetMemoryUsed(), Equals, int64(100))
+
+	// Memory is released once the first body is closed
+	first.Close()
+	r, hash := createReaderOfSize(100)
+	bb, err := NewBodyBufferWithOptions(r, BodyBufferOptions{MemBufferBytes: 1024, Storage: storage})
+	c.Assert(err, IsNil)
+	c.Assert(hashOfReader(bb), Equals, hash)
+	bb.Close()
+}
+
+func (s *StorageSuite) TestDiskLimit(c *C) {
+	storage, err := NewLocalStorage(LocalStorageOptions{Dir: s.dir, MaxDiskBytes: 1000})
+	c.Assert(err, IsNil)
+
+	r, _ := createReaderOfSize(2048)
+	_, err = NewBodyBufferWithOptions(r, BodyBufferOptions{MemBufferBytes: 10, Storage: storage})
+	c.Assert(err, FitsTypeOf, &DiskLimitReachedError{})
+	c.Assert(storage.GetMemoryUsed(), Equals, int64(0))
+	c.Assert(storage.GetDiskUsed(), Equals, int64(0))
+
+	r, hash := createReaderOfSize(1000)
+	bb, err := NewBodyBufferWithOptions(r, BodyBufferOptions{MemBufferBytes: 10, Storage: storage})
+	c.Assert(err, IsNil)
+	c.Assert(hashOfReader(bb), Equals, hash)
+	bb.Close()
+}
+
+func (s *StorageSuite) TestSweepOrphans(c *C) {
+	orphan := filepath.Join(s.dir, spillFilePrefix+"123")
+	other := filepath.Join(s.dir, "other")
+	for _, name := range []string{orphan, other} {
+		c.Assert(ioutil.WriteFile(name, []byte("data"), 0600), IsNil)
+		past := time.Now().Add(-time.Hour)
+		c.Assert(os.Chtimes(name, past, past), IsNil)
+	}
+
+	_, err := NewLocalStorage(LocalStorageOptions{Dir: s.dir, SweepOrphans: true})
+	c.Assert(err, IsNil)
+
+	_, err = os.Stat(orphan)
+	c.Assert(os.IsNotExist(err), Equals, true)
+	_, err = os.Stat(other)
+	c.Assert(err, IsNil)
+
+	// System temp directory is shared, so it is never swept
+	_, err = NewLocalStorage(LocalStorageOptions{SweepOrphans: true})
+	c.Assert(err, NotNil)
+}
+
+// Small buffers are returned to the pool, large buffers are left to the garbage collector
+func (s *StorageSuite) TestPooledBuffers(c *C) {
+	storage, err := NewLocalStorage(LocalStorageOptions{PoolBufferBytes: 1024})
+	c.Assert(err, IsNil)
+
+	b := storage.NewMemoryBuffer().(*memoryBuffer)
+	buffer := b.buffer
+	_, err = b.Write([]byte("hello"))
+	c.Assert(err, IsNil)
+	b.Free()
+	c.Assert(buffer.Len(), Equals, 0)
+
+	b = storage.NewMemoryBuffer().(*memoryBuffer)
+	_, err = b.Write(bytes.Repeat([]byte("a"), 2048))
+	c.Assert(err, IsNil)
+	large := b.buffer
+	b.Free()
+	c.Assert(large.Len(), Equals, 2048)
+}
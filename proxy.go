@@ -5,10 +5,12 @@ import (
 	"io"
 	"net"
 	"net/http"
+	"strings"
 	"sync/atomic"
 
 	log "github.com/mailgun/gotools-log"
 	"github.com/mailgun/vulcan/errors"
+	"github.com/mailgun/vulcan/headers"
 	"github.com/mailgun/vulcan/netutils"
 	"github.com/mailgun/vulcan/request"
 	"github.com/mailgun/vulcan/route"
@@ -76,21 +78,77 @@ func (p *Proxy) proxyRequest(w http.ResponseWriter, r *http.Request) error {
 
 	response, err := location.RoundTrip(req)
 	if response != nil {
-		netutils.CopyHeaders(w.Header(), response.Header)
-		w.WriteHeader(response.StatusCode)
-		io.Copy(w, response.Body)
 		defer response.Body.Close()
+		p.writeResponse(w, req, response)
 		return nil
 	} else {
 		return err
 	}
 }
 
+// Writes the response to the client, streams the bodies of unknown length and mirrors the trailers
+func (p *Proxy) writeResponse(w http.ResponseWriter, req request.Request, response *http.Response) {
+	netutils.CopyHeaders(w.Header(), response.Header)
+
+	// Trailers have to be announced before the body, their values are known once it's read
+	announced := len(response.Trailer)
+	if announced > 0 {
+		keys := make([]string, 0, announced)
+		for k := range response.Trailer {
+			keys = append(keys, k)
+		}
+		w.Header().Set(headers.Trailer, strings.Join(keys, ", "))
+		// HTTP/1.1 clients get the trailers with chunked encoding only
+		w.Header().Del(headers.ContentLength)
+	}
+	w.WriteHeader(response.StatusCode)
+
+	if err := copyBody(w, response); err != nil {
+		// The status is sent already, abort the response so the client does not take the body as a complete one
+		log.Errorf("%s failed to write the response: %s", req, err)
+		panic(http.ErrAbortHandler)
+	}
+
+	// Endpoints can send the trailers they have not announced, e.g. HTTP/2 endpoints
+	for k, vv := range response.Trailer {
+		if len(response.Trailer) != announced {
+			k = http.TrailerPrefix + k
+		}
+		for _, v := range vv {
+			w.Header().Add(k, v)
+		}
+	}
+}
+
+// Copies the body, bodies of unknown length (e.g. streaming RPCs or events) are flushed to the client as they arrive
+func copyBody(w http.ResponseWriter, response *http.Response) error {
+	flusher, ok := w.(http.Flusher)
+	if !ok || response.ContentLength != -1 {
+		_, err := io.Copy(w, response.Body)
+		return err
+	}
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := response.Body.Read(buf)
+		if n > 0 {
+			if _, werr := w.Write(buf[:n]); werr != nil {
+				return werr
+			}
+			flusher.Flush()
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
 // replyError is a helper function that takes error and replies with HTTP compatible error to the client.
 func (p *Proxy) replyError(err error, w http.ResponseWriter, req *http.Request) {
 	proxyError := convertError(err)
-	statusCode, body, contentType := p.options.ErrorFormatter.Format(proxyError)
-	w.Header().Set("Content-Type", contentType)
+	statusCode, body := errors.FormatResponse(p.options.ErrorFormatter, req, proxyError, w.Header())
 	w.WriteHeader(statusCode)
 	w.Write(body)
 }
@@ -112,6 +170,10 @@ func convertError(err error) errors.ProxyError {
 		}
 	case *netutils.MaxSizeReachedError:
 		return errors.FromStatus(http.StatusRequestEntityTooLarge)
+	case *netutils.MemoryLimitReachedError:
+		return errors.FromStatus(http.StatusServiceUnavailable)
+	case *netutils.DiskLimitReachedError:
+		return errors.FromStatus(http.StatusInsufficientStorage)
 	}
 	return errors.FromStatus(http.StatusBadGateway)
 }
@@ -1,6 +1,7 @@
 package vulcan
 
 import (
+	"bufio"
 	timetools "github.com/mailgun/gotools-time"
 	. "github.com/mailgun/vulcan/location"
 	. "github.com/mailgun/vulcan/route"
@@ -49,6 +50,56 @@ func (s *ProxySuite) TestFailure(c *C) {
 	c.Assert(response.StatusCode, Equals, http.StatusBadGateway)
 }
 
+func (s *ProxySuite) TestTrailers(c *C) {
+	server := NewTestServer(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Trailer", "X-Checksum")
+		w.Write([]byte("Hi, I'm endpoint"))
+		w.Header().Set("X-Checksum", "abc")
+		w.Header().Set(http.TrailerPrefix+"X-Status", "done")
+	})
+	defer server.Close()
+
+	proxy, err := NewProxy(&ConstRouter{&ConstHttpLocation{server.URL}})
+	c.Assert(err, IsNil)
+	proxyServer := httptest.NewServer(proxy)
+	defer proxyServer.Close()
+
+	response, bodyBytes := Get(c, proxyServer.URL, nil, "")
+	c.Assert(string(bodyBytes), Equals, "Hi, I'm endpoint")
+	c.Assert(response.Trailer.Get("X-Checksum"), Equals, "abc")
+	c.Assert(response.Trailer.Get("X-Status"), Equals, "done")
+}
+
+// Bodies of unknown length reach the client before the endpoint finishes the response
+func (s *ProxySuite) TestStreaming(c *C) {
+	release := make(chan bool)
+	server := NewTestServer(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("first\n"))
+		w.(http.Flusher).Flush()
+		<-release
+		w.Write([]byte("second\n"))
+	})
+	defer server.Close()
+
+	proxy, err := NewProxy(&ConstRouter{&ConstHttpLocation{server.URL}})
+	c.Assert(err, IsNil)
+	proxyServer := httptest.NewServer(proxy)
+	defer proxyServer.Close()
+
+	response, err := http.Get(proxyServer.URL)
+	c.Assert(err, IsNil)
+	defer response.Body.Close()
+	reader := bufio.NewReader(response.Body)
+	line, err := reader.ReadString('\n')
+	c.Assert(err, IsNil)
+	c.Assert(line, Equals, "first\n")
+
+	close(release)
+	line, err = reader.ReadString('\n')
+	c.Assert(err, IsNil)
+	c.Assert(line, Equals, "second\n")
+}
+
 func (s *ProxySuite) TestReadTimeout(c *C) {
 	c.Skip("This test is not stable")
 
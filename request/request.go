@@ -38,6 +38,22 @@ type BaseAttempt struct {
 	Duration time.Duration
 	Response *http.Response
 	Endpoint endpoint.Endpoint
+	// Set if the proxy has cancelled the attempt itself, e.g. the hedged attempt that has lost the race
+	Cancelled bool
+	// Set if the attempt was served with the response to another request and has not reached the endpoint
+	Coalesced bool
+}
+
+// Cancelled attempt says nothing about the endpoint, so it's not accounted as a failure
+func IsCancelled(a Attempt) bool {
+	ba, ok := a.(*BaseAttempt)
+	return ok && ba.Cancelled
+}
+
+// Coalesced attempt has been served by the middleware, so it's not accounted by the meters
+func IsCoalesced(a Attempt) bool {
+	ba, ok := a.(*BaseAttempt)
+	return ok && ba.Coalesced
 }
 
 func (ba *BaseAttempt) GetResponse() *http.Response {
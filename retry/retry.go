@@ -0,0 +1,308 @@
+// Package retry contains policies that control when and how fast failed requests are retried.
+package retry
+
+/*
+Policy complements failover predicates: once location decides that request can fail over,
+the policy decides whether the retry fits into the location's retry budget and how long
+to wait before the next attempt, e.g.
+
+  NewPolicy(Options{
+	Backoff: Backoff{Initial: 10 * time.Millisecond, Max: time.Second},
+	Budget:  Budget{Ratio: 0.2},
+  })
+
+retries idempotent requests with exponential backoff starting with 10 milliseconds, while
+allowing at most 20% of the location's requests to be retried.
+*/
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	timetools "github.com/mailgun/gotools-time"
+
+	"github.com/mailgun/vulcan/failover"
+	"github.com/mailgun/vulcan/grpc"
+	"github.com/mailgun/vulcan/headers"
+	"github.com/mailgun/vulcan/request"
+)
+
+// Policy paces request retries
+type Policy interface {
+	// Will be called once for every request received by the location, before the first attempt
+	ObserveRequest(r request.Request)
+	// Will be called after failed attempt, returns the time to wait before the next attempt
+	// and false if the request should not be retried
+	NextDelay(r request.Request) (time.Duration, bool)
+}
+
+// Backoff controls delays between attempts
+type Backoff struct {
+	// Delay before the first retry
+	Initial time.Duration
+	// Maximum delay between attempts
+	Max time.Duration
+	// Each next delay is multiplied by this value
+	Multiplier float64
+	// Fraction of the delay that is randomized, in range [0, 1], e.g. 0.2 turns 100ms into 80-120ms
+	Jitter float64
+	// Zero Jitter means the default one, this turns the randomization off
+	DisableJitter bool
+}
+
+// Budget limits the amount of retries per location to prevent retry storms
+type Budget struct {
+	// Fraction of the requests that can be retried, e.g. 0.2 allows retrying 20% of requests
+	Ratio float64
+	// Retries that are always allowed within the window, so locations with low traffic can retry as well
+	MinRetries int64
+	// Zero Ratio and MinRetries mean the default ones, these allow only MinRetries or only the Ratio of requests
+	DisableRatio      bool
+	DisableMinRetries bool
+	// Budget is calculated within the rolling window of this size
+	Window time.Duration
+}
+
+type Options struct {
+	Backoff Backoff
+	Budget  Budget
+	// Retry-After values in 503 responses and gRPC retry pushbacks that exceed this value prevent the retry
+	MaxRetryAfter time.Duration
+	// Predicate that defines what requests can be retried, defaults to idempotent requests
+	ShouldRetry failover.Predicate
+	// Time provider (useful for testing purposes)
+	TimeProvider timetools.TimeProvider
+}
+
+// BackoffPolicy implements exponential backoff with jitter, Retry-After support and retry budget
+type BackoffPolicy struct {
+	options  Options
+	mutex    *sync.Mutex
+	rand     *rand.Rand
+	requests *rollingCounter
+	retries  *rollingCounter
+}
+
+func NewPolicy(o Options) (*BackoffPolicy, error) {
+	o, err := parseOptions(o)
+	if err != nil {
+		return nil, err
+	}
+	return &BackoffPolicy{
+		options:  o,
+		mutex:    &sync.Mutex{},
+		rand:     rand.New(rand.NewSource(o.TimeProvider.UtcNow().UnixNano())),
+		requests: newRollingCounter(o.Budget.Window, o.TimeProvider),
+		retries:  newRollingCounter(o.Budget.Window, o.TimeProvider),
+	}, nil
+}
+
+func (p *BackoffPolicy) GetOptions() Options {
+	return p.options
+}
+
+func (p *BackoffPolicy) ObserveRequest(r request.Request) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.requests.inc()
+}
+
+func (p *BackoffPolicy) NextDelay(r request.Request) (time.Duration, bool) {
+	if !p.options.ShouldRetry(r) {
+		return 0, false
+	}
+
+	delay := p.backoff(len(r.GetAttempts()))
+	if retryAfter, ok := p.retryAfter(r); ok {
+		if retryAfter < 0 || retryAfter > p.options.MaxRetryAfter {
+			return 0, false
+		}
+		if retryAfter > delay {
+			delay = retryAfter
+		}
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if !p.withinBudget() {
+		return 0, false
+	}
+	p.retries.inc()
+	return delay, true
+}
+
+// Returns true if there's one more retry left in the budget
+func (p *BackoffPolicy) withinBudget() bool {
+	allowed := int64(float64(p.requests.sum())*p.options.Budget.Ratio) + p.options.Budget.MinRetries
+	return p.retries.sum() < allowed
+}
+
+// Calculates the delay before the next attempt, attempts is a number of attempts made so far
+func (p *BackoffPolicy) backoff(attempts int) time.Duration {
+	b := p.options.Backoff
+	if attempts < 1 {
+		attempts = 1
+	}
+	delay := float64(b.Initial) * math.Pow(b.Multiplier, float64(attempts-1))
+	if delay > float64(b.Max) {
+		delay = float64(b.Max)
+	}
+	if b.Jitter > 0 {
+		p.mutex.Lock()
+		delay += delay * b.Jitter * (p.rand.Float64()*2 - 1)
+		p.mutex.Unlock()
+	}
+	return time.Duration(delay)
+}
+
+// Returns delay requested by the upstream in Retry-After header of the 503 response, or in the retry pushback
+// of the gRPC response, where negative delay tells that the call should not be retried
+func (p *BackoffPolicy) retryAfter(r request.Request) (time.Duration, bool) {
+	a := r.GetLastAttempt()
+	if a == nil || a.GetResponse() == nil {
+		return 0, false
+	}
+	if pushback, ok := grpc.GetRetryPushback(a.GetResponse()); ok {
+		return pushback, true
+	}
+	if a.GetResponse().StatusCode != http.StatusServiceUnavailable {
+		return 0, false
+	}
+	return ParseRetryAfter(a.GetResponse().Header.Get(headers.RetryAfter), p.options.TimeProvider.UtcNow())
+}
+
+// Parses the value of Retry-After header, that is either amount of seconds or HTTP date
+func ParseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	t, err := http.ParseTime(value)
+	if err != nil {
+		return 0, false
+	}
+	if !t.After(now) {
+		return 0, true
+	}
+	return t.Sub(now), true
+}
+
+// Counts events in the rolling window with a second resolution
+type rollingCounter struct {
+	buckets      []int64
+	lastUpdated  time.Time
+	timeProvider timetools.TimeProvider
+}
+
+func newRollingCounter(window time.Duration, timeProvider timetools.TimeProvider) *rollingCounter {
+	return &rollingCounter{
+		buckets:      make([]int64, int(window/time.Second)),
+		timeProvider: timeProvider,
+	}
+}
+
+func (c *rollingCounter) inc() {
+	now := c.cleanup()
+	c.buckets[c.getBucket(now)] += 1
+}
+
+func (c *rollingCounter) sum() int64 {
+	c.cleanup()
+	out := int64(0)
+	for _, v := range c.buckets {
+		out += v
+	}
+	return out
+}
+
+func (c *rollingCounter) getBucket(t time.Time) int {
+	return int(t.Unix() % int64(len(c.buckets)))
+}
+
+// Resets the buckets that were not updated since the last time and returns current time
+func (c *rollingCounter) cleanup() time.Time {
+	now := c.timeProvider.UtcNow().Truncate(time.Second)
+	passed := int(now.Sub(c.lastUpdated) / time.Second)
+	if passed > len(c.buckets) {
+		passed = len(c.buckets)
+	}
+	for i := 0; i < passed; i++ {
+		c.buckets[c.getBucket(now.Add(time.Duration(-i)*time.Second))] = 0
+	}
+	c.lastUpdated = now
+	return now
+}
+
+const (
+	DefaultInitialBackoff = 10 * time.Millisecond
+	DefaultMaxBackoff     = time.Second
+	DefaultMultiplier     = 2
+	DefaultJitter         = 0.2
+	DefaultBudgetRatio    = 0.2
+	DefaultMinRetries     = 10
+	DefaultBudgetWindow   = 10 * time.Second
+	DefaultMaxRetryAfter  = 5 * time.Second
+)
+
+func parseOptions(o Options) (Options, error) {
+	if o.Backoff.Initial <= 0 {
+		o.Backoff.Initial = DefaultInitialBackoff
+	}
+	if o.Backoff.Max <= 0 {
+		o.Backoff.Max = DefaultMaxBackoff
+	}
+	if o.Backoff.Max < o.Backoff.Initial {
+		return o, fmt.Errorf("Max backoff %s should be >= initial backoff %s", o.Backoff.Max, o.Backoff.Initial)
+	}
+	if o.Backoff.Multiplier == 0 {
+		o.Backoff.Multiplier = DefaultMultiplier
+	}
+	if o.Backoff.Multiplier < 1 {
+		return o, fmt.Errorf("Backoff multiplier should be >= 1, got: %f", o.Backoff.Multiplier)
+	}
+	if o.Backoff.DisableJitter {
+		o.Backoff.Jitter = 0
+	} else if o.Backoff.Jitter == 0 {
+		o.Backoff.Jitter = DefaultJitter
+	}
+	if o.Backoff.Jitter < 0 || o.Backoff.Jitter > 1 {
+		return o, fmt.Errorf("Jitter should be in range [0, 1], got: %f", o.Backoff.Jitter)
+	}
+	if o.Budget.DisableRatio {
+		o.Budget.Ratio = 0
+	} else if o.Budget.Ratio == 0 {
+		o.Budget.Ratio = DefaultBudgetRatio
+	}
+	if o.Budget.Ratio < 0 {
+		return o, fmt.Errorf("Budget ratio should be >= 0, got: %f", o.Budget.Ratio)
+	}
+	if o.Budget.DisableMinRetries {
+		o.Budget.MinRetries = 0
+	} else if o.Budget.MinRetries <= 0 {
+		o.Budget.MinRetries = DefaultMinRetries
+	}
+	if o.Budget.Window < time.Second {
+		o.Budget.Window = DefaultBudgetWindow
+	}
+	if o.MaxRetryAfter <= 0 {
+		o.MaxRetryAfter = DefaultMaxRetryAfter
+	}
+	if o.ShouldRetry == nil {
+		o.ShouldRetry = failover.IsIdempotent
+	}
+	if o.TimeProvider == nil {
+		o.TimeProvider = &timetools.RealTime{}
+	}
+	return o, nil
+}
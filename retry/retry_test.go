@@ -0,0 +1,196 @@
+package retry
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	timetools "github.com/mailgun/gotools-time"
+	"github.com/mailgun/vulcan/failover"
+	. "github.com/mailgun/vulcan/request"
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type RetrySuite struct {
+	tm *timetools.FreezedTime
+}
+
+var _ = Suite(&RetrySuite{})
+
+func (s *RetrySuite) SetUpTest(c *C) {
+	s.tm = &timetools.FreezedTime{
+		CurrentTime: time.Date(2012, 3, 4, 5, 6, 7, 0, time.UTC),
+	}
+}
+
+func (s *RetrySuite) newPolicy(c *C, o Options) *BackoffPolicy {
+	o.TimeProvider = s.tm
+	p, err := NewPolicy(o)
+	c.Assert(err, IsNil)
+	return p
+}
+
+func makeRequest(method string, attempts ...Attempt) *BaseRequest {
+	return &BaseRequest{
+		HttpRequest: &http.Request{Method: method, Header: make(http.Header)},
+		Attempts:    attempts,
+	}
+}
+
+func failedAttempts(count int) []Attempt {
+	out := make([]Attempt, count)
+	for i := range out {
+		out[i] = &BaseAttempt{Error: fmt.Errorf("Something failed")}
+	}
+	return out
+}
+
+func (s *RetrySuite) TestExponentialBackoff(c *C) {
+	p := s.newPolicy(c, Options{
+		Backoff: Backoff{Initial: 100 * time.Millisecond, Max: time.Second, Jitter: 0.1},
+	})
+
+	expected := []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond, 800 * time.Millisecond, time.Second}
+	for i, e := range expected {
+		p.ObserveRequest(makeRequest("GET"))
+		delay, ok := p.NextDelay(makeRequest("GET", failedAttempts(i+1)...))
+		c.Assert(ok, Equals, true)
+		c.Assert(delay >= e-e/10 && delay <= e+e/10, Equals, true, Commentf("attempt %d, delay %s", i+1, delay))
+	}
+}
+
+func (s *RetrySuite) TestIdempotentDefaults(c *C) {
+	p := s.newPolicy(c, Options{})
+
+	for _, m := range []string{"GET", "HEAD", "PUT", "DELETE"} {
+		_, ok := p.NextDelay(makeRequest(m, failedAttempts(1)...))
+		c.Assert(ok, Equals, true, Commentf("method %s", m))
+	}
+
+	req := makeRequest("POST", failedAttempts(1)...)
+	_, ok := p.NextDelay(req)
+	c.Assert(ok, Equals, false)
+
+	req.HttpRequest.Header.Set("Idempotency-Key", "abc")
+	_, ok = p.NextDelay(req)
+	c.Assert(ok, Equals, true)
+}
+
+func (s *RetrySuite) TestBudget(c *C) {
+	p := s.newPolicy(c, Options{
+		Budget: Budget{Ratio: 0.2, MinRetries: 1, Window: 10 * time.Second},
+	})
+
+	for i := 0; i < 10; i++ {
+		p.ObserveRequest(makeRequest("GET"))
+	}
+
+	// 20% of 10 requests plus one retry that is always allowed
+	for i := 0; i < 3; i++ {
+		_, ok := p.NextDelay(makeRequest("GET", failedAttempts(1)...))
+		c.Assert(ok, Equals, true)
+	}
+	_, ok := p.NextDelay(makeRequest("GET", failedAttempts(1)...))
+	c.Assert(ok, Equals, false)
+
+	// Budget is restored once the window passes
+	s.tm.CurrentTime = s.tm.CurrentTime.Add(11 * time.Second)
+	_, ok = p.NextDelay(makeRequest("GET", failedAttempts(1)...))
+	c.Assert(ok, Equals, true)
+}
+
+func (s *RetrySuite) TestDisableDefaults(c *C) {
+	p := s.newPolicy(c, Options{
+		Backoff: Backoff{Initial: 100 * time.Millisecond, DisableJitter: true},
+		Budget:  Budget{MinRetries: 1, DisableRatio: true},
+	})
+	c.Assert(p.GetOptions().Backoff.Jitter, Equals, 0.0)
+	c.Assert(p.GetOptions().Budget.Ratio, Equals, 0.0)
+
+	for i := 0; i < 10; i++ {
+		p.ObserveRequest(makeRequest("GET"))
+	}
+	// Only the retry that is always allowed fits into the budget, its delay is not randomized
+	delay, ok := p.NextDelay(makeRequest("GET", failedAttempts(1)...))
+	c.Assert(ok, Equals, true)
+	c.Assert(delay, Equals, 100*time.Millisecond)
+	_, ok = p.NextDelay(makeRequest("GET", failedAttempts(1)...))
+	c.Assert(ok, Equals, false)
+
+	p = s.newPolicy(c, Options{Budget: Budget{Ratio: 0.5, DisableMinRetries: true}})
+	c.Assert(p.GetOptions().Budget.MinRetries, Equals, int64(0))
+	_, ok = p.NextDelay(makeRequest("GET", failedAttempts(1)...))
+	c.Assert(ok, Equals, false)
+}
+
+func (s *RetrySuite) TestRetryAfter(c *C) {
+	p := s.newPolicy(c, Options{MaxRetryAfter: 3 * time.Second})
+
+	response := &http.Response{StatusCode: http.StatusServiceUnavailable, Header: make(http.Header)}
+	response.Header.Set("Retry-After", "2")
+	delay, ok := p.NextDelay(makeRequest("GET", &BaseAttempt{Response: response}))
+	c.Assert(ok, Equals, true)
+	c.Assert(delay, Equals, 2*time.Second)
+
+	// Upstream asks to wait too long, there's no point in retrying
+	response.Header.Set("Retry-After", "10")
+	_, ok = p.NextDelay(makeRequest("GET", &BaseAttempt{Response: response}))
+	c.Assert(ok, Equals, false)
+}
+
+func (s *RetrySuite) TestGrpcRetryPushback(c *C) {
+	p := s.newPolicy(c, Options{MaxRetryAfter: 3 * time.Second, ShouldRetry: failover.GrpcStatusEq(14)})
+
+	response := &http.Response{StatusCode: http.StatusOK, Header: http.Header{"Grpc-Status": []string{"14"}}}
+	response.Header.Set("Grpc-Retry-Pushback-Ms", "1500")
+	delay, ok := p.NextDelay(makeRequest("POST", &BaseAttempt{Response: response}))
+	c.Assert(ok, Equals, true)
+	c.Assert(delay, Equals, 1500*time.Millisecond)
+
+	// Negative pushback tells not to retry the call
+	response.Header.Set("Grpc-Retry-Pushback-Ms", "-1")
+	_, ok = p.NextDelay(makeRequest("POST", &BaseAttempt{Response: response}))
+	c.Assert(ok, Equals, false)
+
+	response.Header.Set("Grpc-Retry-Pushback-Ms", "10000")
+	_, ok = p.NextDelay(makeRequest("POST", &BaseAttempt{Response: response}))
+	c.Assert(ok, Equals, false)
+
+	response.Header.Del("Grpc-Retry-Pushback-Ms")
+	response.Header.Set("Grpc-Status", "3")
+	_, ok = p.NextDelay(makeRequest("POST", &BaseAttempt{Response: response}))
+	c.Assert(ok, Equals, false)
+}
+
+func (s *RetrySuite) TestParseRetryAfter(c *C) {
+	now := s.tm.UtcNow()
+
+	d, ok := ParseRetryAfter("120", now)
+	c.Assert(ok, Equals, true)
+	c.Assert(d, Equals, 2*time.Minute)
+
+	d, ok = ParseRetryAfter(now.Add(time.Minute).Format(http.TimeFormat), now)
+	c.Assert(ok, Equals, true)
+	c.Assert(d, Equals, time.Minute)
+
+	for _, v := range []string{"", "-1", "tomorrow"} {
+		_, ok = ParseRetryAfter(v, now)
+		c.Assert(ok, Equals, false)
+	}
+}
+
+func (s *RetrySuite) TestInvalidParams(c *C) {
+	cases := []Options{
+		{Backoff: Backoff{Initial: time.Second, Max: time.Millisecond}},
+		{Backoff: Backoff{Multiplier: 0.5}},
+		{Backoff: Backoff{Jitter: 2}},
+		{Budget: Budget{Ratio: -1}},
+	}
+	for _, o := range cases {
+		_, err := NewPolicy(o)
+		c.Assert(err, NotNil)
+	}
+}
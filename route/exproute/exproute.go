@@ -109,6 +109,18 @@ func (e *ExpRouter) GetLocationById(id string) location.Location {
 	return nil
 }
 
+// Returns the copy of the locations by route expression
+func (e *ExpRouter) GetLocations() map[string]location.Location {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+
+	routes := make(map[string]location.Location, len(e.routes))
+	for expr, l := range e.routes {
+		routes[expr] = l
+	}
+	return routes
+}
+
 func (e *ExpRouter) Route(req request.Request) (location.Location, error) {
 	e.mutex.RLock()
 	defer e.mutex.RUnlock()
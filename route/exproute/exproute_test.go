@@ -1,6 +1,10 @@
 package exproute
 
 import (
+	"net/http"
+
+	"github.com/mailgun/vulcan/location"
+	"github.com/mailgun/vulcan/request"
 	. "gopkg.in/check.v1"
 )
 
@@ -30,11 +34,13 @@ func (s *RouteSuite) TestCRUD(c *C) {
 
 	c.Assert(r.GetLocationById("loc1"), Equals, l1)
 	c.Assert(r.GetLocationByExpression(`TrieRoute("/r1")`), Equals, l1)
+	c.Assert(r.GetLocations(), DeepEquals, map[string]location.Location{`TrieRoute("/r1")`: l1})
 
 	c.Assert(r.RemoveLocationById("loc1"), IsNil)
 
 	c.Assert(r.GetLocationById("loc1"), IsNil)
 	c.Assert(r.GetLocationByExpression(`TrieRoute("/r1")`), IsNil)
+	c.Assert(len(r.GetLocations()), Equals, 0)
 }
 
 func (s *RouteSuite) TestAddTwiceFails(c *C) {
@@ -176,3 +182,44 @@ func (s *RouteSuite) TestMatchLongestPath(c *C) {
 	c.Assert(err, IsNil)
 	c.Assert(out, Equals, l2)
 }
+
+func (s *RouteSuite) TestGrpcRoute(c *C) {
+	r := NewExpRouter()
+
+	l1 := makeLoc("loc1")
+	c.Assert(r.AddLocation(`GrpcRoute("helloworld.Greeter", "SayHello")`, l1), IsNil)
+
+	l2 := makeLoc("loc2")
+	c.Assert(r.AddLocation(`GrpcRoute("helloworld.Greeter")`, l2), IsNil)
+
+	l3 := makeLoc("loc3")
+	c.Assert(r.AddLocation(`TrieRoute("/helloworld.Greeter/SayHello")`, l3), IsNil)
+
+	makeCall := func(path, contentType string) request.Request {
+		req := makeReq("http://google.com" + path)
+		req.GetHttpRequest().Method = "POST"
+		req.GetHttpRequest().Header = http.Header{"Content-Type": []string{contentType}}
+		return req
+	}
+
+	tc := []struct {
+		Req      request.Request
+		Expected location.Location
+	}{
+		{Req: makeCall("/helloworld.Greeter/SayHello", "application/grpc"), Expected: l1},
+		{Req: makeCall("/helloworld.Greeter/SayGoodbye", "application/grpc+proto"), Expected: l2},
+		// Requests that are not gRPC calls are routed by other expressions
+		{Req: makeCall("/helloworld.Greeter/SayHello", "application/json"), Expected: l3},
+		{Req: makeCall("/helloworld.Greeter/SayHello", "application/grpc-web"), Expected: l3},
+		{Req: makeCall("/helloworld.Other/SayHello", "application/grpc"), Expected: nil},
+	}
+	for i, t := range tc {
+		out, err := r.Route(t.Req)
+		c.Assert(err, IsNil)
+		c.Assert(out, Equals, t.Expected, Commentf("Test case %d", i))
+	}
+
+	for _, expr := range []string{`GrpcRoute()`, `GrpcRoute("a", "b", "c")`, `GrpcRoute("a/b")`, `GrpcRoute("a", "")`} {
+		c.Assert(r.AddLocation(expr, l1), NotNil, Commentf("Expression %s", expr))
+	}
+}
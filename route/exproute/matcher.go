@@ -2,6 +2,7 @@ package exproute
 
 import (
 	"fmt"
+	"github.com/mailgun/vulcan/grpc"
 	"github.com/mailgun/vulcan/location"
 	"github.com/mailgun/vulcan/request"
 	"regexp"
@@ -103,3 +104,23 @@ func (m *methodMatcher) match(req request.Request) location.Location {
 	}
 	return nil
 }
+
+// Matches gRPC calls only, so the other requests with the same path are routed elsewhere
+type grpcMatcher struct {
+	matcher matcher
+}
+
+func (m *grpcMatcher) canMerge(matcher) bool {
+	return false
+}
+
+func (m *grpcMatcher) merge(matcher) (matcher, error) {
+	return nil, fmt.Errorf("Method not supported")
+}
+
+func (m *grpcMatcher) match(req request.Request) location.Location {
+	if grpc.IsGrpcRequest(req.GetHttpRequest()) {
+		return m.matcher.match(req)
+	}
+	return nil
+}
@@ -7,6 +7,7 @@ import (
 	"go/parser"
 	"go/token"
 	"strconv"
+	"strings"
 )
 
 // Parses expression in the go language into matchers, e.g.
@@ -78,6 +79,8 @@ func createMatcher(currentMatcher matcher, call *funcCall) (matcher, error) {
 		return makeTrieRouteMatcher(currentMatcher, call.args)
 	case RegexpRouteFn:
 		return makeRegexpRouteMatcher(currentMatcher, call.args)
+	case GrpcRouteFn:
+		return makeGrpcRouteMatcher(currentMatcher, call.args)
 	}
 	return nil, fmt.Errorf("Unsupported method: %s", call.name)
 }
@@ -129,6 +132,32 @@ func makeRegexpRouteMatcher(matcher matcher, params []interface{}) (matcher, err
 	return t, nil
 }
 
+// GrpcRoute("package.Service", "Method") matches the calls of the method,
+// GrpcRoute("package.Service") matches the calls of all the methods of the service
+func makeGrpcRouteMatcher(matcher matcher, params []interface{}) (matcher, error) {
+	if len(params) < 1 || len(params) > 2 {
+		return nil, fmt.Errorf("%s accepts service and optional method name", GrpcRouteFn)
+	}
+	args, err := toStrings(params)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range args {
+		if name == "" || strings.ContainsAny(name, "/<>") {
+			return nil, fmt.Errorf("%s - invalid name '%s'", GrpcRouteFn, name)
+		}
+	}
+	path := "/" + args[0] + "/<method>"
+	if len(args) == 2 {
+		path = "/" + args[0] + "/" + args[1]
+	}
+	t, err := parseTrie(path, &grpcMatcher{matcher: matcher})
+	if err != nil {
+		return nil, fmt.Errorf("%s - failed to parse path expression, %s", GrpcRouteFn, err)
+	}
+	return t, nil
+}
+
 func toStrings(in []interface{}) ([]string, error) {
 	out := make([]string, len(in))
 	for i, v := range in {
@@ -144,4 +173,5 @@ func toStrings(in []interface{}) ([]string, error) {
 const (
 	TrieRouteFn   = "TrieRoute"
 	RegexpRouteFn = "RegexpRoute"
+	GrpcRouteFn   = "GrpcRoute"
 )
@@ -5,6 +5,7 @@ import (
 	"github.com/mailgun/vulcan/location"
 	"github.com/mailgun/vulcan/request"
 	"regexp"
+	"sort"
 	"strings"
 )
 
@@ -94,6 +95,25 @@ func (e *trieNode) isPatternMatcher() bool {
 	return e.patternMatcher != nil
 }
 
+// Pattern node that leads to gRPC routes only
+func (e *trieNode) isGrpcPattern() bool {
+	return e.isPatternMatcher() && e.isGrpcOnly()
+}
+
+func (e *trieNode) isGrpcOnly() bool {
+	for _, m := range e.requestMatchers {
+		if _, ok := m.(*grpcMatcher); !ok {
+			return false
+		}
+	}
+	for _, c := range e.children {
+		if !c.isGrpcOnly() {
+			return false
+		}
+	}
+	return true
+}
+
 func (e *trieNode) isCharMatcher() bool {
 	return e.char != 0
 }
@@ -153,11 +173,24 @@ func (e *trieNode) merge(o *trieNode) (*trieNode, error) {
 		}
 	}
 
+	// gRPC service routes match any method with a pattern, so explicitly routed methods are checked first
+	sort.SliceStable(children, func(i, j int) bool {
+		return !children[i].isGrpcPattern() && children[j].isGrpcPattern()
+	})
+
+	// gRPC matchers go first, so the other matchers on the same path don't shadow them
+	matchers := append(append([]matcher{}, e.requestMatchers...), o.requestMatchers...)
+	sort.SliceStable(matchers, func(i, j int) bool {
+		_, iGrpc := matchers[i].(*grpcMatcher)
+		_, jGrpc := matchers[j].(*grpcMatcher)
+		return iGrpc && !jGrpc
+	})
+
 	return &trieNode{
 		char:            e.char,
 		children:        children,
 		patternMatcher:  e.patternMatcher,
-		requestMatchers: append(e.requestMatchers, o.requestMatchers...),
+		requestMatchers: matchers,
 	}, nil
 }
 
@@ -200,6 +200,34 @@ root
 	c.Assert(t3.match(makeReq("http://google.com/a")), Equals, l1.location)
 }
 
+func (s *TrieSuite) TestMergeGrpcMethodBeforeService(c *C) {
+	service := &grpcMatcher{matcher: &constMatcher{location: makeLoc("service")}}
+	method := &grpcMatcher{matcher: &constMatcher{location: makeLoc("method")}}
+
+	t1, err := parseTrie("/svc/<method>", service)
+	c.Assert(err, IsNil)
+	t2, err := parseTrie("/svc/Get", method)
+	c.Assert(err, IsNil)
+
+	for _, order := range [][]*trie{{t1, t2}, {t2, t1}} {
+		t3, err := order[0].merge(order[1])
+		c.Assert(err, IsNil)
+
+		c.Assert(t3.match(makeGrpcReq("http://google.com/svc/Get")), Equals, method.matcher.(*constMatcher).location)
+		c.Assert(t3.match(makeGrpcReq("http://google.com/svc/List")), Equals, service.matcher.(*constMatcher).location)
+	}
+}
+
+func (s *TrieSuite) TestMergeKeepsNonGrpcOrder(c *C) {
+	t1, l1 := makeTrie(c, "/users/<string:id>", makeLoc("loc1"))
+	t2, _ := makeTrie(c, "/users/me", makeLoc("loc2"))
+
+	t3, err := t1.merge(t2)
+	c.Assert(err, IsNil)
+
+	c.Assert(t3.match(makeReq("http://google.com/users/me")), Equals, l1.location)
+}
+
 func (s *TrieSuite) TestMergeAndMatchCases(c *C) {
 	testCases := []struct {
 		trees    []string
@@ -317,6 +345,17 @@ func makeReq(url string) request.Request {
 	}
 }
 
+func makeGrpcReq(url string) request.Request {
+	u := netutils.MustParseUrl(url)
+	return &request.BaseRequest{
+		HttpRequest: &http.Request{
+			Method: "POST",
+			URL:    u,
+			Header: http.Header{"Content-Type": []string{"application/grpc"}},
+		},
+	}
+}
+
 func makeLoc(url string) location.Location {
 	return &location.ConstHttpLocation{Url: url}
 }
@@ -56,6 +56,18 @@ func (h *HostRouter) GetRouter(hostname string) Router {
 	return router
 }
 
+// Returns the copy of the routers by hostname
+func (h *HostRouter) GetRouters() map[string]Router {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	routers := make(map[string]Router, len(h.routers))
+	for hostname, router := range h.routers {
+		routers[hostname] = router
+	}
+	return routers
+}
+
 func (h *HostRouter) RemoveRouter(hostname string) {
 	h.mutex.Lock()
 	defer h.mutex.Unlock()
@@ -74,7 +74,10 @@ func (s *HostSuite) TestRemove(c *C) {
 	c.Assert(err, IsNil)
 	c.Assert(out, Equals, rB.Location)
 
+	c.Assert(m.GetRouters(), DeepEquals, map[string]Router{"google.com": rA, "yahoo.com": rB})
+
 	m.RemoveRouter("yahoo.com")
+	c.Assert(m.GetRouters(), DeepEquals, map[string]Router{"google.com": rA})
 
 	out, err = m.Route(request("google.com", "http://google.com/"))
 	c.Assert(err, IsNil)
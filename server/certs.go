@@ -0,0 +1,207 @@
+package server
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/mailgun/gotools-log"
+)
+
+// CertStore selects the certificate by the host name the client has sent in SNI.
+// Hosts are matched exactly first, then by the wildcard, e.g. "*.example.com" matches "api.example.com".
+// Certificates can be added and removed while the server is running.
+type CertStore struct {
+	mutex       *sync.RWMutex
+	certs       map[string]*tls.Certificate
+	files       map[string]*certFiles
+	defaultCert *tls.Certificate
+}
+
+// Files the certificate has been loaded from
+type certFiles struct {
+	certFile string
+	keyFile  string
+	ocspFile string
+	modTimes map[string]time.Time
+}
+
+func NewCertStore() *CertStore {
+	return &CertStore{
+		mutex: &sync.RWMutex{},
+		certs: make(map[string]*tls.Certificate),
+		files: make(map[string]*certFiles),
+	}
+}
+
+// Adds or replaces the certificate for the host, host can be a wildcard, e.g. "*.example.com"
+func (s *CertStore) AddCert(host string, cert *tls.Certificate) error {
+	host, err := parseHost(host)
+	if err != nil {
+		return err
+	}
+	if cert == nil {
+		return fmt.Errorf("Provide certificate")
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.certs[host] = cert
+	delete(s.files, host)
+	return nil
+}
+
+// Adds or replaces the certificate for the host loaded from the PEM files. Optional OCSP file contains
+// DER encoded OCSP response stapled to the handshakes. Files are reloaded by Reload once they change.
+func (s *CertStore) AddCertFromFiles(host, certFile, keyFile, ocspFile string) error {
+	host, err := parseHost(host)
+	if err != nil {
+		return err
+	}
+	files := &certFiles{certFile: certFile, keyFile: keyFile, ocspFile: ocspFile}
+	cert, modTimes, err := files.load()
+	if err != nil {
+		return err
+	}
+	files.modTimes = modTimes
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.certs[host] = cert
+	s.files[host] = files
+	return nil
+}
+
+func (s *CertStore) RemoveCert(host string) {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.certs, host)
+	delete(s.files, host)
+}
+
+// Sets the certificate used when no host matches, e.g. for the clients that don't support SNI
+func (s *CertStore) SetDefaultCert(cert *tls.Certificate) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.defaultCert = cert
+}
+
+// Returns the sorted list of hosts with the certificates
+func (s *CertStore) GetHosts() []string {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	hosts := make([]string, 0, len(s.certs))
+	for host := range s.certs {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	return hosts
+}
+
+// Reloads the certificates whose files have changed. Certificates that fail to load are kept as they are.
+func (s *CertStore) Reload() error {
+	s.mutex.RLock()
+	changed := make(map[string]*certFiles)
+	for host, files := range s.files {
+		if files.changed() {
+			changed[host] = files
+		}
+	}
+	s.mutex.RUnlock()
+
+	var lastErr error
+	for host, files := range changed {
+		cert, modTimes, err := files.load()
+		if err != nil {
+			log.Errorf("Failed to reload certificate for %s: %s", host, err)
+			lastErr = err
+			continue
+		}
+		s.mutex.Lock()
+		// Certificate could have been removed or replaced while loading
+		if s.files[host] == files {
+			s.certs[host] = cert
+			files.modTimes = modTimes
+		}
+		s.mutex.Unlock()
+		log.Infof("Reloaded certificate for %s", host)
+	}
+	return lastErr
+}
+
+// Selects the certificate for the TLS handshake, see tls.Config.GetCertificate
+func (s *CertStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	host := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	if cert, ok := s.certs[host]; ok {
+		return cert, nil
+	}
+	if i := strings.Index(host, "."); i != -1 {
+		if cert, ok := s.certs["*"+host[i:]]; ok {
+			return cert, nil
+		}
+	}
+	if s.defaultCert != nil {
+		return s.defaultCert, nil
+	}
+	return nil, fmt.Errorf("No certificate for host '%s'", hello.ServerName)
+}
+
+func parseHost(host string) (string, error) {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if host == "" {
+		return "", fmt.Errorf("Provide host")
+	}
+	if strings.Contains(host, "*") && (!strings.HasPrefix(host, "*.") || strings.Count(host, "*") != 1) {
+		return "", fmt.Errorf("Invalid wildcard host '%s', expected *.domain", host)
+	}
+	return host, nil
+}
+
+func (f *certFiles) paths() []string {
+	paths := []string{f.certFile, f.keyFile}
+	if f.ocspFile != "" {
+		paths = append(paths, f.ocspFile)
+	}
+	return paths
+}
+
+// Loads the certificate, returns the modification times of the files
+func (f *certFiles) load() (*tls.Certificate, map[string]time.Time, error) {
+	modTimes := make(map[string]time.Time)
+	for _, path := range f.paths() {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		modTimes[path] = info.ModTime()
+	}
+	cert, err := tls.LoadX509KeyPair(f.certFile, f.keyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	if f.ocspFile != "" {
+		staple, err := ioutil.ReadFile(f.ocspFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		cert.OCSPStaple = staple
+	}
+	return &cert, modTimes, nil
+}
+
+func (f *certFiles) changed() bool {
+	for path, modTime := range f.modTimes {
+		info, err := os.Stat(path)
+		if err != nil || !info.ModTime().Equal(modTime) {
+			return true
+		}
+	}
+	return false
+}
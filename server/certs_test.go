@@ -0,0 +1,151 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+func TestServer(t *testing.T) { TestingT(t) }
+
+type CertSuite struct {
+	dir string
+}
+
+var _ = Suite(&CertSuite{})
+
+func (s *CertSuite) SetUpTest(c *C) {
+	s.dir = c.MkDir()
+}
+
+// Generates self signed certificate for the host names
+func newTestCert(c *C, names ...string) *tls.Certificate {
+	certPEM, keyPEM := newTestCertPEM(c, names...)
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	c.Assert(err, IsNil)
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	c.Assert(err, IsNil)
+	return &cert
+}
+
+func newTestCertPEM(c *C, names ...string) ([]byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, IsNil)
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	c.Assert(err, IsNil)
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: names[0]},
+		DNSNames:              names,
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	c.Assert(err, IsNil)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	c.Assert(err, IsNil)
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+}
+
+func (s *CertSuite) writeCert(c *C, name string) (string, string) {
+	certPEM, keyPEM := newTestCertPEM(c, name)
+	certPath, keyPath := filepath.Join(s.dir, name+".crt"), filepath.Join(s.dir, name+".key")
+	c.Assert(ioutil.WriteFile(certPath, certPEM, 0600), IsNil)
+	c.Assert(ioutil.WriteFile(keyPath, keyPEM, 0600), IsNil)
+	return certPath, keyPath
+}
+
+func getCert(c *C, store *CertStore, serverName string) *tls.Certificate {
+	cert, err := store.GetCertificate(&tls.ClientHelloInfo{ServerName: serverName})
+	if err != nil {
+		return nil
+	}
+	return cert
+}
+
+func (s *CertSuite) TestMatching(c *C) {
+	store := NewCertStore()
+	exact, wildcard := newTestCert(c, "api.example.com"), newTestCert(c, "*.example.com")
+	c.Assert(store.AddCert("api.example.com", exact), IsNil)
+	c.Assert(store.AddCert("*.Example.com", wildcard), IsNil)
+
+	c.Assert(getCert(c, store, "api.example.com"), Equals, exact)
+	c.Assert(getCert(c, store, "API.example.com."), Equals, exact)
+	c.Assert(getCert(c, store, "www.example.com"), Equals, wildcard)
+	// Wildcard matches a single label only
+	c.Assert(getCert(c, store, "a.b.example.com"), IsNil)
+	c.Assert(getCert(c, store, "example.com"), IsNil)
+	c.Assert(getCert(c, store, ""), IsNil)
+
+	def := newTestCert(c, "default")
+	store.SetDefaultCert(def)
+	c.Assert(getCert(c, store, "other.org"), Equals, def)
+	c.Assert(store.GetHosts(), DeepEquals, []string{"*.example.com", "api.example.com"})
+
+	store.RemoveCert("api.example.com")
+	c.Assert(getCert(c, store, "api.example.com"), Equals, wildcard)
+}
+
+func (s *CertSuite) TestInvalidHosts(c *C) {
+	store := NewCertStore()
+	cert := newTestCert(c, "example.com")
+	for _, host := range []string{"", "*", "a.*.com", "*.*.com", "*example.com"} {
+		c.Assert(store.AddCert(host, cert), NotNil, Commentf("Host '%s'", host))
+	}
+	c.Assert(store.AddCert("example.com", nil), NotNil)
+}
+
+func (s *CertSuite) TestFilesWithOCSP(c *C) {
+	certPath, keyPath := s.writeCert(c, "example.com")
+	ocspPath := filepath.Join(s.dir, "example.com.ocsp")
+	c.Assert(ioutil.WriteFile(ocspPath, []byte("staple"), 0600), IsNil)
+
+	store := NewCertStore()
+	c.Assert(store.AddCertFromFiles("example.com", certPath, keyPath, ocspPath), IsNil)
+	c.Assert(string(getCert(c, store, "example.com").OCSPStaple), Equals, "staple")
+
+	c.Assert(store.AddCertFromFiles("missing.com", certPath, keyPath, ocspPath+".missing"), NotNil)
+	c.Assert(store.AddCertFromFiles("missing.com", certPath+".missing", keyPath, ""), NotNil)
+}
+
+func (s *CertSuite) TestReload(c *C) {
+	certPath, keyPath := s.writeCert(c, "example.com")
+	store := NewCertStore()
+	c.Assert(store.AddCertFromFiles("example.com", certPath, keyPath, ""), IsNil)
+	before := getCert(c, store, "example.com")
+
+	// Nothing has changed
+	c.Assert(store.Reload(), IsNil)
+	c.Assert(getCert(c, store, "example.com"), Equals, before)
+
+	s.writeCert(c, "example.com")
+	future := time.Now().Add(time.Hour)
+	c.Assert(os.Chtimes(certPath, future, future), IsNil)
+	c.Assert(os.Chtimes(keyPath, future, future), IsNil)
+	c.Assert(store.Reload(), IsNil)
+	after := getCert(c, store, "example.com")
+	c.Assert(after, Not(Equals), before)
+
+	// Broken files keep the loaded certificate
+	c.Assert(ioutil.WriteFile(certPath, []byte("garbage"), 0600), IsNil)
+	future = future.Add(time.Hour)
+	c.Assert(os.Chtimes(certPath, future, future), IsNil)
+	c.Assert(store.Reload(), NotNil)
+	c.Assert(getCert(c, store, "example.com"), Equals, after)
+}
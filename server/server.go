@@ -0,0 +1,270 @@
+// Server runs the proxy on several listeners, terminates TLS and drains the requests in flight on shutdown
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/mailgun/gotools-log"
+)
+
+type Listener struct {
+	// Address to listen on, e.g. ":443"
+	Address string
+	// Terminates TLS with the certificates from the server's certificate store
+	TLS bool
+	// Redirects all the requests to https instead of serving them, plain listeners only
+	RedirectToHttps bool
+	// Port used in the redirects, defaults to 443
+	HttpsPort int
+	// Accepts cleartext HTTP/2 (h2c) with prior knowledge along with HTTP/1.1, plain listeners only.
+	// TLS listeners negotiate HTTP/2 with the clients anyway.
+	H2C bool
+}
+
+type Options struct {
+	// Certificates for the TLS listeners, selected by SNI
+	Certs *CertStore
+	// Minimum TLS version accepted from the clients, defaults to TLS 1.2
+	MinTlsVersion uint16
+	// Allowed cipher suites, Go defaults are used if not set
+	CipherSuites []uint16
+	// How often the certificate files are checked for changes, certificates are not reloaded if not set
+	CertReloadInterval time.Duration
+	ReadTimeout        time.Duration
+	WriteTimeout       time.Duration
+	// How long the keep-alive connections wait for the next request
+	IdleTimeout time.Duration
+}
+
+// Server serves the handler (usually vulcan.Proxy) on the listeners
+type Server struct {
+	mutex     *sync.Mutex
+	handler   http.Handler
+	listeners []Listener
+	options   Options
+	servers   []*http.Server
+	addrs     []net.Addr
+	errors    chan error
+	running   *sync.WaitGroup
+	stop      chan bool
+}
+
+func NewServer(handler http.Handler, listeners []Listener) (*Server, error) {
+	return NewServerWithOptions(handler, listeners, Options{})
+}
+
+func NewServerWithOptions(handler http.Handler, listeners []Listener, o Options) (*Server, error) {
+	if handler == nil {
+		return nil, fmt.Errorf("Provide handler")
+	}
+	if len(listeners) == 0 {
+		return nil, fmt.Errorf("Provide at least one listener")
+	}
+	o, err := parseOptions(o)
+	if err != nil {
+		return nil, err
+	}
+	for _, l := range listeners {
+		if l.Address == "" {
+			return nil, fmt.Errorf("Provide listener address")
+		}
+		if l.TLS && l.RedirectToHttps {
+			return nil, fmt.Errorf("Listener %s can't redirect to https, it's TLS already", l.Address)
+		}
+		if l.TLS && l.H2C {
+			return nil, fmt.Errorf("Listener %s can't accept h2c, it's TLS already", l.Address)
+		}
+		if l.TLS && o.Certs == nil {
+			return nil, fmt.Errorf("Listener %s requires certificate store", l.Address)
+		}
+	}
+	return &Server{
+		mutex:     &sync.Mutex{},
+		handler:   handler,
+		listeners: listeners,
+		options:   o,
+		running:   &sync.WaitGroup{},
+	}, nil
+}
+
+// Binds all the listeners and starts serving, returns error if any of the listeners fails to bind
+func (s *Server) Start() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.servers != nil {
+		return fmt.Errorf("Server is already started")
+	}
+	listeners := make([]net.Listener, 0, len(s.listeners))
+	for _, l := range s.listeners {
+		ln, err := net.Listen("tcp", l.Address)
+		if err != nil {
+			for _, ln := range listeners {
+				ln.Close()
+			}
+			return err
+		}
+		listeners = append(listeners, ln)
+	}
+
+	s.errors = make(chan error, len(listeners))
+	s.stop = make(chan bool)
+	for i, ln := range listeners {
+		srv := s.newHttpServer(s.listeners[i])
+		s.servers = append(s.servers, srv)
+		s.addrs = append(s.addrs, ln.Addr())
+		s.running.Add(1)
+		go s.serve(srv, ln, s.listeners[i].TLS)
+	}
+	if s.options.Certs != nil && s.options.CertReloadInterval > 0 {
+		go s.reloadCerts(s.stop)
+	}
+	return nil
+}
+
+// Starts the server and blocks until it's shut down or any of the listeners fails
+func (s *Server) ListenAndServe() error {
+	if err := s.Start(); err != nil {
+		return err
+	}
+	return s.Wait()
+}
+
+// Blocks until all the listeners stop, returns the first error of the listeners
+func (s *Server) Wait() error {
+	s.running.Wait()
+	select {
+	case err := <-s.errors:
+		return err
+	default:
+		return nil
+	}
+}
+
+// Stops accepting new connections and waits for the requests in flight to complete
+// or the context to expire, whatever happens first
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mutex.Lock()
+	servers := s.servers
+	if s.stop != nil {
+		close(s.stop)
+		s.stop = nil
+	}
+	s.mutex.Unlock()
+
+	errors := make(chan error, len(servers))
+	for _, srv := range servers {
+		go func(srv *http.Server) {
+			errors <- srv.Shutdown(ctx)
+		}(srv)
+	}
+	var err error
+	for range servers {
+		if e := <-errors; e != nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// Returns the addresses of the listeners in the same order, useful when listening on the port 0
+func (s *Server) GetAddrs() []net.Addr {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.addrs
+}
+
+func (s *Server) String() string {
+	return fmt.Sprintf("Server(listeners=%d)", len(s.listeners))
+}
+
+func (s *Server) newHttpServer(l Listener) *http.Server {
+	srv := &http.Server{
+		Handler:      s.handler,
+		ReadTimeout:  s.options.ReadTimeout,
+		WriteTimeout: s.options.WriteTimeout,
+		IdleTimeout:  s.options.IdleTimeout,
+	}
+	if l.RedirectToHttps {
+		srv.Handler = &httpsRedirect{port: l.HttpsPort}
+	}
+	if l.H2C {
+		srv.Protocols = &http.Protocols{}
+		srv.Protocols.SetHTTP1(true)
+		srv.Protocols.SetUnencryptedHTTP2(true)
+	}
+	if l.TLS {
+		srv.TLSConfig = &tls.Config{
+			GetCertificate: s.options.Certs.GetCertificate,
+			MinVersion:     s.options.MinTlsVersion,
+			CipherSuites:   s.options.CipherSuites,
+			NextProtos:     []string{"h2", "http/1.1"},
+		}
+	}
+	return srv
+}
+
+func (s *Server) serve(srv *http.Server, ln net.Listener, isTLS bool) {
+	defer s.running.Done()
+	var err error
+	if isTLS {
+		err = srv.ServeTLS(ln, "", "")
+	} else {
+		err = srv.Serve(ln)
+	}
+	if err != nil && err != http.ErrServerClosed {
+		log.Errorf("%s failed to serve on %s: %s", s, ln.Addr(), err)
+		s.errors <- err
+	}
+}
+
+func (s *Server) reloadCerts(stop chan bool) {
+	ticker := time.NewTicker(s.options.CertReloadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.options.Certs.Reload()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Redirects the requests to the same URL with https scheme
+type httpsRedirect struct {
+	port int
+}
+
+func (h *httpsRedirect) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if h.port != 0 && h.port != 443 {
+		host = net.JoinHostPort(host, strconv.Itoa(h.port))
+	}
+	// Permanent redirect that keeps the method for the requests with body
+	code := http.StatusMovedPermanently
+	if r.Method != "GET" && r.Method != "HEAD" {
+		code = http.StatusPermanentRedirect
+	}
+	http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), code)
+}
+
+func parseOptions(o Options) (Options, error) {
+	if o.MinTlsVersion == 0 {
+		o.MinTlsVersion = tls.VersionTLS12
+	}
+	if o.CertReloadInterval < 0 {
+		return o, fmt.Errorf("Certificate reload interval should be >= 0, got: %s", o.CertReloadInterval)
+	}
+	return o, nil
+}
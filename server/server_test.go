@@ -0,0 +1,252 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+type ServerSuite struct {
+}
+
+var _ = Suite(&ServerSuite{})
+
+func newHandler(body string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(body))
+	})
+}
+
+// Client trusting the certificate that connects to the address no matter what the URL host is
+func newTlsClient(cert *tls.Certificate, addr net.Addr) *http.Client {
+	pool := x509.NewCertPool()
+	pool.AddCert(cert.Leaf)
+	return &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{RootCAs: pool},
+			Dial: func(network, _ string) (net.Conn, error) {
+				return net.Dial(network, addr.String())
+			},
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+func (s *ServerSuite) TestServeTLS(c *C) {
+	store := NewCertStore()
+	a, b := newTestCert(c, "a.example.com"), newTestCert(c, "*.example.org")
+	c.Assert(store.AddCert("a.example.com", a), IsNil)
+	c.Assert(store.AddCert("*.example.org", b), IsNil)
+
+	srv, err := NewServerWithOptions(newHandler("hello"), []Listener{
+		{Address: "127.0.0.1:0", TLS: true},
+		{Address: "127.0.0.1:0"},
+	}, Options{Certs: store})
+	c.Assert(err, IsNil)
+	c.Assert(srv.Start(), IsNil)
+	defer srv.Shutdown(context.Background())
+	addrs := srv.GetAddrs()
+
+	for host, cert := range map[string]*tls.Certificate{"a.example.com": a, "www.example.org": b} {
+		re, err := newTlsClient(cert, addrs[0]).Get("https://" + host + "/")
+		c.Assert(err, IsNil)
+		body, _ := ioutil.ReadAll(re.Body)
+		re.Body.Close()
+		c.Assert(string(body), Equals, "hello")
+		c.Assert(re.TLS.PeerCertificates[0].Subject.CommonName, Equals, cert.Leaf.Subject.CommonName)
+	}
+
+	// Certificates are added on the fly
+	_, err = newTlsClient(a, addrs[0]).Get("https://b.example.com/")
+	c.Assert(err, NotNil)
+	added := newTestCert(c, "b.example.com")
+	c.Assert(store.AddCert("b.example.com", added), IsNil)
+	re, err := newTlsClient(added, addrs[0]).Get("https://b.example.com/")
+	c.Assert(err, IsNil)
+	re.Body.Close()
+
+	// Plain listener serves the same handler
+	re, err = http.Get("http://" + addrs[1].String())
+	c.Assert(err, IsNil)
+	body, _ := ioutil.ReadAll(re.Body)
+	re.Body.Close()
+	c.Assert(string(body), Equals, "hello")
+}
+
+func (s *ServerSuite) TestHTTP2(c *C) {
+	store := NewCertStore()
+	cert := newTestCert(c, "example.com")
+	c.Assert(store.AddCert("example.com", cert), IsNil)
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Proto))
+	})
+	srv, err := NewServerWithOptions(handler, []Listener{
+		{Address: "127.0.0.1:0", TLS: true},
+		{Address: "127.0.0.1:0", H2C: true},
+	}, Options{Certs: store})
+	c.Assert(err, IsNil)
+	c.Assert(srv.Start(), IsNil)
+	defer srv.Shutdown(context.Background())
+	addrs := srv.GetAddrs()
+
+	client := newTlsClient(cert, addrs[0])
+	client.Transport.(*http.Transport).ForceAttemptHTTP2 = true
+	re, err := client.Get("https://example.com/")
+	c.Assert(err, IsNil)
+	body, _ := ioutil.ReadAll(re.Body)
+	re.Body.Close()
+	c.Assert(string(body), Equals, "HTTP/2.0")
+
+	// Cleartext listener accepts both HTTP/2 with prior knowledge and HTTP/1.1
+	protocols := &http.Protocols{}
+	protocols.SetUnencryptedHTTP2(true)
+	h2c := &http.Client{Transport: &http.Transport{Protocols: protocols}}
+	for client, expected := range map[*http.Client]string{h2c: "HTTP/2.0", http.DefaultClient: "HTTP/1.1"} {
+		re, err := client.Get("http://" + addrs[1].String())
+		c.Assert(err, IsNil)
+		body, _ := ioutil.ReadAll(re.Body)
+		re.Body.Close()
+		c.Assert(string(body), Equals, expected)
+	}
+}
+
+func (s *ServerSuite) TestRedirectToHttps(c *C) {
+	srv, err := NewServer(newHandler("hello"), []Listener{
+		{Address: "127.0.0.1:0", RedirectToHttps: true},
+		{Address: "127.0.0.1:0", RedirectToHttps: true, HttpsPort: 8443},
+	})
+	c.Assert(err, IsNil)
+	c.Assert(srv.Start(), IsNil)
+	defer srv.Shutdown(context.Background())
+	addrs := srv.GetAddrs()
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	tc := []struct {
+		Addr     net.Addr
+		Method   string
+		Code     int
+		Location string
+	}{
+		{Addr: addrs[0], Method: "GET", Code: http.StatusMovedPermanently, Location: "https://127.0.0.1/path?a=b"},
+		{Addr: addrs[0], Method: "POST", Code: http.StatusPermanentRedirect, Location: "https://127.0.0.1/path?a=b"},
+		{Addr: addrs[1], Method: "GET", Code: http.StatusMovedPermanently, Location: "https://127.0.0.1:8443/path?a=b"},
+	}
+	for _, t := range tc {
+		req, err := http.NewRequest(t.Method, "http://"+t.Addr.String()+"/path?a=b", nil)
+		c.Assert(err, IsNil)
+		re, err := client.Do(req)
+		c.Assert(err, IsNil)
+		re.Body.Close()
+		c.Assert(re.StatusCode, Equals, t.Code)
+		c.Assert(re.Header.Get("Location"), Equals, t.Location)
+	}
+}
+
+func (s *ServerSuite) TestGracefulShutdown(c *C) {
+	started, release := make(chan bool), make(chan bool)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		w.Write([]byte("done"))
+	})
+	srv, err := NewServer(handler, []Listener{{Address: "127.0.0.1:0"}})
+	c.Assert(err, IsNil)
+	c.Assert(srv.Start(), IsNil)
+	addr := srv.GetAddrs()[0].String()
+
+	type result struct {
+		body string
+		err  error
+	}
+	results := make(chan result, 1)
+	go func() {
+		re, err := http.Get("http://" + addr)
+		if err != nil {
+			results <- result{err: err}
+			return
+		}
+		defer re.Body.Close()
+		body, err := ioutil.ReadAll(re.Body)
+		results <- result{body: string(body), err: err}
+	}()
+	<-started
+
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- srv.Shutdown(context.Background())
+	}()
+
+	// New connections are refused while the request in flight is drained
+	for i := 0; i < 100; i++ {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			break
+		}
+		conn.Close()
+		time.Sleep(time.Millisecond)
+	}
+	_, err = net.Dial("tcp", addr)
+	c.Assert(err, NotNil)
+
+	close(release)
+	r := <-results
+	c.Assert(r.err, IsNil)
+	c.Assert(r.body, Equals, "done")
+	c.Assert(<-shutdown, IsNil)
+	c.Assert(srv.Wait(), IsNil)
+}
+
+func (s *ServerSuite) TestShutdownTimeout(c *C) {
+	release := make(chan bool)
+	defer close(release)
+	started := make(chan bool)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	})
+	srv, err := NewServer(handler, []Listener{{Address: "127.0.0.1:0"}})
+	c.Assert(err, IsNil)
+	c.Assert(srv.Start(), IsNil)
+
+	go http.Get("http://" + srv.GetAddrs()[0].String())
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	c.Assert(srv.Shutdown(ctx), NotNil)
+}
+
+func (s *ServerSuite) TestInvalidOptions(c *C) {
+	handler := newHandler("hello")
+	_, err := NewServer(nil, []Listener{{Address: ":0"}})
+	c.Assert(err, NotNil)
+	_, err = NewServer(handler, nil)
+	c.Assert(err, NotNil)
+	_, err = NewServer(handler, []Listener{{}})
+	c.Assert(err, NotNil)
+	_, err = NewServer(handler, []Listener{{Address: ":0", TLS: true}})
+	c.Assert(err, NotNil)
+	_, err = NewServerWithOptions(handler, []Listener{{Address: ":0", TLS: true, RedirectToHttps: true}}, Options{Certs: NewCertStore()})
+	c.Assert(err, NotNil)
+	_, err = NewServerWithOptions(handler, []Listener{{Address: ":0", TLS: true, H2C: true}}, Options{Certs: NewCertStore()})
+	c.Assert(err, NotNil)
+}
+
+func (s *ServerSuite) TestBindFailure(c *C) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	defer ln.Close()
+
+	srv, err := NewServer(newHandler("hello"), []Listener{{Address: "127.0.0.1:0"}, {Address: ln.Addr().String()}})
+	c.Assert(err, IsNil)
+	c.Assert(srv.Start(), NotNil)
+}